@@ -15,18 +15,29 @@
 package cmd
 
 import (
+	"compress/gzip"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/mem"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/s3"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/manifest"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/registry"
+	"github.com/container-registry/helm-charts-oci-proxy/pkg/sigv4"
 	"github.com/dgraph-io/ristretto"
+	"github.com/opencontainers/go-digest"
+	"io"
 	"k8s.io/utils/env"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -53,7 +64,11 @@ Contents are only stored in memory, and when the process exits, pushed data is l
 		RunE: func(cmd *cobra.Command, _ []string) error {
 			ctx := cmd.Context()
 
-			l := log.New(os.Stdout, "proxy-", log.LstdFlags)
+			var out io.Writer = os.Stdout
+			if redact, _ := env.GetBool("LOG_REDACT", true); redact {
+				out = helper.NewRedactor(envList("LOG_REDACT_NAMES")...).Writer(out)
+			}
+			l := log.New(out, "proxy-", log.LstdFlags)
 
 			port, err := env.GetInt("PORT", 9000)
 			if err != nil {
@@ -64,6 +79,170 @@ Contents are only stored in memory, and when the process exits, pushed data is l
 			cacheTTL, _ := env.GetInt("MANIFEST_CACHE_TTL", 60)              // 1 minute
 			indexCacheTTL, _ := env.GetInt("INDEX_CACHE_TTL", 3600*4)        // 4 hours
 			indexErrorCacheTTL, _ := env.GetInt("INDEX_ERROR_CACHE_TTL", 30) // 30 seconds
+			cacheTTLJitter, _ := env.GetInt("MANIFEST_CACHE_TTL_JITTER", 0)
+			cacheTTLFloor, _ := env.GetInt("MANIFEST_CACHE_MIN_TTL", 0)
+			cacheStatusHeader := env.GetString("CACHE_STATUS_HEADER", "X-Cache")
+			fallbackContentType := env.GetString("FALLBACK_CONTENT_TYPE", "")
+			digestAlgorithm := env.GetString("DIGEST_ALGORITHM", string(digest.Canonical))
+			preserveUpstreamDigests, _ := env.GetBool("PRESERVE_UPSTREAM_DIGESTS", false)
+			mediaTypeRewrite := env.GetString("MEDIA_TYPE_REWRITE", "")
+			if mediaTypeRewrite != "" && mediaTypeRewrite != manifest.MediaTypeRewriteAccept && mediaTypeRewrite != manifest.MediaTypeRewriteDocker {
+				l.Fatalf("MEDIA_TYPE_REWRITE: must be %s or %s", manifest.MediaTypeRewriteAccept, manifest.MediaTypeRewriteDocker)
+			}
+			if !digest.Algorithm(digestAlgorithm).Available() {
+				l.Fatalf("DIGEST_ALGORITHM: %s is not supported", digestAlgorithm)
+			}
+			staleWhileRevalidate, _ := env.GetInt("MANIFEST_STALE_WHILE_REVALIDATE", 0)
+			staleIfError, _ := env.GetInt("MANIFEST_STALE_IF_ERROR", 0)
+			tagsPageSize, _ := env.GetInt("TAGS_PAGE_SIZE", 0)
+			tagsMaxPageSize, _ := env.GetInt("TAGS_MAX_PAGE_SIZE", 10000)
+			lowercaseRepos, _ := env.GetBool("LOWERCASE_REPOS", false)
+			readOnly, _ := env.GetBool("READ_ONLY", false)
+			allowPush, _ := env.GetBool("ALLOW_PUSH", false)
+			maxUploadSize, _ := env.GetInt("MAX_UPLOAD_SIZE", 0)
+			uploadTTL, _ := env.GetInt("UPLOAD_TTL", 0)
+			streamIndex, _ := env.GetBool("STREAM_INDEX", false)
+			prefetchNext, _ := env.GetBool("PREFETCH_NEXT", false)
+			extractCRDs, _ := env.GetBool("EXTRACT_CRDS", false)
+			chartReadme := env.GetString("CHART_README", "")
+			fetchProvenance, _ := env.GetBool("FETCH_PROVENANCE", false)
+			if chartReadme != "" && chartReadme != manifest.ReadmeModeAnnotation && chartReadme != manifest.ReadmeModeArtifact {
+				l.Fatalf("CHART_README must be %s or %s", manifest.ReadmeModeAnnotation, manifest.ReadmeModeArtifact)
+			}
+			catalogProviders, _ := env.GetBool("CATALOG_PROVIDERS", false)
+			catalogNamespaces, _ := env.GetBool("CATALOG_NAMESPACES", false)
+			catalogDiscovery, _ := env.GetBool("CATALOG_DISCOVERY", false)
+			catalogCacheTTL, _ := env.GetInt("CATALOG_CACHE_TTL", 0)
+			maxManifestBlobs, _ := env.GetInt("MAX_MANIFEST_BLOBS", 0)
+			blobFetchConcurrency, _ := env.GetInt("BLOB_FETCH_CONCURRENCY", 1)
+			blobDigestRetries, _ := env.GetInt("BLOB_DIGEST_RETRIES", 2)
+			maxConcurrentPrepares, _ := env.GetInt("MAX_CONCURRENT_PREPARES", 0)
+			warmUpConcurrency, _ := env.GetInt("WARM_UP_CONCURRENCY", 4)
+			fetchForeignLayers, _ := env.GetBool("FETCH_FOREIGN_LAYERS", false)
+			foreignLayerMaxSize, _ := env.GetInt("FOREIGN_LAYER_MAX_SIZE", 0)
+			chartChunkSize, _ := env.GetInt("CHART_CHUNK_SIZE", 0)
+			upstreamMaxIdleConns, _ := env.GetInt("UPSTREAM_MAX_IDLE_CONNS", 0)
+			upstreamMaxIdleConnsPerHost, _ := env.GetInt("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", 0)
+			upstreamIdleConnTimeout, _ := env.GetInt("UPSTREAM_IDLE_CONN_TIMEOUT", 0)
+
+			adminToken := env.GetString("ADMIN_TOKEN", "")
+			authPassthroughHosts := envList("AUTH_PASSTHROUGH_HOSTS")
+			upstreamSigners := map[string]manifest.RequestSigner{}
+			for host, scope := range envMap("UPSTREAM_SIGV4_HOSTS") {
+				region, service, _ := strings.Cut(scope, "/")
+				upstreamSigners[strings.ToLower(host)] = &sigv4.Signer{
+					AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+					SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+					SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+					Region:          region,
+					Service:         service,
+				}
+			}
+			ociUpstreams := envList("OCI_UPSTREAMS")
+			warmUp := envList("WARM_UP")
+			providers := envMap("PROVIDERS")
+			chartAliases := envMap("CHART_ALIASES")
+			yanked := envList("YANKED")
+			yankedStatus, _ := env.GetInt("YANKED_STATUS", http.StatusGone)
+			tombstones := envList("TOMBSTONES")
+			foreignLayerHosts := envList("FOREIGN_LAYER_HOSTS")
+			upstreamOverrideHosts := envList("UPSTREAM_OVERRIDE_HOSTS")
+			insecureSkipVerifyHosts := envList("INSECURE_SKIP_VERIFY_HOSTS")
+			httpFallbackHosts := envList("HTTP_FALLBACK_HOSTS")
+			fileUpstreams := envMap("FILE_UPSTREAMS")
+			s3PathStyle, _ := env.GetBool("S3_PATH_STYLE", false)
+			nonChartContentTypes := envList("NON_CHART_CONTENT_TYPES")
+			upstreamCAs := map[string][]byte{}
+			for host, file := range envMap("UPSTREAM_CA_FILES") {
+				bundle, err := os.ReadFile(file)
+				if err != nil {
+					l.Fatalln(err)
+				}
+				if !x509.NewCertPool().AppendCertsFromPEM(bundle) {
+					l.Fatalf("no certificates found in %s", file)
+				}
+				upstreamCAs[host] = bundle
+			}
+			var tagRewrites []manifest.TagRewrite
+			for _, rule := range strings.Fields(os.Getenv("TAG_REWRITES")) {
+				pattern, replacement, _ := strings.Cut(rule, "=")
+				re, err := regexp.Compile(pattern)
+				if err != nil {
+					l.Fatalf("TAG_REWRITES: %v", err)
+				}
+				tagRewrites = append(tagRewrites, manifest.TagRewrite{Pattern: re, Replacement: replacement})
+			}
+			repoQuotas := map[string]int64{}
+			for prefix, quota := range envMap("REPO_QUOTAS") {
+				n, err := strconv.ParseInt(quota, 10, 64)
+				if err != nil {
+					l.Fatalf("REPO_QUOTAS: %s: %v", prefix, err)
+				}
+				repoQuotas[strings.Trim(prefix, "/")] = n
+			}
+			immutableRepos := map[string]bool{}
+			for prefix, immutable := range envMap("IMMUTABLE_REPOS") {
+				b, err := strconv.ParseBool(immutable)
+				if err != nil {
+					l.Fatalf("IMMUTABLE_REPOS: %s: %v", prefix, err)
+				}
+				immutableRepos[strings.Trim(prefix, "/")] = b
+			}
+			maxChartVersions, _ := env.GetInt("MAX_CHART_VERSIONS", 0)
+			var onEvict func(manifest.Eviction)
+			if webhook := env.GetString("EVICTION_WEBHOOK", ""); webhook != "" {
+				onEvict = manifest.EvictionWebhook(webhook, l)
+			}
+			fetchBudgets := map[string]float64{}
+			for host, budget := range envMap("FETCH_BUDGETS") {
+				n, err := strconv.ParseFloat(budget, 64)
+				if err != nil {
+					l.Fatalf("FETCH_BUDGETS: %s: %v", host, err)
+				}
+				fetchBudgets[host] = n
+			}
+			fetchBudgetMaxWait, _ := env.GetInt("FETCH_BUDGET_MAX_WAIT", 5)
+			upstreamBreakerThreshold, _ := env.GetInt("UPSTREAM_BREAKER_THRESHOLD", 0)
+			upstreamBreakerCooldown, _ := env.GetInt("UPSTREAM_BREAKER_COOLDOWN", 30)
+			latestPolicies := envMap("LATEST_POLICIES")
+			for prefix, policy := range latestPolicies {
+				if policy != manifest.LatestTag && policy != manifest.LatestStable && policy != manifest.LatestPrerelease {
+					l.Fatalf("LATEST_POLICIES: %s: must be %s, %s or %s", prefix, manifest.LatestTag, manifest.LatestStable, manifest.LatestPrerelease)
+				}
+			}
+			annotationsAllow := envList("ANNOTATIONS_ALLOW")
+			annotationsDeny := envList("ANNOTATIONS_DENY")
+
+			requestTimeout, _ := env.GetInt("REQUEST_TIMEOUT", 0)
+			maxConcurrentRequests, _ := env.GetInt("MAX_CONCURRENT_REQUESTS", 0)
+			requestQueueDepth, _ := env.GetInt("REQUEST_QUEUE_DEPTH", 100)
+			limits := registry.DefaultServerLimits
+			readHeaderTimeout, _ := env.GetInt("READ_HEADER_TIMEOUT", int(limits.ReadHeaderTimeout/time.Second))
+			readTimeout, _ := env.GetInt("READ_TIMEOUT", int(limits.ReadTimeout/time.Second))
+			writeTimeout, _ := env.GetInt("WRITE_TIMEOUT", int(limits.WriteTimeout/time.Second))
+			idleTimeout, _ := env.GetInt("IDLE_TIMEOUT", int(limits.IdleTimeout/time.Second))
+			limits.ReadHeaderTimeout = time.Duration(readHeaderTimeout) * time.Second
+			limits.ReadTimeout = time.Duration(readTimeout) * time.Second
+			limits.WriteTimeout = time.Duration(writeTimeout) * time.Second
+			limits.IdleTimeout = time.Duration(idleTimeout) * time.Second
+			limits.MaxConns, _ = env.GetInt("MAX_CONNS", limits.MaxConns)
+			compressResponses, _ := env.GetBool("COMPRESS_RESPONSES", false)
+			compressLevel, _ := env.GetInt("COMPRESS_LEVEL", 0)
+			if compressLevel != 0 && (compressLevel < gzip.BestSpeed || compressLevel > gzip.BestCompression) {
+				l.Fatalf("COMPRESS_LEVEL: must be from %d to %d", gzip.BestSpeed, gzip.BestCompression)
+			}
+			notFoundRedirect := env.GetString("NOT_FOUND_REDIRECT", "")
+			responseHeaders := http.Header{}
+			for name, value := range envMap("RESPONSE_HEADERS") {
+				if name == "" || strings.ContainsAny(name, " \t:") {
+					l.Fatalf("RESPONSE_HEADERS: invalid header name %q", name)
+				}
+				responseHeaders.Set(name, value)
+			}
+			trustedProxies, err := registry.ParseCIDRs(envList("TRUSTED_PROXIES"))
+			if err != nil {
+				l.Fatalf("TRUSTED_PROXIES: %v", err)
+			}
 
 			useTLS, _ := env.GetBool("USE_TLS", false)
 			certFile := env.GetString("CERT_FILE", "certs/registry.pem")
@@ -75,6 +254,7 @@ Contents are only stored in memory, and when the process exits, pushed data is l
 			}
 
 			portI := listener.Addr().(*net.TCPAddr).Port
+			listener = limits.Listener(listener)
 
 			indexCache, err := ristretto.NewCache(&ristretto.Config{
 				NumCounters: 1e7,       // number of keys to track frequency of (10M).
@@ -85,26 +265,144 @@ Contents are only stored in memory, and when the process exits, pushed data is l
 				l.Fatalln(err)
 			}
 
-			blobsHandler := mem.NewMemHandler()
+			var blobsHandler handler.BlobHandler = mem.NewMemHandler()
+			switch store := env.GetString("BLOB_STORE", "memory"); store {
+			case "memory":
+			case "s3":
+				s3Handler, err := s3.NewHandler(s3.Config{
+					Endpoint:        env.GetString("S3_ENDPOINT", "https://s3.amazonaws.com"),
+					Bucket:          os.Getenv("S3_BUCKET"),
+					Region:          os.Getenv("S3_REGION"),
+					AccessKeyID:     env.GetString("S3_ACCESS_KEY_ID", os.Getenv("AWS_ACCESS_KEY_ID")),
+					SecretAccessKey: env.GetString("S3_SECRET_ACCESS_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY")),
+					Prefix:          os.Getenv("S3_PREFIX"),
+					PathStyle:       s3PathStyle,
+				})
+				if err != nil {
+					l.Fatalln(err)
+				}
+				blobsHandler = s3Handler
+			default:
+				l.Fatalf("BLOB_STORE: must be memory or s3, not %s", store)
+			}
 
 			manifests := manifest.NewManifests(ctx, blobsHandler, manifest.Config{
 				Debug:              debug,
 				CacheTTL:           time.Duration(cacheTTL) * time.Second,
+				CacheTTLJitter:     time.Duration(cacheTTLJitter) * time.Second,
+				CacheTTLFloor:      time.Duration(cacheTTLFloor) * time.Second,
 				IndexCacheTTL:      time.Duration(indexCacheTTL) * time.Second,
 				IndexErrorCacheTTl: time.Duration(indexErrorCacheTTL) * time.Second,
+				TagsPageSize:       tagsPageSize,
+				TagsMaxPageSize:    tagsMaxPageSize,
+				LowercaseRepos:     lowercaseRepos,
+				ReadOnly:           readOnly,
+				AllowPush:          allowPush,
+
+				CacheStatusHeader:     cacheStatusHeader,
+				FallbackContentType:   fallbackContentType,
+				DigestAlgorithm:       digestAlgorithm,
+				MediaTypeRewrite:      mediaTypeRewrite,
+				StaleWhileRevalidate:  time.Duration(staleWhileRevalidate) * time.Second,
+				StaleIfError:          time.Duration(staleIfError) * time.Second,
+				AnnotationsAllow:      annotationsAllow,
+				AnnotationsDeny:       annotationsDeny,
+				Yanked:                yanked,
+				YankedStatus:          yankedStatus,
+				Tombstones:            tombstones,
+				StreamIndex:           streamIndex,
+				TagRewrites:           tagRewrites,
+				Providers:             providers,
+				ChartAliases:          chartAliases,
+				CatalogProviders:      catalogProviders,
+				CatalogNamespaces:     catalogNamespaces,
+				CatalogDiscovery:      catalogDiscovery,
+				CatalogCacheTTL:       time.Duration(catalogCacheTTL) * time.Second,
+				OCIUpstreams:          ociUpstreams,
+				MaxManifestBlobs:      maxManifestBlobs,
+				BlobFetchConcurrency:  blobFetchConcurrency,
+				BlobDigestRetries:     blobDigestRetries,
+				MaxConcurrentPrepares: maxConcurrentPrepares,
+				RepoQuotas:            repoQuotas,
+				ImmutableRepos:        immutableRepos,
+				MaxChartVersions:      maxChartVersions,
+				OnEvict:               onEvict,
+				LatestPolicies:        latestPolicies,
+				PrefetchNext:          prefetchNext,
+				WarmUp:                warmUp,
+				WarmUpConcurrency:     warmUpConcurrency,
+				FetchForeignLayers:    fetchForeignLayers,
+				ForeignLayerHosts:     foreignLayerHosts,
+				ForeignLayerMaxSize:   int64(foreignLayerMaxSize),
+				ChartChunkSize:        int64(chartChunkSize),
+				ExtractCRDs:           extractCRDs,
+				ChartReadme:           chartReadme,
+				FetchProvenance:       fetchProvenance,
+				AuthPassthroughHosts:  authPassthroughHosts,
+				UpstreamSigners:       upstreamSigners,
+				UpstreamOverrideHosts: upstreamOverrideHosts,
+				FetchBudgets:          fetchBudgets,
+				FetchBudgetMaxWait:    time.Duration(fetchBudgetMaxWait) * time.Second,
+				UpstreamCAs:           upstreamCAs,
+				FileUpstreams:         fileUpstreams,
+
+				InsecureSkipVerifyHosts: insecureSkipVerifyHosts,
+				HTTPFallbackHosts:       httpFallbackHosts,
+				NonChartContentTypes:    nonChartContentTypes,
+				PreserveUpstreamDigests: preserveUpstreamDigests,
+
+				UpstreamBreakerThreshold: upstreamBreakerThreshold,
+				UpstreamBreakerCooldown:  time.Duration(upstreamBreakerCooldown) * time.Second,
+
+				UpstreamMaxIdleConns:        upstreamMaxIdleConns,
+				UpstreamMaxIdleConnsPerHost: upstreamMaxIdleConnsPerHost,
+				UpstreamIdleConnTimeout:     time.Duration(upstreamIdleConnTimeout) * time.Second,
 			}, indexCache, l)
+			go manifests.WarmUp(ctx)
 
 			blobsHttpHandler := blobs.NewBlobs(blobsHandler, l)
+			blobsHttpHandler.Served = manifests.CountBlobBytes
+			blobsHttpHandler.MediaType = manifests.BlobMediaType
+			blobsHttpHandler.Chunks = manifests.BlobChunks
+			blobsHttpHandler.CacheStatusHeader = cacheStatusHeader
+			blobsHttpHandler.Uploads = allowPush && !readOnly
+			blobsHttpHandler.MaxUploadSize = int64(maxUploadSize)
+			blobsHttpHandler.UploadTTL = time.Duration(uploadTTL) * time.Second
 			//blobsHandler = file.NewHandler(dbLocation)
-			s := &http.Server{
-				ReadHeaderTimeout: 5 * time.Second, // prevent slowloris, quiet linter
-				Handler: registry.New(
-					manifests.Handle,
-					blobsHttpHandler.Handle,
-					manifests.HandleTags,
-					manifests.HandleCatalog,
-					registry.Debug(debug), registry.Logger(l)),
+
+			opts := []registry.Option{
+				registry.Referrers(manifests.HandleReferrers),
+				registry.Compress(compressResponses), registry.CompressLevel(compressLevel),
+				registry.Debug(debug), registry.Logger(l),
+			}
+			if allowPush {
+				opts = append(opts, registry.AllowMethods(registry.RouteManifests, http.MethodGet, http.MethodHead, http.MethodPut))
+				opts = append(opts, registry.AllowMethods(registry.RouteBlobs, http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPatch, http.MethodPut))
+			}
+			if len(trustedProxies) > 0 {
+				opts = append(opts, registry.TrustedProxies(trustedProxies))
 			}
+			if notFoundRedirect != "" {
+				opts = append(opts, registry.NotFoundRedirect(notFoundRedirect))
+			}
+			if len(responseHeaders) > 0 {
+				opts = append(opts, registry.ResponseHeaders(responseHeaders))
+			}
+			if requestTimeout > 0 {
+				opts = append(opts, registry.Timeout(time.Duration(requestTimeout)*time.Second))
+			}
+			if maxConcurrentRequests > 0 {
+				opts = append(opts, registry.Queue(maxConcurrentRequests, requestQueueDepth))
+			}
+			if adminToken != "" {
+				opts = append(opts, registry.Admin(manifests.HandleAdmin, adminToken))
+			}
+			s := registry.NewServer(registry.New(
+				manifests.Handle,
+				blobsHttpHandler.Handle,
+				manifests.HandleTags,
+				manifests.HandleCatalog,
+				opts...), limits)
 
 			errCh := make(chan error)
 			go func() {
@@ -129,3 +427,25 @@ Contents are only stored in memory, and when the process exits, pushed data is l
 		},
 	}
 }
+
+// envList reads a comma separated list from the environment.
+func envList(key string) []string {
+	var res []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// envMap parses a comma separated list of key=value pairs, keys are lowercased.
+func envMap(key string) map[string]string {
+	res := map[string]string{}
+	for _, v := range envList(key) {
+		if k, val, ok := strings.Cut(v, "="); ok {
+			res[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(val)
+		}
+	}
+	return res
+}
@@ -6,7 +6,11 @@ set -e -u # -e "Automatic exit from bash shell script on error"  -u "Treat unset
 
 
 build() {
-  CGO_ENABLED=0 go build -o .bin/proxy .
+  pkg=github.com/container-registry/helm-charts-oci-proxy/internal/version
+  version=$(git describe --tags --always 2>/dev/null || echo dev)
+  git_commit=$(git rev-parse --short HEAD 2>/dev/null || echo unknown)
+  build_date=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+  CGO_ENABLED=0 go build -ldflags "-X $pkg.Version=$version -X $pkg.Commit=$git_commit -X $pkg.Date=$build_date" -o .bin/proxy .
 }
 
 build_push_image() {
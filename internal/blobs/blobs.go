@@ -2,10 +2,13 @@ package blobs
 
 import (
 	"bytes"
+	"context"
 	cerrors "errors"
 	"fmt"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
+	"github.com/container-registry/helm-charts-oci-proxy/pkg/verify"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/sirupsen/logrus"
 	"io"
@@ -13,21 +16,45 @@ import (
 	"path"
 	"strings"
 	"sync"
+	"time"
 )
 
 // errNotFound represents an error locating the Blob.
 
 // Blobs service
 type Blobs struct {
-	handler handler.BlobHandler `json:"blobHandler"`
+	// Served, if set, is told the bytes of each blob served by repo
+	Served func(repo string, n int64)
+	// MediaType, if set, names the Content-Type of a blob by digest, blobs it
+	// doesn't know are served as application/octet-stream
+	MediaType func(digest string) string
+	// CacheStatusHeader, if set, is sent as HIT with every blob, blobs are
+	// only served from the store
+	CacheStatusHeader string
+	// Chunks, if set, lists the blobs a blob split into chunks is
+	// reassembled from, in order, and its size. Others are served as stored
+	Chunks func(digest string) ([]string, int64)
+	// Uploads, if set, accepts blobs pushed to the upload endpoints of a
+	// handler able to put them
+	Uploads bool
+	// MaxUploadSize is the largest blob accepted by the upload endpoints,
+	// 512 MiB if it's zero
+	MaxUploadSize int64
+	// UploadTTL is for how long an upload session is kept without
+	// requests, 10 minutes if it's zero
+	UploadTTL time.Duration
+
+	handler handler.BlobHandler
 	// Each upload gets a unique id that writes occur to until finalized.
 	// Temporary storage
-	lock sync.Mutex
-	log  logrus.StdLogger
+	uploads map[string]*upload
+	lock    sync.Mutex
+	log     logrus.StdLogger
+	now     func() time.Time
 }
 
 func NewBlobs(blobHandler handler.BlobHandler, log logrus.StdLogger) *Blobs {
-	return &Blobs{handler: blobHandler, log: log}
+	return &Blobs{handler: blobHandler, log: log, now: time.Now}
 }
 
 func (b *Blobs) Handle(resp http.ResponseWriter, req *http.Request) error {
@@ -42,26 +69,39 @@ func (b *Blobs) Handle(resp http.ResponseWriter, req *http.Request) error {
 	if len(elem) < 4 {
 		return &errors.RegError{
 			Status:  http.StatusBadRequest,
-			Code:    "NAME_INVALID",
+			Code:    errors.CodeNameInvalid,
 			Message: "Blobs must be attached to a repo",
 		}
 	}
+	// the manifests of other identities are cached under names with an @
+	if name, _, _ := strings.Cut(req.URL.Path, "/blobs/"); strings.Contains(name, "@") {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    errors.CodeNameInvalid,
+			Message: "Invalid repository name",
+		}
+	}
+	if isUpload(elem) {
+		return b.handleUpload(resp, req, elem)
+	}
 	target := elem[len(elem)-1]
 	repo := req.URL.Host + path.Join(elem[1:len(elem)-2]...)
 
 	switch req.Method {
 	case http.MethodHead:
-		h, err := v1.NewHash(target)
+		h, err := helper.NewHash(target)
 		if err != nil {
 			return &errors.RegError{
 				Status:  http.StatusBadRequest,
-				Code:    "NAME_INVALID",
+				Code:    errors.CodeDigestInvalid,
 				Message: "invalid digest",
 			}
 		}
 
 		var size int64
-		if bsh, ok := b.handler.(handler.BlobStatHandler); ok {
+		if chunks, chunkedSize := b.chunks(h); len(chunks) > 0 {
+			size = chunkedSize
+		} else if bsh, ok := b.handler.(handler.BlobStatHandler); ok {
 			size, err = bsh.Stat(ctx, repo, h)
 			if cerrors.Is(err, ErrNotFound) {
 				return regErrBlobUnknown
@@ -98,18 +138,30 @@ func (b *Blobs) Handle(resp http.ResponseWriter, req *http.Request) error {
 		return nil
 
 	case http.MethodGet:
-		h, err := v1.NewHash(target)
+		h, err := helper.NewHash(target)
 		if err != nil {
 			return &errors.RegError{
 				Status:  http.StatusBadRequest,
-				Code:    "NAME_INVALID",
+				Code:    errors.CodeDigestInvalid,
 				Message: "invalid digest",
 			}
 		}
 
 		var size int64
 		var r io.Reader
-		if bsh, ok := b.handler.(handler.BlobStatHandler); ok {
+		if chunks, chunkedSize := b.chunks(h); len(chunks) > 0 {
+			rc, err := b.reassemble(ctx, repo, chunks)
+			if cerrors.Is(err, ErrNotFound) {
+				return regErrBlobUnknown
+			} else if err != nil {
+				return errors.RegErrInternal(err)
+			}
+			defer rc.Close()
+			size = chunkedSize
+			if r, err = verify.ReadCloser(rc, size, h); err != nil {
+				return errors.RegErrInternal(err)
+			}
+		} else if bsh, ok := b.handler.(handler.BlobStatHandler); ok {
 			size, err = bsh.Stat(ctx, repo, h)
 			if cerrors.Is(err, ErrNotFound) {
 				return regErrBlobUnknown
@@ -135,7 +187,9 @@ func (b *Blobs) Handle(resp http.ResponseWriter, req *http.Request) error {
 				return errors.RegErrInternal(err)
 			}
 			defer rc.Close()
-			r = rc
+			if r, err = verify.ReadCloser(rc, size, h); err != nil {
+				return errors.RegErrInternal(err)
+			}
 		} else {
 			tmp, err := b.handler.Get(ctx, repo, h)
 			if cerrors.Is(err, ErrNotFound) {
@@ -150,23 +204,92 @@ func (b *Blobs) Handle(resp http.ResponseWriter, req *http.Request) error {
 				return errors.RegErrInternal(err)
 			}
 			defer tmp.Close()
+			vrc, err := verify.ReadCloser(tmp, verify.SizeUnknown, h)
+			if err != nil {
+				return errors.RegErrInternal(err)
+			}
 			var buf bytes.Buffer
-			io.Copy(&buf, tmp)
+			if _, err = io.Copy(&buf, vrc); err != nil {
+				return errors.RegErrInternal(err)
+			}
 			size = int64(buf.Len())
 			r = &buf
 		}
 
+		mediaType := "application/octet-stream"
+		if b.MediaType != nil {
+			if mt := b.MediaType(h.String()); mt != "" {
+				mediaType = mt
+			}
+		}
 		resp.Header().Set("Content-Length", fmt.Sprint(size))
 		resp.Header().Set("Docker-Content-Digest", h.String())
+		// don't let the content be sniffed, tarballs aren't gzip encoded responses
+		resp.Header().Set("Content-Type", mediaType)
+		if b.CacheStatusHeader != "" {
+			resp.Header().Set(b.CacheStatusHeader, "HIT")
+		}
 		resp.WriteHeader(http.StatusOK)
-		io.Copy(resp, r)
+		n, err := io.Copy(resp, r)
+		if err != nil {
+			// too late for an error status, clients verifying the digest reject it
+			b.log.Printf("serving blob %s: %v", h, err)
+		}
+		if b.Served != nil {
+			b.Served(repo, n)
+		}
 		return nil
 
 	default:
 		return &errors.RegError{
 			Status:  http.StatusBadRequest,
-			Code:    "METHOD_UNKNOWN",
+			Code:    errors.CodeUnsupported,
 			Message: "We don't understand your method + url",
 		}
 	}
 }
+
+func (b *Blobs) chunks(h v1.Hash) ([]string, int64) {
+	if b.Chunks == nil {
+		return nil, 0
+	}
+	return b.Chunks(h.String())
+}
+
+// reassemble reads the chunks of a blob one after another.
+func (b *Blobs) reassemble(ctx context.Context, repo string, chunks []string) (io.ReadCloser, error) {
+	rc := &chunksReader{}
+	var readers []io.Reader
+	for _, c := range chunks {
+		h, err := helper.NewHash(c)
+		if err != nil {
+			_ = rc.Close()
+			return nil, err
+		}
+		chunk, err := b.handler.Get(ctx, repo, h)
+		if err != nil {
+			_ = rc.Close()
+			return nil, err
+		}
+		readers = append(readers, chunk)
+		rc.closers = append(rc.closers, chunk)
+	}
+	rc.Reader = io.MultiReader(readers...)
+	return rc, nil
+}
+
+// chunksReader reads chunks sequentially and closes them all.
+type chunksReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *chunksReader) Close() error {
+	var err error
+	for _, c := range r.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,254 @@
+package blobs_test
+
+import (
+	"bytes"
+	"context"
+	cerrors "errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/mem"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/opencontainers/go-digest"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const chartLayerMediaType = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+
+// getOnly hides the Stat of a handler, so blobs are read without their size.
+type getOnly struct {
+	h *mem.Handler
+}
+
+func (g getOnly) Get(ctx context.Context, repo string, h v1.Hash) (io.ReadCloser, error) {
+	return g.h.Get(ctx, repo, h)
+}
+
+func put(t *testing.T, h *mem.Handler, d digest.Digest, data []byte) {
+	t.Helper()
+	hash, err := helper.NewHash(d.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = h.Put(context.Background(), "", hash, io.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(b *blobs.Blobs, d string) (*httptest.ResponseRecorder, error) {
+	rec := httptest.NewRecorder()
+	return rec, b.Handle(rec, httptest.NewRequest(http.MethodGet, "/v2/example.com/charts/nginx/blobs/"+d, nil))
+}
+
+func TestGetBlob(t *testing.T) {
+	data := []byte("chart archive")
+	d := digest.FromBytes(data)
+	h := mem.NewMemHandler()
+	put(t, h, d, data)
+
+	b := blobs.NewBlobs(h, log.Default())
+	b.MediaType = func(got string) string {
+		if got == d.String() {
+			return chartLayerMediaType
+		}
+		return ""
+	}
+	b.CacheStatusHeader = "X-Cache"
+	rec, err := get(b, d.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d; want 200", rec.Code)
+	}
+	if got := digest.FromBytes(rec.Body.Bytes()); got != d {
+		t.Errorf("served blob digest = %s; want %s", got, d)
+	}
+	if got := rec.Header().Get("Docker-Content-Digest"); got != d.String() {
+		t.Errorf("Docker-Content-Digest = %q; want %q", got, d)
+	}
+	if got := rec.Header().Get("Content-Type"); got != chartLayerMediaType {
+		t.Errorf("Content-Type = %q; want %q", got, chartLayerMediaType)
+	}
+	if got := rec.Header().Get("X-Cache"); got != "HIT" {
+		t.Errorf("X-Cache = %q; want HIT", got)
+	}
+
+	// blobs no manifest refers to aren't sniffed
+	other := []byte(`{"key": "value"}`)
+	od := digest.FromBytes(other)
+	put(t, h, od, other)
+	rec, err = get(b, od.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/octet-stream" {
+		t.Errorf("Content-Type = %q; want application/octet-stream", got)
+	}
+}
+
+func TestGetBlobUnknown(t *testing.T) {
+	b := blobs.NewBlobs(mem.NewMemHandler(), log.Default())
+	for _, bh := range []*blobs.Blobs{b, blobs.NewBlobs(getOnly{mem.NewMemHandler()}, log.Default())} {
+		_, err := get(bh, digest.FromString("missing").String())
+		var regErr *errors.RegError
+		if !cerrors.As(err, &regErr) {
+			t.Fatalf("err = %v; want a RegError", err)
+		}
+		if regErr.Status != http.StatusNotFound || regErr.Code != errors.CodeBlobUnknown {
+			t.Errorf("got %d %s; want 404 %s", regErr.Status, regErr.Code, errors.CodeBlobUnknown)
+		}
+	}
+}
+
+func TestBlobScopedName(t *testing.T) {
+	b := blobs.NewBlobs(mem.NewMemHandler(), log.Default())
+	err := b.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/example.com/charts/nginx@0123abcd/blobs/"+digest.FromString("x").String(), nil))
+	var regErr *errors.RegError
+	if !cerrors.As(err, &regErr) || regErr.Status != http.StatusBadRequest || regErr.Code != errors.CodeNameInvalid {
+		t.Errorf("err = %v; want 400 %s", err, errors.CodeNameInvalid)
+	}
+}
+
+func TestGetBlobVerified(t *testing.T) {
+	d := digest.FromString("chart archive")
+	h := mem.NewMemHandler()
+	put(t, h, d, []byte("tampered archive"))
+
+	// without a size the blob is verified before anything is sent
+	_, err := get(blobs.NewBlobs(getOnly{h}, log.Default()), d.String())
+	var regErr *errors.RegError
+	if !cerrors.As(err, &regErr) || regErr.Status != http.StatusInternalServerError {
+		t.Errorf("err = %v; want a 500 RegError", err)
+	}
+}
+
+func upload(b *blobs.Blobs, method string, target string, body []byte) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	if err := b.Handle(rec, httptest.NewRequest(method, target, bytes.NewReader(body))); err != nil {
+		var regErr *errors.RegError
+		if cerrors.As(err, &regErr) {
+			rec.Code = regErr.Status
+		}
+	}
+	return rec
+}
+
+func TestUploadBlob(t *testing.T) {
+	const uploads = "/v2/example.com/charts/nginx/blobs/uploads/"
+	data := []byte("chart archive")
+	d := digest.FromBytes(data)
+
+	b := blobs.NewBlobs(mem.NewMemHandler(), log.New(io.Discard, "", 0))
+	if rec := upload(b, http.MethodPost, uploads+"?digest="+d.String(), data); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("upload disabled: status = %d; want 405", rec.Code)
+	}
+	b.Uploads = true
+
+	// monolithic
+	rec := upload(b, http.MethodPost, uploads+"?digest="+d.String(), data)
+	if rec.Code != http.StatusCreated || rec.Header().Get("Docker-Content-Digest") != d.String() {
+		t.Fatalf("monolithic upload: status = %d, digest %q; want 201 %s", rec.Code, rec.Header().Get("Docker-Content-Digest"), d)
+	}
+	if rec, err := get(b, d.String()); err != nil || !bytes.Equal(rec.Body.Bytes(), data) {
+		t.Errorf("GET after monolithic upload = %q, %v; want %q", rec.Body.Bytes(), err, data)
+	}
+
+	// chunked
+	chunked := []byte("chunked chart archive")
+	cd := digest.FromBytes(chunked)
+	rec = upload(b, http.MethodPost, uploads, nil)
+	location := rec.Header().Get("Location")
+	if rec.Code != http.StatusAccepted || location == "" {
+		t.Fatalf("upload session: status = %d, location %q; want 202", rec.Code, location)
+	}
+	if rec = upload(b, http.MethodPatch, location, chunked[:8]); rec.Code != http.StatusAccepted || rec.Header().Get("Range") != "0-7" {
+		t.Fatalf("first chunk: status = %d, range %q; want 202 0-7", rec.Code, rec.Header().Get("Range"))
+	}
+	req := httptest.NewRequest(http.MethodPatch, location, bytes.NewReader(chunked[8:]))
+	req.Header.Set("Content-Range", "0-12")
+	rrec := httptest.NewRecorder()
+	var regErr *errors.RegError
+	if err := b.Handle(rrec, req); !cerrors.As(err, &regErr) || regErr.Status != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("out of order chunk: err = %v; want 416", err)
+	}
+	req = httptest.NewRequest(http.MethodPatch, location, bytes.NewReader(chunked[8:16]))
+	req.Header.Set("Content-Range", "8-15")
+	rrec = httptest.NewRecorder()
+	if err := b.Handle(rrec, req); err != nil || rrec.Header().Get("Range") != "0-15" {
+		t.Fatalf("second chunk: err = %v, range %q; want 0-15", err, rrec.Header().Get("Range"))
+	}
+	if rec = upload(b, http.MethodPut, location+"?digest="+cd.String(), chunked[16:]); rec.Code != http.StatusCreated {
+		t.Fatalf("closing upload: status = %d; want 201", rec.Code)
+	}
+	if rec, err := get(b, cd.String()); err != nil || !bytes.Equal(rec.Body.Bytes(), chunked) {
+		t.Errorf("GET after chunked upload = %q, %v; want %q", rec.Body.Bytes(), err, chunked)
+	}
+	if rec = upload(b, http.MethodPatch, location, chunked); rec.Code != http.StatusNotFound {
+		t.Errorf("PATCH to a closed upload: status = %d; want 404", rec.Code)
+	}
+
+	// digest mismatch
+	other := digest.FromString("other")
+	if rec = upload(b, http.MethodPost, uploads+"?digest="+other.String(), data); rec.Code != http.StatusBadRequest {
+		t.Errorf("mismatching upload: status = %d; want 400", rec.Code)
+	}
+	if _, err := get(b, other.String()); err == nil {
+		t.Error("mismatching blob stored")
+	}
+}
+
+func TestUploadLimits(t *testing.T) {
+	const uploads = "/v2/example.com/charts/nginx/blobs/uploads/"
+	data := []byte("chart archive")
+	b := blobs.NewBlobs(mem.NewMemHandler(), log.New(io.Discard, "", 0))
+	b.Uploads, b.MaxUploadSize = true, 8
+
+	if rec := upload(b, http.MethodPost, uploads+"?digest="+digest.FromBytes(data).String(), data); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("monolithic upload too large: status = %d; want 413", rec.Code)
+	}
+	location := upload(b, http.MethodPost, uploads, nil).Header().Get("Location")
+	if rec := upload(b, http.MethodPatch, location, data[:4]); rec.Code != http.StatusAccepted {
+		t.Fatalf("first chunk: status = %d; want 202", rec.Code)
+	}
+	if rec := upload(b, http.MethodPatch, location, data[4:]); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunk past the limit: status = %d; want 413", rec.Code)
+	}
+	if rec := upload(b, http.MethodPatch, location, data[:4]); rec.Code != http.StatusNotFound {
+		t.Errorf("PATCH to an upload too large: status = %d; want 404", rec.Code)
+	}
+
+	b.UploadTTL = time.Millisecond
+	location = upload(b, http.MethodPost, uploads, nil).Header().Get("Location")
+	time.Sleep(10 * time.Millisecond)
+	if rec := upload(b, http.MethodPatch, location, data[:4]); rec.Code != http.StatusNotFound {
+		t.Errorf("PATCH to an idle upload: status = %d; want 404", rec.Code)
+	}
+}
+
+func TestGetBlobSHA512(t *testing.T) {
+	data := []byte("chart archive")
+	d := digest.SHA512.FromBytes(data)
+	h := mem.NewMemHandler()
+	put(t, h, d, data)
+
+	for _, b := range []*blobs.Blobs{blobs.NewBlobs(h, log.Default()), blobs.NewBlobs(getOnly{h}, log.Default())} {
+		rec, err := get(b, d.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rec.Body.Bytes(), data) || rec.Header().Get("Docker-Content-Digest") != d.String() {
+			t.Errorf("served %q as %s; want %q as %s", rec.Body.Bytes(), rec.Header().Get("Docker-Content-Digest"), data, d)
+		}
+	}
+
+	put(t, h, d, []byte("tampered archive"))
+	if _, err := get(blobs.NewBlobs(getOnly{h}, log.Default()), d.String()); err == nil {
+		t.Error("tampered sha512 blob served")
+	}
+}
@@ -24,6 +24,12 @@ func (e redirectError) Error() string { return fmt.Sprintf("redirecting (%d): %s
 
 var regErrBlobUnknown = &errors.RegError{
 	Status:  http.StatusNotFound,
-	Code:    "BLOB_UNKNOWN",
+	Code:    errors.CodeBlobUnknown,
 	Message: "Unknown Blob",
 }
+
+var regErrBlobUploadUnknown = &errors.RegError{
+	Status:  http.StatusNotFound,
+	Code:    errors.CodeBlobUploadUnknown,
+	Message: "Unknown upload",
+}
@@ -0,0 +1,179 @@
+// Package s3 stores blobs in a bucket of an S3-compatible object storage,
+// like AWS S3, MinIO or Google Cloud Storage with HMAC keys.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs"
+	"github.com/container-registry/helm-charts-oci-proxy/pkg/sigv4"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultTimeout bounds storage requests, streaming blobs included, as long
+// as the server's default WriteTimeout.
+const defaultTimeout = 10 * time.Minute
+
+type Config struct {
+	// Endpoint is the URL of the storage, like https://s3.eu-west-1.amazonaws.com
+	// or http://localhost:9000
+	Endpoint string
+	Bucket   string
+	// Region requests are signed for, us-east-1 if it's empty
+	Region string
+	// AccessKeyID and SecretAccessKey sign requests, they're sent anonymously
+	// if they're empty
+	AccessKeyID     string
+	SecretAccessKey string
+	// Prefix is prepended to the keys of blobs, like cache/
+	Prefix string
+	// PathStyle addresses the bucket in the path instead of the host, as
+	// MinIO and most self-hosted storages need
+	PathStyle bool
+	// Timeout bounds each request including its body, 10 minutes if it's zero
+	Timeout time.Duration
+}
+
+type Handler struct {
+	config   Config
+	endpoint *url.URL
+	client   *http.Client
+	signer   *sigv4.Signer
+}
+
+func NewHandler(config Config) (*Handler, error) {
+	u, err := url.Parse(strings.TrimSuffix(config.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("s3: invalid endpoint %q", config.Endpoint)
+	}
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("s3: no bucket")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	signer := &sigv4.Signer{
+		AccessKeyID:     config.AccessKeyID,
+		SecretAccessKey: config.SecretAccessKey,
+		Region:          config.Region,
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+	return &Handler{config: config, endpoint: u, client: &http.Client{Timeout: config.Timeout}, signer: signer}, nil
+}
+
+// key is where blob h is stored, by digest.
+func (s *Handler) key(h v1.Hash) string {
+	return s.config.Prefix + h.Algorithm + "/" + h.Hex
+}
+
+func (s *Handler) Stat(ctx context.Context, _ string, h v1.Hash) (int64, error) {
+	resp, err := s.do(ctx, http.MethodHead, s.key(h), nil, 0, sigv4.EmptyPayloadHash)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("s3: HEAD %s: no Content-Length", s.key(h))
+	}
+	return resp.ContentLength, nil
+}
+
+// Get streams the blob from the storage, the caller has to close it.
+func (s *Handler) Get(ctx context.Context, _ string, h v1.Hash) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.key(h), nil, 0, sigv4.EmptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Put stores the blob. The payload is signed with its hash and sent with its
+// length, it's spooled to a temporary file to learn both rather than held in
+// memory.
+func (s *Handler) Put(ctx context.Context, _ string, h v1.Hash, rc io.ReadCloser) error {
+	defer rc.Close()
+	f, err := os.CreateTemp("", "s3-put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	sum := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, sum), rc)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodPut, s.key(h), f, size, hex.EncodeToString(sum.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Delete removes the blob, storages don't tell whether it existed.
+func (s *Handler) Delete(ctx context.Context, _ string, h v1.Hash) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.key(h), nil, 0, sigv4.EmptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// do sends a signed request for the object key with size bytes of body
+// hashing to payloadHash, returning blobs.ErrNotFound if there's none and an
+// error for any other unsuccessful status.
+func (s *Handler) do(ctx context.Context, method string, key string, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	u := *s.endpoint
+	if s.config.PathStyle {
+		u.Path += "/" + s.config.Bucket + "/" + key
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+		u.Path += "/" + key
+	}
+	u.RawPath = sigv4.EscapePath(u.Path)
+	if size == 0 {
+		// otherwise sent chunked
+		body = http.NoBody
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if err = s.signer.Sign(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, blobs.ErrNotFound
+	}
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3: %s %s: %s %s", method, key, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
@@ -0,0 +1,97 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	cerrors "errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestRoundTrip runs against the S3-compatible storage at S3_TEST_ENDPOINT,
+// like a local MinIO, into the existing S3_TEST_BUCKET.
+func TestRoundTrip(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT not set")
+	}
+	s, err := NewHandler(Config{
+		Endpoint:        endpoint,
+		Bucket:          os.Getenv("S3_TEST_BUCKET"),
+		Region:          os.Getenv("S3_TEST_REGION"),
+		AccessKeyID:     os.Getenv("S3_TEST_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_TEST_SECRET_ACCESS_KEY"),
+		Prefix:          "test-" + strconv.FormatInt(time.Now().UnixNano(), 10) + "/",
+		PathStyle:       true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("chart"), 64*1024)
+	h, _, err := v1.SHA256(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.Stat(ctx, "", h); !cerrors.Is(err, blobs.ErrNotFound) {
+		t.Fatalf("Stat before Put = %v; want ErrNotFound", err)
+	}
+	if err = s.Put(ctx, "", h, io.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = s.Delete(ctx, "", h)
+	})
+	if size, err := s.Stat(ctx, "", h); err != nil || size != int64(len(data)) {
+		t.Errorf("Stat = %d, %v; want %d", size, err, len(data))
+	}
+	rc, err := s.Get(ctx, "", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Get = %d bytes, %v; want the %d bytes put", len(got), err, len(data))
+	}
+	if err = s.Delete(ctx, "", h); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Get(ctx, "", h); !cerrors.Is(err, blobs.ErrNotFound) {
+		t.Errorf("Get after Delete = %v; want ErrNotFound", err)
+	}
+}
+
+func TestPutStreamed(t *testing.T) {
+	data := bytes.Repeat([]byte("chart"), 64*1024)
+	h, _, err := v1.SHA256(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength != int64(len(data)) || r.Header.Get("X-Amz-Content-Sha256") != h.Hex {
+			t.Errorf("PUT with Content-Length %d and payload hash %s; want %d and %s", r.ContentLength, r.Header.Get("X-Amz-Content-Sha256"), len(data), h.Hex)
+		}
+		got, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+	s, err := NewHandler(Config{Endpoint: srv.URL, Bucket: "test", AccessKeyID: "id", SecretAccessKey: "secret", PathStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put(context.Background(), "", h, io.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("stored %d bytes; want the %d bytes put", len(got), len(data))
+	}
+}
@@ -0,0 +1,281 @@
+package blobs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
+	"github.com/opencontainers/go-digest"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// isUpload is whether elem, the path of a blobs request, is one of the upload
+// endpoints /v2/{name}/blobs/uploads/ and /v2/{name}/blobs/uploads/{id}.
+func isUpload(elem []string) bool {
+	n := len(elem)
+	return elem[n-1] == "uploads" && elem[n-2] == "blobs" ||
+		n > 4 && elem[n-2] == "uploads" && elem[n-3] == "blobs"
+}
+
+// defaultMaxUploadSize and defaultUploadTTL apply when MaxUploadSize and
+// UploadTTL aren't set.
+const (
+	defaultMaxUploadSize = 512 << 20
+	defaultUploadTTL     = 10 * time.Minute
+)
+
+// upload is a session chunks are appended to until it's closed, spooled to a
+// temporary file rather than held in memory.
+type upload struct {
+	lock    sync.Mutex
+	file    *os.File
+	size    int64
+	touched time.Time
+}
+
+func (u *upload) remove() {
+	_ = u.file.Close()
+	_ = os.Remove(u.file.Name())
+}
+
+func (b *Blobs) newUpload() (*upload, error) {
+	f, err := os.CreateTemp("", "blob-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	return &upload{file: f, touched: b.now()}, nil
+}
+
+// handleUpload stores blobs pushed in one request, or in chunks appended to
+// an upload session until it's closed with the digest of the blob. Blobs are
+// at most MaxUploadSize, sessions idle for UploadTTL are dropped.
+func (b *Blobs) handleUpload(resp http.ResponseWriter, req *http.Request, elem []string) error {
+	putHandler, ok := b.handler.(handler.BlobPutHandler)
+	if !b.Uploads || !ok {
+		return &errors.RegError{
+			Status:  http.StatusMethodNotAllowed,
+			Code:    errors.CodeUnsupported,
+			Message: "Pushing blobs is disabled",
+		}
+	}
+	target := elem[len(elem)-1]
+	var repo string
+	if target == "uploads" {
+		repo = req.URL.Host + path.Join(elem[1:len(elem)-2]...)
+	} else {
+		repo = req.URL.Host + path.Join(elem[1:len(elem)-3]...)
+	}
+	b.expireUploads()
+
+	switch {
+	case req.Method == http.MethodPost && target == "uploads":
+		u, err := b.newUpload()
+		if err != nil {
+			return errors.RegErrInternal(err)
+		}
+		if d := req.URL.Query().Get("digest"); d != "" {
+			// monolithic upload
+			defer u.remove()
+			if err := b.appendUpload(u, req.Body); err != nil {
+				return err
+			}
+			return b.putUpload(resp, req, putHandler, repo, d, u)
+		}
+		id, err := uploadID()
+		if err != nil {
+			u.remove()
+			return errors.RegErrInternal(err)
+		}
+		b.lock.Lock()
+		if b.uploads == nil {
+			b.uploads = map[string]*upload{}
+		}
+		b.uploads[id] = u
+		b.lock.Unlock()
+
+		resp.Header().Set("Location", "/"+path.Join("v2", repo, "blobs/uploads", id))
+		resp.Header().Set("Docker-Upload-UUID", id)
+		resp.Header().Set("Range", "0-0")
+		resp.WriteHeader(http.StatusAccepted)
+		return nil
+
+	case req.Method == http.MethodPatch && target != "uploads":
+		b.lock.Lock()
+		u, ok := b.uploads[target]
+		b.lock.Unlock()
+		if !ok {
+			return regErrBlobUploadUnknown
+		}
+		u.lock.Lock()
+		defer u.lock.Unlock()
+		if start, ok := rangeStart(req.Header.Get("Content-Range")); ok && start != u.size {
+			return &errors.RegError{
+				Status:  http.StatusRequestedRangeNotSatisfiable,
+				Code:    errors.CodeBlobUploadInvalid,
+				Message: fmt.Sprintf("Chunk starts at %d, %d bytes are uploaded", start, u.size),
+			}
+		}
+		if err := b.appendUpload(u, req.Body); err != nil {
+			b.dropUpload(target)
+			return err
+		}
+
+		resp.Header().Set("Location", "/"+path.Join("v2", repo, "blobs/uploads", target))
+		resp.Header().Set("Docker-Upload-UUID", target)
+		resp.Header().Set("Range", fmt.Sprintf("0-%d", u.size-1))
+		resp.WriteHeader(http.StatusAccepted)
+		return nil
+
+	case req.Method == http.MethodPut && target != "uploads":
+		b.lock.Lock()
+		u, ok := b.uploads[target]
+		delete(b.uploads, target)
+		b.lock.Unlock()
+		if !ok {
+			return regErrBlobUploadUnknown
+		}
+		u.lock.Lock()
+		defer u.lock.Unlock()
+		defer u.remove()
+		if err := b.appendUpload(u, req.Body); err != nil {
+			return err
+		}
+		return b.putUpload(resp, req, putHandler, repo, req.URL.Query().Get("digest"), u)
+
+	default:
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    errors.CodeUnsupported,
+			Message: "We don't understand your method + url",
+		}
+	}
+}
+
+// appendUpload appends body to u, failing once u exceeds MaxUploadSize. Must
+// be called with the lock of u held.
+func (b *Blobs) appendUpload(u *upload, body io.Reader) error {
+	limit := b.MaxUploadSize
+	if limit <= 0 {
+		limit = defaultMaxUploadSize
+	}
+	n, err := io.Copy(u.file, io.LimitReader(body, limit-u.size+1))
+	u.size += n
+	u.touched = b.now()
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+	if u.size > limit {
+		return &errors.RegError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    errors.CodeSizeInvalid,
+			Message: fmt.Sprintf("Blobs are limited to %d bytes", limit),
+		}
+	}
+	return nil
+}
+
+// dropUpload removes the session id, its chunks are deleted.
+func (b *Blobs) dropUpload(id string) {
+	b.lock.Lock()
+	u, ok := b.uploads[id]
+	delete(b.uploads, id)
+	b.lock.Unlock()
+	if ok {
+		u.remove()
+	}
+}
+
+// expireUploads drops the sessions no request touched for UploadTTL, those
+// a request is appending to are kept.
+func (b *Blobs) expireUploads() {
+	ttl := b.UploadTTL
+	if ttl <= 0 {
+		ttl = defaultUploadTTL
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for id, u := range b.uploads {
+		if !u.lock.TryLock() {
+			continue
+		}
+		if b.now().Sub(u.touched) > ttl {
+			delete(b.uploads, id)
+			u.remove()
+		}
+		u.lock.Unlock()
+	}
+}
+
+// putUpload streams the blob uploaded to u to the store as d once it's
+// verified to be it. Must be called with the lock of u held.
+func (b *Blobs) putUpload(resp http.ResponseWriter, req *http.Request, putHandler handler.BlobPutHandler, repo string, d string, u *upload) error {
+	want, err := digest.Parse(d)
+	if err != nil {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    errors.CodeDigestInvalid,
+			Message: "invalid digest",
+		}
+	}
+	verifier := want.Algorithm().Digester()
+	if _, err = u.file.Seek(0, io.SeekStart); err != nil {
+		return errors.RegErrInternal(err)
+	}
+	if _, err = io.Copy(verifier.Hash(), u.file); err != nil {
+		return errors.RegErrInternal(err)
+	}
+	if got := verifier.Digest(); got != want {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    errors.CodeDigestInvalid,
+			Message: fmt.Sprintf("Blob digest is %s, not %s", got, want),
+		}
+	}
+	h, err := helper.NewHash(want.String())
+	if err != nil {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    errors.CodeDigestInvalid,
+			Message: "invalid digest",
+		}
+	}
+	if _, err = u.file.Seek(0, io.SeekStart); err != nil {
+		return errors.RegErrInternal(err)
+	}
+	if err = putHandler.Put(req.Context(), repo, h, io.NopCloser(u.file)); err != nil {
+		return errors.RegErrInternal(err)
+	}
+	b.log.Printf("pushed blob %s to %s", h, repo)
+
+	resp.Header().Set("Location", "/"+path.Join("v2", repo, "blobs", h.String()))
+	resp.Header().Set("Docker-Content-Digest", h.String())
+	resp.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func uploadID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// rangeStart returns the first byte of a Content-Range of form start-end.
+func rangeStart(contentRange string) (int64, bool) {
+	start, _, ok := strings.Cut(strings.TrimPrefix(contentRange, "bytes="), "-")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(start, 10, 64)
+	return n, err == nil
+}
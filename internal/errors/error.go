@@ -20,9 +20,35 @@ import (
 	"net/http"
 )
 
+// Code is an error code of the distribution spec, clients may match on it.
+type Code string
+
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#error-codes
+const (
+	CodeBlobUnknown         Code = "BLOB_UNKNOWN"
+	CodeBlobUploadInvalid   Code = "BLOB_UPLOAD_INVALID"
+	CodeBlobUploadUnknown   Code = "BLOB_UPLOAD_UNKNOWN"
+	CodeDigestInvalid       Code = "DIGEST_INVALID"
+	CodeManifestBlobUnknown Code = "MANIFEST_BLOB_UNKNOWN"
+	CodeManifestInvalid     Code = "MANIFEST_INVALID"
+	CodeManifestUnknown     Code = "MANIFEST_UNKNOWN"
+	CodeNameInvalid         Code = "NAME_INVALID"
+	CodeNameUnknown         Code = "NAME_UNKNOWN"
+	CodeSizeInvalid         Code = "SIZE_INVALID"
+	CodeUnauthorized        Code = "UNAUTHORIZED"
+	CodeDenied              Code = "DENIED"
+	CodeUnsupported         Code = "UNSUPPORTED"
+	CodeTooManyRequests     Code = "TOOMANYREQUESTS"
+
+	// not in the OCI spec but defined by the distribution registry, which
+	// clients know as well
+	CodeUnknown     Code = "UNKNOWN"
+	CodeUnavailable Code = "UNAVAILABLE"
+)
+
 type RegError struct {
 	Status  int
-	Code    string
+	Code    Code
 	Message string
 }
 
@@ -31,10 +57,11 @@ func (r *RegError) Error() string {
 }
 
 func (r *RegError) Write(resp http.ResponseWriter) error {
+	resp.Header().Set("Content-Type", "application/json")
 	resp.WriteHeader(r.Status)
 
 	type err struct {
-		Code    string `json:"code"`
+		Code    Code   `json:"code"`
 		Message string `json:"message"`
 	}
 	type wrap struct {
@@ -54,25 +81,25 @@ func (r *RegError) Write(resp http.ResponseWriter) error {
 func RegErrInternal(err error) *RegError {
 	return &RegError{
 		Status:  http.StatusInternalServerError,
-		Code:    "INTERNAL_SERVER_ERROR",
+		Code:    CodeUnknown,
 		Message: err.Error(),
 	}
 }
 
 var RegErrUnsupported = &RegError{
 	Status:  http.StatusMethodNotAllowed,
-	Code:    "UNSUPPORTED",
+	Code:    CodeUnsupported,
 	Message: "Unsupported operation",
 }
 
 var RegErrDigestMismatch = &RegError{
 	Status:  http.StatusBadRequest,
-	Code:    "DIGEST_INVALID",
+	Code:    CodeDigestInvalid,
 	Message: "digest does not match contents",
 }
 
 var RegErrDigestInvalid = &RegError{
 	Status:  http.StatusBadRequest,
-	Code:    "NAME_INVALID",
+	Code:    CodeDigestInvalid,
 	Message: "invalid digest",
 }
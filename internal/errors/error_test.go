@@ -0,0 +1,111 @@
+package errors
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var canonical = map[Code]bool{
+	"BLOB_UNKNOWN":          true,
+	"BLOB_UPLOAD_INVALID":   true,
+	"BLOB_UPLOAD_UNKNOWN":   true,
+	"DIGEST_INVALID":        true,
+	"MANIFEST_BLOB_UNKNOWN": true,
+	"MANIFEST_INVALID":      true,
+	"MANIFEST_UNKNOWN":      true,
+	"NAME_INVALID":          true,
+	"NAME_UNKNOWN":          true,
+	"SIZE_INVALID":          true,
+	"UNAUTHORIZED":          true,
+	"DENIED":                true,
+	"UNSUPPORTED":           true,
+	"TOOMANYREQUESTS":       true,
+	"UNKNOWN":               true,
+	"UNAVAILABLE":           true,
+}
+
+// codeConsts maps the Code constants declared in this package to their values.
+func codeConsts(t *testing.T) map[string]Code {
+	t.Helper()
+	f, err := parser.ParseFile(token.NewFileSet(), "error.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := map[string]Code{}
+	ast.Inspect(f, func(n ast.Node) bool {
+		vs, ok := n.(*ast.ValueSpec)
+		if !ok || vs.Type == nil || vs.Type.(*ast.Ident).Name != "Code" {
+			return true
+		}
+		for i, name := range vs.Names {
+			res[name.Name] = Code(strings.Trim(vs.Values[i].(*ast.BasicLit).Value, `"`))
+		}
+		return true
+	})
+	return res
+}
+
+func TestCanonicalCodes(t *testing.T) {
+	consts := codeConsts(t)
+	for name, code := range consts {
+		if !canonical[code] {
+			t.Errorf("%s = %q is not a distribution error code", name, code)
+		}
+	}
+
+	// every RegError of the module must use one of the constants
+	fset := token.NewFileSet()
+	err := filepath.WalkDir("../..", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return err
+		}
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			cl, ok := n.(*ast.CompositeLit)
+			if !ok || !isRegError(cl.Type) {
+				return true
+			}
+			for _, elt := range cl.Elts {
+				kv, ok := elt.(*ast.KeyValueExpr)
+				if !ok || kv.Key.(*ast.Ident).Name != "Code" {
+					continue
+				}
+				switch v := kv.Value.(type) {
+				case *ast.Ident:
+					ok = consts[v.Name] != ""
+				case *ast.SelectorExpr:
+					// another RegError's code is fine
+					ok = consts[v.Sel.Name] != "" || v.Sel.Name == "Code"
+				default:
+					ok = false
+				}
+				if !ok {
+					t.Errorf("%s: error code is not a Code constant", fset.Position(kv.Value.Pos()))
+				}
+			}
+			return true
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func isRegError(expr ast.Expr) bool {
+	switch v := expr.(type) {
+	case *ast.Ident:
+		return v.Name == "RegError"
+	case *ast.SelectorExpr:
+		return v.Sel.Name == "RegError"
+	}
+	return false
+}
@@ -0,0 +1,17 @@
+package helper
+
+import (
+	_ "crypto/sha512" // makes sha384 and sha512 digests available
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/opencontainers/go-digest"
+)
+
+// NewHash parses a digest of any algorithm go-digest supports, like
+// sha256, sha384 and sha512. v1.NewHash only takes sha256 ones.
+func NewHash(s string) (v1.Hash, error) {
+	d, err := digest.Parse(s)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	return v1.Hash{Algorithm: d.Algorithm().String(), Hex: d.Encoded()}, nil
+}
@@ -54,6 +54,15 @@ func IsTags(req *http.Request) bool {
 	return elems[len(elems)-2] == "tags"
 }
 
+func IsReferrers(req *http.Request) bool {
+	elems := strings.Split(req.URL.Path, "/")
+	elems = elems[1:]
+	if len(elems) < 4 {
+		return false
+	}
+	return elems[len(elems)-2] == "referrers"
+}
+
 func IsCatalog(req *http.Request) bool {
 	elems := strings.Split(req.URL.Path, "/")
 	elems = elems[1:]
@@ -64,6 +73,21 @@ func IsCatalog(req *http.Request) bool {
 	return elems[len(elems)-1] == "_catalog"
 }
 
+func IsAdmin(req *http.Request) bool {
+	return strings.HasPrefix(req.URL.Path, "/admin/")
+}
+
+// IsRegistry returns whether the url is under a /v2/ prefix, Harbor style
+// /<host>/v2/ prefixes included.
+func IsRegistry(req *http.Request) bool {
+	for _, elem := range strings.Split(req.URL.Path, "/") {
+		if elem == "v2" {
+			return true
+		}
+	}
+	return false
+}
+
 func IsV2(req *http.Request) bool {
 	elems := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
 	if len(elems) < 1 {
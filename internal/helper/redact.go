@@ -0,0 +1,73 @@
+package helper
+
+import (
+	"io"
+	"regexp"
+	"strings"
+)
+
+// redacted replaces the credentials a Redactor removes
+const redacted = "REDACTED"
+
+// CredentialNames are the headers and query parameters whose values are
+// always redacted, matched case-insensitively.
+var CredentialNames = []string{
+	"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key", "X-Auth-Token",
+	"access_token", "token", "password", "secret", "api_key", "X-Amz-Credential", "X-Amz-Signature", "sig",
+}
+
+var (
+	// scheme://user:password@ of URLs
+	userinfoPattern = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/?#\s@]+@`)
+	// bearer and basic credentials without a header name
+	schemePattern = regexp.MustCompile(`(?i)\b(Bearer|Basic)\s+[A-Za-z0-9._~+/=-]+`)
+)
+
+// Redactor removes credentials from text before it's logged: the userinfo of
+// URLs, the values of credential headers and query parameters and bearer or
+// basic credentials.
+type Redactor struct {
+	headers *regexp.Regexp
+	params  *regexp.Regexp
+}
+
+// NewRedactor redacts the CredentialNames and names besides them.
+func NewRedactor(names ...string) *Redactor {
+	var quoted []string
+	for _, n := range append(CredentialNames, names...) {
+		if n = strings.TrimSpace(n); n != "" {
+			quoted = append(quoted, regexp.QuoteMeta(n))
+		}
+	}
+	alt := strings.Join(quoted, "|")
+	return &Redactor{
+		// Name: value, name=value and Name:[value] of printed header maps
+		headers: regexp.MustCompile(`(?i)\b(` + alt + `)("?\s*[:=]\s*\[?"?)[^\]\r\n,;"&]+`),
+		params:  regexp.MustCompile(`(?i)([?&](?:` + alt + `)=)[^&\s#"]+`),
+	}
+}
+
+// Redact returns s without the credentials it contains.
+func (r *Redactor) Redact(s string) string {
+	s = userinfoPattern.ReplaceAllString(s, "${1}"+redacted+"@")
+	s = r.params.ReplaceAllString(s, "${1}"+redacted)
+	s = r.headers.ReplaceAllString(s, "${1}${2}"+redacted)
+	return schemePattern.ReplaceAllString(s, "${1} "+redacted)
+}
+
+// Writer redacts what's written to w, log.Logger writes each entry at once.
+func (r *Redactor) Writer(w io.Writer) io.Writer {
+	return &redactingWriter{w: w, r: r}
+}
+
+type redactingWriter struct {
+	w io.Writer
+	r *Redactor
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.r.Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
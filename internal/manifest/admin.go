@@ -0,0 +1,318 @@
+package manifest
+
+import (
+	"archive/tar"
+	"encoding/json"
+	cerrors "errors"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
+	"github.com/container-registry/helm-charts-oci-proxy/pkg/verify"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// cache archive layout
+const (
+	archiveManifests = "manifests.json"
+	archiveBlobs     = "blobs/"
+)
+
+type importResult struct {
+	Manifests int      `json:"manifests"`
+	Blobs     int      `json:"blobs"`
+	Rejected  []string `json:"rejected,omitempty"`
+}
+
+// HandleAdmin serves the /admin/ endpoints, authorization is up to the caller.
+func (m *Manifests) HandleAdmin(resp http.ResponseWriter, req *http.Request) error {
+	p := strings.TrimPrefix(req.URL.Path, "/admin/")
+	switch {
+	case p == "export" && req.Method == http.MethodGet:
+		return m.handleExport(resp, req)
+	case p == "import" && req.Method == http.MethodPost:
+		return m.handleImport(resp, req)
+	case p == "stats" && req.Method == http.MethodGet:
+		return m.handleStats(resp)
+	case p == "search" && req.Method == http.MethodGet:
+		return m.handleSearch(resp, req)
+	case strings.HasPrefix(p, "resolve/") && req.Method == http.MethodGet:
+		return m.handleResolve(resp, req)
+	case strings.HasPrefix(p, "chartmeta/") && req.Method == http.MethodGet:
+		return m.handleChartMeta(resp, req)
+	case strings.HasPrefix(p, "manifest/") && req.Method == http.MethodGet:
+		return m.handleManifestDump(resp, req)
+	case p == "prepare" && req.Method == http.MethodPost:
+		return m.handlePrepare(resp, req)
+	case p == "upstreams" && req.Method == http.MethodGet:
+		return m.handleUpstreams(resp, req)
+	case p == "fsck" && req.Method == http.MethodPost:
+		return m.handleFsck(resp, req)
+	case p == "drain" && (req.Method == http.MethodPost || req.Method == http.MethodDelete):
+		return m.handleDrain(resp, req)
+	}
+	return &errors.RegError{
+		Status:  http.StatusNotFound,
+		Code:    errors.CodeUnsupported,
+		Message: fmt.Sprintf("We don't understand your method + url: %s %s", req.Method, req.URL.Path),
+	}
+}
+
+// handleDrain turns the drain mode on for POST and off for DELETE. Cached
+// manifests are still served while draining, cache misses get a 503.
+func (m *Manifests) handleDrain(resp http.ResponseWriter, req *http.Request) error {
+	m.draining.Store(req.Method == http.MethodPost)
+	m.log.Printf("drain mode: %v", m.draining.Load())
+	msg, err := json.Marshal(struct {
+		Draining bool `json:"draining"`
+	}{m.draining.Load()})
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	_, err = resp.Write(msg)
+	return err
+}
+
+// handleManifestDump writes the stored bytes of a cached manifest as is,
+// nothing is fetched for manifests that aren't cached.
+func (m *Manifests) handleManifestDump(resp http.ResponseWriter, req *http.Request) error {
+	p := strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin/manifest/"), "/")
+	sep := strings.LastIndex(p, "/")
+	if sep < 0 || strings.Count(p[:sep], "/") < 1 {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    errors.CodeNameInvalid,
+			Message: "No chart name or reference specified",
+		}
+	}
+	repo, reference := m.canonicalRepo(p[:sep]), p[sep+1:]
+	repo, rerr := m.resolveRepo(req, repo)
+	if rerr != nil {
+		return rerr
+	}
+
+	// the entries of every identity are looked at, the admin has none
+	var ma Manifest
+	var err error
+	m.lock.Lock()
+	for _, key := range m.scopedKeys(repo) {
+		if ma, err = m.Read(key, reference); err == nil {
+			break
+		}
+	}
+	m.lock.Unlock()
+	if err != nil {
+		return &errors.RegError{
+			Status:  http.StatusNotFound,
+			Code:    errors.CodeManifestUnknown,
+			Message: fmt.Sprintf("Chart %s:%s is not cached", repo, reference),
+		}
+	}
+	resp.Header().Set("Content-Type", m.contentType(ma))
+	resp.Header().Set("Content-Length", fmt.Sprint(len(ma.Blob)))
+	resp.Header().Set("Docker-Content-Digest", m.servedDigest(ma, reference).String())
+	resp.WriteHeader(http.StatusOK)
+	_, err = resp.Write(ma.Blob)
+	return err
+}
+
+// snapshot copies the manifests map so it can be read without the lock.
+func (m *Manifests) snapshot() map[string]map[string]Manifest {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res := make(map[string]map[string]Manifest, len(m.manifests))
+	for repo, refs := range m.manifests {
+		c := make(map[string]Manifest, len(refs))
+		for ref, ma := range refs {
+			c[ref] = ma
+		}
+		res[repo] = c
+	}
+	return res
+}
+
+// sharedSnapshot is a snapshot of the entries served to every client, the
+// ones cached for an identity are left out.
+func (m *Manifests) sharedSnapshot() map[string]map[string]Manifest {
+	res := m.snapshot()
+	for key := range res {
+		if _, scope := splitScopedRepo(key); scope != "" {
+			delete(res, key)
+		}
+	}
+	return res
+}
+
+// blobDigests lists the blobs referenced by ma.
+func blobDigests(ma Manifest) []string {
+	set := map[string]bool{}
+	for _, ref := range ma.Refs {
+		set[ref] = true
+	}
+	var om ocispec.Manifest
+	if err := json.Unmarshal(ma.Blob, &om); err == nil {
+		if om.Config.Digest != "" {
+			set[om.Config.Digest.String()] = true
+		}
+		for _, l := range om.Layers {
+			set[l.Digest.String()] = true
+		}
+	}
+	res := make([]string, 0, len(set))
+	for d := range set {
+		res = append(res, d)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// handleExport writes the cached manifests and their blobs as a tar archive.
+// The ones cached for an identity are left out, their scope is only known to
+// this process.
+func (m *Manifests) handleExport(resp http.ResponseWriter, req *http.Request) error {
+	manifests := m.sharedSnapshot()
+	data, err := json.Marshal(manifests)
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+
+	resp.Header().Set("Content-Type", "application/x-tar")
+	resp.WriteHeader(http.StatusOK)
+	tw := tar.NewWriter(resp)
+	if err = tw.WriteHeader(&tar.Header{Name: archiveManifests, Mode: 0644, Size: int64(len(data))}); err != nil {
+		return err
+	}
+	if _, err = tw.Write(data); err != nil {
+		return err
+	}
+
+	written := map[string]bool{}
+	for _, refs := range manifests {
+		for _, ma := range refs {
+			for _, d := range blobDigests(ma) {
+				if written[d] {
+					continue
+				}
+				h, err := helper.NewHash(d)
+				if err != nil {
+					continue
+				}
+				rc, err := m.blobHandler.Get(req.Context(), "", h)
+				if err != nil {
+					m.log.Printf("export: skipping blob %s: %v", d, err)
+					continue
+				}
+				blob, err := io.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					return err
+				}
+				if err = tw.WriteHeader(&tar.Header{Name: archiveBlobs + h.Algorithm + "/" + h.Hex, Mode: 0644, Size: int64(len(blob))}); err != nil {
+					return err
+				}
+				if _, err = tw.Write(blob); err != nil {
+					return err
+				}
+				written[d] = true
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// handleImport loads an archive produced by handleExport, entries failing
+// digest verification or cached for an identity are rejected. Imported
+// entries expire as if they were just fetched.
+func (m *Manifests) handleImport(resp http.ResponseWriter, req *http.Request) error {
+	putHandler, ok := m.blobHandler.(handler.BlobPutHandler)
+	if !ok {
+		return errors.RegErrUnsupported
+	}
+	res := importResult{}
+	var manifests map[string]map[string]Manifest
+
+	tr := tar.NewReader(req.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &errors.RegError{
+				Status:  http.StatusBadRequest,
+				Code:    errors.CodeUnsupported,
+				Message: fmt.Sprintf("reading archive: %v", err),
+			}
+		}
+		switch {
+		case hdr.Name == archiveManifests:
+			if err = json.NewDecoder(tr).Decode(&manifests); err != nil {
+				return &errors.RegError{
+					Status:  http.StatusBadRequest,
+					Code:    errors.CodeManifestInvalid,
+					Message: fmt.Sprintf("decoding %s: %v", archiveManifests, err),
+				}
+			}
+		case strings.HasPrefix(hdr.Name, archiveBlobs):
+			h, err := helper.NewHash(strings.Replace(strings.TrimPrefix(hdr.Name, archiveBlobs), "/", ":", 1))
+			if err != nil {
+				res.Rejected = append(res.Rejected, hdr.Name)
+				continue
+			}
+			vrc, err := verify.ReadCloser(io.NopCloser(tr), hdr.Size, h)
+			if err != nil {
+				return errors.RegErrInternal(err)
+			}
+			if err = putHandler.Put(req.Context(), "", h, vrc); err != nil {
+				var verr verify.Error
+				if !cerrors.As(err, &verr) {
+					m.log.Printf("import: blob %s: %v", h, err)
+				}
+				res.Rejected = append(res.Rejected, hdr.Name)
+				continue
+			}
+			res.Blobs++
+		}
+	}
+
+	m.lock.Lock()
+	for repo, refs := range manifests {
+		for ref, ma := range refs {
+			d := digest.FromBytes(ma.Blob)
+			if _, scope := splitScopedRepo(repo); scope != "" || ma.Scope != "" {
+				// not reachable by any client of this process
+				res.Rejected = append(res.Rejected, repo+":"+ref)
+				continue
+			}
+			if !matchesDigest(ma.Blob, ref) {
+				res.Rejected = append(res.Rejected, repo+"@"+ref)
+				continue
+			}
+			if _, ok := refs[d.String()]; !ok {
+				// tags must point to an imported manifest
+				res.Rejected = append(res.Rejected, repo+":"+ref)
+				continue
+			}
+			ma.CreatedAt, ma.TTL = m.now(), m.entryTTL()
+			_ = m.Write(repo, ref, ma)
+			res.Manifests++
+		}
+	}
+	m.lock.Unlock()
+
+	msg, err := json.Marshal(res)
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	_, err = resp.Write(msg)
+	return err
+}
@@ -0,0 +1,397 @@
+package manifest
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"helm.sh/helm/v3/pkg/chart"
+)
+
+func adminRequest(t *testing.T, m *Manifests, method, path string, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	if err := m.HandleAdmin(rec, httptest.NewRequest(method, path, bytes.NewReader(body))); err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return rec
+}
+
+func TestExportImport(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	src := newTestManifests(t, u, Config{})
+	want := get(t, src.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0").Body.Bytes()
+
+	archive := adminRequest(t, src, http.MethodGet, "/admin/export", nil).Body.Bytes()
+
+	// imported past the CacheTTL of the exported entries
+	dst := newTestManifests(t, nil, Config{ReadOnly: true, CacheStatusHeader: "X-Cache"})
+	dst.now = (&testClock{t: time.Now().Add(2 * time.Minute)}).now
+	var res importResult
+	if err := json.Unmarshal(adminRequest(t, dst, http.MethodPost, "/admin/import", archive).Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Rejected) != 0 || res.Blobs != 2 {
+		t.Errorf("import result = %+v; want 2 blobs and nothing rejected", res)
+	}
+
+	rec := get(t, dst.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0")
+	if status := rec.Header().Get("X-Cache"); status != cacheHit {
+		t.Errorf("imported manifest cache status = %s; want %s", status, cacheHit)
+	}
+	got := rec.Body.Bytes()
+	if !bytes.Equal(got, want) {
+		t.Errorf("imported manifest differs:\n%s\nwant:\n%s", got, want)
+	}
+	for _, d := range blobDigests(Manifest{Blob: got}) {
+		h, _ := v1.NewHash(d)
+		if _, err := dst.blobHandler.Get(context.Background(), "", h); err != nil {
+			t.Errorf("blob %s not imported: %v", d, err)
+		}
+	}
+}
+
+func TestImportRejectsCorruptEntries(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	src := newTestManifests(t, u, Config{})
+	get(t, src.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0")
+	archive := adminRequest(t, src, http.MethodGet, "/admin/export", nil).Body.Bytes()
+
+	// flip the last byte of every blob
+	var corrupt bytes.Buffer
+	tr := tar.NewReader(bytes.NewReader(archive))
+	tw := tar.NewWriter(&corrupt)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(tr)
+		if strings.HasPrefix(hdr.Name, archiveBlobs) {
+			data[len(data)-1] ^= 0xff
+		}
+		_ = tw.WriteHeader(hdr)
+		_, _ = tw.Write(data)
+	}
+	_ = tw.Close()
+
+	dst := newTestManifests(t, nil, Config{ReadOnly: true})
+	var res importResult
+	if err := json.Unmarshal(adminRequest(t, dst, http.MethodPost, "/admin/import", corrupt.Bytes()).Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Blobs != 0 || len(res.Rejected) != 2 {
+		t.Errorf("import result = %+v; want both blobs rejected", res)
+	}
+}
+
+func TestImportRejectsScopedEntries(t *testing.T) {
+	blob := []byte(`{"schemaVersion":2}`)
+	d := digest.FromBytes(blob).String()
+	data, err := json.Marshal(map[string]map[string]Manifest{
+		"example.com/foo@0123abcd": {d: {Blob: blob}},
+		"example.com/bar":          {d: {Blob: blob, Scope: "0123abcd"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	_ = tw.WriteHeader(&tar.Header{Name: archiveManifests, Mode: 0644, Size: int64(len(data))})
+	_, _ = tw.Write(data)
+	_ = tw.Close()
+
+	dst := newTestManifests(t, nil, Config{ReadOnly: true})
+	var res importResult
+	if err := json.Unmarshal(adminRequest(t, dst, http.MethodPost, "/admin/import", archive.Bytes()).Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Manifests != 0 || len(res.Rejected) != 2 {
+		t.Errorf("import result = %+v; want both entries of an identity rejected", res)
+	}
+}
+
+func TestPullStats(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	m := newTestManifests(t, u, Config{})
+	for i := 0; i < 3; i++ {
+		get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0")
+	}
+	get(t, m.Handle, http.MethodHead, "/v2/"+u.host()+"/foo/manifests/1.0.0")
+
+	var res stats
+	if err := json.Unmarshal(adminRequest(t, m, http.MethodGet, "/admin/stats", nil).Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if n := res.Pulls[u.host()+"/foo:1.0.0"]; n != 3 {
+		t.Errorf("got %d pulls; want 3", n)
+	}
+}
+
+func TestByteStats(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	m := newTestManifests(t, u, Config{})
+	b := blobs.NewBlobs(m.blobHandler, log.Default())
+	b.Served = m.CountBlobBytes
+	repo := u.host() + "/foo"
+
+	manifest := get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/1.0.0").Body.Bytes()
+	var om ocispec.Manifest
+	if err := json.Unmarshal(manifest, &om); err != nil {
+		t.Fatal(err)
+	}
+	layer := get(t, b.Handle, http.MethodGet, "/v2/"+repo+"/blobs/"+om.Layers[0].Digest.String()).Body.Bytes()
+
+	var res stats
+	if err := json.Unmarshal(adminRequest(t, m, http.MethodGet, "/admin/stats", nil).Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if n := res.ManifestBytes[u.host()]; n != int64(len(manifest)) {
+		t.Errorf("manifest bytes = %d; want %d", n, len(manifest))
+	}
+	if n := res.BlobBytes[u.host()]; n != int64(len(layer)) || n != om.Layers[0].Size {
+		t.Errorf("blob bytes = %d; want %d", n, om.Layers[0].Size)
+	}
+	// the index and the archive
+	if n := res.UpstreamBytes[u.host()]; n <= int64(len(layer)) {
+		t.Errorf("upstream bytes = %d; want more than the %d of the archive", n, len(layer))
+	}
+}
+
+func TestDrain(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"}, testChart{name: "bar", version: "1.0.0"})
+	m := newTestManifests(t, u, Config{})
+	foo := "/v2/" + u.host() + "/foo/manifests/1.0.0"
+	bar := "/v2/" + u.host() + "/bar/manifests/1.0.0"
+	get(t, m.Handle, http.MethodGet, foo)
+
+	adminRequest(t, m, http.MethodPost, "/admin/drain", nil)
+	get(t, m.Handle, http.MethodGet, foo)
+	if regErr := handleErr(t, m.Handle, http.MethodGet, bar); regErr.Status != http.StatusServiceUnavailable {
+		t.Errorf("cache miss while draining: status = %d; want 503", regErr.Status)
+	}
+
+	adminRequest(t, m, http.MethodDelete, "/admin/drain", nil)
+	get(t, m.Handle, http.MethodGet, bar)
+}
+
+func TestSearch(t *testing.T) {
+	u := newTestUpstream(t,
+		testChart{name: "nginx", version: "1.0.0"},
+		testChart{name: "nginx-ingress", version: "2.0.0"},
+		testChart{name: "my-nginx", version: "3.0.0"},
+		testChart{name: "redis", version: "4.0.0"},
+	)
+	m := newTestManifests(t, u, Config{})
+	for _, c := range []string{"my-nginx/manifests/3.0.0", "nginx-ingress/manifests/2.0.0", "nginx/manifests/1.0.0", "redis/manifests/4.0.0"} {
+		get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/"+c)
+	}
+
+	var res struct {
+		Results []searchResult `json:"results"`
+	}
+	if err := json.Unmarshal(adminRequest(t, m, http.MethodGet, "/admin/search?q=NGINX", nil).Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range res.Results {
+		got = append(got, strings.TrimPrefix(r.Repository, u.host()+"/")+":"+strings.Join(r.Tags, ","))
+	}
+	want := []string{"nginx:1.0.0", "nginx-ingress:2.0.0", "my-nginx:3.0.0"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("results = %v; want %v", got, want)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	u := newTestUpstream(t,
+		testChart{name: "foo", version: "1.0.0"},
+		testChart{name: "foo", version: "1.2.0"},
+		testChart{name: "foo", version: "2.0.0"},
+	)
+	m := newTestManifests(t, u, Config{})
+	repo := u.host() + "/foo"
+
+	for reference, version := range map[string]string{
+		"1.0.0":          "1.0.0",
+		"v1.2.0":         "1.2.0",
+		">=1.0.0 <2.0.0": "1.2.0",
+		"^1":             "1.2.0",
+		"latest":         "2.0.0",
+		"~2.0":           "2.0.0",
+	} {
+		var res resolveResult
+		rec := adminRequest(t, m, http.MethodGet, "/admin/resolve/"+repo+"/"+url.PathEscape(reference), nil)
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		want := get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/"+version).Body.Bytes()
+		if res.Version != version || res.Digest != digest.FromBytes(want).String() || res.MediaType != ocispec.MediaTypeImageManifest {
+			t.Errorf("%s: resolved to %+v; want version %s digest %s", reference, res, version, digest.FromBytes(want))
+		}
+	}
+
+	if regErr := handleErr(t, m.HandleAdmin, http.MethodGet, "/admin/resolve/"+repo+"/"+url.PathEscape("^3")); regErr.Status != http.StatusNotFound {
+		t.Errorf("unsatisfiable constraint status = %d; want 404", regErr.Status)
+	}
+}
+
+func TestAdminNoAuthPassthrough(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"}, testChart{name: "bar", version: "1.0.0"}, testChart{name: "baz", version: "1.0.0"})
+	m := newTestManifests(t, u, Config{AuthPassthroughHosts: []string{u.host()}})
+	// each entry pulls another chart so the upstream is asked
+	for _, tc := range []struct {
+		method, path, body string
+	}{
+		{http.MethodGet, "/admin/resolve/" + u.host() + "/foo/1.0.0", ""},
+		{http.MethodGet, "/admin/chartmeta/" + u.host() + "/bar/1.0.0", ""},
+		{http.MethodPost, "/admin/prepare", `["` + u.host() + `/baz:1.0.0"]`},
+	} {
+		u.authorization.Store("")
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		req.Header.Set("Authorization", "Bearer admin-token")
+		if err := m.HandleAdmin(httptest.NewRecorder(), req); err != nil {
+			t.Fatalf("%s %s: %v", tc.method, tc.path, err)
+		}
+		if got := u.authorization.Load(); got != "" {
+			t.Errorf("%s %s: upstream got Authorization %q; want none", tc.method, tc.path, got)
+		}
+	}
+}
+
+func TestManifestDump(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	m := newTestManifests(t, u, Config{})
+	repo := u.host() + "/foo"
+	want := get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/1.0.0")
+
+	d := want.Header().Get("Docker-Content-Digest")
+	for _, reference := range []string{"1.0.0", d} {
+		rec := adminRequest(t, m, http.MethodGet, "/admin/manifest/"+repo+"/"+reference, nil)
+		if !bytes.Equal(rec.Body.Bytes(), want.Body.Bytes()) {
+			t.Errorf("%s: dumped\n%s\nwant:\n%s", reference, rec.Body.Bytes(), want.Body.Bytes())
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != want.Header().Get("Content-Type") {
+			t.Errorf("%s: Content-Type = %s; want %s", reference, ct, want.Header().Get("Content-Type"))
+		}
+		if got := rec.Header().Get("Docker-Content-Digest"); got != d {
+			t.Errorf("%s: Docker-Content-Digest = %s; want %s", reference, got, d)
+		}
+	}
+
+	if regErr := handleErr(t, m.HandleAdmin, http.MethodGet, "/admin/manifest/"+repo+"/2.0.0"); regErr.Status != http.StatusNotFound {
+		t.Errorf("uncached manifest status = %d; want 404", regErr.Status)
+	}
+	if n := atomic.LoadInt32(&u.indexRequests); n != 1 {
+		t.Errorf("index fetched %d times; want once, dumps don't fetch", n)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	m := newTestManifests(t, u, Config{})
+	repo := u.host() + "/foo"
+	get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/1.0.0")
+
+	fsck := func(path string) fsckReport {
+		t.Helper()
+		var res fsckReport
+		if err := json.Unmarshal(adminRequest(t, m, http.MethodPost, path, nil).Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	if res := fsck("/admin/fsck"); res.Manifests == 0 || res.Blobs == 0 || len(res.Problems) != 0 {
+		t.Fatalf("fsck of a sound cache = %+v", res)
+	}
+
+	// overwrite the chart archive with other content
+	m.lock.Lock()
+	ma := m.manifests[repo]["1.0.0"]
+	m.lock.Unlock()
+	var om ocispec.Manifest
+	if err := json.Unmarshal(ma.Blob, &om); err != nil {
+		t.Fatal(err)
+	}
+	archive := om.Layers[0].Digest.String()
+	h, _ := v1.NewHash(archive)
+	if err := m.blobHandler.(handler.BlobPutHandler).Put(context.Background(), "", h, io.NopCloser(strings.NewReader("corrupt"))); err != nil {
+		t.Fatal(err)
+	}
+
+	res := fsck("/admin/fsck")
+	if len(res.Problems) == 0 {
+		t.Fatal("fsck found no problem with a corrupt blob")
+	}
+	for _, p := range res.Problems {
+		if p.Blob != archive || p.Problem != fsckBlobMismatch || p.Repaired {
+			t.Errorf("problem = %+v; want a digest mismatch of %s", p, archive)
+		}
+	}
+
+	for _, p := range fsck("/admin/fsck?repair=true").Problems {
+		if !p.Repaired {
+			t.Errorf("problem %+v not repaired", p)
+		}
+	}
+	if res := fsck("/admin/fsck"); len(res.Problems) != 0 {
+		t.Errorf("problems after the repair = %+v", res.Problems)
+	}
+}
+
+func TestChartMeta(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0", files: map[string]string{
+		"Chart.yaml": "apiVersion: v2\nname: foo\nversion: 1.0.0\nappVersion: \"2.3\"\ndescription: A chart\ntype: application\nkeywords: [web, proxy]\nmaintainers:\n- name: Jane\n  email: jane@example.com\n",
+	}})
+	m := newTestManifests(t, u, Config{})
+	want := chart.Metadata{
+		APIVersion:  "v2",
+		Name:        "foo",
+		Version:     "1.0.0",
+		AppVersion:  "2.3",
+		Description: "A chart",
+		Type:        "application",
+		Keywords:    []string{"web", "proxy"},
+		Maintainers: []*chart.Maintainer{{Name: "Jane", Email: "jane@example.com"}},
+	}
+	for _, reference := range []string{"1.0.0", "latest"} {
+		rec := adminRequest(t, m, http.MethodGet, "/admin/chartmeta/"+u.host()+"/foo/"+reference, nil)
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		var got chart.Metadata
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: metadata = %+v; want %+v", reference, got, want)
+		}
+	}
+	if n := atomic.LoadInt32(&u.tarballRequests); n != 1 {
+		t.Errorf("%d archive requests; want the chart pulled once", n)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/chartmeta/"+u.host()+"/foo/9.9.9", nil)
+	if err := m.HandleAdmin(httptest.NewRecorder(), req); err == nil {
+		t.Error("metadata of an unknown version served")
+	}
+}
@@ -0,0 +1,96 @@
+package manifest
+
+import (
+	"fmt"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/repo"
+	"path"
+	"strings"
+)
+
+// Manifest annotations of index.yaml entry fields
+const (
+	AppVersionAnnotation  = "com.container-registry.helm.chart.app-version"
+	KeywordsAnnotation    = "com.container-registry.helm.chart.keywords" // comma separated
+	IndexDigestAnnotation = "com.container-registry.helm.chart.index-digest"
+)
+
+// chartAnnotations maps Chart.yaml fields to OCI manifest annotations. Custom
+// chart annotations are kept but can't override the standard keys.
+func chartAnnotations(meta *chart.Metadata) map[string]string {
+	res := map[string]string{}
+	for k, v := range meta.Annotations {
+		res[k] = v
+	}
+	set := func(k, v string) {
+		if v = strings.TrimSpace(v); v != "" {
+			res[k] = v
+		}
+	}
+	set(ocispec.AnnotationTitle, meta.Name)
+	set(ocispec.AnnotationVersion, meta.Version)
+	set(ocispec.AnnotationDescription, meta.Description)
+	set(ocispec.AnnotationURL, meta.Home)
+	if len(meta.Sources) > 0 {
+		set(ocispec.AnnotationSource, meta.Sources[0])
+	}
+	var authors []string
+	for _, mt := range meta.Maintainers {
+		if mt == nil {
+			continue
+		}
+		if mt.Email != "" {
+			authors = append(authors, fmt.Sprintf("%s (%s)", mt.Name, mt.Email))
+		} else {
+			authors = append(authors, mt.Name)
+		}
+	}
+	set(ocispec.AnnotationAuthors, strings.Join(authors, ", "))
+	return res
+}
+
+// indexAnnotations adds the appVersion, keywords and digest of the index
+// entry of a chart to annotations, the appVersion and keywords of its
+// Chart.yaml meta if the entry has none.
+func indexAnnotations(annotations map[string]string, chartVer *repo.ChartVersion, meta *chart.Metadata) {
+	set := func(k, v string) {
+		if v = strings.TrimSpace(v); v != "" {
+			annotations[k] = v
+		}
+	}
+	appVersion, keywords := meta.AppVersion, meta.Keywords
+	if chartVer.Metadata != nil && chartVer.AppVersion != "" {
+		appVersion = chartVer.AppVersion
+	}
+	if chartVer.Metadata != nil && len(chartVer.Keywords) > 0 {
+		keywords = chartVer.Keywords
+	}
+	set(AppVersionAnnotation, appVersion)
+	set(KeywordsAnnotation, strings.Join(keywords, ","))
+	set(IndexDigestAnnotation, chartVer.Digest)
+}
+
+// filterAnnotations drops the keys not matching AnnotationsAllow (if set) or
+// matching AnnotationsDeny. Patterns use path.Match syntax.
+func (m *Manifests) filterAnnotations(annotations map[string]string) map[string]string {
+	for k := range annotations {
+		if len(m.config.AnnotationsAllow) > 0 && !matchAny(m.config.AnnotationsAllow, k) {
+			delete(annotations, k)
+			continue
+		}
+		if matchAny(m.config.AnnotationsDeny, k) {
+			delete(annotations, k)
+		}
+	}
+	return annotations
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
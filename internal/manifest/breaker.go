@@ -0,0 +1,111 @@
+package manifest
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// States of the circuit breaker of an upstream host
+const (
+	BreakerDisabled = "disabled"  // UpstreamBreakerThreshold is zero
+	BreakerClosed   = "closed"    // requests are sent
+	BreakerOpen     = "open"      // requests fail fast until the cooldown passed
+	BreakerHalfOpen = "half-open" // the next request closes or opens it again
+)
+
+// defaultBreakerCooldown is for how long a breaker stays open when
+// UpstreamBreakerCooldown is zero.
+const defaultBreakerCooldown = 30 * time.Second
+
+// breaker counts the consecutive failures of an upstream host.
+type breaker struct {
+	failures int
+	openedAt time.Time
+}
+
+// breakerError rejects an upstream request while the breaker of its host is
+// open.
+type breakerError struct {
+	Host  string
+	Until time.Time
+}
+
+func (e *breakerError) Error() string {
+	return fmt.Sprintf("circuit breaker of %s is open until %s", e.Host, e.Until.Format(time.RFC3339))
+}
+
+func (m *Manifests) breakerCooldown() time.Duration {
+	if m.config.UpstreamBreakerCooldown > 0 {
+		return m.config.UpstreamBreakerCooldown
+	}
+	return defaultBreakerCooldown
+}
+
+// breakerState returns the state of the breaker of host, BreakerDisabled
+// without UpstreamBreakerThreshold.
+func (m *Manifests) breakerState(host string) string {
+	if m.config.UpstreamBreakerThreshold <= 0 {
+		return BreakerDisabled
+	}
+	m.breakerLock.Lock()
+	defer m.breakerLock.Unlock()
+	b, ok := m.breakers[strings.ToLower(host)]
+	switch {
+	case !ok || b.failures < m.config.UpstreamBreakerThreshold:
+		return BreakerClosed
+	case m.now().Before(b.openedAt.Add(m.breakerCooldown())):
+		return BreakerOpen
+	default:
+		return BreakerHalfOpen
+	}
+}
+
+// allowUpstream rejects requests to host while its breaker is open.
+func (m *Manifests) allowUpstream(host string) error {
+	if m.breakerState(host) != BreakerOpen {
+		return nil
+	}
+	m.breakerLock.Lock()
+	defer m.breakerLock.Unlock()
+	return &breakerError{Host: host, Until: m.breakers[strings.ToLower(host)].openedAt.Add(m.breakerCooldown())}
+}
+
+// do signs and sends an upstream request, counting transport errors and 5xx
+// answers towards opening the breaker of its host. Requests canceled by the
+// client don't count.
+func (m *Manifests) do(req *http.Request) (*http.Response, error) {
+	if err := m.sign(req); err != nil {
+		return nil, err
+	}
+	resp, err := m.client.Do(req)
+	if m.config.UpstreamBreakerThreshold <= 0 || (err != nil && req.Context().Err() != nil) {
+		return resp, err
+	}
+	failed := err != nil || resp.StatusCode >= http.StatusInternalServerError
+	host := strings.ToLower(req.URL.Host)
+
+	m.breakerLock.Lock()
+	defer m.breakerLock.Unlock()
+	b, ok := m.breakers[host]
+	switch {
+	case !failed:
+		delete(m.breakers, host)
+	case !ok && len(m.breakers) >= maxCounterKeys:
+		// clients name arbitrary hosts, keep the map bounded
+	default:
+		if !ok {
+			b = &breaker{}
+			m.breakers[host] = b
+		}
+		b.failures++
+		if b.failures >= m.config.UpstreamBreakerThreshold {
+			if b.failures == m.config.UpstreamBreakerThreshold {
+				m.log.Printf("circuit breaker of %s opened after %d failures", host, b.failures)
+			}
+			b.openedAt = m.now()
+		}
+	}
+	return resp, err
+}
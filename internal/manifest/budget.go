@@ -0,0 +1,61 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/time/rate"
+	"strings"
+	"time"
+)
+
+// budgetError rejects an upstream request its host's FetchBudgets entry
+// wouldn't allow before FetchBudgetMaxWait.
+type budgetError struct {
+	Host  string
+	Delay time.Duration
+}
+
+func (e *budgetError) Error() string {
+	return fmt.Sprintf("fetch budget of %s exhausted, next fetch allowed in %v", e.Host, e.Delay.Round(time.Millisecond))
+}
+
+// newFetchBudgets returns a token bucket per FetchBudgets host, holding a
+// single token so fetches are spread evenly and never exceed the rate.
+func newFetchBudgets(config Config) map[string]*rate.Limiter {
+	res := map[string]*rate.Limiter{}
+	for host, perSecond := range config.FetchBudgets {
+		if perSecond > 0 {
+			res[strings.ToLower(host)] = rate.NewLimiter(rate.Limit(perSecond), 1)
+		}
+	}
+	return res
+}
+
+// waitBudget holds an upstream request to host until its budget allows it,
+// up to FetchBudgetMaxWait. Requests that would wait longer or whose context
+// ends first are rejected and don't use the budget. Upstream requests are
+// never sent holding the lock, so other pulls are served while one waits.
+func (m *Manifests) waitBudget(ctx context.Context, host string) error {
+	limiter, ok := m.budgets[strings.ToLower(host)]
+	if !ok {
+		return nil
+	}
+	r := limiter.Reserve()
+	delay := r.Delay()
+	if delay == 0 {
+		return nil
+	}
+	if delay > m.config.FetchBudgetMaxWait {
+		r.Cancel()
+		return &budgetError{Host: host, Delay: delay}
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	}
+}
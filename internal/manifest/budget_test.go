@@ -0,0 +1,95 @@
+package manifest
+
+import (
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"golang.org/x/time/rate"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFetchBudgets(t *testing.T) {
+	var charts []testChart
+	for i := 0; i < 8; i++ {
+		charts = append(charts, testChart{name: fmt.Sprintf("chart%d", i), version: "1.0.0"})
+	}
+	u := newTestUpstream(t, charts...)
+	var lock sync.Mutex
+	var sent []time.Time
+	record := func() {
+		lock.Lock()
+		defer lock.Unlock()
+		sent = append(sent, time.Now())
+	}
+	u.onIndex, u.onTarball = record, record
+
+	const perSecond = 20
+	m := newTestManifests(t, u, Config{FetchBudgets: map[string]float64{u.host(): perSecond}, FetchBudgetMaxWait: 10 * time.Second})
+	var wg sync.WaitGroup
+	for _, c := range charts {
+		c := c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/"+c.name+"/manifests/1.0.0")
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(sent, func(i, j int) bool { return sent[i].Before(sent[j]) })
+	if len(sent) != len(charts)+1 {
+		t.Fatalf("%d fetches; want the index and %d archives", len(sent), len(charts))
+	}
+	// a little slack for the scheduling of the upstream's handlers
+	minGap := time.Second/perSecond - 10*time.Millisecond
+	for i := 1; i < len(sent); i++ {
+		if gap := sent[i].Sub(sent[i-1]); gap < minGap {
+			t.Errorf("fetch %d sent %v after the previous one; want at least %v", i, gap, minGap)
+		}
+	}
+
+	// without waiting, fetches beyond the budget are refused
+	u = newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	m = newTestManifests(t, u, Config{FetchBudgets: map[string]float64{u.host(): 1}})
+	regErr := handleErr(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0")
+	if regErr.Status != http.StatusTooManyRequests || regErr.Code != errors.CodeTooManyRequests {
+		t.Errorf("got %d %s; want 429 %s once the index used the budget", regErr.Status, regErr.Code, errors.CodeTooManyRequests)
+	}
+}
+
+func TestBudgetWaitUnlocked(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"}, testChart{name: "bar", version: "1.0.0"})
+	u.etags = true
+	m := newTestManifests(t, u, Config{FetchBudgetMaxWait: 10 * time.Second, CacheStatusHeader: "X-Cache"})
+	clock := &testClock{t: time.Now()}
+	m.now = clock.now
+	get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0")
+	clock.advance(50 * time.Second)
+	get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/bar/manifests/1.0.0")
+	clock.advance(20 * time.Second)
+
+	// the budget is used up for the next two seconds
+	limiter := rate.NewLimiter(0.5, 1)
+	limiter.Allow()
+	m.budgets[u.host()] = limiter
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if status := get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0").Header().Get("X-Cache"); status != cacheRevalidated {
+			t.Errorf("cache status of the expired chart = %s; want %s", status, cacheRevalidated)
+		}
+	}()
+	eventually(t, func() bool { return limiter.Tokens() < 0 }, "revalidation didn't wait for the budget")
+
+	start := time.Now()
+	if status := get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/bar/manifests/1.0.0").Header().Get("X-Cache"); status != cacheHit {
+		t.Errorf("cache status = %s; want %s", status, cacheHit)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("cache hit took %v, waiting for the budget of another pull", d)
+	}
+	<-done
+}
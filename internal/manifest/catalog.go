@@ -0,0 +1,199 @@
+package manifest
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bounds of the index discovery of catalogs with CatalogDiscovery
+const (
+	maxDiscoveredIndexes = 100
+	discoveryConcurrency = 4
+	discoveryTimeout     = time.Minute
+)
+
+// catalogSnapshot is the sorted catalog of every repository, as built at
+// builtAt.
+type catalogSnapshot struct {
+	repos   []string
+	builtAt time.Time
+}
+
+// catalogRepos returns the sorted repositories of the catalog, those cached
+// for other identities than the client of ctx left out. With CatalogCacheTTL
+// set they come from a snapshot, rebuilt in the background once it's older
+// than that without the client's credentials, the snapshot is shared by all
+// of them. Callers must not modify them.
+func (m *Manifests) catalogRepos(ctx context.Context) []string {
+	return m.visibleRepos(ctx, m.snapshotRepos(ctx))
+}
+
+// snapshotRepos returns the sorted manifests keys and other repositories of
+// the catalog, from the snapshot with CatalogCacheTTL set.
+func (m *Manifests) snapshotRepos(ctx context.Context) []string {
+	if m.config.CatalogCacheTTL <= 0 {
+		return m.buildCatalog(ctx)
+	}
+	m.catalogLock.Lock()
+	snapshot := m.catalog
+	stale := snapshot != nil && m.now().Sub(snapshot.builtAt) >= m.config.CatalogCacheTTL
+	if stale && !m.catalogRefreshing {
+		m.catalogRefreshing = true
+		go func() {
+			m.snapshotCatalog()
+			m.catalogLock.Lock()
+			m.catalogRefreshing = false
+			m.catalogLock.Unlock()
+		}()
+	}
+	m.catalogLock.Unlock()
+	if snapshot != nil {
+		return snapshot.repos
+	}
+	return m.snapshotCatalog().repos
+}
+
+// snapshotCatalog builds the catalog snapshot, once for concurrent callers.
+func (m *Manifests) snapshotCatalog() *catalogSnapshot {
+	v, _, _ := m.catalogGroup.Do("catalog", func() (interface{}, error) {
+		snapshot := &catalogSnapshot{builtAt: m.now(), repos: m.buildCatalog(context.Background())}
+		m.catalogLock.Lock()
+		m.catalog = snapshot
+		m.catalogLock.Unlock()
+		return snapshot, nil
+	})
+	return v.(*catalogSnapshot)
+}
+
+// buildCatalog lists the cached repositories and, with CatalogProviders, the
+// charts of the providers, sorted.
+func (m *Manifests) buildCatalog(ctx context.Context) []string {
+	// indexes are fetched before locking, it's held by every pull
+	known := m.providerRepos(ctx)
+	if m.config.CatalogDiscovery {
+		m.discover()
+		m.discoveryLock.Lock()
+		for repo := range m.discovered {
+			known[repo] = true
+		}
+		m.discoveryLock.Unlock()
+	}
+
+	// only the keys are copied under the lock, large catalogs are sorted
+	// without it
+	m.lock.Lock()
+	for key := range m.manifests {
+		known[key] = true
+	}
+	m.lock.Unlock()
+
+	repos := make([]string, 0, len(known))
+	for key := range known {
+		repos = append(repos, key)
+	}
+	sort.Strings(repos)
+	return repos
+}
+
+// visibleRepos leaves out the manifests keys of repos cached for other
+// identities than the client of ctx, the ones of its identity are named as
+// they're pulled. repos is returned as is if none are scoped.
+func (m *Manifests) visibleRepos(ctx context.Context, repos []string) []string {
+	var res []string
+	scoped := false
+	for i, key := range repos {
+		if !strings.Contains(key, "@") {
+			if res != nil {
+				res = append(res, key)
+			}
+			continue
+		}
+		if res == nil {
+			res = append(make([]string, 0, len(repos)), repos[:i]...)
+		}
+		if repo, ok := m.visibleRepo(ctx, key); ok {
+			res = append(res, repo)
+			scoped = true
+		}
+	}
+	if res == nil {
+		return repos
+	}
+	if scoped {
+		// the repo may also be listed unscoped
+		sort.Strings(res)
+		uniq := res[:0]
+		for _, repo := range res {
+			if len(uniq) == 0 || repo != uniq[len(uniq)-1] {
+				uniq = append(uniq, repo)
+			}
+		}
+		res = uniq
+	}
+	return res
+}
+
+// namespaceRepos returns the repositories of the catalog under namespace, a
+// host, a path under it or a provider name, named as they're pulled through
+// it.
+func (m *Manifests) namespaceRepos(ctx context.Context, namespace string) []string {
+	namespace = m.canonicalRepo(strings.Trim(namespace, "/"))
+	prefix := strings.TrimSuffix(m.expandProvider(namespace), "/") + "/"
+	var res []string
+	for _, repo := range m.catalogRepos(ctx) {
+		if strings.HasPrefix(repo, prefix) {
+			res = append(res, namespace+"/"+strings.TrimPrefix(repo, prefix))
+		}
+	}
+	return res
+}
+
+// discover lists the charts of the chart repositories knownUpstreams returns
+// in the background, at most maxDiscoveredIndexes of them discoveryConcurrency
+// at a time, for the next catalogs. A single discovery runs at once, indexes
+// are cached as for pulls.
+func (m *Manifests) discover() {
+	if m.config.ReadOnly || !m.discovering.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer m.discovering.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+		defer cancel()
+
+		var upstreams []string
+		for _, upstream := range m.knownUpstreams() {
+			if !m.isOCIUpstream(repoHost(upstream)) && len(upstreams) < maxDiscoveredIndexes {
+				upstreams = append(upstreams, upstream)
+			}
+		}
+		slots := make(chan struct{}, discoveryConcurrency)
+		var wg sync.WaitGroup
+		for _, upstream := range upstreams {
+			slots <- struct{}{}
+			wg.Add(1)
+			go func(upstream string) {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+				index, err := m.GetIndex(ctx, upstream)
+				if err != nil {
+					m.log.Printf("catalog discovery: %s: %v", upstream, err)
+					return
+				}
+				m.discoveryLock.Lock()
+				defer m.discoveryLock.Unlock()
+				for name := range index.Entries {
+					if len(m.discovered) < maxCounterKeys {
+						m.discovered[m.canonicalRepo(upstream+"/"+name)] = true
+					}
+				}
+			}(upstream)
+		}
+		wg.Wait()
+	}()
+}
@@ -0,0 +1,68 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"helm.sh/helm/v3/pkg/chart"
+	helmregistry "helm.sh/helm/v3/pkg/registry"
+	"io"
+)
+
+// invalidChartError rejects a chart whose archive or config blob isn't one.
+type invalidChartError struct {
+	Name string
+	Err  error
+}
+
+func (e *invalidChartError) Error() string {
+	return fmt.Sprintf("chart %s is invalid: %v", e.Name, e.Err)
+}
+
+func (e *invalidChartError) Unwrap() error {
+	return e.Err
+}
+
+// validateChartConfig checks data is the Chart.yaml metadata JSON helm
+// reads from the config blob of a chart.
+func validateChartConfig(data []byte) error {
+	var meta chart.Metadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	if meta.Name == "" {
+		return fmt.Errorf("config: no chart name")
+	}
+	return nil
+}
+
+// checkChartConfig validates the config blob of om, already stored, if it's a
+// chart manifest. Other artifacts are left alone.
+func (m *Manifests) checkChartConfig(ctx context.Context, om ocispec.Manifest) error {
+	isChart := om.Config.MediaType == helmregistry.ConfigMediaType
+	for _, l := range om.Layers {
+		isChart = isChart || l.MediaType == helmregistry.ChartLayerMediaType
+	}
+	if !isChart {
+		return nil
+	}
+	if om.Config.MediaType != helmregistry.ConfigMediaType {
+		return fmt.Errorf("config: media type %q, want %s", om.Config.MediaType, helmregistry.ConfigMediaType)
+	}
+	h, err := helper.NewHash(om.Config.Digest.String())
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	rc, err := m.blobHandler.Get(ctx, "", h)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	return validateChartConfig(data)
+}
@@ -0,0 +1,78 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"helm.sh/helm/v3/pkg/chart"
+	helmregistry "helm.sh/helm/v3/pkg/registry"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// handleChartMeta serves the Chart.yaml of /admin/chartmeta/<repo>/<reference>
+// as JSON, from the config of its manifest. The chart is pulled if it isn't
+// cached, references resolve like for /admin/resolve.
+func (m *Manifests) handleChartMeta(resp http.ResponseWriter, req *http.Request) error {
+	p := strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin/chartmeta/"), "/")
+	sep := strings.LastIndex(p, "/")
+	if sep < 0 || strings.Count(p[:sep], "/") < 1 {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    errors.CodeNameInvalid,
+			Message: "No chart name or reference specified",
+		}
+	}
+	repo, reference := m.canonicalRepo(p[:sep]), p[sep+1:]
+	repo, rerr := m.resolveRepo(req, repo)
+	if rerr != nil {
+		return rerr
+	}
+	// never relay the admin token upstream
+	ctx := req.Context()
+
+	version, rerr := m.resolveVersion(ctx, repo, reference)
+	if rerr != nil {
+		return rerr
+	}
+	m.lock.Lock()
+	ma, rerr := m.lookup(ctx, repo, version)
+	m.lock.Unlock()
+	if rerr != nil {
+		return rerr
+	}
+
+	var om ocispec.Manifest
+	if err := json.Unmarshal(ma.Blob, &om); err != nil || om.Config.MediaType != helmregistry.ConfigMediaType {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    errors.CodeManifestInvalid,
+			Message: fmt.Sprintf("%s:%s is not a chart manifest", repo, reference),
+		}
+	}
+	h, err := helper.NewHash(om.Config.Digest.String())
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+	rc, err := m.blobHandler.Get(ctx, "", h)
+	if err != nil {
+		return errors.RegErrInternal(fmt.Errorf("config of %s:%s: %w", repo, reference, err))
+	}
+	defer rc.Close()
+	var meta chart.Metadata
+	if err = json.NewDecoder(io.LimitReader(rc, om.Config.Size)).Decode(&meta); err != nil {
+		return errors.RegErrInternal(fmt.Errorf("config of %s:%s: %w", repo, reference, err))
+	}
+
+	msg, err := json.Marshal(meta)
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	_, err = resp.Write(msg)
+	return err
+}
@@ -1,14 +1,19 @@
 package manifest
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	cerrors "errors"
 	"fmt"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
 	helmregistry "helm.sh/helm/v3/pkg/registry"
 	"helm.sh/helm/v3/pkg/repo"
 	"io"
@@ -19,71 +24,293 @@ import (
 	"path/filepath"
 	"sigs.k8s.io/yaml"
 	"strings"
+	"time"
 )
 
-func (m *Manifests) prepareChart(ctx context.Context, repo string, reference string) *errors.RegError {
+// prepareUpstream fetches repo:reference from its upstream and stores it,
+// cached for scope. Must be called with the lock held, it's released while
+// fetching.
+func (m *Manifests) prepareUpstream(ctx context.Context, repo string, reference string, scope string) *errors.RegError {
+	if m.config.ReadOnly {
+		return &errors.RegError{
+			Status:  http.StatusNotFound,
+			Code:    errors.CodeManifestUnknown,
+			Message: fmt.Sprintf("Chart %s:%s is not cached and the proxy is read-only", repo, reference),
+		}
+	}
 	elem := strings.Split(repo, "/")
 
 	if len(elem) < 2 {
 		return errors.RegErrInternal(fmt.Errorf("invalid repo length"))
 	}
+	if m.isOCIUpstream(elem[0]) {
+		return m.prepareOCI(ctx, repo, reference, scope)
+	}
+	if _, ok := cosignSubject(reference); ok {
+		return &errors.RegError{
+			Status:  http.StatusNotFound,
+			Code:    errors.CodeManifestUnknown,
+			Message: fmt.Sprintf("Chart %s has no signature %s, only OCI upstreams store cosign signatures", repo, reference),
+		}
+	}
 
 	path := strings.Join(elem[:len(elem)-1], "/")
 	chart := elem[len(elem)-1]
 
-	index, err := m.GetIndex(path)
-	if err != nil {
+	var fetched fetchedChart
+	var rerr *errors.RegError
+	m.unlocked(func() {
+		fetched, rerr = m.fetchChart(ctx, path, chart, reference)
+	})
+	if rerr != nil {
+		return rerr
+	}
+	chartVer, reference, u, downloadUrl := fetched.version, fetched.reference, fetched.url, fetched.url.String()
+	manifestData, header, prov := fetched.data, fetched.header, fetched.prov
+
+	chartRepo := fmt.Sprintf("%s/%s", path, chartVer.Name)
+	key := scopedRepo(chartRepo, scope)
+	if d, ok := m.manifestWithLayer(key, digest.FromBytes(manifestData)); ok {
+		// the same archive as another version, share its manifest
+		for _, ref := range []string{reference, d} {
+			if err := m.Write(key, ref, m.manifests[key][d]); err != nil {
+				return errors.RegErrInternal(err)
+			}
+		}
+		return nil
+	}
+
+	memStore := memory.New()
+	root, err := m.packChart(ctx, memStore, chartVer, manifestData, prov, archiveName(u, chartVer))
+	var invalid *invalidChartError
+	if cerrors.As(err, &invalid) {
 		return &errors.RegError{
-			Status:  http.StatusNotFound,
-			Code:    "NAME_UNKNOWN",
-			Message: fmt.Sprintf("index file fetch error: %s", path),
+			Status:  http.StatusBadGateway,
+			Code:    errors.CodeManifestInvalid,
+			Message: fmt.Sprintf("Chart archive %s is invalid: %v", downloadUrl, invalid.Err),
 		}
+	} else if err != nil {
+		return errors.RegErrInternal(err)
 	}
+	copyOptions := oras.DefaultCopyOptions
+	copyOptions.Concurrency = 1
 
-	if reference != "" && !strings.HasPrefix(reference, "v") {
-		reference = fmt.Sprintf("v%s", reference)
+	var refs []string
+
+	copyOptions.PreCopy = func(ctx context.Context, desc ocispec.Descriptor) error {
+		if desc.MediaType == ocispec.MediaTypeImageManifest {
+			// oci manifest
+			for k, ref := range refs {
+				desc.Annotations[fmt.Sprintf("%s%d", ProxyRefAnnotationPrefix, k)] = ref
+			}
+		} else {
+			refs = append(refs, desc.Digest.String())
+		}
+		return nil
 	}
 
-	m.log.Printf("searching index for %s with reference %s\n", chart, reference)
-	chartVer, err := index.Get(chart, reference)
+	dst := NewInternalDst(key, m.blobHandler.(handler.BlobPutHandler), m)
+	dst.scope = scope
+	if m.chunked(manifestData) {
+		// only its chunks are stored
+		dst.skip = map[digest.Digest]bool{digest.FromBytes(manifestData): true}
+	}
+	// push
+	if reference == "" {
+		err = oras.CopyGraph(ctx, memStore, dst, root, copyOptions.CopyGraphOptions)
+	} else {
+		_, err = oras.Copy(ctx, memStore, root.Digest.String(), dst, reference, copyOptions)
+	}
 	if err != nil {
-		return &errors.RegError{
+		return errors.RegErrInternal(err)
+	}
+	for _, ref := range []string{reference, root.Digest.String()} {
+		if ma, ok := m.manifests[dst.repo][ref]; ok {
+			ma.Source, ma.ETag, ma.LastModified = downloadUrl, header.Get("ETag"), header.Get("Last-Modified")
+			ma.IndexDigest = chartVer.Digest
+			ma.Deprecated = chartVer.Deprecated
+			_ = m.Write(dst.repo, ref, ma)
+		}
+	}
+	if m.config.ExtractCRDs {
+		if err = m.storeCRDs(ctx, dst.repo, scope, root, manifestData); err != nil {
+			m.log.Printf("extracting CRDs of %s: %v\n", downloadUrl, err)
+		}
+	}
+	if m.config.ChartReadme == ReadmeModeArtifact {
+		if err = m.storeReadme(ctx, dst.repo, scope, root, manifestData); err != nil {
+			m.log.Printf("extracting README of %s: %v\n", downloadUrl, err)
+		}
+	}
+	return nil
+}
+
+// fetchedChart is a chart version fetched from a chart repository.
+type fetchedChart struct {
+	version   *repo.ChartVersion
+	reference string // the tag clients pull it with
+	url       *url.URL
+	data      []byte // the archive
+	header    http.Header
+	prov      []byte // with FetchProvenance, if there's one
+}
+
+// fetchChart looks up reference of chart in the index of the repository at
+// path and downloads its archive. It doesn't need the lock.
+func (m *Manifests) fetchChart(ctx context.Context, path string, chart string, reference string) (fetchedChart, *errors.RegError) {
+	var res fetchedChart
+	index, err := m.chartIndex(ctx, path, chart)
+	if err != nil {
+		return res, upstreamRegError(err, &errors.RegError{
+			Status:  http.StatusNotFound,
+			Code:    errors.CodeNameUnknown,
+			Message: fmt.Sprintf("index file fetch error: %s", path),
+		})
+	}
+
+	chartVer, err := m.indexVersion(index, chart, reference)
+	if err != nil {
+		return res, &errors.RegError{
 			Status:  http.StatusNotFound,
-			Code:    "NOT FOUND",
+			Code:    errors.CodeManifestUnknown,
 			Message: fmt.Sprintf("Chart: %s version: %s not found: %v", chart, reference, err),
 		}
 	}
 
 	if len(chartVer.URLs) == 0 {
-		return &errors.RegError{
+		return res, &errors.RegError{
 			Status:  http.StatusNotFound,
-			Code:    "NOT FOUND",
+			Code:    errors.CodeManifestUnknown,
 			Message: fmt.Sprintf("Chart has no URLs"),
 		}
 	}
-	reference = strings.TrimPrefix(chartVer.Version, "v")
+	res.version, res.reference = chartVer, m.clientTag(chartVer.Version)
 
-	var downloadUrl string
+	u, err := chartURL(path, chartVer.URLs[0])
+	if err != nil {
+		return res, &errors.RegError{
+			Status:  http.StatusBadGateway,
+			Code:    errors.CodeUnavailable,
+			Message: fmt.Sprintf("Chart: %s version: %s has an invalid URL: %v", chart, chartVer.Version, err),
+		}
+	}
+	res.url = u
+	downloadUrl := u.String()
 
-	u, err := url.Parse(chartVer.URLs[0])
+	res.data, res.header, err = m.download(ctx, downloadUrl)
 	if err != nil {
-		return errors.RegErrInternal(err)
+		return res, upstreamRegError(err, &errors.RegError{
+			Status:  http.StatusNotFound,
+			Code:    errors.CodeManifestUnknown,
+			Message: fmt.Sprintf("Chart archive not found: %s", downloadUrl),
+		})
 	}
-	if u.IsAbs() {
-		downloadUrl = u.String()
-	} else {
-		downloadUrl = fmt.Sprintf("https://%s/%s", path, chartVer.URLs[0])
+
+	if res.data, err = normalizeArchive(res.data); err != nil {
+		return res, &errors.RegError{
+			Status:  http.StatusBadGateway,
+			Code:    errors.CodeUnavailable,
+			Message: fmt.Sprintf("Chart archive %s is invalid: %v", downloadUrl, err),
+		}
 	}
 
-	manifestData, err := m.download(downloadUrl)
+	if m.config.FetchProvenance {
+		if res.prov, err = m.downloadProvenance(ctx, downloadUrl); err != nil {
+			return res, upstreamRegError(err, &errors.RegError{
+				Status:  http.StatusNotFound,
+				Code:    errors.CodeManifestUnknown,
+				Message: fmt.Sprintf("Chart provenance not found: %s.prov", downloadUrl),
+			})
+		}
+	}
+	return res, nil
+}
+
+// indexVersion finds the version of chart clients pull as reference in index.
+func (m *Manifests) indexVersion(index *repo.IndexFile, chart string, reference string) (*repo.ChartVersion, error) {
+	if chartVer, ok := m.upstreamVersion(index, chart, reference); ok {
+		return chartVer, nil
+	}
+	if reference != "" && !strings.HasPrefix(reference, "v") {
+		reference = fmt.Sprintf("v%s", reference)
+	}
+	m.log.Printf("searching index for %s with reference %s\n", chart, reference)
+	return index.Get(chart, reference)
+}
+
+// chartURL resolves a chart archive URL of the index of the repository at
+// repoURLPath, relative ones are relative to the index whatever the archive
+// is named.
+func chartURL(repoURLPath string, ref string) (*url.URL, error) {
+	base, err := url.Parse("https://" + strings.TrimSuffix(repoURLPath, "/") + "/")
 	if err != nil {
-		return errors.RegErrInternal(err)
+		return nil, err
 	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	return base.ResolveReference(u), nil
+}
 
-	packOpts := oras.PackOptions{}
-	memStore := memory.New()
+// archiveName is the file name of the chart archive at u, the conventional
+// <chart>-<version>.tgz if u doesn't end with one, like download endpoints.
+func archiveName(u *url.URL, chartVer *repo.ChartVersion) string {
+	if name := filepath.Base(u.Path); strings.HasSuffix(name, ".tgz") || strings.HasSuffix(name, ".tar.gz") {
+		return name
+	}
+	return fmt.Sprintf("%s-%s.tgz", chartVer.Name, chartVer.Version)
+}
 
-	configData := []byte("{}")
+// manifestWithLayer returns the digest of a manifest of repo referencing the
+// layer, if any. Must be called with the lock held.
+func (m *Manifests) manifestWithLayer(repo string, layer digest.Digest) (string, bool) {
+	for ref, ma := range m.manifests[repo] {
+		if !isDigest(ref) {
+			continue
+		}
+		for _, r := range ma.Refs {
+			if r == layer.String() {
+				return ref, true
+			}
+		}
+	}
+	return "", false
+}
+
+// packChart builds the OCI manifest of a chart archive in store, its config
+// is the Chart.yaml metadata like helm push makes it. The result only depends
+// on the archive and its index entry, so the same chart always gets the same
+// digest. Archives that aren't charts are rejected with an invalidChartError.
+func (m *Manifests) packChart(ctx context.Context, store *memory.Store, chartVer *repo.ChartVersion, data []byte, prov []byte, name string) (ocispec.Descriptor, error) {
+	ch, err := loader.LoadArchive(bytes.NewReader(data))
+	if err != nil {
+		return ocispec.Descriptor{}, &invalidChartError{Name: name, Err: err}
+	}
+	configData, err := json.Marshal(ch.Metadata)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if err = validateChartConfig(configData); err != nil {
+		return ocispec.Descriptor{}, &invalidChartError{Name: name, Err: err}
+	}
+
+	packOpts := oras.PackOptions{}
+	annotations := chartAnnotations(ch.Metadata)
+	indexAnnotations(annotations, chartVer, ch.Metadata)
+	if _, readme, ok := chartReadme(ch); ok && m.config.ChartReadme == ReadmeModeAnnotation {
+		annotations[ReadmeAnnotation] = truncateReadme(readme)
+	}
+	packOpts.ManifestAnnotations = m.filterAnnotations(annotations)
+	if packOpts.ManifestAnnotations == nil {
+		packOpts.ManifestAnnotations = map[string]string{}
+	}
+	// oras would stamp the current time otherwise
+	created := time.Unix(0, 0).UTC()
+	if !chartVer.Created.IsZero() {
+		created = chartVer.Created.UTC()
+	}
+	packOpts.ManifestAnnotations[ocispec.AnnotationCreated] = created.Format(time.RFC3339)
 
 	desc := ocispec.Descriptor{
 		MediaType: helmregistry.ConfigMediaType,
@@ -94,171 +321,319 @@ func (m *Manifests) prepareChart(ctx context.Context, repo string, reference str
 		},
 	}
 
-	err = memStore.Push(ctx, desc, bytes.NewReader(configData))
-	if err != nil {
-		return errors.RegErrInternal(err)
+	if err = store.Push(ctx, desc, bytes.NewReader(configData)); err != nil {
+		return ocispec.Descriptor{}, err
 	}
 
 	desc.Annotations = packOpts.ConfigAnnotations
 	packOpts.ConfigDescriptor = &desc
 	packOpts.PackImageManifest = true
-	name := filepath.Clean(filepath.Base(downloadUrl))
 
 	manifestFile := ocispec.Descriptor{
 		MediaType: helmregistry.ChartLayerMediaType,
-		Digest:    digest.FromBytes(manifestData),
-		Size:      int64(len(manifestData)),
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
 		Annotations: map[string]string{
 			ocispec.AnnotationTitle: name,
 		},
 	}
 
-	err = memStore.Push(ctx, manifestFile, bytes.NewReader(manifestData))
-	copyOptions := oras.DefaultCopyOptions
-	copyOptions.Concurrency = 1
-
-	root, err := oras.Pack(ctx, memStore, "", []ocispec.Descriptor{manifestFile}, packOpts)
-	if err != nil {
-		return errors.RegErrInternal(err)
+	if err = store.Push(ctx, manifestFile, bytes.NewReader(data)); err != nil {
+		return ocispec.Descriptor{}, err
 	}
-	if err = memStore.Tag(ctx, root, root.Digest.String()); err != nil {
-		return errors.RegErrInternal(err)
+	// the archive comes first and its provenance second, as helm pushes them
+	layers := []ocispec.Descriptor{manifestFile}
+	if prov != nil {
+		provFile := ocispec.Descriptor{
+			MediaType: helmregistry.ProvLayerMediaType,
+			Digest:    digest.FromBytes(prov),
+			Size:      int64(len(prov)),
+			Annotations: map[string]string{
+				ocispec.AnnotationTitle: name + ".prov",
+			},
+		}
+		if err = store.Push(ctx, provFile, bytes.NewReader(prov)); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		layers = append(layers, provFile)
 	}
-
-	var refs []string
-
-	copyOptions.PreCopy = func(ctx context.Context, desc ocispec.Descriptor) error {
-		if desc.MediaType == ocispec.MediaTypeImageManifest {
-			// oci manifest
-			for k, ref := range refs {
-				desc.Annotations[fmt.Sprintf("%s%d", ProxyRefAnnotationPrefix, k)] = ref
-			}
-		} else {
-			refs = append(refs, desc.Digest.String())
+	if m.chunked(data) {
+		// clients get the archive reassembled from its chunks, which follow
+		chunks, err := m.pushChunks(ctx, store, manifestFile, data)
+		if err != nil {
+			return ocispec.Descriptor{}, err
 		}
-		return nil
+		layers = append(layers, chunks...)
 	}
 
-	dst := NewInternalDst(fmt.Sprintf("%s/%s", path, chartVer.Name), m.blobHandler.(handler.BlobPutHandler), m)
-	// push
-	if reference == "" {
-		err = oras.CopyGraph(ctx, memStore, dst, root, copyOptions.CopyGraphOptions)
-	} else {
-		_, err = oras.Copy(ctx, memStore, root.Digest.String(), dst, reference, copyOptions)
-	}
+	root, err := oras.Pack(ctx, store, "", layers, packOpts)
 	if err != nil {
-		return errors.RegErrInternal(err)
+		return ocispec.Descriptor{}, err
 	}
-	return nil
+	if err = store.Tag(ctx, root, root.Digest.String()); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return root, nil
 }
 
-func (m *Manifests) GetIndex(repoURLPath string) (*repo.IndexFile, error) {
+var errReadOnly = cerrors.New("upstream fetching is disabled in read-only mode")
 
-	type cacheResp struct {
-		c   *repo.IndexFile
-		err error
+// indexEntry is a parsed index.yaml shared by every chart of the same
+// repository host path.
+type indexEntry struct {
+	index        *repo.IndexFile
+	err          error
+	etag         string
+	lastModified string
+	expiresAt    time.Time
+}
+
+func (m *Manifests) GetIndex(ctx context.Context, repoURLPath string) (*repo.IndexFile, error) {
+	return m.getIndex(ctx, repoURLPath, repoURLPath, readIndex)
+}
+
+// chartIndex returns the index of repoURLPath, holding only the versions of
+// chart if StreamIndex is set.
+func (m *Manifests) chartIndex(ctx context.Context, repoURLPath string, chart string) (*repo.IndexFile, error) {
+	if !m.config.StreamIndex {
+		return m.GetIndex(ctx, repoURLPath)
 	}
+	return m.getIndex(ctx, repoURLPath+"#"+chart, repoURLPath, func(r io.Reader) (*repo.IndexFile, error) {
+		return streamIndex(r, chart)
+	})
+}
 
-	c, ok := m.cache.Get(repoURLPath)
+// getIndex returns the index of repoURLPath parsed with parse, cached as key.
+func (m *Manifests) getIndex(ctx context.Context, key string, repoURLPath string, parse func(io.Reader) (*repo.IndexFile, error)) (*repo.IndexFile, error) {
+	if scope := m.cacheScope(ctx, repoURLPath); scope != "" {
+		// indexes fetched with client credentials may list private charts
+		key += "@" + scope
+	}
+	c, ok := m.cache.Get(key)
+	prev, _ := c.(*indexEntry)
 
-	if !ok || c == nil {
-		// nothing in the cache
-		res := &cacheResp{}
-		res.c, res.err = m.downloadIndex(repoURLPath)
+	if ok && prev != nil && (m.config.ReadOnly || m.now().Before(prev.expiresAt)) {
+		return prev.index, prev.err
+	}
+	if m.config.ReadOnly {
+		return nil, errReadOnly
+	}
+
+	// charts of the same host share a single download and parse
+	v, _, _ := m.indexGroup.Do(key, func() (interface{}, error) {
+		res := m.downloadIndex(ctx, repoURLPath, prev, parse)
+		if cerrors.Is(res.err, context.Canceled) {
+			// the client went away, that says nothing about the upstream
+			return res, nil
+		}
 
 		var ttl = m.config.IndexCacheTTL
 		if res.err != nil {
 			// cache error too to avoid external resource exhausting
 			ttl = m.config.IndexErrorCacheTTl
 		}
-		m.cache.SetWithTTL(repoURLPath, res, 1000, ttl)
-		return res.c, res.err
-	}
-
-	res, ok := c.(*cacheResp)
-	if !ok {
-		return nil, fmt.Errorf("internal error")
-	}
-	return res.c, res.err
+		res.expiresAt = m.now().Add(ttl)
+		// expiry is tracked by the entry itself, so it survives for revalidation
+		m.cache.SetWithTTL(key, res, 1000, 0)
+		return res, nil
+	})
+	res := v.(*indexEntry)
+	return res.index, res.err
 }
 
-func (m *Manifests) downloadIndex(repoURLPath string) (*repo.IndexFile, error) {
+// downloadIndex fetches and parses the index file, revalidating prev with a
+// conditional request when possible.
+func (m *Manifests) downloadIndex(ctx context.Context, repoURLPath string, prev *indexEntry, parse func(io.Reader) (*repo.IndexFile, error)) *indexEntry {
 	url := fmt.Sprintf("https://%s/index.yaml", repoURLPath)
 	if m.config.Debug {
 		m.log.Printf("download index: %s\n", url)
 	}
-	data, err := m.getIndexBytes(url)
+	req, err := m.newUpstreamRequest(ctx, http.MethodGet, url)
 	if err != nil {
-		return nil, err
+		return &indexEntry{err: err}
 	}
-	i := repo.NewIndexFile()
+	if prev != nil && prev.err == nil {
+		if prev.etag != "" {
+			req.Header.Set("If-None-Match", prev.etag)
+		}
+		if prev.lastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.lastModified)
+		}
+	}
+	resp, err := m.do(req)
+	if err != nil {
+		return &indexEntry{err: err}
+	}
+	defer resp.Body.Close()
 
-	if len(data) == 0 {
-		return i, repo.ErrEmptyIndexYaml
+	if resp.StatusCode == http.StatusNotModified && prev != nil {
+		if m.config.Debug {
+			m.log.Printf("index not modified: %s\n", url)
+		}
+		return &indexEntry{index: prev.index, etag: prev.etag, lastModified: prev.lastModified}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &indexEntry{err: &statusError{URL: url, StatusCode: resp.StatusCode}}
+	}
+	body := bufio.NewReader(m.countedBody(resp))
+	head, _ := body.Peek(512)
+	if err = m.checkContentType(url, resp.Header, head); err != nil {
+		return &indexEntry{err: err}
+	}
+	i, err := parse(body)
+	return &indexEntry{
+		index:        i,
+		err:          err,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
 	}
-	if err = yaml.UnmarshalStrict(data, i); err != nil {
+}
+
+func readIndex(r io.Reader) (*repo.IndexFile, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
 		return nil, err
 	}
+	return parseIndex(data)
+}
 
-	for _, cvs := range i.Entries {
-		for idx := len(cvs) - 1; idx >= 0; idx-- {
-			if cvs[idx] == nil {
+// parseIndex reads index.yaml documents of apiVersion v1 or v2, as helm 2
+// and 3 or other tooling generate them. Fields it doesn't know are ignored, a
+// missing apiVersion means v1 and versions that aren't valid charts are
+// dropped, only documents that aren't an index at all are rejected.
+func parseIndex(data []byte) (*repo.IndexFile, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return repo.NewIndexFile(), repo.ErrEmptyIndexYaml
+	}
+	i := &repo.IndexFile{}
+	if err := yaml.Unmarshal(data, i); err != nil {
+		return nil, fmt.Errorf("parsing index: %w", err)
+	}
+	if i.APIVersion == "" && i.Entries == nil {
+		return nil, cerrors.New("parsing index: neither apiVersion nor entries found")
+	}
+	if i.APIVersion == "" {
+		i.APIVersion = repo.APIVersionV1
+	}
+	if i.Entries == nil {
+		i.Entries = map[string]repo.ChartVersions{}
+	}
+
+	for name, cvs := range i.Entries {
+		valid := cvs[:0]
+		for _, cv := range cvs {
+			if cv == nil || cv.Metadata == nil {
 				continue
 			}
-			if cvs[idx].APIVersion == "" {
-				cvs[idx].APIVersion = chart.APIVersionV1
+			if cv.APIVersion == "" {
+				cv.APIVersion = chart.APIVersionV1
+			}
+			if cv.Name == "" {
+				cv.Name = name
 			}
-			if err := cvs[idx].Validate(); err != nil {
-				cvs = append(cvs[:idx], cvs[idx+1:]...)
+			if err := cv.Validate(); err == nil {
+				valid = append(valid, cv)
 			}
 		}
+		i.Entries[name] = valid
 	}
 	i.SortEntries()
-	if i.APIVersion == "" {
-		return i, repo.ErrNoAPIVersion
-	}
 	return i, nil
 }
 
-func (m *Manifests) getIndexBytes(url string) ([]byte, error) {
-
-	type cacheResp struct {
-		c   []byte
-		err error
+func (m *Manifests) download(ctx context.Context, url string) ([]byte, http.Header, error) {
+	if m.config.Debug {
+		m.log.Printf("downloading : %s\n", url)
 	}
+	req, err := m.newUpstreamRequest(ctx, http.MethodGet, url)
+	if err != nil {
+		return nil, nil, err
+	}
+	// keep the archive as is, the transport would transparently decompress
+	// archives served with Content-Encoding: gzip otherwise
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := m.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, &statusError{URL: url, StatusCode: resp.StatusCode}
+	}
+	data, err := io.ReadAll(m.countedBody(resp))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = m.checkContentType(url, resp.Header, data); err != nil {
+		return nil, nil, err
+	}
+	return data, resp.Header, nil
+}
 
-	c, ok := m.cache.Get(url)
-
-	if !ok || c == nil {
-		// nothing in the cache
-		res := &cacheResp{}
-		res.c, res.err = m.download(url)
-
-		var ttl = m.config.IndexCacheTTL
-		if res.err != nil {
-			// cache error too to avoid external resource exhausting
-			ttl = m.config.IndexErrorCacheTTl
+// normalizeArchive returns a chart archive compressed exactly once, as the
+// chart layer media type says. Plain tar archives are compressed, archives
+// compressed twice by servers adding a Content-Encoding are unwrapped.
+func normalizeArchive(data []byte) ([]byte, error) {
+	if !isGzip(data) {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(data); err != nil {
+			return nil, err
 		}
-		m.cache.SetWithTTL(url, res, 1000, ttl)
-		return res.c, res.err
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
 	}
-
-	res, ok := c.(*cacheResp)
-	if !ok {
-		return nil, fmt.Errorf("internal error")
+	for {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		head := make([]byte, 2)
+		if _, err = io.ReadFull(gz, head); err != nil || !isGzip(head) {
+			return data, nil
+		}
+		if data, err = io.ReadAll(io.MultiReader(bytes.NewReader(head), gz)); err != nil {
+			return nil, err
+		}
 	}
-	return res.c, res.err
+}
 
+func isGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
 }
 
-func (m *Manifests) download(url string) ([]byte, error) {
-	if m.config.Debug {
-		m.log.Printf("downloading : %s\n", url)
+// revalidate asks the upstream with a conditional HEAD whether the chart
+// archive ma was built from is unchanged. It doesn't need the lock.
+func (m *Manifests) revalidate(ctx context.Context, ma Manifest) bool {
+	if m.config.ReadOnly || ma.Source == "" || (ma.ETag == "" && ma.LastModified == "") {
+		return false
 	}
-	resp, err := http.Get(url)
+	req, err := m.newUpstreamRequest(ctx, http.MethodHead, ma.Source)
 	if err != nil {
-		return nil, err
+		return false
 	}
-	defer resp.Body.Close()
-	return io.ReadAll(resp.Body)
+	if ma.ETag != "" {
+		req.Header.Set("If-None-Match", ma.ETag)
+	}
+	if ma.LastModified != "" {
+		req.Header.Set("If-Modified-Since", ma.LastModified)
+	}
+	resp, err := m.do(req)
+	if err != nil {
+		if m.config.Debug {
+			m.log.Printf("revalidating %s: %v\n", ma.Source, err)
+		}
+		return false
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return true
+	case http.StatusOK:
+		// some servers ignore conditional HEAD requests
+		return ma.ETag != "" && resp.Header.Get("ETag") == ma.ETag
+	}
+	return false
 }
@@ -0,0 +1,1203 @@
+package manifest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	cerrors "errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/mem"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
+	"github.com/container-registry/helm-charts-oci-proxy/pkg/sigv4"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	helmregistry "helm.sh/helm/v3/pkg/registry"
+	"helm.sh/helm/v3/pkg/repo"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"oras.land/oras-go/v2/content/memory"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamFailures(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+
+	down := httptest.NewTLSServer(http.NotFoundHandler())
+	downHost := strings.TrimPrefix(down.URL, "https://")
+	down.Close()
+
+	broken := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(broken.Close)
+
+	slow := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	t.Cleanup(slow.Close)
+
+	for _, tc := range []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"connection refused", "/v2/" + downHost + "/foo/manifests/1.0.0", http.StatusBadGateway},
+		{"upstream 500", "/v2/" + strings.TrimPrefix(broken.URL, "https://") + "/foo/manifests/1.0.0", http.StatusBadGateway},
+		{"upstream timeout", "/v2/" + strings.TrimPrefix(slow.URL, "https://") + "/foo/manifests/1.0.0", http.StatusGatewayTimeout},
+		{"chart missing from index", "/v2/" + u.host() + "/bar/manifests/1.0.0", http.StatusNotFound},
+		{"version missing from index", "/v2/" + u.host() + "/foo/manifests/9.9.9", http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newTestManifests(t, u, Config{})
+			m.client.Timeout = 100 * time.Millisecond
+			if regErr := handleErr(t, m.Handle, http.MethodGet, tc.path); regErr.Status != tc.status {
+				t.Errorf("status = %d (%s); want %d", regErr.Status, regErr.Message, tc.status)
+			}
+		})
+	}
+}
+
+func TestAuthPassthrough(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+
+	for _, tc := range []struct {
+		name  string
+		hosts []string
+		want  string
+	}{
+		{"passthrough", []string{u.host()}, "Bearer client-token"},
+		{"other host", []string{"example.com"}, ""},
+		{"disabled", nil, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newTestManifests(t, u, Config{AuthPassthroughHosts: tc.hosts})
+			req := httptest.NewRequest(http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0", nil)
+			req.Header.Set("Authorization", "Bearer client-token")
+			if err := m.Handle(httptest.NewRecorder(), req); err != nil {
+				t.Fatal(err)
+			}
+			if got := u.authorization.Load(); got != tc.want {
+				t.Errorf("upstream got Authorization %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAuthPassthroughCacheScope(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	m := newTestManifests(t, u, Config{AuthPassthroughHosts: []string{u.host()}})
+	pull := func(auth string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		if err := m.Handle(httptest.NewRecorder(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pull("Bearer alice")
+	pull("Bearer alice")
+	if n := atomic.LoadInt32(&u.tarballRequests); n != 1 {
+		t.Fatalf("%d archive requests; want the entry cached for the same identity", n)
+	}
+	pull("Bearer bob")
+	if n := atomic.LoadInt32(&u.tarballRequests); n != 2 {
+		t.Errorf("%d archive requests; want another identity to miss the cache", n)
+	}
+	if n := atomic.LoadInt32(&u.indexRequests); n != 2 {
+		t.Errorf("%d index requests; want one per identity", n)
+	}
+	if got := u.authorization.Load(); got != "Bearer bob" {
+		t.Errorf("upstream got Authorization %q; want the second identity's", got)
+	}
+	pull("")
+	if n := atomic.LoadInt32(&u.tarballRequests); n != 3 {
+		t.Errorf("%d archive requests; want an anonymous client to miss the cache", n)
+	}
+	pull("Bearer alice")
+	pull("Bearer bob")
+	if n := atomic.LoadInt32(&u.tarballRequests); n != 3 {
+		t.Errorf("%d archive requests; want every identity to keep its own entry", n)
+	}
+
+	// without passthrough everyone shares the entries
+	m = newTestManifests(t, u, Config{})
+	pull("Bearer alice")
+	pull("Bearer bob")
+	if n := atomic.LoadInt32(&u.tarballRequests); n != 4 {
+		t.Errorf("%d archive requests; want the entry shared", n)
+	}
+}
+
+func TestAuthPassthroughScopedNames(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	m := newTestManifests(t, u, Config{AuthPassthroughHosts: []string{u.host()}})
+	repo := u.host() + "/foo"
+	req := httptest.NewRequest(http.MethodGet, "/v2/"+repo+"/manifests/1.0.0", nil)
+	req.Header.Set("Authorization", "Bearer alice")
+	rec := httptest.NewRecorder()
+	if err := m.Handle(rec, req); err != nil {
+		t.Fatal(err)
+	}
+
+	// alice's entries can't be addressed by the key they're cached under
+	scoped := scopedRepo(repo, m.cacheScope(withClientAuth(req), repo))
+	for _, tc := range []struct {
+		h    func(http.ResponseWriter, *http.Request) error
+		path string
+	}{
+		{m.Handle, "/v2/" + scoped + "/manifests/1.0.0"},
+		{m.HandleTags, "/v2/" + scoped + "/tags/list"},
+		{m.HandleReferrers, "/v2/" + scoped + "/referrers/" + rec.Header().Get("Docker-Content-Digest")},
+	} {
+		if regErr := handleErr(t, tc.h, http.MethodGet, tc.path); regErr.Status != http.StatusBadRequest || regErr.Code != errors.CodeNameInvalid {
+			t.Errorf("GET %s: got %d %s; want 400 %s", tc.path, regErr.Status, regErr.Code, errors.CodeNameInvalid)
+		}
+	}
+}
+
+func TestAuthPassthroughListings(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0", files: map[string]string{"README.md": "# foo"}})
+	m := newTestManifests(t, u, Config{AuthPassthroughHosts: []string{u.host()}, ChartReadme: ReadmeModeArtifact})
+	as := func(auth string, h func(http.ResponseWriter, *http.Request) error, path string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", auth)
+		var regErr *errors.RegError
+		if err := h(rec, req); cerrors.As(err, &regErr) {
+			rec.Code = regErr.Status
+		} else if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		return rec
+	}
+	repo := u.host() + "/foo"
+	chartDigest := digest.FromBytes(as("Bearer alice", m.Handle, "/v2/"+repo+"/manifests/1.0.0").Body.Bytes())
+
+	for _, tc := range []struct {
+		auth    string
+		visible bool
+	}{
+		{"Bearer alice", true},
+		{"Bearer bob", false},
+	} {
+		t.Run(tc.auth, func(t *testing.T) {
+			var catalog Catalog
+			if err := json.Unmarshal(as(tc.auth, m.HandleCatalog, "/v2/_catalog").Body.Bytes(), &catalog); err != nil {
+				t.Fatal(err)
+			}
+			if listed := len(catalog.Repos) == 1 && catalog.Repos[0] == repo; listed != tc.visible || len(catalog.Repos) > 1 {
+				t.Errorf("catalog = %v; want %s listed: %v", catalog.Repos, repo, tc.visible)
+			}
+			var index ocispec.Index
+			if err := json.Unmarshal(as(tc.auth, m.HandleReferrers, "/v2/"+repo+"/referrers/"+chartDigest.String()).Body.Bytes(), &index); err != nil {
+				t.Fatal(err)
+			}
+			if listed := len(index.Manifests) == 1; listed != tc.visible {
+				t.Errorf("got %d referrers; want them listed: %v", len(index.Manifests), tc.visible)
+			}
+		})
+	}
+
+	// the admin sees the entries of every identity, whatever its token
+	dump := as("Bearer admin-token", m.HandleAdmin, "/admin/manifest/"+repo+"/1.0.0")
+	if dump.Code != http.StatusOK || digest.FromBytes(dump.Body.Bytes()) != chartDigest {
+		t.Errorf("manifest dump = %d %s; want alice's manifest", dump.Code, digest.FromBytes(dump.Body.Bytes()))
+	}
+	var search struct {
+		Results []searchResult `json:"results"`
+	}
+	if err := json.Unmarshal(as("Bearer admin-token", m.HandleAdmin, "/admin/search?q=foo").Body.Bytes(), &search); err != nil {
+		t.Fatal(err)
+	}
+	if len(search.Results) != 1 || search.Results[0].Repository != repo || !reflect.DeepEqual(search.Results[0].Tags, []string{"1.0.0"}) {
+		t.Errorf("search results = %+v; want %s:1.0.0", search.Results, repo)
+	}
+	// exports only carry the shared entries
+	if archive := as("Bearer admin-token", m.HandleAdmin, "/admin/export").Body.Bytes(); bytes.Contains(archive, []byte(repo)) {
+		t.Error("the entries of an identity were exported")
+	}
+	as("", m.Handle, "/v2/"+repo+"/manifests/1.0.0")
+	archive := as("Bearer admin-token", m.HandleAdmin, "/admin/export").Body.Bytes()
+	if !bytes.Contains(archive, []byte(`"`+repo+`"`)) || bytes.Contains(archive, []byte(repo+"@")) {
+		t.Error("export doesn't carry just the shared entries")
+	}
+}
+
+func TestAuthPassthroughRefreshes(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	gate := make(chan struct{})
+	var once sync.Once
+	release := func() { once.Do(func() { close(gate) }) }
+	t.Cleanup(release)
+	var blocking atomic.Bool
+	var refreshing int32
+	u.onTarball = func() {
+		if blocking.Load() {
+			atomic.AddInt32(&refreshing, 1)
+			<-gate
+		}
+	}
+	m := newTestManifests(t, u, Config{AuthPassthroughHosts: []string{u.host()}, StaleWhileRevalidate: time.Hour, CacheStatusHeader: "X-Cache"})
+	clock := &testClock{t: time.Now()}
+	m.now = clock.now
+	pull := func(auth string) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0", nil)
+		req.Header.Set("Authorization", auth)
+		if err := m.Handle(rec, req); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Header().Get("X-Cache")
+	}
+	pull("Bearer alice")
+	pull("Bearer bob")
+	clock.advance(2 * time.Minute)
+
+	blocking.Store(true)
+	for _, auth := range []string{"Bearer alice", "Bearer bob"} {
+		if status := pull(auth); status != cacheStale {
+			t.Errorf("cache status for %s = %s; want %s", auth, status, cacheStale)
+		}
+	}
+	// the running refresh of alice's entry doesn't stand for bob's
+	eventually(t, func() bool { return atomic.LoadInt32(&refreshing) == 2 }, "only one identity's entry was refreshed")
+	release()
+	eventually(t, func() bool {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		return len(m.refreshing) == 0
+	}, "refreshes didn't finish")
+}
+
+func TestRedactedLogs(t *testing.T) {
+	u := newTestUpstream(t,
+		testChart{name: "foo", version: "1.0.0", url: "https://user:s3cret@{host}/foo-1.0.0.tgz"},
+		testChart{name: "bar", version: "1.0.0", url: "https://{host}/bar-1.0.0.tgz?token=s3cret"},
+	)
+	var buf bytes.Buffer
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	m := NewManifests(ctx, mem.NewMemHandler(), Config{Debug: true, CacheTTL: time.Minute, IndexCacheTTL: time.Hour}, &testCache{}, log.New(helper.NewRedactor().Writer(&buf), "", 0))
+	m.client = u.Client()
+
+	get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0")
+	if got := u.authorization.Load(); !strings.HasPrefix(got.(string), "Basic ") {
+		t.Fatalf("upstream got Authorization %q; want the credentials of the chart URL", got)
+	}
+	get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/bar/manifests/1.0.0")
+	m.log.Printf("upstream request headers: %v", http.Header{"Authorization": {"Bearer s3cret"}})
+
+	logs := buf.String()
+	if strings.Contains(logs, "s3cret") || strings.Contains(logs, "user:") {
+		t.Errorf("credentials logged:\n%s", logs)
+	}
+	for _, want := range []string{"https://REDACTED@" + u.host() + "/foo-1.0.0.tgz", "bar-1.0.0.tgz?token=REDACTED", "Authorization:[REDACTED]"} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("logs don't contain %s:\n%s", want, logs)
+		}
+	}
+}
+
+func TestNonChartContent(t *testing.T) {
+	const login = "<!DOCTYPE html><html><body><form action=\"/login\"></form></body></html>"
+	index := "apiVersion: v1\nentries:\n  foo:\n  - apiVersion: v2\n    name: foo\n    version: 1.0.0\n    urls:\n    - foo-1.0.0.tgz\n"
+	for _, tc := range []struct {
+		name    string
+		config  Config
+		handler http.HandlerFunc
+	}{
+		{"html index", Config{}, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = io.WriteString(w, login)
+		}},
+		{"html archive", Config{}, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/index.yaml" {
+				_, _ = io.WriteString(w, index)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = io.WriteString(w, login)
+		}},
+		{"sniffed html", Config{}, func(w http.ResponseWriter, r *http.Request) {
+			w.Header()["Content-Type"] = nil
+			_, _ = io.WriteString(w, login)
+		}},
+		{"configured types", Config{NonChartContentTypes: []string{"application/json"}}, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(w, `{"error":"unauthorized"}`)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := httptest.NewTLSServer(tc.handler)
+			t.Cleanup(s.Close)
+			m := newTestManifests(t, nil, tc.config)
+			m.client = s.Client()
+			host := s.Listener.Addr().String()
+
+			err := handleErr(t, m.Handle, http.MethodGet, "/v2/"+host+"/foo/manifests/1.0.0")
+			if err.Status != http.StatusBadGateway || err.Code != errors.CodeUnavailable || !strings.Contains(err.Message, "instead of a chart index or archive") {
+				t.Errorf("pull = %d %s %q; want an informative 502", err.Status, err.Code, err.Message)
+			}
+		})
+	}
+}
+
+func TestUpstreamOverride(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+
+	for _, tc := range []struct {
+		name   string
+		hosts  []string
+		header string
+		status int // 0 means success
+	}{
+		{"override", []string{u.host()}, u.host(), 0},
+		{"not allowed", []string{"example.com"}, u.host(), http.StatusForbidden},
+		{"disabled", nil, u.host(), http.StatusBadGateway},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newTestManifests(t, u, Config{UpstreamOverrideHosts: tc.hosts})
+			req := httptest.NewRequest(http.MethodGet, "/v2/example.invalid/foo/manifests/1.0.0", nil)
+			req.Header.Set(UpstreamHeader, tc.header)
+			err := m.Handle(httptest.NewRecorder(), req)
+			if tc.status == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err = m.Read(u.host()+"/foo", "1.0.0"); err != nil {
+					t.Errorf("chart not cached under its upstream: %v", err)
+				}
+				return
+			}
+			var regErr *errors.RegError
+			if !cerrors.As(err, &regErr) || regErr.Status != tc.status {
+				t.Errorf("got %v; want status %d", err, tc.status)
+			}
+		})
+	}
+}
+
+func TestUpstreamTransport(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"}, testChart{name: "bar", version: "1.0.0"})
+	m := newTestManifests(t, nil, Config{
+		UpstreamMaxIdleConns:        7,
+		UpstreamMaxIdleConnsPerHost: 3,
+		UpstreamIdleConnTimeout:     42 * time.Second,
+	})
+	tr, ok := m.client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("got transport %T; want *http.Transport", m.client.Transport)
+	}
+	if tr.MaxIdleConns != 7 || tr.MaxIdleConnsPerHost != 3 || tr.IdleConnTimeout != 42*time.Second {
+		t.Errorf("got MaxIdleConns %d, MaxIdleConnsPerHost %d, IdleConnTimeout %v; want 7, 3, 42s",
+			tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout)
+	}
+
+	tr.TLSClientConfig = u.Client().Transport.(*http.Transport).TLSClientConfig
+	get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0")
+	get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/bar/manifests/1.0.0")
+	var conns int
+	u.conns.Range(func(_, _ interface{}) bool {
+		conns++
+		return true
+	})
+	if conns != 1 {
+		t.Errorf("upstream saw %d connections; want 1", conns)
+	}
+}
+
+func TestUpstreamCA(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	other := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: u.Certificate().Raw})
+
+	for _, tc := range []struct {
+		name string
+		cas  map[string][]byte
+		ok   bool
+	}{
+		{"configured", map[string][]byte{u.host(): ca}, true},
+		{"other host", map[string][]byte{other.host(): ca}, false},
+		{"none", nil, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newTestManifests(t, nil, Config{UpstreamCAs: tc.cas})
+			req := httptest.NewRequest(http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0", nil)
+			if err := m.Handle(httptest.NewRecorder(), req); (err == nil) != tc.ok {
+				t.Errorf("got %v; want success %v", err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestInsecureSkipVerify(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	other := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	var logs bytes.Buffer
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := NewManifests(ctx, mem.NewMemHandler(), Config{
+		CacheTTL:                time.Minute,
+		InsecureSkipVerifyHosts: []string{u.host()},
+	}, &testCache{}, log.New(&logs, "", 0))
+	if !strings.Contains(logs.String(), "WARNING") || !strings.Contains(logs.String(), u.host()) {
+		t.Errorf("no warning logged for %s: %q", u.host(), logs.String())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0", nil)
+	if err := m.Handle(httptest.NewRecorder(), req); err != nil {
+		t.Errorf("configured host: %v", err)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/v2/"+other.host()+"/foo/manifests/1.0.0", nil)
+	if err := m.Handle(httptest.NewRecorder(), req); err == nil {
+		t.Error("other host wasn't verified")
+	}
+}
+
+func TestHTTPFallback(t *testing.T) {
+	u := startTestUpstream(t, false, testChart{name: "foo", version: "1.0.0"})
+	other := startTestUpstream(t, false, testChart{name: "foo", version: "1.0.0"})
+	var logs bytes.Buffer
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := NewManifests(ctx, mem.NewMemHandler(), Config{
+		CacheTTL:          time.Minute,
+		HTTPFallbackHosts: []string{u.host()},
+	}, &testCache{}, log.New(&logs, "", 0))
+	if !strings.Contains(logs.String(), "WARNING") || !strings.Contains(logs.String(), u.host()) {
+		t.Errorf("no warning logged for %s: %q", u.host(), logs.String())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0", nil)
+	if err := m.Handle(httptest.NewRecorder(), req); err != nil {
+		t.Errorf("configured host: %v", err)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/v2/"+other.host()+"/foo/manifests/1.0.0", nil)
+	if err := m.Handle(httptest.NewRecorder(), req); err == nil {
+		t.Error("other host fetched over plain HTTP")
+	}
+	if n := atomic.LoadInt32(&other.indexRequests); n != 0 {
+		t.Errorf("other host got %d plain HTTP index requests; want 0", n)
+	}
+}
+
+func TestIndexAnnotations(t *testing.T) {
+	created := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	u := newTestUpstream(t,
+		testChart{name: "foo", version: "1.0.0", created: created, index: "    appVersion: 2.3.4\n    keywords:\n    - database\n    - sql\n    digest: abc123\n"},
+		testChart{name: "bar", version: "1.0.0", files: map[string]string{
+			"Chart.yaml": "apiVersion: v2\nname: bar\nversion: 1.0.0\nappVersion: 0.9.0\nkeywords:\n- cache\n",
+		}},
+	)
+	m := newTestManifests(t, u, Config{})
+	annotations := func(chart string) map[string]string {
+		var om ocispec.Manifest
+		if err := json.Unmarshal(get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/"+chart+"/manifests/1.0.0").Body.Bytes(), &om); err != nil {
+			t.Fatal(err)
+		}
+		return om.Annotations
+	}
+
+	a := annotations("foo")
+	for k, want := range map[string]string{
+		AppVersionAnnotation:      "2.3.4",
+		KeywordsAnnotation:        "database,sql",
+		IndexDigestAnnotation:     "abc123",
+		ocispec.AnnotationCreated: created.Format(time.RFC3339),
+	} {
+		if a[k] != want {
+			t.Errorf("foo: %s = %q; want %q from the index entry", k, a[k], want)
+		}
+	}
+	// the Chart.yaml values where the entry has none
+	a = annotations("bar")
+	if a[AppVersionAnnotation] != "0.9.0" || a[KeywordsAnnotation] != "cache" {
+		t.Errorf("bar: annotations = %v; want the Chart.yaml appVersion and keywords", a)
+	}
+	if _, ok := a[IndexDigestAnnotation]; ok {
+		t.Errorf("bar: %s set without a digest in the index", IndexDigestAnnotation)
+	}
+}
+
+func TestAnnotationsFilter(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0", files: map[string]string{
+		"Chart.yaml": "apiVersion: v2\nname: foo\nversion: 1.0.0\ndescription: A chart\nhome: https://example.com\n" +
+			"maintainers:\n- name: Jane\n  email: jane@example.com\nannotations:\n  category: Database\n",
+	}})
+
+	for _, tc := range []struct {
+		name    string
+		config  Config
+		present []string
+		absent  []string
+	}{
+		{
+			name:    "all",
+			present: []string{ocispec.AnnotationTitle, ocispec.AnnotationDescription, ocispec.AnnotationAuthors, "category"},
+		},
+		{
+			name:    "deny",
+			config:  Config{AnnotationsDeny: []string{ocispec.AnnotationAuthors}},
+			present: []string{ocispec.AnnotationTitle, ocispec.AnnotationDescription, "category"},
+			absent:  []string{ocispec.AnnotationAuthors},
+		},
+		{
+			name:    "allow",
+			config:  Config{AnnotationsAllow: []string{"org.opencontainers.image.*"}, AnnotationsDeny: []string{ocispec.AnnotationURL}},
+			present: []string{ocispec.AnnotationTitle, ocispec.AnnotationVersion, ocispec.AnnotationAuthors},
+			absent:  []string{"category", ocispec.AnnotationURL},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newTestManifests(t, u, tc.config)
+			var om ocispec.Manifest
+			if err := json.Unmarshal(get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0").Body.Bytes(), &om); err != nil {
+				t.Fatal(err)
+			}
+			for _, k := range tc.present {
+				if _, ok := om.Annotations[k]; !ok {
+					t.Errorf("annotation %s missing from %v", k, om.Annotations)
+				}
+			}
+			for _, k := range tc.absent {
+				if _, ok := om.Annotations[k]; ok {
+					t.Errorf("annotation %s should be filtered from %v", k, om.Annotations)
+				}
+			}
+		})
+	}
+	if got := chartAnnotations(&chart.Metadata{Name: "foo", Maintainers: []*chart.Maintainer{{Name: "Jane", Email: "jane@example.com"}}}); got[ocispec.AnnotationAuthors] != "Jane (jane@example.com)" {
+		t.Errorf("authors annotation = %q", got[ocispec.AnnotationAuthors])
+	}
+}
+
+func TestPackChartDeterministic(t *testing.T) {
+	m := newTestManifests(t, nil, Config{})
+	clock := &testClock{t: time.Now()}
+	m.now = clock.now
+	data := chartTgz(t, testChart{name: "foo", version: "1.0.0", files: map[string]string{
+		"Chart.yaml": "apiVersion: v2\nname: foo\nversion: 1.0.0\nannotations:\n  b: \"2\"\n  a: \"1\"\n  c: \"3\"\n",
+	}})
+	chartVer := &repo.ChartVersion{Metadata: &chart.Metadata{Name: "foo", Version: "1.0.0"}}
+
+	var manifests [][]byte
+	for i := 0; i < 2; i++ {
+		ctx := context.Background()
+		store := memory.New()
+		root, err := m.packChart(ctx, store, chartVer, data, nil, "foo-1.0.0.tgz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, err := store.Fetch(ctx, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		manifests = append(manifests, b)
+		clock.advance(time.Hour)
+	}
+	if !bytes.Equal(manifests[0], manifests[1]) {
+		t.Errorf("manifests differ:\n%s\n%s", manifests[0], manifests[1])
+	}
+}
+
+func TestSameArchiveSharesManifest(t *testing.T) {
+	files := map[string]string{"Chart.yaml": "apiVersion: v2\nname: foo\nversion: 1.2.3\n"}
+	u := newTestUpstream(t,
+		testChart{name: "foo", version: "1.2.3", files: files, created: time.Unix(1, 0)},
+		testChart{name: "foo", version: "1.2.4", files: files, created: time.Unix(2, 0)},
+	)
+	m := newTestManifests(t, u, Config{})
+	repo := u.host() + "/foo"
+	first := get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/1.2.3").Header().Get("Docker-Content-Digest")
+	second := get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/1.2.4").Header().Get("Docker-Content-Digest")
+	if first != second {
+		t.Errorf("tags of the same archive got digests %s and %s", first, second)
+	}
+	var digests int
+	for ref := range m.manifests[repo] {
+		if isDigest(ref) {
+			digests++
+		}
+	}
+	if digests != 1 {
+		t.Errorf("got %d stored manifests; want 1", digests)
+	}
+}
+
+func TestProviders(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "nginx", version: "1.0.0"})
+	m := newTestManifests(t, u, Config{Providers: map[string]string{"bitnami": u.host() + "/"}})
+
+	get(t, m.Handle, http.MethodGet, "/v2/bitnami/nginx/manifests/1.0.0")
+	if _, err := m.Read(u.host()+"/nginx", "1.0.0"); err != nil {
+		t.Errorf("chart not cached under its upstream: %v", err)
+	}
+	rec := get(t, m.HandleTags, http.MethodGet, "/v2/bitnami/nginx/tags/list")
+	if !strings.Contains(rec.Body.String(), "1.0.0") {
+		t.Errorf("tags = %s; want 1.0.0", rec.Body)
+	}
+	// anything else names the upstream host, like single-label ones
+	if repo := m.expandProvider("chartmuseum/nginx"); repo != "chartmuseum/nginx" {
+		t.Errorf("chartmuseum/nginx expanded to %s; want it unchanged", repo)
+	}
+	m = newTestManifests(t, u, Config{})
+	if repo := m.expandProvider("bitnami/nginx"); repo != "bitnami/nginx" {
+		t.Errorf("bitnami/nginx expanded to %s without Providers; want it unchanged", repo)
+	}
+}
+
+func TestChartAliases(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "postgresql", version: "1.0.0"})
+	m := newTestManifests(t, u, Config{
+		Providers:    map[string]string{"bitnami": u.host()},
+		ChartAliases: map[string]string{"bitnami/postgres": "postgresql", u.host() + "/pg": "postgresql"},
+	})
+
+	for _, repo := range []string{"bitnami/postgres", "bitnami/Postgres", u.host() + "/pg"} {
+		if rec := get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/1.0.0"); rec.Code != http.StatusOK {
+			t.Errorf("%s: status = %d; want 200", repo, rec.Code)
+		}
+	}
+	if _, err := m.Read(u.host()+"/postgresql", "1.0.0"); err != nil {
+		t.Errorf("chart not cached under its upstream name: %v", err)
+	}
+	rec := get(t, m.HandleTags, http.MethodGet, "/v2/bitnami/postgres/tags/list")
+	if !strings.Contains(rec.Body.String(), "1.0.0") {
+		t.Errorf("tags = %s; want 1.0.0", rec.Body)
+	}
+}
+
+func TestCatalogProviders(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "nginx", version: "1.0.0"}, testChart{name: "redis", version: "1.0.0"})
+	for _, enabled := range []bool{false, true} {
+		m := newTestManifests(t, u, Config{Providers: map[string]string{"bitnami": u.host() + "/"}, CatalogProviders: enabled})
+		get(t, m.Handle, http.MethodGet, "/v2/bitnami/nginx/manifests/1.0.0")
+
+		var catalog Catalog
+		if err := json.Unmarshal(get(t, m.HandleCatalog, http.MethodGet, "/v2/_catalog").Body.Bytes(), &catalog); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{u.host() + "/nginx"}
+		if enabled {
+			want = append(want, u.host()+"/redis")
+		}
+		if !reflect.DeepEqual(catalog.Repos, want) {
+			t.Errorf("CatalogProviders %v: repos = %v; want %v", enabled, catalog.Repos, want)
+		}
+	}
+}
+
+func TestCatalogDiscovery(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "nginx", version: "1.0.0"}, testChart{name: "redis", version: "1.0.0"})
+	catalog := func(m *Manifests) []string {
+		var c Catalog
+		if err := json.Unmarshal(get(t, m.HandleCatalog, http.MethodGet, "/v2/_catalog").Body.Bytes(), &c); err != nil {
+			t.Fatal(err)
+		}
+		return c.Repos
+	}
+	want := []string{u.host() + "/nginx", u.host() + "/redis"}
+
+	// the repository of a cached chart
+	m := newTestManifests(t, u, Config{CatalogDiscovery: true})
+	get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/nginx/manifests/1.0.0")
+	eventually(t, func() bool {
+		return reflect.DeepEqual(catalog(m), want)
+	}, "cached chart repository not discovered")
+
+	// a provider nothing was pulled from yet
+	m = newTestManifests(t, u, Config{CatalogDiscovery: true, Providers: map[string]string{"bitnami": u.host()}})
+	eventually(t, func() bool {
+		return reflect.DeepEqual(catalog(m), want)
+	}, "provider not discovered")
+
+	m = newTestManifests(t, u, Config{Providers: map[string]string{"bitnami": u.host()}})
+	if repos := catalog(m); len(repos) != 0 {
+		t.Errorf("repos without CatalogDiscovery = %v; want none", repos)
+	}
+}
+
+func TestChartArchiveCompressedOnce(t *testing.T) {
+	for _, double := range []bool{false, true} {
+		u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+		u.doubleGzip = double
+		m := newTestManifests(t, u, Config{})
+		rec := get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0")
+		var om ocispec.Manifest
+		if err := json.Unmarshal(rec.Body.Bytes(), &om); err != nil {
+			t.Fatal(err)
+		}
+		if len(om.Layers) != 1 || om.Layers[0].MediaType != helmregistry.ChartLayerMediaType {
+			t.Fatalf("layers = %+v; want one %s", om.Layers, helmregistry.ChartLayerMediaType)
+		}
+		h, _ := v1.NewHash(om.Layers[0].Digest.String())
+		rc, err := m.blobHandler.Get(context.Background(), "", h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("double gzip %v: layer isn't gzip compressed: %v", double, err)
+		}
+		inner, err := io.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isGzip(inner) {
+			t.Errorf("double gzip %v: layer is compressed twice", double)
+		}
+		ch, err := loader.LoadArchive(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("double gzip %v: layer isn't a chart archive: %v", double, err)
+		}
+		if ch.Metadata.Name != "foo" || ch.Metadata.Version != "1.0.0" {
+			t.Errorf("double gzip %v: layer holds chart %s-%s", double, ch.Metadata.Name, ch.Metadata.Version)
+		}
+	}
+}
+
+func TestYanked(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"}, testChart{name: "foo", version: "1.0.1"})
+
+	for _, status := range []int{0, http.StatusNotFound} {
+		m := newTestManifests(t, u, Config{Yanked: []string{u.host() + "/foo:1.0.1"}, YankedStatus: status})
+		want := status
+		if want == 0 {
+			want = http.StatusGone
+		}
+		if regErr := handleErr(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.1"); regErr.Status != want {
+			t.Errorf("yanked pull status = %d; want %d", regErr.Status, want)
+		}
+		get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0")
+
+		var tags listTags
+		if err := json.Unmarshal(get(t, m.HandleTags, http.MethodGet, "/v2/"+u.host()+"/foo/tags/list").Body.Bytes(), &tags); err != nil {
+			t.Fatal(err)
+		}
+		if len(tags.Tags) != 1 || tags.Tags[0] != "1.0.0" {
+			t.Errorf("tags = %v; want [1.0.0]", tags.Tags)
+		}
+	}
+}
+
+func TestYankedGoneUncachedNotFound(t *testing.T) {
+	// read-only, so nothing is cached and only yanked versions are gone
+	m := newTestManifests(t, nil, Config{ReadOnly: true, Yanked: []string{"example.com/foo:1.0.*"}})
+	for reference, want := range map[string]int{
+		"1.0.1":  http.StatusGone,
+		"v1.0.2": http.StatusGone,
+		"1.1.0":  http.StatusNotFound,
+	} {
+		if regErr := handleErr(t, m.Handle, http.MethodGet, "/v2/example.com/foo/manifests/"+reference); regErr.Status != want {
+			t.Errorf("%s: status = %d; want %d", reference, regErr.Status, want)
+		}
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"}, testChart{name: "foo", version: "1.0.1"})
+	m := newTestManifests(t, u, Config{Tombstones: []string{u.host() + "/foo:1.0.1"}, YankedStatus: http.StatusNotFound})
+
+	regErr := handleErr(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.1")
+	if regErr.Status != http.StatusGone || !strings.Contains(regErr.Message, "permanently removed") {
+		t.Errorf("tombstoned pull = %d %q; want 410 saying it was removed", regErr.Status, regErr.Message)
+	}
+	if regErr := handleErr(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/9.9.9"); regErr.Status != http.StatusNotFound {
+		t.Errorf("missing pull status = %d; want 404", regErr.Status)
+	}
+
+	var tags listTags
+	if err := json.Unmarshal(get(t, m.HandleTags, http.MethodGet, "/v2/"+u.host()+"/foo/tags/list").Body.Bytes(), &tags); err != nil {
+		t.Fatal(err)
+	}
+	if len(tags.Tags) != 1 || tags.Tags[0] != "1.0.0" {
+		t.Errorf("tags = %v; want [1.0.0]", tags.Tags)
+	}
+
+	// read-only, so nothing is cached
+	m = newTestManifests(t, nil, Config{ReadOnly: true, Tombstones: []string{"example.com/foo:1.0.*"}})
+	for reference, want := range map[string]int{"1.0.1": http.StatusGone, "1.1.0": http.StatusNotFound} {
+		if regErr := handleErr(t, m.Handle, http.MethodGet, "/v2/example.com/foo/manifests/"+reference); regErr.Status != want {
+			t.Errorf("%s: status = %d; want %d", reference, regErr.Status, want)
+		}
+	}
+}
+
+func TestTagRewrites(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "v1.0.0"}, testChart{name: "foo", version: "2.0.0-release"})
+	m := newTestManifests(t, u, Config{TagRewrites: []TagRewrite{
+		{Pattern: regexp.MustCompile(`^(\d+\.\d+\.\d+)-release$`), Replacement: "$1"},
+		{Pattern: regexp.MustCompile(`^v(.*)$`), Replacement: "$1"},
+	}})
+
+	for tag, version := range map[string]string{"1.0.0": "v1.0.0", "2.0.0": "2.0.0-release"} {
+		rr := get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/"+tag)
+		var om ocispec.Manifest
+		if err := json.Unmarshal(rr.Body.Bytes(), &om); err != nil {
+			t.Fatal(err)
+		}
+		if got := om.Annotations[ocispec.AnnotationVersion]; got != version {
+			t.Errorf("%s: version = %q; want %q", tag, got, version)
+		}
+	}
+
+	var tags listTags
+	if err := json.Unmarshal(get(t, m.HandleTags, http.MethodGet, "/v2/"+u.host()+"/foo/tags/list").Body.Bytes(), &tags); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1.0.0", "2.0.0"}; !reflect.DeepEqual(tags.Tags, want) {
+		t.Errorf("tags = %v; want %v", tags.Tags, want)
+	}
+}
+
+func TestBlobMediaType(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	m := newTestManifests(t, u, Config{})
+	rec := get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0")
+	var om ocispec.Manifest
+	if err := json.Unmarshal(rec.Body.Bytes(), &om); err != nil {
+		t.Fatal(err)
+	}
+	for _, desc := range append([]ocispec.Descriptor{om.Config}, om.Layers...) {
+		if got := m.BlobMediaType(desc.Digest.String()); got != desc.MediaType {
+			t.Errorf("BlobMediaType(%s) = %q; want %q", desc.Digest, got, desc.MediaType)
+		}
+	}
+	if got := m.BlobMediaType(digest.FromString("unknown").String()); got != "" {
+		t.Errorf("BlobMediaType of an unknown blob = %q; want none", got)
+	}
+
+	// blobs are served while charts are prepared
+	m.lock.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.BlobMediaType(om.Config.Digest.String())
+		m.BlobChunks(om.Layers[0].Digest.String())
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("BlobMediaType waited for the manifests lock")
+	}
+	m.lock.Unlock()
+
+	clock := &testClock{t: time.Now()}
+	m.now = clock.now
+	clock.advance(time.Hour)
+	m.evictExpired(context.Background())
+	if got := m.BlobMediaType(om.Config.Digest.String()); got != "" {
+		t.Errorf("BlobMediaType of an evicted blob = %q; want none", got)
+	}
+	if n := len(m.mediaTypes); n != 0 {
+		t.Errorf("%d media types kept after every manifest was evicted; want none", n)
+	}
+}
+
+func TestChartArchiveURLs(t *testing.T) {
+	u := newTestUpstream(t,
+		testChart{name: "foo", version: "1.0.0", url: "download/foo-stable.tgz?sig=abc"},
+		testChart{name: "bar", version: "1.0.0", url: "/archive/bar.tgz"},
+		testChart{name: "baz", version: "1.0.0", url: "https://{host}/pkgs/latest"},
+	)
+	m := newTestManifests(t, u, Config{})
+	for chart, title := range map[string]string{"foo": "foo-stable.tgz", "bar": "bar.tgz", "baz": "baz-1.0.0.tgz"} {
+		rec := get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/"+chart+"/manifests/1.0.0")
+		var om ocispec.Manifest
+		if err := json.Unmarshal(rec.Body.Bytes(), &om); err != nil {
+			t.Fatal(err)
+		}
+		if len(om.Layers) != 1 {
+			t.Fatalf("%s: layers = %+v; want one", chart, om.Layers)
+		}
+		if got := om.Layers[0].Annotations[ocispec.AnnotationTitle]; got != title {
+			t.Errorf("%s: layer title = %q; want %q", chart, got, title)
+		}
+	}
+	if n := atomic.LoadInt32(&u.tarballRequests); n != 3 {
+		t.Errorf("%d archives fetched; want 3", n)
+	}
+}
+
+func TestDeprecatedWarning(t *testing.T) {
+	u := newTestUpstream(t,
+		testChart{name: "foo", version: "1.0.0", deprecated: true},
+		testChart{name: "foo", version: "2.0.0"},
+	)
+	m := newTestManifests(t, u, Config{})
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		rec := get(t, m.Handle, method, "/v2/"+u.host()+"/foo/manifests/1.0.0")
+		want := `299 - "Chart ` + u.host() + `/foo:1.0.0 is deprecated"`
+		if w := rec.Header().Get("Warning"); w != want {
+			t.Errorf("%s deprecated chart: Warning = %q; want %q", method, w, want)
+		}
+		rec = get(t, m.Handle, method, "/v2/"+u.host()+"/foo/manifests/2.0.0")
+		if w := rec.Header().Values("Warning"); len(w) != 0 {
+			t.Errorf("%s chart: Warning = %q; want none", method, w)
+		}
+	}
+}
+
+func TestFileUpstream(t *testing.T) {
+	dir := t.TempDir()
+	c := testChart{name: "foo", version: "1.0.0"}
+	if err := os.WriteFile(filepath.Join(dir, "foo-1.0.0.tgz"), chartTgz(t, c), 0644); err != nil {
+		t.Fatal(err)
+	}
+	index := "apiVersion: v1\nentries:\n  foo:\n  - apiVersion: v2\n    name: foo\n    version: 1.0.0\n    urls:\n    - foo-1.0.0.tgz\n"
+	if err := os.WriteFile(filepath.Join(dir, "index.yaml"), []byte(index), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newTestManifests(t, nil, Config{FileUpstreams: map[string]string{"charts.local": "file://" + dir}})
+	rec := get(t, m.Handle, http.MethodGet, "/v2/charts.local/foo/manifests/1.0.0")
+	var om ocispec.Manifest
+	if err := json.Unmarshal(rec.Body.Bytes(), &om); err != nil {
+		t.Fatal(err)
+	}
+	if len(om.Layers) != 1 || om.Layers[0].Digest != digest.FromBytes(chartTgz(t, c)) {
+		t.Errorf("layers = %+v; want the archive from %s", om.Layers, dir)
+	}
+
+	err := m.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/charts.local/foo/manifests/2.0.0", nil))
+	if regErr, ok := err.(*errors.RegError); !ok || regErr.Code != errors.CodeManifestUnknown {
+		t.Errorf("missing version: err = %v; want %s", err, errors.CodeManifestUnknown)
+	}
+}
+
+func TestChartConfig(t *testing.T) {
+	u := newTestUpstream(t,
+		testChart{name: "foo", version: "1.0.0"},
+		testChart{name: "bar", version: "1.0.0", files: map[string]string{"Chart.yaml": "name: [bar"}},
+	)
+	m := newTestManifests(t, u, Config{})
+	var om ocispec.Manifest
+	if err := json.Unmarshal(get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0").Body.Bytes(), &om); err != nil {
+		t.Fatal(err)
+	}
+	h, _ := v1.NewHash(om.Config.Digest.String())
+	rc, err := m.blobHandler.Get(context.Background(), "", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	var meta chart.Metadata
+	if err = json.NewDecoder(rc).Decode(&meta); err != nil || meta.Name != "foo" || meta.Version != "1.0.0" {
+		t.Errorf("config = %+v, %v; want the metadata of foo 1.0.0", meta, err)
+	}
+
+	regErr := handleErr(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/bar/manifests/1.0.0")
+	if regErr.Status != http.StatusBadGateway || regErr.Code != errors.CodeManifestInvalid {
+		t.Errorf("malformed chart: got %d %s; want 502 %s", regErr.Status, regErr.Code, errors.CodeManifestInvalid)
+	}
+}
+
+func TestParseIndexFormats(t *testing.T) {
+	versions := func(i *repo.IndexFile, name string) []string {
+		var res []string
+		for _, cv := range i.Entries[name] {
+			res = append(res, cv.Version)
+		}
+		return res
+	}
+	for _, tc := range []struct {
+		name  string
+		index string
+		want  map[string][]string
+	}{
+		{"helm 2 v1", `apiVersion: v1
+entries:
+  foo:
+  - created: 2018-05-16T10:00:00.000000000Z
+    description: A chart
+    digest: 0123456789abcdef
+    engine: gotpl
+    name: foo
+    tillerVersion: '>=2.8.0'
+    urls:
+    - foo-1.0.0.tgz
+    version: 1.0.0
+  - name: foo
+    version: 1.1.0
+    urls:
+    - foo-1.1.0.tgz
+generated: 2018-05-16T10:00:00.000000000Z
+`, map[string][]string{"foo": {"1.1.0", "1.0.0"}}},
+		{"helm 3 v2", `apiVersion: v2
+entries:
+  foo:
+  - apiVersion: v2
+    name: foo
+    type: application
+    version: 2.0.0
+    appVersion: "1.2"
+    annotations:
+      category: Infrastructure
+    dependencies:
+    - name: common
+      version: 1.x.x
+      repository: https://charts.example.com
+    urls:
+    - https://charts.example.com/foo-2.0.0.tgz
+  bar:
+  - apiVersion: v2
+    version: 0.1.0
+    urls:
+    - bar-0.1.0.tgz
+serverInfo:
+  contextPath: /v1
+generated: "2023-01-02T03:04:05Z"
+`, map[string][]string{"foo": {"2.0.0"}, "bar": {"0.1.0"}}},
+		{"without apiVersion, invalid versions", `entries:
+  foo:
+  - name: foo
+    version: not-semver
+  - name: foo
+    version: 1.0.0
+  -
+`, map[string][]string{"foo": {"1.0.0"}}},
+	} {
+		i, err := parseIndex([]byte(tc.index))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if i.APIVersion == "" {
+			t.Errorf("%s: no apiVersion", tc.name)
+		}
+		for name, want := range tc.want {
+			if got := versions(i, name); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: versions of %s = %v; want %v", tc.name, name, got, want)
+			}
+		}
+	}
+
+	for _, doc := range []string{"<html><body>Not Found</body></html>", "foo: bar\n", "entries: [1, 2]\n"} {
+		if _, err := parseIndex([]byte(doc)); err == nil {
+			t.Errorf("parsed %q as an index", doc)
+		}
+	}
+}
+
+func TestProvenanceLayer(t *testing.T) {
+	const prov = "-----BEGIN PGP SIGNED MESSAGE-----\nname: foo\n"
+	u := newTestUpstream(t,
+		testChart{name: "foo", version: "1.0.0", prov: prov},
+		testChart{name: "foo", version: "2.0.0"},
+	)
+	layers := func(m *Manifests, version string) []ocispec.Descriptor {
+		t.Helper()
+		var om ocispec.Manifest
+		if err := json.Unmarshal(get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/"+version).Body.Bytes(), &om); err != nil {
+			t.Fatal(err)
+		}
+		return om.Layers
+	}
+
+	m := newTestManifests(t, u, Config{FetchProvenance: true})
+	got := layers(m, "1.0.0")
+	if len(got) != 2 || got[0].MediaType != helmregistry.ChartLayerMediaType || got[1].MediaType != helmregistry.ProvLayerMediaType {
+		t.Fatalf("layers = %+v; want the archive, then its provenance", got)
+	}
+	if title := got[1].Annotations[ocispec.AnnotationTitle]; title != "foo-1.0.0.tgz.prov" {
+		t.Errorf("provenance title = %q", title)
+	}
+	if got[1].Digest != digest.FromString(prov) {
+		t.Errorf("provenance digest = %s; want the upstream file's", got[1].Digest)
+	}
+	if got := layers(m, "2.0.0"); len(got) != 1 || got[0].MediaType != helmregistry.ChartLayerMediaType {
+		t.Errorf("layers of a chart without provenance = %+v", got)
+	}
+
+	// chunks follow both
+	m = newTestManifests(t, u, Config{FetchProvenance: true, ChartChunkSize: 100})
+	got = layers(m, "1.0.0")
+	if len(got) < 3 || got[0].MediaType != helmregistry.ChartLayerMediaType || got[1].MediaType != helmregistry.ProvLayerMediaType {
+		t.Fatalf("chunked layers = %+v; want the archive, its provenance and chunks", got)
+	}
+	for _, l := range got[2:] {
+		if l.MediaType != ChartChunkMediaType {
+			t.Errorf("layer %s after the provenance has media type %s; want a chunk", l.Digest, l.MediaType)
+		}
+	}
+
+	// without FetchProvenance the file isn't fetched
+	m = newTestManifests(t, u, Config{})
+	if got := layers(m, "1.0.0"); len(got) != 1 {
+		t.Errorf("layers = %+v; want only the archive", got)
+	}
+}
+
+func TestUpstreamSigners(t *testing.T) {
+	signer := &sigv4.Signer{
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+		Region:          "eu-west-1",
+		Now:             func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) },
+	}
+	archive := chartTgz(t, testChart{name: "foo", version: "1.0.0"})
+	const index = "apiVersion: v1\nentries:\n  foo:\n  - apiVersion: v2\n    name: foo\n    version: 1.0.0\n    urls:\n    - foo-1.0.0.tgz\n"
+	var signed int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the request as received must carry the signature of its copy
+		want := r.Clone(r.Context())
+		want.Header.Del("Authorization")
+		_ = signer.Sign(want)
+		if got := r.Header.Get("Authorization"); got == "" || got != want.Header.Get("Authorization") {
+			http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+			return
+		}
+		atomic.AddInt32(&signed, 1)
+		switch r.URL.Path {
+		case "/charts/index.yaml":
+			_, _ = io.WriteString(w, index)
+		case "/charts/foo-1.0.0.tgz":
+			_, _ = w.Write(archive)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	host := srv.Listener.Addr().String()
+	path := "/v2/" + host + "/charts/foo/manifests/1.0.0"
+
+	m := newTestManifests(t, nil, Config{})
+	m.client = srv.Client()
+	if err := handleErr(t, m.Handle, http.MethodGet, path); err.Status < http.StatusBadRequest {
+		t.Errorf("unsigned pull = %v; want it refused", err)
+	}
+
+	m = newTestManifests(t, nil, Config{UpstreamSigners: map[string]RequestSigner{host: signer}})
+	m.client = srv.Client()
+	get(t, m.Handle, http.MethodGet, path)
+	if n := atomic.LoadInt32(&signed); n != 2 {
+		t.Errorf("%d signed requests; want the index and the archive", n)
+	}
+}
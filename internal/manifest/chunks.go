@@ -0,0 +1,95 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+const (
+	// ChartChunkMediaType is the media type of the layers holding a part of
+	// a chart archive split by ChartChunkSize
+	ChartChunkMediaType = "application/vnd.container-registry.helm.chart.chunk.v1"
+	// ChunkOfAnnotation of a chunk layer is the digest of the chart archive
+	// it's a part of, in layer order
+	ChunkOfAnnotation = "com.container-registry.chunk-of"
+)
+
+// chunkedArchive lists the chunks a chart archive is reassembled from.
+type chunkedArchive struct {
+	chunks []string
+	size   int64
+}
+
+// chunked is whether a chart archive is split into layers of ChartChunkSize.
+func (m *Manifests) chunked(data []byte) bool {
+	return m.config.ChartChunkSize > 0 && int64(len(data)) > m.config.ChartChunkSize
+}
+
+// pushChunks stores the ChartChunkSize parts of the chart archive described
+// by archive in store, returning their layers.
+func (m *Manifests) pushChunks(ctx context.Context, store *memory.Store, archive ocispec.Descriptor, data []byte) ([]ocispec.Descriptor, error) {
+	var layers []ocispec.Descriptor
+	for off := int64(0); off < int64(len(data)); off += m.config.ChartChunkSize {
+		chunk := data[off:minInt64(off+m.config.ChartChunkSize, int64(len(data)))]
+		desc := ocispec.Descriptor{
+			MediaType: ChartChunkMediaType,
+			Digest:    digest.FromBytes(chunk),
+			Size:      int64(len(chunk)),
+			Annotations: map[string]string{
+				ChunkOfAnnotation: archive.Digest.String(),
+			},
+		}
+		if exists, err := store.Exists(ctx, desc); err != nil {
+			return nil, err
+		} else if !exists {
+			// identical chunks are stored once
+			if err = store.Push(ctx, desc, bytes.NewReader(chunk)); err != nil {
+				return nil, err
+			}
+		}
+		layers = append(layers, desc)
+	}
+	return layers, nil
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// indexChunks records the chunks the chart archives of om are reassembled
+// from. Must be called with the lock held.
+func (m *Manifests) indexChunks(om ocispec.Manifest) {
+	archives := map[string]*chunkedArchive{}
+	for _, desc := range om.Layers {
+		of, ok := desc.Annotations[ChunkOfAnnotation]
+		if desc.MediaType != ChartChunkMediaType || !ok {
+			continue
+		}
+		if archives[of] == nil {
+			archives[of] = &chunkedArchive{}
+		}
+		archives[of].chunks = append(archives[of].chunks, desc.Digest.String())
+		archives[of].size += desc.Size
+	}
+	m.blobLock.Lock()
+	defer m.blobLock.Unlock()
+	for d, a := range archives {
+		m.chunks[d] = *a
+	}
+}
+
+// BlobChunks returns the digests of the chunks the chart archive d is
+// reassembled from, in order, and its size. There are none if it's stored
+// whole.
+func (m *Manifests) BlobChunks(d string) ([]string, int64) {
+	m.blobLock.RLock()
+	defer m.blobLock.RUnlock()
+	a := m.chunks[d]
+	return a.chunks, a.size
+}
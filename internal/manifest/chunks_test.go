@@ -0,0 +1,75 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	helmregistry "helm.sh/helm/v3/pkg/registry"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChartChunks(t *testing.T) {
+	noise := make([]byte, 48*1024)
+	if _, err := rand.Read(noise); err != nil {
+		t.Fatal(err)
+	}
+	c := testChart{name: "foo", version: "1.0.0", files: map[string]string{"files/noise": base64.StdEncoding.EncodeToString(noise)}}
+	archive := chartTgz(t, c)
+	const chunkSize = 16 * 1024
+	u := newTestUpstream(t, c)
+	m := newTestManifests(t, u, Config{ChartChunkSize: chunkSize})
+	repo := u.host() + "/foo"
+
+	var om ocispec.Manifest
+	if err := json.Unmarshal(get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/1.0.0").Body.Bytes(), &om); err != nil {
+		t.Fatal(err)
+	}
+	chart := om.Layers[0]
+	if chart.MediaType != helmregistry.ChartLayerMediaType || chart.Digest != digest.FromBytes(archive) {
+		t.Fatalf("first layer = %+v; want the chart archive", chart)
+	}
+	chunks := om.Layers[1:]
+	if want := (len(archive) + chunkSize - 1) / chunkSize; len(chunks) != want {
+		t.Fatalf("%d chunks of a %d bytes archive; want %d", len(chunks), len(archive), want)
+	}
+	for _, chunk := range chunks {
+		if chunk.MediaType != ChartChunkMediaType || chunk.Size > chunkSize || chunk.Annotations[ChunkOfAnnotation] != chart.Digest.String() {
+			t.Errorf("chunk = %+v", chunk)
+		}
+	}
+	h, _ := v1.NewHash(chart.Digest.String())
+	if _, err := m.blobHandler.Get(context.Background(), "", h); err == nil {
+		t.Error("whole archive stored besides its chunks")
+	}
+
+	b := blobs.NewBlobs(m.blobHandler, log.New(io.Discard, "", 0))
+	b.Chunks = m.BlobChunks
+	rec := httptest.NewRecorder()
+	if err := b.Handle(rec, httptest.NewRequest(http.MethodGet, "/v2/"+repo+"/blobs/"+chart.Digest.String(), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), archive) {
+		t.Errorf("reassembled %d bytes differing from the %d bytes archive", rec.Body.Len(), len(archive))
+	}
+
+	// archives below the chunk size stay whole
+	small := newTestUpstream(t, testChart{name: "bar", version: "1.0.0"})
+	m = newTestManifests(t, small, Config{ChartChunkSize: chunkSize})
+	om = ocispec.Manifest{}
+	if err := json.Unmarshal(get(t, m.Handle, http.MethodGet, "/v2/"+small.host()+"/bar/manifests/1.0.0").Body.Bytes(), &om); err != nil {
+		t.Fatal(err)
+	}
+	if len(om.Layers) != 1 {
+		t.Errorf("layers = %+v; want the chart archive only", om.Layers)
+	}
+}
@@ -5,6 +5,186 @@ import "time"
 type Config struct {
 	Debug              bool
 	CacheTTL           time.Duration // for how long store manifest
+	CacheTTLJitter     time.Duration // random extra time added to CacheTTL per entry
+	CacheTTLFloor      time.Duration // shortest time an entry is kept, whatever its TTL
 	IndexCacheTTL      time.Duration
 	IndexErrorCacheTTl time.Duration
+	TagsPageSize       int  // tags returned when the client doesn't pass n, 0 means up to TagsMaxPageSize
+	TagsMaxPageSize    int  // upper bound for n, 0 means unbounded
+	LowercaseRepos     bool // treat chart paths case-insensitively, the host is always lowercased
+	ReadOnly           bool // serve cached charts only, never contact upstreams
+	AllowPush          bool // accept manifests PUT by clients, their blobs must be cached
+
+	// CacheStatusHeader names the header manifests are sent with, telling
+	// whether they were a HIT, a MISS, STALE or REVALIDATED. None is sent if
+	// it's empty
+	CacheStatusHeader string
+	// FallbackContentType is the Content-Type of manifests stored without
+	// one, like entries of older caches. The OCI image manifest media type
+	// if it's empty
+	FallbackContentType string
+	// DigestAlgorithm is the algorithm of the Docker-Content-Digest manifests
+	// are served with, sha256 if it's empty. Manifests are pulled by their
+	// digest of any algorithm go-digest supports whatever it is
+	DigestAlgorithm string
+	// PreserveUpstreamDigests serves manifests of OCI upstreams pulled by
+	// tag with the Docker-Content-Digest the upstream reported, if it's the
+	// digest of their content, instead of the one of DigestAlgorithm
+	PreserveUpstreamDigests bool
+	// MediaTypeRewrite serves manifests with the Docker media type where
+	// their OCI one is stored or the other way around, MediaTypeRewriteAccept
+	// when the client only accepts the other and MediaTypeRewriteDocker always
+	// for OCI ones. The stored bytes are served as is
+	MediaTypeRewrite string
+	// StaleWhileRevalidate is for how long past expiry a manifest is still
+	// served while it's refreshed in the background
+	StaleWhileRevalidate time.Duration
+	// StaleIfError is for how long past expiry a manifest is still served
+	// when refreshing it fails with an upstream error
+	StaleIfError time.Duration
+	// AnnotationsAllow and AnnotationsDeny filter the Chart.yaml derived
+	// manifest annotations by key, using path.Match patterns
+	AnnotationsAllow []string
+	AnnotationsDeny  []string
+	// Yanked are host/chart:version references never served nor listed,
+	// using path.Match patterns. Pulls get YankedStatus, 410 if it's zero
+	Yanked       []string
+	YankedStatus int
+	// Tombstones are host/chart:version references permanently removed,
+	// using path.Match patterns. They're never listed and pulls always get
+	// 410, telling them apart from versions merely missing
+	Tombstones []string
+	// TagRewrites map upstream chart versions to the tags clients pull and
+	// list, the first matching rule applies
+	TagRewrites []TagRewrite
+	// StreamIndex parses index.yaml line by line when pulling or listing tags,
+	// keeping only the versions of the requested chart in memory. Catalogs
+	// still load whole indexes
+	StreamIndex bool
+	// Providers maps names used in place of a host, like bitnami in
+	// bitnami/nginx, to their upstream host and path
+	Providers map[string]string
+	// ChartAliases maps lowercase repositories clients pull, through a
+	// Providers name or not, to the chart name of their upstream, so a
+	// canonical name resolves to however each upstream calls the chart
+	ChartAliases map[string]string
+	// CatalogProviders lists the charts of every Providers upstream in the
+	// catalog, not only the cached ones
+	CatalogProviders bool
+	// CatalogDiscovery makes catalogs fetch the indexes of the Providers,
+	// FileUpstreams and chart repositories of cached charts in the
+	// background, a bounded number of them, so the next ones list all their
+	// charts
+	CatalogDiscovery bool
+	// CatalogNamespaces scopes /v2/<namespace>/_catalog to the repositories
+	// under namespace, a host, a path under it or a Providers name, instead
+	// of listing the upstream index
+	CatalogNamespaces bool
+	// CatalogCacheTTL is for how long a catalog snapshot is served before
+	// it's rebuilt in the background, it's built for every request if zero
+	CatalogCacheTTL time.Duration
+	// OCIUpstreams are hosts of OCI registries charts are mirrored from,
+	// instead of chart repositories serving index.yaml
+	OCIUpstreams []string
+	// MaxManifestBlobs bounds the blobs or child manifests a manifest from an
+	// OCI upstream may reference, 0 means unbounded
+	MaxManifestBlobs int
+	// BlobFetchConcurrency is how many blobs of a manifest from an OCI
+	// upstream are fetched at once, one at a time if it's zero
+	BlobFetchConcurrency int
+	// MaxConcurrentPrepares bounds the charts prepared at once, further
+	// prepares wait for one to complete. 0 means unbounded
+	MaxConcurrentPrepares int
+	// BlobDigestRetries is how many times a blob from an OCI upstream is
+	// downloaded again when it doesn't match its digest
+	BlobDigestRetries int
+	// LatestPolicies sets how the latest reference of the repositories under
+	// a prefix resolves, LatestTag, LatestStable or LatestPrerelease. The
+	// longest matching prefix applies
+	LatestPolicies map[string]string
+	// RepoQuotas caps the bytes the manifests and blobs of the repositories
+	// under a prefix, keyed by it, take together. The oldest of them are
+	// evicted when a pull exceeds it, the longest matching prefix applies
+	RepoQuotas map[string]int64
+	// ImmutableRepos keeps the cached versions of the repositories under a
+	// prefix, keyed by it, once the upstream changes them, logging a warning.
+	// The longest matching prefix applies
+	ImmutableRepos map[string]bool
+	// MaxChartVersions caps the versions of a chart cached at once, the
+	// lowest are evicted when a pull exceeds it. 0 means unbounded
+	MaxChartVersions int
+	// OnEvict, if set, is told about each entry evicted from the cache. It's
+	// called with the cache locked so it must not call back into it
+	OnEvict func(Eviction)
+	// PrefetchNext prepares the next higher version of a chart in the
+	// background when one is pulled, at most a few at a time
+	PrefetchNext bool
+	// WarmUp lists repo:reference manifests WarmUp prepares, a missing
+	// reference means the latest version
+	WarmUp []string
+	// WarmUpConcurrency is how many WarmUp entries are prepared at once, one
+	// at a time if it's zero
+	WarmUpConcurrency int
+	// FetchForeignLayers copies layers OCI upstreams reference by URL
+	// instead of passing their descriptors through, from ForeignLayerHosts
+	// only and up to ForeignLayerMaxSize bytes if it's set
+	FetchForeignLayers  bool
+	ForeignLayerHosts   []string
+	ForeignLayerMaxSize int64
+	// ChartChunkSize splits chart archives larger than it into layers of
+	// that many bytes referenced by the manifest after the chart layer, which
+	// is reassembled from them when pulled. Archives aren't split if it's zero
+	ChartChunkSize int64
+	// ExtractCRDs stores the CRDs bundled with a chart as a referrer of its manifest
+	ExtractCRDs bool
+	// ChartReadme surfaces the README of charts, truncated as a manifest
+	// annotation with ReadmeModeAnnotation or as a referrer of the manifest
+	// with ReadmeModeArtifact. It's not extracted if empty
+	ChartReadme string
+	// FetchProvenance adds the provenance file published next to a chart
+	// archive, <archive URL>.prov, as a layer following the archive's
+	FetchProvenance bool
+	// AuthPassthroughHosts are upstream hosts receiving the client's Authorization header
+	AuthPassthroughHosts []string
+	// UpstreamSigners sign the requests to the upstream hosts they're keyed
+	// by, lowercase. Their Authorization replaces the client's
+	UpstreamSigners map[string]RequestSigner
+	// FetchBudgets caps the requests per second sent to the upstream hosts
+	// they're keyed by. Requests beyond it wait for up to FetchBudgetMaxWait,
+	// the ones that would wait longer get a 429
+	FetchBudgets       map[string]float64
+	FetchBudgetMaxWait time.Duration
+	// UpstreamMaxIdleConns, UpstreamMaxIdleConnsPerHost and
+	// UpstreamIdleConnTimeout tune the pool of upstream connections, Go's
+	// defaults are used where zero
+	UpstreamMaxIdleConns        int
+	UpstreamMaxIdleConnsPerHost int
+	UpstreamIdleConnTimeout     time.Duration
+	// UpstreamCAs are PEM CA bundles trusted for the upstream host they're
+	// keyed by, besides the system roots
+	UpstreamCAs map[string][]byte
+	// InsecureSkipVerifyHosts are upstream hosts whose TLS certificates
+	// aren't verified, for testing against self-signed upstreams only
+	InsecureSkipVerifyHosts []string
+	// HTTPFallbackHosts are upstream hosts requested again over plain HTTP
+	// when HTTPS fails, for development upstreams only. It never applies to
+	// other hosts
+	HTTPFallbackHosts []string
+	// UpstreamBreakerThreshold is how many consecutive transport errors or
+	// 5xx answers of an upstream host open its circuit breaker, failing
+	// requests to it fast for UpstreamBreakerCooldown, 30s if zero. There's
+	// no breaker if it's zero
+	UpstreamBreakerThreshold int
+	UpstreamBreakerCooldown  time.Duration
+	// NonChartContentTypes are the media types of upstream answers taken for
+	// content that's neither an index nor a chart archive, like login pages,
+	// failing pulls with a 502. text/html and application/xhtml+xml if empty
+	NonChartContentTypes []string
+	// FileUpstreams maps hosts to the local directory, optionally a file://
+	// URL, holding their index.yaml and the chart archives it refers to
+	// relatively. Nothing is fetched over the network for them
+	FileUpstreams map[string]string
+	// UpstreamOverrideHosts are the hosts the UpstreamHeader may point to, the
+	// header is ignored if it's empty
+	UpstreamOverrideHosts []string
 }
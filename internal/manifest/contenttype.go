@@ -0,0 +1,47 @@
+package manifest
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// defaultNonChartContentTypes are taken for non-chart content when
+// NonChartContentTypes is empty.
+var defaultNonChartContentTypes = []string{"text/html", "application/xhtml+xml"}
+
+// contentTypeError is returned when an upstream answers with content that
+// can't be an index or a chart archive, like the HTML of a login page.
+type contentTypeError struct {
+	URL         string
+	ContentType string
+}
+
+func (e *contentTypeError) Error() string {
+	return fmt.Sprintf("%s: upstream returned %s content instead of a chart index or archive, it may require a login or be misconfigured", e.URL, e.ContentType)
+}
+
+// checkContentType rejects answers of url whose Content-Type is one of the
+// NonChartContentTypes, sniffing it from head, the start of the body, if
+// there's none.
+func (m *Manifests) checkContentType(url string, header http.Header, head []byte) error {
+	ct := header.Get("Content-Type")
+	if ct == "" {
+		ct = http.DetectContentType(head)
+	}
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return nil
+	}
+	rejected := m.config.NonChartContentTypes
+	if len(rejected) == 0 {
+		rejected = defaultNonChartContentTypes
+	}
+	for _, t := range rejected {
+		if strings.EqualFold(t, mediaType) {
+			return &contentTypeError{URL: url, ContentType: mediaType}
+		}
+	}
+	return nil
+}
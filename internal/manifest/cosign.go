@@ -0,0 +1,55 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"net/http"
+	"regexp"
+)
+
+// CosignSignatureArtifactType is the artifact type signatures stored under
+// cosign's sibling tags are listed with as referrers.
+const CosignSignatureArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+
+// cosign tags the signatures of a manifest sha256-<hex>.sig, after its digest
+var cosignTag = regexp.MustCompile(`^(sha256|sha512)-([a-f0-9]+)\.sig$`)
+
+func cosignSignatureTag(d digest.Digest) string {
+	return d.Algorithm().String() + "-" + d.Encoded() + ".sig"
+}
+
+// cosignSubject returns the digest of the manifest tag holds the signatures
+// of, if it's a cosign signature tag.
+func cosignSubject(tag string) (digest.Digest, bool) {
+	match := cosignTag.FindStringSubmatch(tag)
+	if match == nil {
+		return "", false
+	}
+	d := digest.NewDigestFromEncoded(digest.Algorithm(match[1]), match[2])
+	return d, d.Validate() == nil
+}
+
+// cosignReferrer returns the signature of subject stored under its cosign
+// tag, fetching it from the OCI upstream of repo if it isn't cached. Must be
+// called with the lock held.
+func (m *Manifests) cosignReferrer(ctx context.Context, repo string, subject digest.Digest) (ocispec.Descriptor, bool) {
+	tag := cosignSignatureTag(subject)
+	ma, err := m.lookup(ctx, repo, tag)
+	if err != nil {
+		if err.Status != http.StatusNotFound {
+			m.log.Printf("cosign signature %s:%s: %v", repo, tag, err)
+		}
+		return ocispec.Descriptor{}, false
+	}
+	var rm referrerManifest
+	_ = json.Unmarshal(ma.Blob, &rm)
+	return ocispec.Descriptor{
+		MediaType:    ma.ContentType,
+		Digest:       digest.FromBytes(ma.Blob),
+		Size:         int64(len(ma.Blob)),
+		ArtifactType: CosignSignatureArtifactType,
+		Annotations:  rm.Annotations,
+	}, true
+}
@@ -0,0 +1,110 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"io"
+	"oras.land/oras-go/v2/content"
+)
+
+const (
+	// CRDsArtifactType is the artifact type of the referrer bundling the CRDs of a chart
+	CRDsArtifactType = "application/vnd.container-registry.helm.chart.crds.v1+json"
+	// CRDLayerMediaType is the media type of a single CRD file of that referrer
+	CRDLayerMediaType = "application/vnd.container-registry.helm.chart.crd.v1+yaml"
+)
+
+// storeCRDs stores the files under crds/ of a chart archive, subcharts
+// included, as one manifest referring to the chart manifest subject.
+// Charts without CRDs are skipped.
+func (m *Manifests) storeCRDs(ctx context.Context, repo string, scope string, subject ocispec.Descriptor, data []byte) error {
+	ch, err := loader.LoadArchive(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	crds := ch.CRDObjects()
+	if len(crds) == 0 {
+		return nil
+	}
+	files := make([]referrerFile, 0, len(crds))
+	for _, crd := range crds {
+		files = append(files, referrerFile{name: crd.Filename, mediaType: CRDLayerMediaType, data: crd.File.Data})
+	}
+	return m.storeReferrer(ctx, repo, scope, subject, CRDsArtifactType, files)
+}
+
+type referrerFile struct {
+	name      string
+	mediaType string
+	data      []byte
+}
+
+// storeReferrer stores files as the layers of a manifest of artifactType
+// referring to subject, cached for scope.
+func (m *Manifests) storeReferrer(ctx context.Context, repo string, scope string, subject ocispec.Descriptor, artifactType string, files []referrerFile) error {
+	putHandler, ok := m.blobHandler.(handler.BlobPutHandler)
+	if !ok {
+		return fmt.Errorf("blob handler is read-only")
+	}
+	put := func(desc ocispec.Descriptor, b []byte) error {
+		h, err := helper.NewHash(desc.Digest.String())
+		if err != nil {
+			return err
+		}
+		return putHandler.Put(ctx, "", h, io.NopCloser(bytes.NewReader(b)))
+	}
+
+	configData := []byte("{}")
+	config := content.NewDescriptorFromBytes(artifactType, configData)
+	if err := put(config, configData); err != nil {
+		return err
+	}
+	refs := []string{config.Digest.String()}
+
+	layers := make([]ocispec.Descriptor, 0, len(files))
+	for _, f := range files {
+		desc := content.NewDescriptorFromBytes(f.mediaType, f.data)
+		desc.Annotations = map[string]string{ocispec.AnnotationTitle: f.name}
+		if err := put(desc, f.data); err != nil {
+			return err
+		}
+		layers = append(layers, desc)
+		refs = append(refs, desc.Digest.String())
+	}
+
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    layers,
+		Subject: &ocispec.Descriptor{
+			MediaType: subject.MediaType,
+			Digest:    subject.Digest,
+			Size:      subject.Size,
+		},
+	}
+	if created, ok := subject.Annotations[ocispec.AnnotationCreated]; ok {
+		// keep the digest stable, like the chart manifest's
+		manifest.Annotations = map[string]string{ocispec.AnnotationCreated: created}
+	}
+	blob, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return m.Write(repo, digest.FromBytes(blob).String(), Manifest{
+		ContentType: ocispec.MediaTypeImageManifest,
+		Blob:        blob,
+		Refs:        refs,
+		CreatedAt:   m.now(),
+		TTL:         m.entryTTL(),
+		Scope:       scope,
+	})
+}
@@ -0,0 +1,76 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestExtractCRDs(t *testing.T) {
+	crds := map[string]string{
+		"crds/a.yaml": "kind: CustomResourceDefinition\nmetadata:\n  name: a.example.com\n",
+		"crds/b.yaml": "kind: CustomResourceDefinition\nmetadata:\n  name: b.example.com\n",
+	}
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0", files: crds})
+
+	for _, enabled := range []bool{false, true} {
+		m := newTestManifests(t, u, Config{ExtractCRDs: enabled})
+		repo := u.host() + "/foo"
+		chartDigest := digest.FromBytes(get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/1.0.0").Body.Bytes())
+
+		rec := get(t, m.HandleReferrers, http.MethodGet, "/v2/"+repo+"/referrers/"+chartDigest.String()+"?artifactType="+url.QueryEscape(CRDsArtifactType))
+		var index ocispec.Index
+		if err := json.Unmarshal(rec.Body.Bytes(), &index); err != nil {
+			t.Fatal(err)
+		}
+		if !enabled {
+			if len(index.Manifests) != 0 {
+				t.Errorf("got %d referrers with extraction disabled; want 0", len(index.Manifests))
+			}
+			continue
+		}
+		if len(index.Manifests) != 1 {
+			t.Fatalf("got %d CRD referrers; want 1", len(index.Manifests))
+		}
+
+		rec = get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/"+index.Manifests[0].Digest.String())
+		var om ocispec.Manifest
+		if err := json.Unmarshal(rec.Body.Bytes(), &om); err != nil {
+			t.Fatal(err)
+		}
+		if len(om.Layers) != len(crds) {
+			t.Fatalf("got %d layers; want %d", len(om.Layers), len(crds))
+		}
+		for _, l := range om.Layers {
+			// titles are prefixed with the chart name, like for subcharts
+			want, ok := crds[strings.TrimPrefix(l.Annotations[ocispec.AnnotationTitle], "foo/")]
+			if !ok {
+				t.Errorf("unexpected layer %q", l.Annotations[ocispec.AnnotationTitle])
+				continue
+			}
+			h, err := v1.NewHash(l.Digest.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			rc, err := m.blobHandler.Get(context.Background(), "", h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Errorf("%s = %q; want %q", l.Annotations[ocispec.AnnotationTitle], got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package manifest
+
+import (
+	"github.com/opencontainers/go-digest"
+)
+
+// digestAlgorithm is the DigestAlgorithm manifests are served with, sha256 if
+// it's unset.
+func (m *Manifests) digestAlgorithm() digest.Algorithm {
+	if m.config.DigestAlgorithm == "" {
+		return digest.Canonical
+	}
+	return digest.Algorithm(m.config.DigestAlgorithm)
+}
+
+// servedDigest is the Docker-Content-Digest of ma pulled as target. It's of
+// the algorithm of target if that's a digest, clients compare both, else the
+// one the upstream reported with PreserveUpstreamDigests.
+func (m *Manifests) servedDigest(ma Manifest, target string) digest.Digest {
+	if d, err := digest.Parse(target); err == nil {
+		return d.Algorithm().FromBytes(ma.Blob)
+	}
+	if m.config.PreserveUpstreamDigests && ma.UpstreamDigest != "" {
+		return digest.Digest(ma.UpstreamDigest)
+	}
+	return m.digestAlgorithm().FromBytes(ma.Blob)
+}
+
+// matchesDigest reports whether data is the content of reference, if it's a
+// digest of any algorithm. Data of a tag always matches.
+func matchesDigest(data []byte, reference string) bool {
+	want, err := digest.Parse(reference)
+	return err != nil || want.Algorithm().FromBytes(data) == want
+}
+
+// cachedDigest returns the digest a manifest of repo is cached by, manifests
+// are stored by their sha256 one, when target is its digest of another
+// algorithm. Must be called with the lock held.
+func (m *Manifests) cachedDigest(repo string, target string) (string, bool) {
+	d, err := digest.Parse(target)
+	if err != nil || d.Algorithm() == digest.Canonical {
+		return "", false
+	}
+	if _, ok := m.manifests[repo][target]; ok {
+		return "", false
+	}
+	for ref, ma := range m.manifests[repo] {
+		if isDigest(ref) && d.Algorithm().FromBytes(ma.Blob) == d {
+			return ref, true
+		}
+	}
+	return "", false
+}
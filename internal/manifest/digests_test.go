@@ -0,0 +1,44 @@
+package manifest
+
+import (
+	"bytes"
+	"github.com/opencontainers/go-digest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDigestAlgorithms(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	repo := u.host() + "/foo"
+
+	m := newTestManifests(t, u, Config{})
+	tagged := get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/1.0.0")
+	if d := tagged.Header().Get("Docker-Content-Digest"); d != digest.FromBytes(tagged.Body.Bytes()).String() {
+		t.Errorf("Docker-Content-Digest = %s; want the sha256 digest", d)
+	}
+	sha512 := digest.SHA512.FromBytes(tagged.Body.Bytes())
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		rec := get(t, m.Handle, method, "/v2/"+repo+"/manifests/"+sha512.String())
+		if d := rec.Header().Get("Docker-Content-Digest"); d != sha512.String() {
+			t.Errorf("%s by sha512: Docker-Content-Digest = %s; want %s", method, d, sha512)
+		}
+		if method == http.MethodGet && !bytes.Equal(rec.Body.Bytes(), tagged.Body.Bytes()) {
+			t.Errorf("GET by sha512 served another manifest")
+		}
+	}
+	unknown := digest.SHA512.FromString("unknown")
+	if err := m.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/"+repo+"/manifests/"+unknown.String(), nil)); err == nil {
+		t.Errorf("GET by unknown sha512 digest succeeded")
+	}
+
+	m = newTestManifests(t, u, Config{DigestAlgorithm: "sha512"})
+	rec := get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/1.0.0")
+	if d := rec.Header().Get("Docker-Content-Digest"); d != sha512.String() {
+		t.Errorf("DigestAlgorithm sha512: Docker-Content-Digest = %s; want %s", d, sha512)
+	}
+	sha256 := digest.FromBytes(rec.Body.Bytes())
+	if d := get(t, m.Handle, http.MethodHead, "/v2/"+repo+"/manifests/"+sha256.String()).Header().Get("Docker-Content-Digest"); d != sha256.String() {
+		t.Errorf("HEAD by sha256: Docker-Content-Digest = %s; want %s", d, sha256)
+	}
+}
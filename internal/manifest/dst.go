@@ -3,12 +3,12 @@ package manifest
 import (
 	"context"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
 	"github.com/container-registry/helm-charts-oci-proxy/pkg/verify"
-	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"io"
 	"strings"
-	"time"
 )
 
 const (
@@ -32,6 +32,8 @@ type InternalDst struct {
 	repo           string
 	blobPutHandler handler.BlobPutHandler
 	manifests      *Manifests
+	skip           map[digest.Digest]bool // blobs not to store, reported as existing
+	scope          string                 // cache scope the manifests are written for
 }
 
 func NewInternalDst(repo string, blobPutHandler handler.BlobPutHandler, manifests *Manifests) *InternalDst {
@@ -40,7 +42,7 @@ func NewInternalDst(repo string, blobPutHandler handler.BlobPutHandler, manifest
 
 func (f *InternalDst) Tag(ctx context.Context, desc ocispec.Descriptor, reference string) error {
 
-	h, err := v1.NewHash(desc.Digest.String())
+	h, err := helper.NewHash(desc.Digest.String())
 	if err != nil {
 		return err
 	}
@@ -63,13 +65,13 @@ func (f *InternalDst) Fetch(ctx context.Context, target ocispec.Descriptor) (io.
 }
 
 func (f *InternalDst) Exists(ctx context.Context, target ocispec.Descriptor) (bool, error) {
-	// always does not exist
-	return false, nil
+	// always does not exist, unless it's skipped
+	return f.skip[target.Digest], nil
 }
 
 // Push no need lock
 func (f *InternalDst) Push(ctx context.Context, expected ocispec.Descriptor, content io.Reader) error {
-	h, err := v1.NewHash(expected.Digest.String())
+	h, err := helper.NewHash(expected.Digest.String())
 	if err != nil {
 		return err
 	}
@@ -99,7 +101,9 @@ func (f *InternalDst) Push(ctx context.Context, expected ocispec.Descriptor, con
 			ContentType: expected.MediaType,
 			Blob:        binary,
 			Refs:        refs,
-			CreatedAt:   time.Now(),
+			CreatedAt:   f.manifests.now(),
+			TTL:         f.manifests.entryTTL(),
+			Scope:       f.scope,
 		})
 	}
 	//blob
@@ -0,0 +1,106 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// Reasons an entry is evicted for
+const (
+	EvictedTTL      = "ttl"      // expired past the stale window
+	EvictedQuota    = "quota"    // oldest of the RepoQuotas exceeded
+	EvictedVersions = "versions" // lowest beyond MaxChartVersions
+)
+
+// Eviction describes a repo:reference entry evicted from the cache.
+type Eviction struct {
+	Repo      string        `json:"repo"`
+	Reference string        `json:"reference"`
+	Size      int64         `json:"size"` // of the manifest and the blobs it refers to
+	Age       time.Duration `json:"age"`
+	Reason    string        `json:"reason"`
+}
+
+// evict deletes repo:ref, counting it by reason and telling OnEvict. repo is
+// a manifests key, OnEvict gets it without its scope. Must be called with the
+// lock held.
+func (m *Manifests) evict(repo string, ref string, reason string) {
+	ma, ok := m.manifests[repo][ref]
+	if !ok {
+		return
+	}
+	delete(m.manifests[repo], ref)
+	m.evictions.add(reason, 1)
+	if m.config.OnEvict != nil {
+		name, _ := splitScopedRepo(repo)
+		m.config.OnEvict(Eviction{
+			Repo:      name,
+			Reference: ref,
+			Size:      manifestSize(ma),
+			Age:       m.now().Sub(ma.CreatedAt),
+			Reason:    reason,
+		})
+	}
+}
+
+// evictExpired evicts the entries expired past the stale window, with their
+// blobs.
+func (m *Manifests) evictExpired(ctx context.Context) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delHandler, _ := m.blobHandler.(handler.BlobDeleteHandler)
+	for repo, refs := range m.manifests {
+		for ref, ma := range refs {
+			if !m.expired(ma, m.now().Add(-m.staleWindow())) {
+				continue
+			}
+			m.evict(repo, ref, EvictedTTL)
+			m.forgetBlobs(ma.Refs)
+			if delHandler == nil {
+				continue
+			}
+			for _, d := range ma.Refs {
+				h, err := helper.NewHash(d)
+				if err != nil {
+					continue
+				}
+				if m.config.Debug {
+					m.log.Printf("deleting blob %s", h.String())
+				}
+				if err = delHandler.Delete(ctx, "", h); err != nil {
+					m.log.Println(err)
+				}
+			}
+		}
+	}
+}
+
+// EvictionWebhook returns an OnEvict posting each eviction as JSON to url in
+// the background.
+func EvictionWebhook(url string, log logrus.StdLogger) func(Eviction) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(e Eviction) {
+		body, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("eviction webhook: %v", err)
+			return
+		}
+		go func() {
+			resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+			if err != nil {
+				log.Printf("eviction webhook: %v", err)
+				return
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode >= http.StatusBadRequest {
+				log.Printf("eviction webhook: %s answered %s", url, resp.Status)
+			}
+		}()
+	}
+}
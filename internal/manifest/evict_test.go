@@ -0,0 +1,60 @@
+package manifest
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestEvictionHook(t *testing.T) {
+	u := newTestUpstream(t,
+		testChart{name: "foo", version: "1.0.0"},
+		testChart{name: "foo", version: "2.0.0"},
+	)
+	repo := u.host() + "/foo"
+	clock := &testClock{t: time.Now()}
+	var evictions []Eviction
+	onEvict := func(e Eviction) { evictions = append(evictions, e) }
+
+	// expired
+	m := newTestManifests(t, u, Config{CacheTTL: time.Minute, OnEvict: onEvict})
+	m.now = clock.now
+	get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/1.0.0")
+	size := manifestSize(m.manifests[repo]["1.0.0"])
+	clock.advance(2 * time.Minute)
+	m.evictExpired(context.Background())
+	sort.Slice(evictions, func(i, j int) bool { return evictions[i].Reference < evictions[j].Reference })
+	if len(evictions) != 2 || evictions[0].Reference != "1.0.0" {
+		t.Fatalf("evictions = %+v; want the tag and the digest of 1.0.0", evictions)
+	}
+	for _, e := range evictions {
+		if e.Repo != repo || e.Reason != EvictedTTL || e.Size != size || e.Age != 2*time.Minute {
+			t.Errorf("eviction = %+v; want %s of %d bytes aged 2m for %s", e, repo, size, EvictedTTL)
+		}
+	}
+	if n := m.evictions.snapshot()[EvictedTTL]; n != 2 {
+		t.Errorf("%d evictions counted for %s; want 2", n, EvictedTTL)
+	}
+
+	// over quota, the oldest goes
+	evictions = nil
+	m = newTestManifests(t, u, Config{RepoQuotas: map[string]int64{repo: size + size/2}, OnEvict: onEvict})
+	m.now = clock.now
+	get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/1.0.0")
+	clock.advance(time.Second)
+	get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/2.0.0")
+	sort.Slice(evictions, func(i, j int) bool { return evictions[i].Reference < evictions[j].Reference })
+	if len(evictions) != 2 || evictions[0].Reference != "1.0.0" {
+		t.Fatalf("evictions = %+v; want the tag and the digest of 1.0.0", evictions)
+	}
+	for _, e := range evictions {
+		if e.Reason != EvictedQuota || e.Size != size || e.Age != time.Second {
+			t.Errorf("eviction = %+v; want %d bytes aged 1s for %s", e, size, EvictedQuota)
+		}
+	}
+	if n := m.evictions.snapshot()[EvictedQuota]; n != 2 {
+		t.Errorf("%d evictions counted for %s; want 2", n, EvictedQuota)
+	}
+}
@@ -0,0 +1,200 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	cerrors "errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
+	"github.com/opencontainers/go-digest"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// problems fsck reports
+const (
+	fsckManifestMismatch = "manifest digest mismatch"
+	fsckBlobMissing      = "blob missing"
+	fsckBlobMismatch     = "blob digest mismatch"
+	fsckBlobUnreadable   = "blob unreadable"
+)
+
+type fsckProblem struct {
+	Repo      string `json:"repo"`
+	Reference string `json:"reference"`
+	Blob      string `json:"blob,omitempty"`
+	Problem   string `json:"problem"`
+	Error     string `json:"error,omitempty"`
+	Repaired  bool   `json:"repaired,omitempty"`
+}
+
+type fsckReport struct {
+	Manifests int           `json:"manifests"`
+	Blobs     int           `json:"blobs"`
+	Problems  []fsckProblem `json:"problems"`
+}
+
+// handleFsck checks that the cached manifests match the digests they're
+// cached by and that the blobs they refer to are stored and match theirs.
+// With repair=true the broken entries are evicted with their blobs and
+// fetched again from their upstream.
+func (m *Manifests) handleFsck(resp http.ResponseWriter, req *http.Request) error {
+	repair, _ := strconv.ParseBool(req.URL.Query().Get("repair"))
+	res := m.fsck(req.Context())
+	if repair {
+		m.repair(req.Context(), res.Problems)
+	}
+
+	msg, err := json.Marshal(res)
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	_, err = resp.Write(msg)
+	return err
+}
+
+// fsck walks a snapshot of the cache, each blob is read once.
+func (m *Manifests) fsck(ctx context.Context) fsckReport {
+	res := fsckReport{Problems: []fsckProblem{}}
+	checked := map[string]fsckProblem{} // blob digest -> its problem, none if it's fine
+	manifests := m.snapshot()
+	repos := make([]string, 0, len(manifests))
+	for repo := range manifests {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	for _, repo := range repos {
+		refs := make([]string, 0, len(manifests[repo]))
+		for ref := range manifests[repo] {
+			refs = append(refs, ref)
+		}
+		sort.Strings(refs)
+		for _, ref := range refs {
+			ma := manifests[repo][ref]
+			res.Manifests++
+			if !matchesDigest(ma.Blob, ref) {
+				res.Problems = append(res.Problems, fsckProblem{Repo: repo, Reference: ref, Problem: fsckManifestMismatch})
+			}
+			for _, d := range ma.Refs {
+				p, ok := checked[d]
+				if !ok {
+					p = m.fsckBlob(ctx, d)
+					checked[d] = p
+					res.Blobs++
+				}
+				if p.Problem != "" {
+					p.Repo, p.Reference = repo, ref
+					res.Problems = append(res.Problems, p)
+				}
+			}
+		}
+	}
+	return res
+}
+
+// fsckBlob reads the blob d, reporting a problem if it's missing or doesn't
+// match d.
+func (m *Manifests) fsckBlob(ctx context.Context, d string) fsckProblem {
+	p := fsckProblem{Blob: d}
+	h, err := helper.NewHash(d)
+	if err != nil {
+		p.Problem, p.Error = fsckBlobUnreadable, err.Error()
+		return p
+	}
+	rc, err := m.blobHandler.Get(ctx, "", h)
+	if cerrors.Is(err, blobs.ErrNotFound) {
+		p.Problem = fsckBlobMissing
+		return p
+	}
+	if err != nil {
+		p.Problem, p.Error = fsckBlobUnreadable, err.Error()
+		return p
+	}
+	defer rc.Close()
+	digester := digest.Algorithm(h.Algorithm).Digester()
+	if _, err = io.Copy(digester.Hash(), rc); err != nil {
+		p.Problem, p.Error = fsckBlobUnreadable, err.Error()
+		return p
+	}
+	if got := digester.Digest(); got.String() != d {
+		p.Problem, p.Error = fsckBlobMismatch, "got "+got.String()
+	}
+	return p
+}
+
+// repair evicts the broken manifests of problems with every reference to
+// them and deletes their broken blobs, then prepares their tags again.
+// Problems of manifests prepared again are marked repaired, pushed ones can't
+// be.
+func (m *Manifests) repair(ctx context.Context, problems []fsckProblem) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if delHandler, ok := m.blobHandler.(handler.BlobDeleteHandler); ok {
+		for _, p := range problems {
+			if p.Problem != fsckBlobMismatch {
+				continue
+			}
+			if h, err := helper.NewHash(p.Blob); err == nil {
+				if err = delHandler.Delete(ctx, "", h); err != nil && !cerrors.Is(err, blobs.ErrNotFound) {
+					m.log.Printf("fsck: deleting blob %s: %v", p.Blob, err)
+				}
+			}
+		}
+	}
+
+	// the tags of every broken manifest, by repo
+	broken := map[string]map[digest.Digest]bool{}
+	for _, p := range problems {
+		ma, ok := m.manifests[p.Repo][p.Reference]
+		if !ok {
+			continue
+		}
+		if broken[p.Repo] == nil {
+			broken[p.Repo] = map[digest.Digest]bool{}
+		}
+		broken[p.Repo][digest.FromBytes(ma.Blob)] = true
+	}
+	prepared := map[string]bool{} // repo:reference
+	for key, digests := range broken {
+		var tags []string
+		for ref, ma := range m.manifests[key] {
+			if !digests[digest.FromBytes(ma.Blob)] {
+				continue
+			}
+			if !isDigest(ref) {
+				tags = append(tags, ref)
+			}
+			delete(m.manifests[key], ref)
+		}
+		repo, scope := splitScopedRepo(key)
+		if scope != "" {
+			// fetched again with the credentials of its identity on its next pull
+			continue
+		}
+		sort.Strings(tags)
+		for _, tag := range tags {
+			if err := m.prepareChart(ctx, repo, tag, scope); err != nil {
+				m.log.Printf("fsck: preparing %s:%s again: %v", repo, tag, err)
+				continue
+			}
+			prepared[repo+":"+tag] = true
+		}
+	}
+	for i, p := range problems {
+		if prepared[p.Repo+":"+p.Reference] {
+			problems[i].Repaired = true
+			continue
+		}
+		// digest references are repaired with a tag of the same manifest
+		if ma, ok := m.manifests[p.Repo][p.Reference]; ok && isDigest(p.Reference) && matchesDigest(ma.Blob, p.Reference) {
+			problems[i].Repaired = true
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// probeTimeout bounds each upstream probe of GET /admin/upstreams.
+const probeTimeout = 5 * time.Second
+
+type upstreamHealth struct {
+	Upstream  string        `json:"upstream"`
+	URL       string        `json:"url"`
+	Probed    bool          `json:"probed"` // unset in ReadOnly mode
+	Reachable bool          `json:"reachable"`
+	Status    int           `json:"status,omitempty"` // of the probe, none if it got no answer
+	Error     string        `json:"error,omitempty"`
+	Latency   time.Duration `json:"latency"`
+	Breaker   string        `json:"breaker"`
+}
+
+// handleUpstreams probes the configured upstreams and the ones of cached
+// charts at once, reporting whether each answered and its breaker state.
+// ReadOnly proxies don't contact upstreams, they're listed unprobed.
+func (m *Manifests) handleUpstreams(resp http.ResponseWriter, req *http.Request) error {
+	upstreams := m.knownUpstreams()
+	res := make([]upstreamHealth, len(upstreams))
+	var wg sync.WaitGroup
+	for i, upstream := range upstreams {
+		if m.config.ReadOnly {
+			res[i] = upstreamHealth{Upstream: upstream, URL: m.probeURL(upstream), Breaker: m.breakerState(repoHost(upstream))}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, upstream string) {
+			defer wg.Done()
+			res[i] = m.probe(req.Context(), upstream)
+			res[i].Breaker = m.breakerState(repoHost(upstream))
+		}(i, upstream)
+	}
+	wg.Wait()
+
+	msg, err := json.Marshal(res)
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	_, err = resp.Write(msg)
+	return err
+}
+
+// knownUpstreams lists the chart repositories of Providers, the
+// OCIUpstreams and FileUpstreams and those cached charts were pulled from,
+// sorted.
+func (m *Manifests) knownUpstreams() []string {
+	set := map[string]bool{}
+	for _, upstream := range m.config.Providers {
+		set[m.canonicalRepo(strings.Trim(upstream, "/"))] = true
+	}
+	for _, host := range m.config.OCIUpstreams {
+		set[strings.ToLower(host)] = true
+	}
+	for host := range m.config.FileUpstreams {
+		set[strings.ToLower(host)] = true
+	}
+	m.lock.Lock()
+	for key := range m.manifests {
+		repo, _ := splitScopedRepo(key)
+		if host := repoHost(repo); m.isOCIUpstream(host) {
+			set[host] = true
+		} else {
+			set[path.Dir(repo)] = true
+		}
+	}
+	m.lock.Unlock()
+
+	res := make([]string, 0, len(set))
+	for upstream := range set {
+		res = append(res, upstream)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// probeURL is the registry API of an OCI upstream or the index of a chart
+// repository.
+func (m *Manifests) probeURL(upstream string) string {
+	if host := repoHost(upstream); m.isOCIUpstream(host) {
+		return "https://" + host + "/v2/"
+	}
+	return "https://" + upstream + "/index.yaml"
+}
+
+// probe sends a HEAD request to the probeURL of upstream. Any answer below
+// 500 counts as reachable.
+func (m *Manifests) probe(ctx context.Context, upstream string) upstreamHealth {
+	url := m.probeURL(upstream)
+	res := upstreamHealth{Upstream: upstream, URL: url, Probed: true}
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	start := time.Now()
+	req, err := m.newUpstreamRequest(ctx, http.MethodHead, url)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	r, err := m.do(req)
+	res.Latency = time.Since(start)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	r.Body.Close()
+	res.Status = r.StatusCode
+	res.Reachable = r.StatusCode < http.StatusInternalServerError
+	return res
+}
@@ -0,0 +1,80 @@
+package manifest
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamHealth(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	l.Close()
+
+	m := newTestManifests(t, u, Config{
+		Providers:                map[string]string{"up": u.host(), "down": down + "/charts"},
+		UpstreamBreakerThreshold: 1,
+		UpstreamBreakerCooldown:  time.Minute,
+	})
+	clock := &testClock{t: time.Now()}
+	m.now = clock.now
+
+	var res []upstreamHealth
+	if err := json.Unmarshal(adminRequest(t, m, http.MethodGet, "/admin/upstreams", nil).Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("upstreams = %+v; want both providers", res)
+	}
+	byUpstream := map[string]upstreamHealth{}
+	for _, h := range res {
+		byUpstream[h.Upstream] = h
+	}
+	if h := byUpstream[u.host()]; !h.Probed || !h.Reachable || h.Status != http.StatusOK || h.Latency <= 0 || h.Breaker != BreakerClosed {
+		t.Errorf("healthy upstream = %+v", h)
+	}
+	if h := byUpstream[down+"/charts"]; h.Reachable || h.Status != 0 || h.Error == "" || h.Breaker != BreakerOpen {
+		t.Errorf("unreachable upstream = %+v", h)
+	}
+
+	// the open breaker fails pulls fast, until the cooldown passed
+	if err := handleErr(t, m.Handle, http.MethodGet, "/v2/down/foo/manifests/1.0.0"); err.Status != http.StatusServiceUnavailable {
+		t.Errorf("pull with the breaker open = %v; want 503", err)
+	}
+	clock.advance(time.Minute)
+	if s := m.breakerState(down); s != BreakerHalfOpen {
+		t.Errorf("breaker past the cooldown = %s; want %s", s, BreakerHalfOpen)
+	}
+
+	// pulls add the upstreams of cached charts
+	m = newTestManifests(t, u, Config{})
+	get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0")
+	res = nil
+	if err := json.Unmarshal(adminRequest(t, m, http.MethodGet, "/admin/upstreams", nil).Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Upstream != u.host() || !res[0].Reachable || res[0].Breaker != BreakerDisabled {
+		t.Errorf("upstreams = %+v; want the one of the cached chart, without breaker", res)
+	}
+
+	// read-only proxies never contact upstreams
+	m = newTestManifests(t, u, Config{ReadOnly: true, Providers: map[string]string{"up": u.host()}})
+	before := atomic.LoadInt32(&u.indexRequests)
+	res = nil
+	if err := json.Unmarshal(adminRequest(t, m, http.MethodGet, "/admin/upstreams", nil).Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Probed || res[0].Reachable {
+		t.Errorf("upstreams = %+v; want the provider listed unprobed", res)
+	}
+	if n := atomic.LoadInt32(&u.indexRequests) - before; n != 0 {
+		t.Errorf("read-only mode probed the upstream %d times", n)
+	}
+}
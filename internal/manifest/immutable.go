@@ -0,0 +1,80 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/opencontainers/go-digest"
+	"strings"
+)
+
+// immutable reports whether the cached versions of repo are never replaced,
+// as the ImmutableRepos entry of the longest matching prefix says.
+func (m *Manifests) immutable(repo string) bool {
+	prefix, ok := longestPrefix(m.config.ImmutableRepos, repo)
+	return ok && m.config.ImmutableRepos[prefix]
+}
+
+// refreshImmutable extends the cached repo:target if the upstream still
+// serves it, otherwise prepares it again for scope but keeps serving cached,
+// warning about it. The manifest the upstream serves now is dropped. Must be
+// called with the lock held.
+func (m *Manifests) refreshImmutable(ctx context.Context, repo string, target string, cached Manifest, scope string) (bool, *errors.RegError) {
+	key, was := scopedRepo(repo, scope), digest.FromBytes(cached.Blob)
+	if m.upstreamUnchanged(ctx, repo, target, cached) {
+		m.extend(key, target, was, cached)
+		return true, nil
+	}
+	if err := m.prepareChart(ctx, repo, target, scope); err != nil {
+		return false, err
+	}
+	now := digest.Digest("")
+	if ma, ok := m.manifests[key][target]; ok {
+		now = digest.FromBytes(ma.Blob)
+	}
+	m.extend(key, target, was, cached)
+	if now != was {
+		m.log.Printf("WARNING: upstream changed immutable %s:%s from %s to %s, keeping the cached version", repo, target, was, now)
+		if fresh, ok := m.manifests[key][now.String()]; ok && !m.tagged(key, now.String()) {
+			delete(m.manifests[key], now.String())
+			m.deleteUnreferenced(ctx, fresh.Refs)
+		}
+	}
+	return true, nil
+}
+
+// extend caches ma as target and d, its digest, of the manifests key for
+// another TTL. Must be called with the lock held.
+func (m *Manifests) extend(key string, target string, d digest.Digest, ma Manifest) {
+	ma.CreatedAt, ma.TTL = m.now(), m.entryTTL()
+	for _, ref := range []string{target, d.String()} {
+		_ = m.Write(key, ref, ma)
+	}
+}
+
+// upstreamUnchanged reports whether the upstream still serves cached as
+// repo:target, comparing the manifest of OCI upstreams and the digest chart
+// repository indexes list the archive with, without downloading the chart.
+// Must be called with the lock held, it's released while asking the upstream.
+func (m *Manifests) upstreamUnchanged(ctx context.Context, repo string, target string, cached Manifest) bool {
+	host, name, _ := strings.Cut(repo, "/")
+	var unchanged bool
+	m.unlocked(func() {
+		if m.isOCIUpstream(host) {
+			data, _, err := m.fetchOCI(ctx, fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, name, target), manifestAccept)
+			unchanged = err == nil && digest.FromBytes(data) == digest.FromBytes(cached.Blob)
+			return
+		}
+		if cached.IndexDigest == "" {
+			return
+		}
+		i := strings.LastIndex(repo, "/")
+		index, err := m.chartIndex(ctx, repo[:i], repo[i+1:])
+		if err != nil {
+			return
+		}
+		chartVer, err := m.indexVersion(index, repo[i+1:], target)
+		unchanged = err == nil && chartVer.Digest == cached.IndexDigest
+	})
+	return unchanged
+}
@@ -0,0 +1,75 @@
+package manifest
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestImmutableRepos(t *testing.T) {
+	r := newTestRegistry(t)
+	first := r.addChart(t, "first", "1.0.0")
+	path := "/v2/" + r.host() + "/charts/foo/manifests/1.0.0"
+
+	for _, tc := range []struct {
+		name      string
+		immutable map[string]bool
+		replaced  bool
+	}{
+		{name: "mutable", replaced: true},
+		{name: "immutable", immutable: map[string]bool{r.host(): true}},
+		{name: "exempted", immutable: map[string]bool{r.host(): true, r.host() + "/charts/foo": false}, replaced: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r.addChart(t, "first", "1.0.0")
+			m := newOCITestManifests(t, r, Config{ImmutableRepos: tc.immutable})
+			var logs bytes.Buffer
+			m.log = log.New(&logs, "", 0)
+			clock := &testClock{t: time.Now()}
+			m.now = clock.now
+			get(t, m.Handle, http.MethodGet, path)
+
+			second := r.addChart(t, "second", "1.0.0")
+			clock.advance(2 * time.Minute)
+			d := get(t, m.Handle, http.MethodGet, path).Header().Get("Docker-Content-Digest")
+			if tc.replaced && d != second.Digest.String() {
+				t.Errorf("Docker-Content-Digest = %s; want the upstream's new %s", d, second.Digest)
+			}
+			if !tc.replaced {
+				if d != first.Digest.String() {
+					t.Errorf("Docker-Content-Digest = %s; want the cached %s", d, first.Digest)
+				}
+				if !strings.Contains(logs.String(), "WARNING") || !strings.Contains(logs.String(), second.Digest.String()) {
+					t.Errorf("no warning logged about the upstream change: %q", logs.String())
+				}
+				if _, ok := m.manifests[r.host()+"/charts/foo"][second.Digest.String()]; ok {
+					t.Errorf("the upstream's new manifest was cached")
+				}
+			}
+		})
+	}
+}
+
+func TestImmutableChartRevalidated(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0", index: "    digest: 0123abcd\n"})
+	m := newTestManifests(t, u, Config{ImmutableRepos: map[string]bool{u.host(): true}, CacheStatusHeader: "X-Cache"})
+	clock := &testClock{t: time.Now()}
+	m.now = clock.now
+	path := "/v2/" + u.host() + "/foo/manifests/1.0.0"
+	get(t, m.Handle, http.MethodGet, path)
+
+	clock.advance(2 * time.Minute)
+	if status := get(t, m.Handle, http.MethodGet, path).Header().Get("X-Cache"); status != cacheRevalidated {
+		t.Errorf("cache status = %s; want %s", status, cacheRevalidated)
+	}
+	if n := atomic.LoadInt32(&u.tarballRequests); n != 1 {
+		t.Errorf("chart downloaded %d times; want once while the index digest is unchanged", n)
+	}
+	if status := get(t, m.Handle, http.MethodGet, path).Header().Get("X-Cache"); status != cacheHit {
+		t.Errorf("cache status after revalidation = %s; want %s", status, cacheHit)
+	}
+}
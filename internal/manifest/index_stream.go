@@ -0,0 +1,91 @@
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"helm.sh/helm/v3/pkg/repo"
+	"io"
+)
+
+// maxIndexLine bounds the length of a single index.yaml line.
+const maxIndexLine = 4 << 20
+
+// streamIndex parses an index.yaml keeping only the versions of chart. The
+// document is scanned line by line and only the top level fields and the
+// block of chart under entries are buffered, so huge indexes don't have to
+// fit in memory. Indexes in flow style, like JSON ones, are parsed whole.
+func streamIndex(r io.Reader, chart string) (*repo.IndexFile, error) {
+	var doc bytes.Buffer
+	keep := func(line []byte) {
+		doc.Write(line)
+		doc.WriteByte('\n')
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), maxIndexLine)
+
+	started, flow := false, false
+	inEntries, inChart, keyIndent := false, false, -1
+	for sc.Scan() {
+		line := sc.Bytes()
+		content := bytes.TrimLeft(line, " ")
+		indent := len(line) - len(content)
+		switch {
+		case flow:
+			keep(line)
+		case len(bytes.TrimSpace(content)) == 0 || content[0] == '#':
+			if inChart || !inEntries {
+				keep(line)
+			}
+		case !started && (content[0] == '{' || content[0] == '['):
+			// not block style, the line structure means nothing
+			flow = true
+			keep(line)
+		case indent == 0:
+			inEntries = bytes.Equal(bytes.TrimRight(content, " "), []byte("entries:"))
+			inChart, keyIndent = false, -1
+			keep(line)
+		case !inEntries:
+			keep(line)
+		default:
+			if keyIndent < 0 {
+				keyIndent = indent
+			}
+			if indent == keyIndent && content[0] != '-' {
+				// the key of a chart, its versions follow
+				inChart = entryKey(content) == chart
+			}
+			if inChart {
+				keep(line)
+			}
+		}
+		if len(bytes.TrimSpace(content)) > 0 && content[0] != '#' {
+			started = true
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading index: %w", err)
+	}
+	index, err := parseIndex(doc.Bytes())
+	if index != nil && flow {
+		for name := range index.Entries {
+			if name != chart {
+				delete(index.Entries, name)
+			}
+		}
+	}
+	return index, err
+}
+
+// entryKey returns the unquoted key of a `key:` line.
+func entryKey(line []byte) string {
+	key := line
+	if i := bytes.Index(line, []byte(":")); i >= 0 {
+		key = line[:i]
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) >= 2 && (key[0] == '"' || key[0] == '\'') && key[len(key)-1] == key[0] {
+		key = key[1 : len(key)-1]
+	}
+	return string(key)
+}
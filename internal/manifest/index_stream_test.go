@@ -0,0 +1,112 @@
+package manifest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// syntheticIndex generates an index.yaml of charts chart0 to chartN with
+// versions 1.0.0 to 1.0.M each, without holding it in memory.
+type syntheticIndex struct {
+	charts, versions int
+	next             int
+	buf, pending     []byte
+}
+
+func (s *syntheticIndex) Read(p []byte) (int, error) {
+	if len(s.pending) == 0 {
+		b := s.buf[:0]
+		switch {
+		case s.next == 0:
+			b = append(b, "apiVersion: v1\nentries:\n"...)
+		case s.next > s.charts:
+			return 0, io.EOF
+		}
+		if s.next < s.charts {
+			name := strconv.AppendInt([]byte("chart"), int64(s.next), 10)
+			b = append(append(append(b, "  "...), name...), ":\n"...)
+			for v := 0; v < s.versions; v++ {
+				b = append(append(b, "  - apiVersion: v2\n    name: "...), name...)
+				b = strconv.AppendInt(append(b, "\n    version: 1.0."...), int64(v), 10)
+				b = append(b, "\n    description: "...)
+				b = append(b, "A synthetic chart padding the index to a realistic size, nothing else to see here."...)
+				b = append(append(append(b, "\n    urls:\n    - "...), name...), "-1.0."...)
+				b = append(strconv.AppendInt(b, int64(v), 10), ".tgz\n"...)
+			}
+		}
+		s.next++
+		s.buf, s.pending = b, b
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func TestStreamIndexLarge(t *testing.T) {
+	const charts, versions = 50000, 3
+	size, _ := io.Copy(io.Discard, &syntheticIndex{charts: charts, versions: versions})
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	index, err := streamIndex(&syntheticIndex{charts: charts, versions: versions}, "chart31337")
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(index.Entries) != 1 || len(index.Entries["chart31337"]) != versions {
+		t.Fatalf("got entries for %d charts; want the %d versions of chart31337 only", len(index.Entries), versions)
+	}
+	if cv, err := index.Get("chart31337", "1.0.2"); err != nil || cv.URLs[0] != "chart31337-1.0.2.tgz" {
+		t.Errorf("chart31337 1.0.2 = %+v, %v", cv, err)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > uint64(size)/10 {
+		t.Errorf("allocated %d bytes parsing a %d bytes index; want at most %d", alloc, size, size/10)
+	}
+}
+
+func TestStreamIndex(t *testing.T) {
+	for _, doc := range []string{
+		// helm's own layout
+		"apiVersion: v1\nentries:\n  bar:\n  - name: bar\n    version: 2.0.0\n  foo:\n  - name: foo\n    version: 1.0.0\n    description: |\n      foo:\n      bar:\n  - name: foo\n    version: 1.0.1\ngenerated: \"2024-01-01T00:00:00Z\"\n",
+		// nested lists and quoted keys
+		"# comment\napiVersion: v1\nentries:\n    \"bar\":\n        - name: bar\n          version: 2.0.0\n    'foo':\n        - name: foo\n          version: 1.0.0\n\n        - name: foo\n          version: 1.0.1\n",
+		// flow style
+		`{"apiVersion": "v1", "entries": {"bar": [{"name": "bar", "version": "2.0.0"}], "foo": [{"name": "foo", "version": "1.0.0"}, {"name": "foo", "version": "1.0.1"}]}}`,
+	} {
+		index, err := streamIndex(strings.NewReader(doc), "foo")
+		if err != nil {
+			t.Errorf("%q: %v", doc, err)
+			continue
+		}
+		var versions []string
+		for _, cv := range index.Entries["foo"] {
+			versions = append(versions, cv.Version)
+		}
+		if want := []string{"1.0.1", "1.0.0"}; len(index.Entries) != 1 || !reflect.DeepEqual(versions, want) {
+			t.Errorf("%q: got %d charts, foo versions %v; want foo %v only", doc, len(index.Entries), versions, want)
+		}
+	}
+}
+
+func TestStreamIndexPull(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"}, testChart{name: "foo", version: "1.0.1"}, testChart{name: "bar", version: "2.0.0"})
+	m := newTestManifests(t, u, Config{StreamIndex: true})
+
+	get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0")
+	get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/bar/manifests/2.0.0")
+	var tags listTags
+	if err := json.Unmarshal(get(t, m.HandleTags, http.MethodGet, "/v2/"+u.host()+"/foo/tags/list").Body.Bytes(), &tags); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1.0.0", "1.0.1"}; !reflect.DeepEqual(tags.Tags, want) {
+		t.Errorf("tags = %v; want %v", tags.Tags, want)
+	}
+}
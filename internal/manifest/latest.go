@@ -0,0 +1,82 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Masterminds/semver/v3"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"net/http"
+	"strings"
+)
+
+// LatestPolicies values, how the latest reference resolves
+const (
+	// LatestTag pulls the latest tag as is, the default of OCI upstreams
+	LatestTag = "tag"
+	// LatestStable pulls the highest version without a prerelease, the
+	// default of chart repositories
+	LatestStable = "stable"
+	// LatestPrerelease pulls the highest version, prereleases included
+	LatestPrerelease = "prerelease"
+)
+
+// longestPrefix returns the longest key of prefixes repo is or is under.
+func longestPrefix[V any](prefixes map[string]V, repo string) (string, bool) {
+	best, found := "", false
+	for prefix := range prefixes {
+		if (repo == prefix || strings.HasPrefix(repo, prefix+"/")) && len(prefix) >= len(best) {
+			best, found = prefix, true
+		}
+	}
+	return best, found
+}
+
+// latestPolicy returns the LatestPolicies entry of repo, the default of its
+// upstream if there's none.
+func (m *Manifests) latestPolicy(repo string) string {
+	if prefix, ok := longestPrefix(m.config.LatestPolicies, repo); ok {
+		return m.config.LatestPolicies[prefix]
+	}
+	host, _, _ := strings.Cut(repo, "/")
+	if m.isOCIUpstream(host) {
+		return LatestTag
+	}
+	return LatestStable
+}
+
+// latestOCITag returns the highest semver tag of repo on its OCI upstream,
+// prereleases only if they're allowed.
+func (m *Manifests) latestOCITag(ctx context.Context, repo string, prereleases bool) (string, *errors.RegError) {
+	host, name, _ := strings.Cut(repo, "/")
+	data, _, err := m.fetchOCI(ctx, fmt.Sprintf("https://%s/v2/%s/tags/list", host, name), "application/json")
+	notFound := &errors.RegError{
+		Status:  http.StatusNotFound,
+		Code:    errors.CodeManifestUnknown,
+		Message: fmt.Sprintf("Chart: %s has no latest version", repo),
+	}
+	if err != nil {
+		return "", upstreamRegError(err, notFound)
+	}
+	var list struct {
+		Tags []string `json:"tags"`
+	}
+	if err = json.Unmarshal(data, &list); err != nil {
+		return "", upstreamRegError(err, notFound)
+	}
+	var latest *semver.Version
+	var tag string
+	for _, t := range list.Tags {
+		v, err := semver.NewVersion(t)
+		if err != nil || (v.Prerelease() != "" && !prereleases) || m.unlisted(repo, strings.TrimPrefix(t, "v")) {
+			continue
+		}
+		if latest == nil || v.GreaterThan(latest) {
+			latest, tag = v, t
+		}
+	}
+	if latest == nil {
+		return "", notFound
+	}
+	return tag, nil
+}
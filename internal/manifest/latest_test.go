@@ -0,0 +1,60 @@
+package manifest
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLatestPolicies(t *testing.T) {
+	r := newTestRegistry(t)
+	tagged := r.addChart(t, "tagged", "latest")
+	r.addChart(t, "1.0.0", "1.0.0")
+	stable := r.addChart(t, "2.0.0", "2.0.0")
+	rc := r.addChart(t, "3.0.0-rc.1", "3.0.0-rc.1")
+	ociRepo := r.host() + "/charts/foo"
+
+	for _, tc := range []struct {
+		policy string
+		want   string
+	}{
+		{"", tagged.Digest.String()},
+		{LatestTag, tagged.Digest.String()},
+		{LatestStable, stable.Digest.String()},
+		{LatestPrerelease, rc.Digest.String()},
+	} {
+		config := Config{}
+		if tc.policy != "" {
+			config.LatestPolicies = map[string]string{r.host(): tc.policy}
+		}
+		m := newOCITestManifests(t, r, config)
+		rec := get(t, m.Handle, http.MethodGet, "/v2/"+ociRepo+"/manifests/latest")
+		if d := rec.Header().Get("Docker-Content-Digest"); d != tc.want {
+			t.Errorf("OCI policy %q: latest = %s; want %s", tc.policy, d, tc.want)
+		}
+	}
+
+	u := newTestUpstream(t,
+		testChart{name: "foo", version: "1.0.0"},
+		testChart{name: "foo", version: "2.0.0-rc.1"},
+	)
+	repo := u.host() + "/foo"
+	for _, tc := range []struct {
+		policy string
+		want   string
+	}{
+		{"", "1.0.0"},
+		{LatestStable, "1.0.0"},
+		{LatestPrerelease, "2.0.0-rc.1"},
+	} {
+		config := Config{}
+		if tc.policy != "" {
+			config.LatestPolicies = map[string]string{repo: tc.policy}
+		}
+		m := newTestManifests(t, u, config)
+		latest := get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/latest").Header().Get("Docker-Content-Digest")
+		want := get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/"+tc.want).Header().Get("Docker-Content-Digest")
+		if latest != want {
+			t.Errorf("policy %q: latest = %s; want %s of %s", tc.policy, latest, want, tc.want)
+		}
+	}
+}
@@ -3,20 +3,25 @@ package manifest
 import (
 	"bytes"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
-	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
+	"helm.sh/helm/v3/pkg/repo"
 	"io"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -34,16 +39,69 @@ type Manifest struct {
 	Blob        []byte    `json:"blob"`
 	Refs        []string  `json:"refs"` // referenced blobs digests
 	CreatedAt   time.Time `json:"createdAt"`
+	// TTL is the jittered cache duration of this entry, CacheTTL if zero
+	TTL time.Duration `json:"ttl,omitempty"`
+	// Source is the upstream chart archive, ETag and LastModified its
+	// validators for revalidating the entry once it expired
+	Source       string `json:"source,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	// IndexDigest is the digest the upstream index lists the archive with
+	IndexDigest string `json:"indexDigest,omitempty"`
+	// Deprecated is set for chart versions marked deprecated upstream
+	Deprecated bool `json:"deprecated,omitempty"`
+	// UpstreamDigest is the Docker-Content-Digest an OCI upstream served
+	// the manifest with
+	UpstreamDigest string `json:"upstreamDigest,omitempty"`
+	// Scope is the identity the manifest was fetched for from an
+	// AuthPassthroughHosts upstream, it's stored apart from the manifests of
+	// other identities
+	Scope string `json:"scope,omitempty"`
 }
 
 type Manifests struct {
-	// maps repo -> Manifest tag/digest -> Manifest
+	// maps repo -> Manifest tag/digest -> Manifest, repo@scope for entries
+	// cached per identity
 	manifests   map[string]map[string]Manifest
 	lock        sync.Mutex
 	log         logrus.StdLogger
 	cache       Cache
 	blobHandler handler.BlobHandler
 	config      Config
+	client      *http.Client
+	indexGroup  singleflight.Group
+	refreshing  map[string]bool // repo@scope:reference being refreshed in the background
+	now         func() time.Time
+	pulls       counters                   // by repo:reference
+	draining    atomic.Bool                // cache misses are refused while set
+	mediaTypes  map[string]string          // blob digest -> media type it's referenced with, guarded by blobLock
+	referrers   map[string]map[string]bool // repo@subject digest -> digests of the manifests referring to it
+	chunks      map[string]chunkedArchive  // chart archive digest -> chunks it's split into, guarded by blobLock
+	blobLock    sync.RWMutex               // read by every blob served, so it doesn't wait for lock
+	prefetches  chan struct{}              // a slot per prefetch running
+	preparing   map[string]*preparation    // repo:reference@scope being prepared
+	prepareSlot chan struct{}              // a slot per prepare running, with MaxConcurrentPrepares
+	budgets     map[string]*rate.Limiter   // FetchBudgets by host
+	breakers    map[string]*breaker        // upstream hosts failing, by host
+	breakerLock sync.Mutex
+	scopeKey    []byte // cache scopes are hashed with
+
+	// catalog snapshot, with CatalogCacheTTL
+	catalog           *catalogSnapshot
+	catalogLock       sync.Mutex
+	catalogRefreshing bool
+	catalogGroup      singleflight.Group
+
+	// charts of the indexes discovered by catalogs, with CatalogDiscovery
+	discovered    map[string]bool
+	discoveryLock sync.Mutex
+	discovering   atomic.Bool
+
+	// bytes served and fetched, by host
+	manifestBytes counters
+	blobBytes     counters
+	upstreamBytes counters
+	evictions     counters // by reason
 }
 
 func NewManifests(ctx context.Context, blobHandler handler.BlobHandler, config Config, cache Cache, log logrus.StdLogger) *Manifests {
@@ -54,6 +112,21 @@ func NewManifests(ctx context.Context, blobHandler handler.BlobHandler, config C
 		log:         log,
 		config:      config,
 		cache:       cache,
+		client:      newUpstreamClient(config, log),
+		refreshing:  map[string]bool{},
+		mediaTypes:  map[string]string{},
+		referrers:   map[string]map[string]bool{},
+		chunks:      map[string]chunkedArchive{},
+		prefetches:  make(chan struct{}, maxPrefetches),
+		preparing:   map[string]*preparation{},
+		budgets:     newFetchBudgets(config),
+		breakers:    map[string]*breaker{},
+		discovered:  map[string]bool{},
+		scopeKey:    newScopeKey(),
+		now:         time.Now,
+	}
+	if config.MaxConcurrentPrepares > 0 {
+		ma.prepareSlot = make(chan struct{}, config.MaxConcurrentPrepares)
 	}
 
 	go func() {
@@ -62,33 +135,14 @@ func NewManifests(ctx context.Context, blobHandler handler.BlobHandler, config C
 		for {
 			select {
 			case <-ticker.C:
+				if ma.config.ReadOnly {
+					// nothing would refill the cache
+					continue
+				}
 				if ma.config.Debug {
 					ma.log.Println("cleanup cycle")
 				}
-				ma.lock.Lock()
-				for _, m := range ma.manifests {
-					for k, v := range m {
-						if v.CreatedAt.Before(time.Now().Add(-ma.config.CacheTTL)) {
-							// delete
-							delete(m, k)
-							if delHandler, ok := ma.blobHandler.(handler.BlobDeleteHandler); ok {
-								for _, ref := range v.Refs {
-									h, err := v1.NewHash(ref)
-									if err != nil {
-										continue
-									}
-									if ma.config.Debug {
-										log.Printf("deleting blob %s", h.String())
-									}
-									if err = delHandler.Delete(ctx, "", h); err != nil {
-										log.Println(err)
-									}
-								}
-							}
-						}
-					}
-				}
-				ma.lock.Unlock()
+				ma.evictExpired(ctx)
 			case <-ctx.Done():
 				return
 			}
@@ -98,6 +152,186 @@ func NewManifests(ctx context.Context, blobHandler handler.BlobHandler, config C
 	return ma
 }
 
+// entryTTL returns the cache duration for a new entry, CacheTTL spread by up
+// to CacheTTLJitter so entries cached together don't expire together.
+func (m *Manifests) entryTTL() time.Duration {
+	if m.config.CacheTTLJitter <= 0 {
+		return m.config.CacheTTL
+	}
+	return m.config.CacheTTL + time.Duration(rand.Int63n(int64(m.config.CacheTTLJitter)))
+}
+
+// staleWindow is for how long past expiry entries may still be served.
+func (m *Manifests) staleWindow() time.Duration {
+	if m.config.StaleIfError > m.config.StaleWhileRevalidate {
+		return m.config.StaleIfError
+	}
+	return m.config.StaleWhileRevalidate
+}
+
+func (m *Manifests) expired(ma Manifest, now time.Time) bool {
+	ttl := ma.TTL
+	if ttl == 0 {
+		ttl = m.config.CacheTTL
+	}
+	if ttl < m.config.CacheTTLFloor {
+		// don't refetch in a loop because of a tiny TTL
+		ttl = m.config.CacheTTLFloor
+	}
+	return ma.CreatedAt.Add(ttl).Before(now)
+}
+
+// cache statuses of manifests, sent in the CacheStatusHeader
+const (
+	cacheHit         = "HIT"
+	cacheMiss        = "MISS"
+	cacheStale       = "STALE"
+	cacheRevalidated = "REVALIDATED"
+)
+
+// lookup returns the cached manifest, preparing it on a miss or once it
+// expired. Within StaleWhileRevalidate past expiry the cached manifest is
+// served and refreshed in the background, within StaleIfError it's served if
+// the upstream fails. ReadOnly proxies serve expired manifests as stale. Must
+// be called with the lock held.
+func (m *Manifests) lookup(ctx context.Context, repo string, target string) (Manifest, *errors.RegError) {
+	ma, _, err := m.lookupStatus(ctx, repo, target)
+	return ma, err
+}
+
+// lookupStatus is lookup also returning the cache status of the manifest.
+// Must be called with the lock held.
+func (m *Manifests) lookupStatus(ctx context.Context, repo string, target string) (Manifest, string, *errors.RegError) {
+	// entries fetched with the credentials of other clients are kept apart
+	key := scopedRepo(repo, m.cacheScope(ctx, repo))
+	if d, ok := m.cachedDigest(key, target); ok {
+		target = d
+	}
+	cached, ok := m.manifests[key][target]
+	if ok {
+		now := m.now()
+		if !m.expired(cached, now) || isDigest(target) {
+			// content addressed manifests don't change upstream
+			return cached, cacheHit, nil
+		}
+		if m.config.ReadOnly {
+			// nothing would refresh it
+			return cached, cacheStale, nil
+		}
+		if !m.expired(cached, now.Add(-m.config.StaleWhileRevalidate)) {
+			m.refreshInBackground(ctx, repo, target)
+			return cached, cacheStale, nil
+		}
+	}
+	revalidated, err := m.refresh(ctx, repo, target)
+	if err != nil {
+		if ok && err.Status >= http.StatusInternalServerError && !m.expired(cached, m.now().Add(-m.config.StaleIfError)) {
+			m.log.Printf("serving stale %s:%s: %v", repo, target, err)
+			return cached, cacheStale, nil
+		}
+		return Manifest{}, "", err
+	}
+	ma, ok := m.manifests[key][target]
+	if !ok {
+		// we failed
+		return Manifest{}, "", &errors.RegError{
+			Status:  http.StatusNotFound,
+			Code:    errors.CodeManifestUnknown,
+			Message: fmt.Sprintf("Chart prepare's result not found: %v, %v", repo, target),
+		}
+	}
+	if revalidated {
+		return ma, cacheRevalidated, nil
+	}
+	m.enforceVersionCap(ctx, key, digest.FromBytes(ma.Blob))
+	m.enforceQuota(ctx, key, digest.FromBytes(ma.Blob))
+	return ma, cacheMiss, nil
+}
+
+// refreshInBackground prepares repo:target again unless a refresh of the
+// entry of the same identity is already running, with the client credentials
+// of ctx.
+func (m *Manifests) refreshInBackground(ctx context.Context, repo string, target string) {
+	key := scopedRepo(repo, m.cacheScope(ctx, repo)) + ":" + target
+	if m.refreshing[key] {
+		return
+	}
+	m.refreshing[key] = true
+	bg := context.Background()
+	if auth, ok := ctx.Value(clientAuthKey{}).(string); ok {
+		bg = context.WithValue(bg, clientAuthKey{}, auth)
+	}
+	go func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		defer delete(m.refreshing, key)
+		if _, err := m.refresh(bg, repo, target); err != nil {
+			m.log.Printf("background refresh of %s failed: %v", key, err)
+		}
+	}()
+}
+
+// refresh extends the cached repo:target if the upstream confirms it's
+// unchanged, reporting it, preparing it again otherwise. Entries are cached
+// for the cacheScope of ctx. Must be called with the lock held, it's released
+// while asking the upstream.
+func (m *Manifests) refresh(ctx context.Context, repo string, target string) (bool, *errors.RegError) {
+	if m.draining.Load() {
+		return false, &errors.RegError{
+			Status:  http.StatusServiceUnavailable,
+			Code:    errors.CodeUnavailable,
+			Message: fmt.Sprintf("%s:%s is not cached and the proxy is draining", repo, target),
+		}
+	}
+	scope := m.cacheScope(ctx, repo)
+	key := scopedRepo(repo, scope)
+	if ma, ok := m.manifests[key][target]; ok {
+		var unchanged bool
+		m.unlocked(func() {
+			unchanged = m.revalidate(ctx, ma)
+		})
+		if unchanged {
+			now, ttl := m.now(), m.entryTTL()
+			for _, ref := range []string{target, digest.FromBytes(ma.Blob).String()} {
+				if e, ok := m.manifests[key][ref]; ok {
+					e.CreatedAt, e.TTL = now, ttl
+					_ = m.Write(key, ref, e)
+				}
+			}
+			return true, nil
+		}
+	}
+	if ma, ok := m.manifests[key][target]; ok && target != "latest" && m.immutable(repo) {
+		return m.refreshImmutable(ctx, repo, target, ma, scope)
+	}
+	return false, m.prepareChart(ctx, repo, target, scope)
+}
+
+func (m *Manifests) setCacheStatus(resp http.ResponseWriter, status string) {
+	if m.config.CacheStatusHeader != "" {
+		resp.Header().Set(m.config.CacheStatusHeader, status)
+	}
+}
+
+// staleWarning is sent with manifests served past their expiry.
+const staleWarning = `110 - "Response is Stale"`
+
+// setWarnings adds the Warning headers of ma served as repo:target, for
+// stale manifests and deprecated charts.
+func (m *Manifests) setWarnings(resp http.ResponseWriter, ma Manifest, repo string, target string) {
+	if !isDigest(target) && m.expired(ma, m.now()) {
+		resp.Header().Add("Warning", staleWarning)
+	}
+	if ma.Deprecated {
+		resp.Header().Add("Warning", fmt.Sprintf(`299 - "Chart %s:%s is deprecated"`, repo, target))
+	}
+}
+
+func isDigest(reference string) bool {
+	_, err := digest.Parse(reference)
+	return err == nil
+}
+
 // https://github.com/opencontainers/distribution-spec/blob/master/spec.md#pulling-an-image-manifest
 // https://github.com/opencontainers/distribution-spec/blob/master/spec.md#pushing-an-image
 func (m *Manifests) Handle(resp http.ResponseWriter, req *http.Request) error {
@@ -106,76 +340,58 @@ func (m *Manifests) Handle(resp http.ResponseWriter, req *http.Request) error {
 	if len(elem) < 3 {
 		return &errors.RegError{
 			Status:  http.StatusBadRequest,
-			Code:    "INVALID PARAMS",
+			Code:    errors.CodeNameInvalid,
 			Message: "No chart name specified",
 		}
 	}
 
-	elem = elem[1:]
-	target := elem[len(elem)-1]
+	repo, target := m.splitPath(req.URL.Path)
+	repo, oerr := m.resolveRepo(req, repo)
+	if oerr != nil {
+		return oerr
+	}
 	if target != "" && strings.HasPrefix(target, "v") {
 		target = target[1:]
 	}
-
-	var repoParts []string
-	for i := len(elem) - 3; i > 0; i-- {
-		if elem[i] == "v2" {
-			//enough
-			break
+	if req.Method == http.MethodPut {
+		return m.handlePush(resp, req, repo, target)
+	}
+	if target == "" && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    errors.CodeNameInvalid,
+			Message: fmt.Sprintf("No reference specified for %s, pull a version, a tag or a digest", repo),
 		}
-		repoParts = append(repoParts, elem[i])
 	}
-	sort.SliceStable(repoParts, func(i, j int) bool {
-		//reverse
-		return i > j
-	})
-	repo := strings.Join(repoParts, "/")
+	ctx := withClientAuth(req)
+	if target == "latest" {
+		if target, oerr = m.resolveVersion(ctx, repo, target); oerr != nil {
+			return oerr
+		}
+	}
+	if m.unlisted(repo, target) {
+		return m.unlistedError(repo, target)
+	}
 
 	switch req.Method {
 	case http.MethodGet:
 		m.lock.Lock()
 		defer m.lock.Unlock()
 
-		var prepared bool
-
-		c, ok := m.manifests[repo]
-		if !ok {
-			err := m.prepareChart(req.Context(), repo, target)
-			if err != nil {
-				return err
-			}
-			prepared = true
-			// re-find
-			c = m.manifests[repo]
-		}
-
-		ma, ok := c[target]
-		if !ok {
-			if !prepared {
-				err := m.prepareChart(req.Context(), repo, target)
-				if err != nil {
-					return err
-				}
-			}
-
-			ma, ok = c[target]
-			if !ok {
-				// we failed
-				return &errors.RegError{
-					Status:  http.StatusNotFound,
-					Code:    "NOT FOUND",
-					Message: fmt.Sprintf("Chart prepare's result not found: %v, %v", repo, target),
-				}
-			}
+		ma, status, err := m.lookupStatus(ctx, repo, target)
+		if err != nil {
+			return err
 		}
-		rd := sha256.Sum256(ma.Blob)
-		d := "sha256:" + hex.EncodeToString(rd[:])
-		resp.Header().Set("Docker-Content-Digest", d)
-		resp.Header().Set("Content-Type", ma.ContentType)
+		m.setCacheStatus(resp, status)
+		m.countPull(repo, target)
+		m.prefetchNext(repo, target)
+		m.countManifestBytes(repo, len(ma.Blob))
+		resp.Header().Set("Docker-Content-Digest", m.servedDigest(ma, target).String())
+		resp.Header().Set("Content-Type", m.servedContentType(m.contentType(ma), req.Header.Values("Accept")))
 		resp.Header().Set("Content-Length", fmt.Sprint(len(ma.Blob)))
+		m.setWarnings(resp, ma, repo, target)
 		resp.WriteHeader(http.StatusOK)
-		_, err := io.Copy(resp, bytes.NewReader(ma.Blob))
-		if err != nil {
+		if _, err := io.Copy(resp, bytes.NewReader(ma.Blob)); err != nil {
 			return errors.RegErrInternal(err)
 		}
 		return nil
@@ -183,41 +399,23 @@ func (m *Manifests) Handle(resp http.ResponseWriter, req *http.Request) error {
 	case http.MethodHead:
 		m.lock.Lock()
 		defer m.lock.Unlock()
-		if _, ok := m.manifests[repo]; !ok {
 
-			err := m.prepareChart(req.Context(), repo, target)
-			if err != nil {
-				return err
-			}
-		}
-		ma, ok := m.manifests[repo][target]
-		if !ok {
-			err := m.prepareChart(req.Context(), repo, target)
-			if err != nil {
-				return err
-			}
-			ma, ok = m.manifests[repo][target]
-			if !ok {
-				// we failed
-				return &errors.RegError{
-					Status:  http.StatusNotFound,
-					Code:    "NOT FOUND",
-					Message: "Chart prepare error",
-				}
-			}
+		ma, status, err := m.lookupStatus(ctx, repo, target)
+		if err != nil {
+			return err
 		}
-		rd := sha256.Sum256(ma.Blob)
-		d := "sha256:" + hex.EncodeToString(rd[:])
-		resp.Header().Set("Docker-Content-Digest", d)
-		resp.Header().Set("Content-Type", ma.ContentType)
+		m.setCacheStatus(resp, status)
+		resp.Header().Set("Docker-Content-Digest", m.servedDigest(ma, target).String())
+		resp.Header().Set("Content-Type", m.servedContentType(m.contentType(ma), req.Header.Values("Accept")))
 		resp.Header().Set("Content-Length", fmt.Sprint(len(ma.Blob)))
+		m.setWarnings(resp, ma, repo, target)
 		resp.WriteHeader(http.StatusOK)
 		return nil
 
 	default:
 		return &errors.RegError{
 			Status:  http.StatusBadRequest,
-			Code:    "METHOD_UNKNOWN",
+			Code:    errors.CodeUnsupported,
 			Message: "We don't understand your method + url",
 		}
 	}
@@ -228,87 +426,101 @@ func (m *Manifests) HandleTags(resp http.ResponseWriter, req *http.Request) erro
 	if len(elem) < 4 {
 		return &errors.RegError{
 			Status:  http.StatusBadRequest,
-			Code:    "INVALID PARAMS",
+			Code:    errors.CodeNameInvalid,
 			Message: "No chart name specified",
 		}
 	}
-	var repoParts []string
-	for i := len(elem) - 3; i > 0; i-- {
-		if elem[i] == "v2" {
-			//stop
-			break
-		}
-		repoParts = append(repoParts, elem[i])
-	}
-	sort.SliceStable(repoParts, func(i, j int) bool {
-		//reverse
-		return i > j
-	})
-	fullRepo := strings.Join(repoParts, "/")
-
-	if req.Method != "GET" {
+	fullRepo, _ := m.splitPath(req.URL.Path)
+	ctx := withClientAuth(req)
+	sep := strings.LastIndex(fullRepo, "/")
+	if sep < 0 {
 		return &errors.RegError{
 			Status:  http.StatusBadRequest,
-			Code:    "METHOD_UNKNOWN",
-			Message: "We don't understand your method + url",
+			Code:    errors.CodeNameInvalid,
+			Message: "No chart name specified",
 		}
 	}
+	fullRepo, oerr := m.resolveRepo(req, fullRepo)
+	if oerr != nil {
+		return oerr
+	}
+	sep = strings.LastIndex(fullRepo, "/")
+
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	c, ok := m.manifests[fullRepo]
+	key := scopedRepo(fullRepo, m.cacheScope(ctx, fullRepo))
+	c, ok := m.manifests[key]
 	if !ok {
-		err := m.prepareChart(req.Context(), fullRepo, "")
+		_, err := m.refresh(ctx, fullRepo, "")
 		if err != nil {
 			return err
 		}
-		c, _ = m.manifests[fullRepo]
+		c, _ = m.manifests[key]
 	}
 
-	repoPath := strings.Join(repoParts[:len(repoParts)-1], "/")
+	repoPath, chartName := fullRepo[:sep], fullRepo[sep+1:]
 	var tags []string
 
-	index, _ := m.GetIndex(repoPath)
+	var index *repo.IndexFile
+	m.unlocked(func() {
+		index, _ = m.chartIndex(ctx, repoPath, chartName)
+	})
+	c = m.manifests[key]
 
 	if index != nil {
-		if versions, ok := index.Entries[repoParts[len(repoParts)-1]]; ok {
+		if versions, ok := index.Entries[chartName]; ok {
 			for _, v := range versions {
-				tags = append(tags, strings.TrimLeft(v.Version, "v"))
+				tags = append(tags, m.clientTag(v.Version))
 			}
 		}
 	} else {
 		for tag := range c {
-			if !strings.Contains(tag, "sha256:") {
+			if !isDigest(tag) {
 				tags = append(tags, tag)
 			}
 		}
 	}
+	listed := tags[:0]
+	for _, tag := range tags {
+		if !m.unlisted(fullRepo, tag) {
+			listed = append(listed, tag)
+		}
+	}
+	tags = listed
 	sort.Strings(tags)
 
 	// https://github.com/opencontainers/distribution-spec/blob/b505e9cc53ec499edbd9c1be32298388921bb705/detail.md#tags-paginated
-	// Offset using last query parameter.
-	if last := req.URL.Query().Get("last"); last != "" {
-		for i, t := range tags {
-			if t > last {
-				tags = tags[i:]
-				break
+	n, ns := m.config.TagsPageSize, req.URL.Query().Get("n")
+	if ns != "" {
+		var err error
+		if n, err = strconv.Atoi(ns); err != nil || n < 0 {
+			return &errors.RegError{
+				Status:  http.StatusBadRequest,
+				Code:    errors.CodeUnsupported,
+				Message: fmt.Sprintf("parsing n: %v", ns),
 			}
 		}
 	}
+	if m.config.TagsMaxPageSize > 0 && (n == 0 && ns == "" || n > m.config.TagsMaxPageSize) {
+		n = m.config.TagsMaxPageSize
+	}
 
-	// Limit using n query parameter.
-	if ns := req.URL.Query().Get("n"); ns != "" {
-		if n, err := strconv.Atoi(ns); err != nil {
-			return &errors.RegError{
-				Status:  http.StatusBadRequest,
-				Code:    "BAD_REQUEST",
-				Message: fmt.Sprintf("parsing n: %v", err),
-			}
-		} else if n < len(tags) {
-			tags = tags[:n]
+	if n == 0 && ns != "" {
+		// an explicit n=0 asks for an empty page
+		tags = nil
+	} else {
+		var more bool
+		tags, more = paginate(tags, req.URL.Query().Get("last"), n)
+		if more {
+			setNextLink(resp, req, n, tags[len(tags)-1])
 		}
 	}
 
+	if tags == nil {
+		// repositories without tags list an empty array, not null
+		tags = []string{}
+	}
 	tagsToList := listTags{
 		Name: fullRepo,
 		Tags: tags,
@@ -324,6 +536,66 @@ func (m *Manifests) HandleTags(resp http.ResponseWriter, req *http.Request) erro
 	return nil
 }
 
+// splitPath returns the canonical repository and the trailing reference of a
+// /v2/<repo>/<kind>/<reference> path. Empty segments from duplicate or
+// trailing slashes are dropped, so equivalent paths share one cache entry.
+func (m *Manifests) splitPath(p string) (string, string) {
+	elem := strings.Split(p, "/")
+	if len(elem) < 3 {
+		return "", ""
+	}
+	var repoParts []string
+	for i := len(elem) - 3; i > 0; i-- {
+		if elem[i] == "v2" {
+			//enough
+			break
+		}
+		if elem[i] == "" {
+			continue
+		}
+		repoParts = append([]string{elem[i]}, repoParts...)
+	}
+	return m.canonicalRepo(strings.Join(repoParts, "/")), elem[len(elem)-1]
+}
+
+// canonicalRepo lowercases the host part of repo, or all of it when
+// LowercaseRepos is set.
+func (m *Manifests) canonicalRepo(repo string) string {
+	if m.config.LowercaseRepos {
+		return strings.ToLower(repo)
+	}
+	host, rest, found := strings.Cut(repo, "/")
+	if !found {
+		return strings.ToLower(host)
+	}
+	return strings.ToLower(host) + "/" + rest
+}
+
+// paginate returns up to n of the sorted items following last, reporting
+// whether any were left out. n == 0 means no limit.
+func paginate(items []string, last string, n int) ([]string, bool) {
+	if last != "" {
+		i := sort.SearchStrings(items, last)
+		if i < len(items) && items[i] == last {
+			i++
+		}
+		items = items[i:]
+	}
+	if n > 0 && n < len(items) {
+		return items[:n], true
+	}
+	return items, false
+}
+
+// setNextLink adds the RFC5988 Link header pointing to the next page.
+func setNextLink(resp http.ResponseWriter, req *http.Request, n int, last string) {
+	q := url.Values{}
+	q.Set("n", strconv.Itoa(n))
+	q.Set("last", last)
+	resp.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", req.URL.Path, q.Encode()))
+}
+
+// Read returns the manifest repo:name. Must be called with the lock held.
 func (m *Manifests) Read(repo string, name string) (Manifest, error) {
 
 	mRepo, ok := m.manifests[repo]
@@ -337,6 +609,9 @@ func (m *Manifests) Read(repo string, name string) (Manifest, error) {
 	return ma, nil
 }
 
+// Write stores n as repo:name, creating the map of repo on its first write
+// so tags of the same repo written one after another are all kept. Must be
+// called with the lock held.
 func (m *Manifests) Write(repo string, name string, n Manifest) error {
 
 	mRepo, ok := m.manifests[repo]
@@ -345,9 +620,72 @@ func (m *Manifests) Write(repo string, name string, n Manifest) error {
 		m.manifests[repo] = mRepo
 	}
 	mRepo[name] = n
+	m.indexManifest(repo, name, n)
 	return nil
 }
 
+// indexManifest records the media types of the blobs n refers to and, if it
+// has a subject, n as one of its referrers. Must be called with the lock held.
+func (m *Manifests) indexManifest(repo string, name string, n Manifest) {
+	if n.ContentType == ocispec.MediaTypeImageManifest || n.ContentType == MediaTypeManifest {
+		var om ocispec.Manifest
+		if err := json.Unmarshal(n.Blob, &om); err == nil {
+			for _, desc := range append([]ocispec.Descriptor{om.Config}, om.Layers...) {
+				if desc.Digest != "" && desc.MediaType != "" {
+					m.blobLock.Lock()
+					m.mediaTypes[desc.Digest.String()] = desc.MediaType
+					m.blobLock.Unlock()
+				}
+			}
+			m.indexChunks(om)
+		}
+	}
+	if !isDigest(name) {
+		// tags point to manifests also stored by digest
+		return
+	}
+	var rm referrerManifest
+	if err := json.Unmarshal(n.Blob, &rm); err != nil || rm.Subject == nil {
+		return
+	}
+	key := repo + "@" + rm.Subject.Digest.String()
+	if m.referrers[key] == nil {
+		m.referrers[key] = map[string]bool{}
+	}
+	m.referrers[key][name] = true
+}
+
+// contentType is the media type ma is served with, FallbackContentType if
+// none was stored with it.
+func (m *Manifests) contentType(ma Manifest) string {
+	if ma.ContentType != "" {
+		return ma.ContentType
+	}
+	if m.config.FallbackContentType != "" {
+		return m.config.FallbackContentType
+	}
+	return ocispec.MediaTypeImageManifest
+}
+
+// BlobMediaType returns the media type the blob d is referenced with by
+// the manifests written so far, or "" if none refers to it.
+func (m *Manifests) BlobMediaType(d string) string {
+	m.blobLock.RLock()
+	defer m.blobLock.RUnlock()
+	return m.mediaTypes[d]
+}
+
+// forgetBlobs drops what's known about the blobs of digests once no manifest
+// refers to them any more.
+func (m *Manifests) forgetBlobs(digests []string) {
+	m.blobLock.Lock()
+	defer m.blobLock.Unlock()
+	for _, d := range digests {
+		delete(m.mediaTypes, d)
+		delete(m.chunks, d)
+	}
+}
+
 func (m *Manifests) HandleCatalog(resp http.ResponseWriter, req *http.Request) error {
 	query := req.URL.Query()
 	nStr := query.Get("n")
@@ -363,47 +701,31 @@ func (m *Manifests) HandleCatalog(resp http.ResponseWriter, req *http.Request) e
 	elems := strings.Split(req.URL.Path, "/")
 	elems = elems[1:]
 
-	if req.Method != "GET" {
-		return &errors.RegError{
-			Status:  http.StatusBadRequest,
-			Code:    "METHOD_UNKNOWN",
-			Message: "We don't understand your method + url",
-		}
-	}
-
+	ctx := withClientAuth(req)
 	var repos []string
-	countRepos := 0
 
-	if len(elems) > 2 {
+	if len(elems) > 2 && m.config.CatalogNamespaces {
+		repos = m.namespaceRepos(ctx, strings.Join(elems[1:len(elems)-1], "/"))
+	} else if len(elems) > 2 {
 		// we have repo
 		repo := strings.Join(elems[0:len(elems)-2], "/")
-		index, _ := m.GetIndex(repo)
+		index, _ := m.GetIndex(ctx, repo)
 		if index != nil {
 			// show index's content instead of local
 			for r := range index.Entries {
-				if countRepos >= n {
-					break
-				}
-				countRepos++
 				repos = append(repos, fmt.Sprintf("%s/%s", repo, r))
 			}
 		}
 
+		sort.Strings(repos)
 	} else {
-		m.lock.Lock()
-		defer m.lock.Unlock()
-
 		// TODO: implement pagination
-		for key := range m.manifests {
-			if countRepos >= n {
-				break
-			}
-			countRepos++
-			repos = append(repos, key)
-		}
+		repos = m.catalogRepos(ctx)
 	}
 
-	sort.Strings(repos)
+	if len(repos) > n {
+		repos = repos[:n]
+	}
 	repositoriesToList := Catalog{
 		Repos: repos,
 	}
@@ -417,3 +739,25 @@ func (m *Manifests) HandleCatalog(resp http.ResponseWriter, req *http.Request) e
 	}
 	return nil
 }
+
+// providerRepos returns the charts of the Providers upstreams if
+// CatalogProviders is set, so the catalog isn't limited to cached repos.
+// Upstreams failing to serve their index are skipped.
+func (m *Manifests) providerRepos(ctx context.Context) map[string]bool {
+	res := map[string]bool{}
+	if !m.config.CatalogProviders {
+		return res
+	}
+	for provider, upstream := range m.config.Providers {
+		upstream = strings.Trim(upstream, "/")
+		index, err := m.GetIndex(ctx, upstream)
+		if err != nil {
+			m.log.Printf("catalog: provider %s: %v", provider, err)
+			continue
+		}
+		for name := range index.Entries {
+			res[m.canonicalRepo(upstream+"/"+name)] = true
+		}
+	}
+	return res
+}
@@ -0,0 +1,889 @@
+package manifest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	cerrors "errors"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler/mem"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCache is a synchronous Cache, ristretto applies sets asynchronously.
+type testCache struct {
+	lock sync.Mutex
+	m    map[interface{}]testCacheItem
+}
+
+type testCacheItem struct {
+	value   interface{}
+	expires time.Time
+}
+
+func (c *testCache) SetWithTTL(key, value interface{}, _ int64, ttl time.Duration) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.m == nil {
+		c.m = map[interface{}]testCacheItem{}
+	}
+	item := testCacheItem{value: value}
+	if ttl > 0 {
+		item.expires = time.Now().Add(ttl)
+	}
+	c.m[key] = item
+	return true
+}
+
+func (c *testCache) Get(key interface{}) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	item, ok := c.m[key]
+	if !ok || (!item.expires.IsZero() && time.Now().After(item.expires)) {
+		return nil, false
+	}
+	return item.value, true
+}
+
+// testChart is a chart version served by a testUpstream.
+type testChart struct {
+	name       string
+	version    string
+	files      map[string]string // extra files besides Chart.yaml
+	created    time.Time         // index entry creation time, omitted if zero
+	url        string            // archive URL in the index, {host} is the upstream's, <name>-<version>.tgz if empty
+	deprecated bool              // marked deprecated in Chart.yaml and the index
+	index      string            // extra YAML fields of the index entry, indented by four spaces
+	prov       string            // provenance file served next to the archive, none if empty
+}
+
+// chartTgz packs a minimal chart archive.
+func chartTgz(t *testing.T, c testChart) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	files := map[string]string{
+		"Chart.yaml": fmt.Sprintf("apiVersion: v2\nname: %s\nversion: %s\n", c.name, c.version),
+	}
+	if c.deprecated {
+		files["Chart.yaml"] += "deprecated: true\n"
+	}
+	for k, v := range c.files {
+		files[k] = v
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	// same files, same archive
+	sort.Strings(names)
+	for _, name := range names {
+		content := files[name]
+		if err := tw.WriteHeader(&tar.Header{
+			Name: c.name + "/" + name,
+			Mode: 0644,
+			Size: int64(len(content)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testUpstream is a chart repository served over TLS.
+type testUpstream struct {
+	*httptest.Server
+	indexRequests   int32
+	tarballRequests int32
+	headRequests    int32
+	authorization   atomic.Value // last Authorization header received
+	conns           sync.Map     // remote addresses of the clients
+	onIndex         func()       // called before serving index.yaml
+	onTarball       func()       // called before serving a chart archive
+	etags           bool         // serve chart archives with ETags, honoring If-None-Match
+	doubleGzip      bool         // gzip chart archives again with Content-Encoding: gzip
+}
+
+func (u *testUpstream) host() string {
+	return u.Listener.Addr().String()
+}
+
+func newTestUpstream(t *testing.T, charts ...testChart) *testUpstream {
+	t.Helper()
+	return startTestUpstream(t, true, charts...)
+}
+
+// startTestUpstream serves charts over HTTPS if useTLS is set, plain HTTP
+// otherwise.
+func startTestUpstream(t *testing.T, useTLS bool, charts ...testChart) *testUpstream {
+	t.Helper()
+	u := &testUpstream{}
+	tarballs := map[string][]byte{}
+
+	var index strings.Builder
+	index.WriteString("apiVersion: v1\nentries:\n")
+	byName := map[string][]testChart{}
+	for _, c := range charts {
+		byName[c.name] = append(byName[c.name], c)
+	}
+	for name, versions := range byName {
+		fmt.Fprintf(&index, "  %s:\n", name)
+		for _, c := range versions {
+			file := fmt.Sprintf("%s-%s.tgz", c.name, c.version)
+			if c.url != "" {
+				file = c.url
+			}
+			pu, err := url.Parse(strings.ReplaceAll(file, "{host}", "upstream"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tarballs["/"+strings.TrimPrefix(pu.Path, "/")] = chartTgz(t, c)
+			if c.prov != "" {
+				tarballs["/"+strings.TrimPrefix(pu.Path, "/")+".prov"] = []byte(c.prov)
+			}
+			fmt.Fprintf(&index, "  - apiVersion: v2\n    name: %s\n    version: %s\n    urls:\n    - %s\n", c.name, c.version, file)
+			if c.deprecated {
+				index.WriteString("    deprecated: true\n")
+			}
+			if !c.created.IsZero() {
+				fmt.Fprintf(&index, "    created: %s\n", c.created.Format(time.RFC3339))
+			}
+			index.WriteString(c.index)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/index.yaml", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&u.indexRequests, 1)
+		if u.onIndex != nil {
+			u.onIndex()
+		}
+		_, _ = io.WriteString(w, strings.ReplaceAll(index.String(), "{host}", r.Host))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		data, ok := tarballs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodHead {
+			atomic.AddInt32(&u.headRequests, 1)
+		}
+		if u.etags {
+			etag := fmt.Sprintf(`"%x"`, sha256.Sum256(data))
+			w.Header().Set("ETag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		if r.Method == http.MethodHead {
+			return
+		}
+		if u.onTarball != nil {
+			u.onTarball()
+		}
+		atomic.AddInt32(&u.tarballRequests, 1)
+		if u.doubleGzip {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			_, _ = gz.Write(data)
+			_ = gz.Close()
+			return
+		}
+		_, _ = w.Write(data)
+	})
+	u.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.authorization.Store(r.Header.Get("Authorization"))
+		u.conns.Store(r.RemoteAddr, true)
+		mux.ServeHTTP(w, r)
+	}))
+	if useTLS {
+		u.StartTLS()
+	} else {
+		u.Start()
+	}
+	t.Cleanup(u.Close)
+	return u
+}
+
+// testClock is a manually advanced clock.
+type testClock struct {
+	lock sync.Mutex
+	t    time.Time
+}
+
+func (c *testClock) now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// eventually polls cond for up to a few seconds.
+func eventually(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatal(msg)
+}
+
+func newTestManifests(t *testing.T, u *testUpstream, config Config) *Manifests {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if config.CacheTTL == 0 {
+		config.CacheTTL = time.Minute
+	}
+	if config.IndexCacheTTL == 0 {
+		config.IndexCacheTTL = time.Hour
+	}
+	m := NewManifests(ctx, mem.NewMemHandler(), config, &testCache{}, log.New(io.Discard, "", 0))
+	if u != nil {
+		m.client = u.Client()
+	}
+	return m
+}
+
+func get(t *testing.T, h func(http.ResponseWriter, *http.Request) error, method, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, nil)
+	if err := h(rec, req); err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return rec
+}
+
+func TestIndexSharedAcrossCharts(t *testing.T) {
+	u := newTestUpstream(t,
+		testChart{name: "foo", version: "1.0.0"},
+		testChart{name: "bar", version: "2.0.0"},
+	)
+	m := newTestManifests(t, u, Config{})
+
+	get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0")
+	get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/bar/manifests/2.0.0")
+
+	if n := atomic.LoadInt32(&u.indexRequests); n != 1 {
+		t.Errorf("index fetched %d times; want 1", n)
+	}
+}
+
+func TestIndexCacheTTL(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	m := newTestManifests(t, u, Config{})
+	clock := &testClock{t: time.Now()}
+	m.now = clock.now
+	tags := "/v2/" + u.host() + "/foo/tags/list"
+
+	get(t, m.HandleTags, http.MethodGet, tags)
+	clock.advance(30 * time.Minute)
+	get(t, m.HandleTags, http.MethodGet, tags)
+	if n := atomic.LoadInt32(&u.indexRequests); n != 1 {
+		t.Errorf("index fetched %d times within IndexCacheTTL; want 1", n)
+	}
+	clock.advance(time.Hour)
+	get(t, m.HandleTags, http.MethodGet, tags)
+	if n := atomic.LoadInt32(&u.indexRequests); n != 2 {
+		t.Errorf("index fetched %d times past IndexCacheTTL; want 2", n)
+	}
+}
+
+func TestConcurrentPrepareSameRepo(t *testing.T) {
+	var charts []testChart
+	for i := 0; i < 8; i++ {
+		charts = append(charts, testChart{name: "foo", version: fmt.Sprintf("1.0.%d", i)})
+	}
+	u := newTestUpstream(t, charts...)
+	m := newTestManifests(t, u, Config{})
+
+	var wg sync.WaitGroup
+	request := func(h func(http.ResponseWriter, *http.Request) error, path string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil)); err != nil {
+				t.Errorf("GET %s: %v", path, err)
+			}
+		}()
+	}
+	for _, c := range charts {
+		request(m.Handle, "/v2/"+u.host()+"/foo/manifests/"+c.version)
+		request(m.HandleTags, "/v2/"+u.host()+"/foo/tags/list")
+	}
+	wg.Wait()
+
+	for _, c := range charts {
+		if _, err := m.Read(u.host()+"/foo", c.version); err != nil {
+			t.Errorf("%s: %v", c.version, err)
+		}
+	}
+}
+
+func TestCatalogSnapshot(t *testing.T) {
+	m := newTestManifests(t, nil, Config{CatalogCacheTTL: time.Minute})
+	clock := &testClock{t: time.Now()}
+	m.now = clock.now
+	write := func(repo string) {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		_ = m.Write(repo, "1.0.0", Manifest{Blob: []byte("{}"), CreatedAt: clock.now(), TTL: time.Hour})
+	}
+	catalog := func() []string {
+		var c Catalog
+		if err := json.Unmarshal(get(t, m.HandleCatalog, http.MethodGet, "/v2/_catalog").Body.Bytes(), &c); err != nil {
+			t.Fatal(err)
+		}
+		return c.Repos
+	}
+
+	write("example.com/foo")
+	if got := catalog(); !reflect.DeepEqual(got, []string{"example.com/foo"}) {
+		t.Fatalf("catalog = %v; want [example.com/foo]", got)
+	}
+	write("example.com/bar")
+	clock.advance(30 * time.Second)
+	if got := catalog(); !reflect.DeepEqual(got, []string{"example.com/foo"}) {
+		t.Errorf("catalog within the TTL = %v; want the snapshot [example.com/foo]", got)
+	}
+
+	clock.advance(time.Minute)
+	want := []string{"example.com/bar", "example.com/foo"}
+	eventually(t, func() bool { return reflect.DeepEqual(catalog(), want) }, "example.com/bar not listed after the TTL")
+}
+
+func TestCatalogNamespaces(t *testing.T) {
+	m := newTestManifests(t, nil, Config{
+		ReadOnly:          true,
+		CatalogNamespaces: true,
+		Providers:         map[string]string{"team-a": "charts.example.com/team-a"},
+	})
+	m.lock.Lock()
+	for _, repo := range []string{"charts.example.com/team-a/foo", "charts.example.com/team-a/bar", "charts.example.com/team-b/foo", "other.example.com/foo"} {
+		_ = m.Write(repo, "1.0.0", Manifest{Blob: []byte("{}"), CreatedAt: time.Now(), TTL: time.Hour})
+	}
+	m.lock.Unlock()
+
+	for path, want := range map[string][]string{
+		"/v2/team-a/_catalog":                    {"team-a/bar", "team-a/foo"},
+		"/v2/charts.example.com/team-b/_catalog": {"charts.example.com/team-b/foo"},
+		"/v2/charts.example.com/_catalog":        {"charts.example.com/team-a/bar", "charts.example.com/team-a/foo", "charts.example.com/team-b/foo"},
+		"/v2/Charts.Example.com/team-a/_catalog": {"charts.example.com/team-a/bar", "charts.example.com/team-a/foo"},
+		"/v2/charts.example.com/team-c/_catalog": nil,
+		"/v2/_catalog":                           {"charts.example.com/team-a/bar", "charts.example.com/team-a/foo", "charts.example.com/team-b/foo", "other.example.com/foo"},
+	} {
+		var c Catalog
+		if err := json.Unmarshal(get(t, m.HandleCatalog, http.MethodGet, path).Body.Bytes(), &c); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.Repos, want) {
+			t.Errorf("%s = %v; want %v", path, c.Repos, want)
+		}
+	}
+	var c Catalog
+	if err := json.Unmarshal(get(t, m.HandleCatalog, http.MethodGet, "/v2/unknown/_catalog").Body.Bytes(), &c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Repos) != 0 {
+		t.Errorf("catalog of an unknown host = %v; want none", c.Repos)
+	}
+}
+
+func TestConcurrentCatalog(t *testing.T) {
+	var charts []testChart
+	for i := 0; i < 8; i++ {
+		charts = append(charts, testChart{name: fmt.Sprintf("chart%d", i), version: "1.0.0"})
+	}
+	u := newTestUpstream(t, charts...)
+	m := newTestManifests(t, u, Config{})
+	m.lock.Lock()
+	for i := 0; i < 5000; i++ {
+		_ = m.Write(fmt.Sprintf("example.com/cached%04d", i), "1.0.0", Manifest{Blob: []byte("{}"), CreatedAt: time.Now(), TTL: time.Hour})
+	}
+	m.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, c := range charts {
+		c := c
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/"+c.name+"/manifests/1.0.0")
+		}()
+		go func() {
+			defer wg.Done()
+			var catalog Catalog
+			if err := json.Unmarshal(get(t, m.HandleCatalog, http.MethodGet, "/v2/_catalog?n=100").Body.Bytes(), &catalog); err != nil {
+				t.Error(err)
+				return
+			}
+			if len(catalog.Repos) != 100 || !sort.StringsAreSorted(catalog.Repos) {
+				t.Errorf("catalog of %d repos, sorted %v; want the first 100", len(catalog.Repos), sort.StringsAreSorted(catalog.Repos))
+			}
+		}()
+	}
+	wg.Wait()
+
+	var catalog Catalog
+	if err := json.Unmarshal(get(t, m.HandleCatalog, http.MethodGet, "/v2/_catalog?n=10").Body.Bytes(), &catalog); err != nil {
+		t.Fatal(err)
+	}
+	// the upstream's host sorts before example.com
+	for i, c := range charts {
+		if want := u.host() + "/" + c.name; catalog.Repos[i] != want {
+			t.Errorf("repos[%d] = %s; want %s", i, catalog.Repos[i], want)
+		}
+	}
+	if catalog.Repos[8] != "example.com/cached0000" || catalog.Repos[9] != "example.com/cached0001" {
+		t.Errorf("repos = %v; want the cached ones after the pulled charts", catalog.Repos)
+	}
+}
+
+func TestTagsDefaultPageSize(t *testing.T) {
+	var charts []testChart
+	for i := 0; i < 25; i++ {
+		charts = append(charts, testChart{name: "foo", version: fmt.Sprintf("1.%02d.0", i)})
+	}
+	u := newTestUpstream(t, charts...)
+	m := newTestManifests(t, u, Config{TagsPageSize: 10, TagsMaxPageSize: 20})
+
+	path := "/v2/" + u.host() + "/foo/tags/list"
+	var seen []string
+	for page := 0; path != ""; page++ {
+		rec := get(t, m.HandleTags, http.MethodGet, path)
+		var tl listTags
+		if err := json.Unmarshal(rec.Body.Bytes(), &tl); err != nil {
+			t.Fatal(err)
+		}
+		if page < 2 && len(tl.Tags) != 10 {
+			t.Fatalf("page %d has %d tags; want 10", page, len(tl.Tags))
+		}
+		seen = append(seen, tl.Tags...)
+
+		path = ""
+		if link := rec.Header().Get("Link"); link != "" {
+			path = strings.TrimPrefix(strings.Split(link, ">")[0], "<")
+		}
+	}
+	if len(seen) != 25 || seen[0] != "1.00.0" || seen[24] != "1.24.0" {
+		t.Errorf("paged through %v; want all 25 tags", seen)
+	}
+
+	rec := get(t, m.HandleTags, http.MethodGet, "/v2/"+u.host()+"/foo/tags/list?n=100")
+	var tl listTags
+	if err := json.Unmarshal(rec.Body.Bytes(), &tl); err != nil {
+		t.Fatal(err)
+	}
+	if len(tl.Tags) != 20 {
+		t.Errorf("n=100 returned %d tags; want max page size 20", len(tl.Tags))
+	}
+
+	rec = get(t, m.HandleTags, http.MethodGet, "/v2/"+u.host()+"/foo/tags/list?n=0")
+	if err := json.Unmarshal(rec.Body.Bytes(), &tl); err != nil {
+		t.Fatal(err)
+	}
+	if len(tl.Tags) != 0 || tl.Tags == nil || rec.Header().Get("Link") != "" {
+		t.Errorf("n=0 returned %v, link %q; want an empty page", tl.Tags, rec.Header().Get("Link"))
+	}
+
+	m = newTestManifests(t, u, Config{})
+	if err := json.Unmarshal(get(t, m.HandleTags, http.MethodGet, "/v2/"+u.host()+"/foo/tags/list").Body.Bytes(), &tl); err != nil {
+		t.Fatal(err)
+	}
+	if len(tl.Tags) != 25 {
+		t.Errorf("got %d tags without page size; want all 25", len(tl.Tags))
+	}
+}
+
+func TestTagsEmpty(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	m := newTestManifests(t, u, Config{Yanked: []string{u.host() + "/foo:*"}})
+
+	for _, path := range []string{
+		"/v2/" + u.host() + "/foo/tags/list",
+		"/v2/" + u.host() + "/foo/tags/list?last=1.0.0",
+	} {
+		rec := get(t, m.HandleTags, http.MethodGet, path)
+		if want := `{"name":"` + u.host() + `/foo","tags":[]}`; rec.Body.String() != want {
+			t.Errorf("%s = %s; want %s", path, rec.Body.String(), want)
+		}
+	}
+
+	// only pulled by digest
+	r := newTestRegistry(t)
+	desc := r.addChart(t, "1.0.0", "1.0.0")
+	om := newOCITestManifests(t, r, Config{})
+	repo := r.host() + "/charts/foo"
+	get(t, om.Handle, http.MethodGet, "/v2/"+repo+"/manifests/"+desc.Digest.String())
+	if rec, want := get(t, om.HandleTags, http.MethodGet, "/v2/"+repo+"/tags/list"), `{"name":"`+repo+`","tags":[]}`; rec.Body.String() != want {
+		t.Errorf("tags of %s = %s; want %s", repo, rec.Body.String(), want)
+	}
+}
+
+// handleErr runs h expecting it to fail with a registry error.
+func handleErr(t *testing.T, h func(http.ResponseWriter, *http.Request) error, method, path string) *errors.RegError {
+	t.Helper()
+	err := h(httptest.NewRecorder(), httptest.NewRequest(method, path, nil))
+	var regErr *errors.RegError
+	if !cerrors.As(err, &regErr) {
+		t.Fatalf("%s %s: got %v; want a registry error", method, path, err)
+	}
+	return regErr
+}
+
+func TestCanonicalRepoPaths(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "chart", version: "1.0.0"})
+	m := newTestManifests(t, u, Config{LowercaseRepos: true})
+
+	for _, repo := range []string{u.host() + "/Chart/", u.host() + "//chart", u.host() + "/chart"} {
+		path := "/v2/" + repo + "/manifests/1.0.0"
+		if got, _ := m.splitPath(path); got != u.host()+"/chart" {
+			t.Errorf("splitPath(%q) = %q; want %q", path, got, u.host()+"/chart")
+		}
+		get(t, m.Handle, http.MethodGet, path)
+	}
+	if len(m.manifests) != 1 {
+		t.Errorf("cached %d repos; want 1", len(m.manifests))
+	}
+	if n := atomic.LoadInt32(&u.tarballRequests); n != 1 {
+		t.Errorf("chart downloaded %d times; want 1", n)
+	}
+
+	m = newTestManifests(t, u, Config{})
+	if got, _ := m.splitPath("/v2/Example.COM/Chart/manifests/1.0.0"); got != "example.com/Chart" {
+		t.Errorf("host only canonicalization gave %q; want example.com/Chart", got)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	u := newTestUpstream(t,
+		testChart{name: "foo", version: "1.0.0"},
+		testChart{name: "bar", version: "1.0.0"},
+	)
+	m := newTestManifests(t, u, Config{CacheStatusHeader: "X-Cache"})
+	clock := &testClock{t: time.Now()}
+	m.now = clock.now
+	get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0")
+
+	m.config.ReadOnly = true
+	atomic.StoreInt32(&u.indexRequests, 0)
+	atomic.StoreInt32(&u.tarballRequests, 0)
+	m.cache = &testCache{}
+
+	if rec := get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0"); rec.Code != http.StatusOK {
+		t.Errorf("cached chart status = %d; want 200", rec.Code)
+	}
+	if regErr := handleErr(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/bar/manifests/1.0.0"); regErr.Status != http.StatusNotFound {
+		t.Errorf("uncached chart status = %d; want 404", regErr.Status)
+	}
+	// past the CacheTTL nothing would refill the cache, the entry is kept
+	clock.advance(2 * time.Minute)
+	if status := get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0").Header().Get("X-Cache"); status != cacheStale {
+		t.Errorf("expired chart cache status = %s; want %s", status, cacheStale)
+	}
+	if n := atomic.LoadInt32(&u.indexRequests) + atomic.LoadInt32(&u.tarballRequests); n != 0 {
+		t.Errorf("read-only mode made %d upstream requests; want 0", n)
+	}
+}
+
+func TestCacheTTLJitter(t *testing.T) {
+	var charts []testChart
+	for i := 0; i < 10; i++ {
+		charts = append(charts, testChart{name: fmt.Sprintf("chart%d", i), version: "1.0.0"})
+	}
+	u := newTestUpstream(t, charts...)
+	m := newTestManifests(t, u, Config{CacheTTL: time.Hour, CacheTTLJitter: 10 * time.Minute})
+	for _, c := range charts {
+		get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/"+c.name+"/manifests/1.0.0")
+	}
+
+	expiries := map[time.Duration]bool{}
+	for repo, refs := range m.manifests {
+		ma := refs["1.0.0"]
+		if ma.TTL < time.Hour || ma.TTL >= time.Hour+10*time.Minute {
+			t.Errorf("%s: TTL %s outside of the jitter window", repo, ma.TTL)
+		}
+		if m.expired(ma, ma.CreatedAt.Add(time.Hour-time.Second)) {
+			t.Errorf("%s: expired before CacheTTL", repo)
+		}
+		expiries[ma.TTL] = true
+	}
+	if len(expiries) < 2 {
+		t.Errorf("all %d entries share one TTL; want them spread", len(charts))
+	}
+}
+
+func TestCacheTTLFloor(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	m := newTestManifests(t, u, Config{CacheTTL: time.Second, CacheTTLFloor: time.Minute})
+	clock := &testClock{t: time.Now()}
+	m.now = clock.now
+	path := "/v2/" + u.host() + "/foo/manifests/1.0.0"
+
+	get(t, m.Handle, http.MethodGet, path)
+	clock.advance(30 * time.Second)
+	get(t, m.Handle, http.MethodGet, path)
+	if n := atomic.LoadInt32(&u.tarballRequests); n != 1 {
+		t.Errorf("chart downloaded %d times within the floor; want 1", n)
+	}
+
+	clock.advance(time.Minute)
+	get(t, m.Handle, http.MethodGet, path)
+	if n := atomic.LoadInt32(&u.tarballRequests); n != 2 {
+		t.Errorf("chart downloaded %d times past the floor; want 2", n)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	m := newTestManifests(t, u, Config{CacheTTL: time.Minute, StaleWhileRevalidate: 10 * time.Minute})
+	clock := &testClock{t: time.Now()}
+	m.now = clock.now
+	path := "/v2/" + u.host() + "/foo/manifests/1.0.0"
+
+	get(t, m.Handle, http.MethodGet, path)
+
+	// stale but within the window: served without waiting for the upstream
+	gate := make(chan struct{})
+	u.onTarball = func() { <-gate }
+	clock.advance(2 * time.Minute)
+	if rec := get(t, m.Handle, http.MethodGet, path); rec.Code != http.StatusOK {
+		t.Fatalf("stale status = %d; want 200", rec.Code)
+	}
+	close(gate)
+	eventually(t, func() bool {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		return atomic.LoadInt32(&u.tarballRequests) == 2 && len(m.refreshing) == 0
+	}, "stale manifest wasn't refreshed in the background")
+	u.onTarball = nil
+
+	// past the window: the request waits for the refetch
+	clock.advance(20 * time.Minute)
+	get(t, m.Handle, http.MethodGet, path)
+	if n := atomic.LoadInt32(&u.tarballRequests); n != 3 {
+		t.Errorf("chart downloaded %d times; want 3", n)
+	}
+}
+
+func TestCacheStatusHeader(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	u.etags = true
+	m := newTestManifests(t, u, Config{CacheTTL: time.Minute, StaleWhileRevalidate: time.Minute, CacheStatusHeader: "X-Cache"})
+	clock := &testClock{t: time.Now()}
+	m.now = clock.now
+	path := "/v2/" + u.host() + "/foo/manifests/1.0.0"
+
+	for _, step := range []struct {
+		name    string
+		advance time.Duration
+		method  string
+		want    string
+	}{
+		{"cold pull", 0, http.MethodGet, cacheMiss},
+		{"warm pull", 0, http.MethodGet, cacheHit},
+		{"warm HEAD", 0, http.MethodHead, cacheHit},
+		{"within stale-while-revalidate", 90 * time.Second, http.MethodGet, cacheStale},
+		{"expired", 10 * time.Minute, http.MethodGet, cacheRevalidated},
+		{"revalidated pull", 0, http.MethodGet, cacheHit},
+	} {
+		clock.advance(step.advance)
+		if got := get(t, m.Handle, step.method, path).Header().Get("X-Cache"); got != step.want {
+			t.Errorf("%s: X-Cache = %q; want %q", step.name, got, step.want)
+		}
+		// let the background refresh of stale manifests finish
+		eventually(t, func() bool {
+			m.lock.Lock()
+			defer m.lock.Unlock()
+			return len(m.refreshing) == 0
+		}, "background refresh didn't finish")
+	}
+
+	if rec := get(t, newTestManifests(t, u, Config{}).Handle, http.MethodGet, path); len(rec.Header().Values("X-Cache")) != 0 {
+		t.Errorf("X-Cache = %q without a CacheStatusHeader; want none", rec.Header().Values("X-Cache"))
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	m := newTestManifests(t, u, Config{CacheTTL: time.Minute, StaleIfError: 10 * time.Minute})
+	clock := &testClock{t: time.Now()}
+	m.now = clock.now
+	path := "/v2/" + u.host() + "/foo/manifests/1.0.0"
+
+	want := get(t, m.Handle, http.MethodGet, path).Body.String()
+	u.Close()
+
+	clock.advance(2 * time.Minute)
+	rec := get(t, m.Handle, http.MethodGet, path)
+	if rec.Body.String() != want {
+		t.Errorf("stale manifest differs from the cached one")
+	}
+	if w := rec.Header().Get("Warning"); w != staleWarning {
+		t.Errorf("Warning = %q; want %q", w, staleWarning)
+	}
+
+	clock.advance(20 * time.Minute)
+	if regErr := handleErr(t, m.Handle, http.MethodGet, path); regErr.Status != http.StatusBadGateway {
+		t.Errorf("status past the window = %d; want 502", regErr.Status)
+	}
+}
+
+func TestRevalidateUnchangedChart(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	u.etags = true
+	m := newTestManifests(t, u, Config{CacheTTL: time.Minute})
+	clock := &testClock{t: time.Now()}
+	m.now = clock.now
+	path := "/v2/" + u.host() + "/foo/manifests/1.0.0"
+
+	get(t, m.Handle, http.MethodGet, path)
+
+	clock.advance(2 * time.Minute)
+	get(t, m.Handle, http.MethodGet, path)
+	if n := atomic.LoadInt32(&u.tarballRequests); n != 1 {
+		t.Errorf("unchanged chart downloaded %d times; want 1", n)
+	}
+	if n := atomic.LoadInt32(&u.headRequests); n != 1 {
+		t.Errorf("got %d revalidations; want 1", n)
+	}
+
+	// revalidation extended the entry
+	clock.advance(30 * time.Second)
+	get(t, m.Handle, http.MethodGet, path)
+	if n := atomic.LoadInt32(&u.headRequests); n != 1 {
+		t.Errorf("got %d revalidations of a fresh entry; want 1", n)
+	}
+
+	// without validators the chart is downloaded again
+	u.etags = false
+	clock.advance(2 * time.Minute)
+	get(t, m.Handle, http.MethodGet, path)
+	if n := atomic.LoadInt32(&u.tarballRequests); n != 2 {
+		t.Errorf("chart downloaded %d times; want 2", n)
+	}
+}
+
+func TestFallbackContentType(t *testing.T) {
+	for fallback, want := range map[string]string{
+		"":                          ocispec.MediaTypeImageManifest,
+		MediaTypeManifest:           MediaTypeManifest,
+		ocispec.MediaTypeImageIndex: ocispec.MediaTypeImageIndex,
+	} {
+		m := newTestManifests(t, nil, Config{ReadOnly: true, FallbackContentType: fallback})
+		repo := "example.com/foo"
+		blob := []byte(`{"schemaVersion":2}`)
+		m.lock.Lock()
+		_ = m.Write(repo, "1.0.0", Manifest{Blob: blob, CreatedAt: time.Now(), TTL: time.Hour})
+		m.lock.Unlock()
+
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			rec := get(t, m.Handle, method, "/v2/"+repo+"/manifests/1.0.0")
+			if ct := rec.Header().Get("Content-Type"); ct != want {
+				t.Errorf("fallback %q: %s Content-Type = %q; want %q", fallback, method, ct, want)
+			}
+		}
+	}
+}
+
+func TestMediaTypeRewrite(t *testing.T) {
+	const (
+		oci    = ocispec.MediaTypeImageManifest
+		docker = MediaTypeManifest
+		both   = ocispec.MediaTypeImageManifest + ", " + MediaTypeManifest + ";q=0.9"
+	)
+	for _, tc := range []struct {
+		mode   string
+		stored string
+		accept string
+		want   string
+	}{
+		{"", oci, docker, oci},
+		{MediaTypeRewriteAccept, oci, docker, docker},
+		{MediaTypeRewriteAccept, oci, oci, oci},
+		{MediaTypeRewriteAccept, oci, both, oci},
+		{MediaTypeRewriteAccept, oci, "", oci},
+		{MediaTypeRewriteAccept, oci, "*/*", oci},
+		{MediaTypeRewriteAccept, docker, oci, oci},
+		{MediaTypeRewriteAccept, ocispec.MediaTypeImageIndex, MediaTypeManifestList, MediaTypeManifestList},
+		{MediaTypeRewriteDocker, oci, oci, docker},
+		{MediaTypeRewriteDocker, docker, oci, docker},
+		{MediaTypeRewriteDocker, ocispec.MediaTypeImageIndex, "", MediaTypeManifestList},
+	} {
+		m := newTestManifests(t, nil, Config{ReadOnly: true, MediaTypeRewrite: tc.mode})
+		repo := "example.com/foo"
+		blob := []byte(`{"schemaVersion":2,"mediaType":"` + tc.stored + `"}`)
+		m.lock.Lock()
+		_ = m.Write(repo, "1.0.0", Manifest{ContentType: tc.stored, Blob: blob, CreatedAt: time.Now(), TTL: time.Hour})
+		m.lock.Unlock()
+
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			req := httptest.NewRequest(method, "/v2/"+repo+"/manifests/1.0.0", nil)
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			rec := httptest.NewRecorder()
+			if err := m.Handle(rec, req); err != nil {
+				t.Fatal(err)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != tc.want {
+				t.Errorf("mode %q, %s stored, Accept %q: %s Content-Type = %q; want %q", tc.mode, tc.stored, tc.accept, method, ct, tc.want)
+			}
+			if d := rec.Header().Get("Docker-Content-Digest"); d != digest.FromBytes(blob).String() {
+				t.Errorf("mode %q: digest = %s; want the stored bytes' %s", tc.mode, d, digest.FromBytes(blob))
+			}
+		}
+	}
+}
+
+func TestEmptyReference(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	m := newTestManifests(t, u, Config{})
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		for _, reference := range []string{"", "v"} {
+			err := handleErr(t, m.Handle, method, "/v2/"+u.host()+"/foo/manifests/"+reference)
+			if err.Status != http.StatusBadRequest || err.Code != errors.CodeNameInvalid || !strings.Contains(err.Message, "No reference") {
+				t.Errorf("%s with reference %q = %+v; want a 400", method, reference, err)
+			}
+		}
+	}
+	if n := atomic.LoadInt32(&u.indexRequests); n != 0 {
+		t.Errorf("%d index requests; want none for requests without reference", n)
+	}
+}
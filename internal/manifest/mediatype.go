@@ -0,0 +1,62 @@
+package manifest
+
+import (
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"mime"
+	"strings"
+)
+
+// MediaTypeRewrite modes
+const (
+	// MediaTypeRewriteAccept serves manifests with the Docker or the OCI media
+	// type of their kind, whichever the client accepts when it doesn't accept
+	// the stored one
+	MediaTypeRewriteAccept = "accept"
+	// MediaTypeRewriteDocker always serves manifests with the Docker media
+	// type of their kind, for clients only knowing those
+	MediaTypeRewriteDocker = "docker"
+)
+
+// equivalentMediaTypes maps the OCI and Docker media types of the same kind
+// of manifest to each other.
+var equivalentMediaTypes = map[string]string{
+	ocispec.MediaTypeImageManifest: MediaTypeManifest,
+	ocispec.MediaTypeImageIndex:    MediaTypeManifestList,
+	MediaTypeManifest:              ocispec.MediaTypeImageManifest,
+	MediaTypeManifestList:          ocispec.MediaTypeImageIndex,
+}
+
+// servedContentType is the Content-Type of a manifest stored as mediaType
+// served to a client sending accept, rewritten as MediaTypeRewrite says. Only
+// the header changes, the bytes and so the digest stay the same.
+func (m *Manifests) servedContentType(mediaType string, accept []string) string {
+	other, ok := equivalentMediaTypes[mediaType]
+	if !ok {
+		return mediaType
+	}
+	switch m.config.MediaTypeRewrite {
+	case MediaTypeRewriteDocker:
+		if strings.HasPrefix(mediaType, "application/vnd.oci.") {
+			return other
+		}
+	case MediaTypeRewriteAccept:
+		accepted := acceptedMediaTypes(accept)
+		if len(accepted) > 0 && !accepted[mediaType] && !accepted["*/*"] && accepted[other] {
+			return other
+		}
+	}
+	return mediaType
+}
+
+// acceptedMediaTypes parses Accept headers, parameters like q are ignored.
+func acceptedMediaTypes(accept []string) map[string]bool {
+	res := map[string]bool{}
+	for _, header := range accept {
+		for _, part := range strings.Split(header, ",") {
+			if mt, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil {
+				res[mt] = true
+			}
+		}
+	}
+	return res
+}
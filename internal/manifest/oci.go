@@ -0,0 +1,401 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	cerrors "errors"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
+	"github.com/container-registry/helm-charts-oci-proxy/pkg/verify"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// maxIndexDepth bounds nested image indexes fetched from OCI upstreams.
+const maxIndexDepth = 2
+
+// emptyJSON is the content of the OCI empty descriptor.
+var emptyJSON = []byte("{}")
+
+var manifestAccept = strings.Join(defaultManifestMediaTypes, ", ")
+
+func (m *Manifests) isOCIUpstream(host string) bool {
+	return matchHost(m.config.OCIUpstreams, host)
+}
+
+// ociCopy is what copyOCIManifest fetched, stored once it's done.
+type ociCopy struct {
+	manifests []ociManifest // child manifests before the indexes of them
+	invalid   []string      // blobs of invalid charts, to delete
+}
+
+type ociManifest struct {
+	digest digest.Digest
+	ma     Manifest
+}
+
+// prepareOCI mirrors a chart from an OCI registry upstream, cached for scope,
+// image indexes are copied with all their child manifests. Must be called
+// with the lock held, it's released while fetching.
+func (m *Manifests) prepareOCI(ctx context.Context, repo string, reference string, scope string) *errors.RegError {
+	host, name, _ := strings.Cut(repo, "/")
+	if reference == "" {
+		reference = "latest"
+	}
+	var fetched ociCopy
+	var d digest.Digest
+	var err error
+	m.unlocked(func() {
+		d, err = m.copyOCIManifest(ctx, repo, host, name, reference, 0, &fetched)
+	})
+	m.deleteUnreferenced(ctx, fetched.invalid)
+	if err != nil {
+		var tooMany *tooManyBlobsError
+		if cerrors.As(err, &tooMany) {
+			return &errors.RegError{
+				Status:  http.StatusBadRequest,
+				Code:    errors.CodeManifestInvalid,
+				Message: err.Error(),
+			}
+		}
+		var invalid *invalidChartError
+		if cerrors.As(err, &invalid) {
+			return &errors.RegError{
+				Status:  http.StatusBadGateway,
+				Code:    errors.CodeManifestInvalid,
+				Message: err.Error(),
+			}
+		}
+		return upstreamRegError(err, &errors.RegError{
+			Status:  http.StatusNotFound,
+			Code:    errors.CodeManifestUnknown,
+			Message: fmt.Sprintf("Chart: %s reference: %s not found: %v", repo, reference, err),
+		})
+	}
+	for _, f := range fetched.manifests {
+		f.ma.Scope = scope
+		refs := []string{f.digest.String()}
+		if f.digest == d && reference != d.String() {
+			refs = append(refs, reference)
+		}
+		for _, ref := range refs {
+			if err = m.Write(scopedRepo(repo, scope), ref, f.ma); err != nil {
+				return errors.RegErrInternal(err)
+			}
+		}
+	}
+	return nil
+}
+
+// copyOCIManifest fetches reference and everything it refers to, storing the
+// blobs and adding the manifests to res. It doesn't need the lock.
+func (m *Manifests) copyOCIManifest(ctx context.Context, repo, host, name, reference string, depth int, res *ociCopy) (digest.Digest, error) {
+	data, header, err := m.fetchOCI(ctx, fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, name, reference), manifestAccept)
+	if err != nil {
+		return "", err
+	}
+	d := digest.FromBytes(data)
+	if !matchesDigest(data, reference) {
+		return "", fmt.Errorf("manifest %s: digest mismatch, got %s", reference, d)
+	}
+	mediaType := strings.TrimSpace(strings.Split(header.Get("Content-Type"), ";")[0])
+	// the digest the upstream reported is kept only if it's the one of data
+	upstreamDigest := header.Get("Docker-Content-Digest")
+	if _, err := digest.Parse(upstreamDigest); err != nil || !matchesDigest(data, upstreamDigest) {
+		upstreamDigest = ""
+	}
+	if !isManifestDescriptor(ocispec.Descriptor{MediaType: mediaType}) {
+		// registries may serve manifests with a generic content type
+		var rm referrerManifest
+		if err = json.Unmarshal(data, &rm); err == nil && rm.MediaType != "" {
+			mediaType = rm.MediaType
+		}
+	}
+
+	var refs []string
+	switch mediaType {
+	case ocispec.MediaTypeImageIndex, MediaTypeManifestList:
+		if depth >= maxIndexDepth {
+			return "", fmt.Errorf("manifest %s: image indexes nested too deep", d)
+		}
+		var index ocispec.Index
+		if err = json.Unmarshal(data, &index); err != nil {
+			return "", err
+		}
+		if err = m.checkBlobCount(d, len(index.Manifests)); err != nil {
+			return "", err
+		}
+		for _, child := range index.Manifests {
+			if _, err = m.copyOCIManifest(ctx, repo, host, name, child.Digest.String(), depth+1, res); err != nil {
+				return "", err
+			}
+		}
+	case ocispec.MediaTypeImageManifest, MediaTypeManifest:
+		var om ocispec.Manifest
+		if err = json.Unmarshal(data, &om); err != nil {
+			return "", err
+		}
+		if err = m.checkBlobCount(d, len(om.Layers)+1); err != nil {
+			return "", err
+		}
+		if refs, err = m.copyOCIBlobs(ctx, host, name, append([]ocispec.Descriptor{om.Config}, om.Layers...)); err != nil {
+			return "", err
+		}
+		if err = m.checkChartConfig(ctx, om); err != nil {
+			res.invalid = append(res.invalid, refs...)
+			return "", &invalidChartError{Name: fmt.Sprintf("%s@%s", repo, d), Err: err}
+		}
+	default:
+		return "", fmt.Errorf("manifest %s: unsupported media type %q", d, mediaType)
+	}
+
+	res.manifests = append(res.manifests, ociManifest{digest: d, ma: Manifest{
+		ContentType:    mediaType,
+		Blob:           data,
+		Refs:           refs,
+		CreatedAt:      m.now(),
+		TTL:            m.entryTTL(),
+		UpstreamDigest: upstreamDigest,
+	}})
+	return d, nil
+}
+
+// tooManyBlobsError rejects a manifest referencing more than MaxManifestBlobs.
+type tooManyBlobsError struct {
+	Digest digest.Digest
+	Count  int
+	Max    int
+}
+
+func (e *tooManyBlobsError) Error() string {
+	return fmt.Sprintf("manifest %s references %d blobs, at most %d are allowed", e.Digest, e.Count, e.Max)
+}
+
+// checkBlobCount is called before fetching anything a manifest references.
+func (m *Manifests) checkBlobCount(d digest.Digest, count int) error {
+	if m.config.MaxManifestBlobs > 0 && count > m.config.MaxManifestBlobs {
+		return &tooManyBlobsError{Digest: d, Count: count, Max: m.config.MaxManifestBlobs}
+	}
+	return nil
+}
+
+// copyOCIBlobs copies the blobs of a manifest, BlobFetchConcurrency at a
+// time. The first failure cancels the others and is returned. The digests of
+// the blobs copied are returned in order.
+func (m *Manifests) copyOCIBlobs(ctx context.Context, host, name string, descs []ocispec.Descriptor) ([]string, error) {
+	g, ctx := errgroup.WithContext(ctx)
+	if m.config.BlobFetchConcurrency > 0 {
+		g.SetLimit(m.config.BlobFetchConcurrency)
+	} else {
+		g.SetLimit(1)
+	}
+	var refs []string
+	for _, desc := range descs {
+		desc := desc
+		switch {
+		case len(desc.URLs) > 0 && !m.config.FetchForeignLayers:
+			// passed through, clients fetch it from desc.URLs themselves
+			continue
+		case len(desc.URLs) > 0:
+			g.Go(func() error { return m.copyForeignBlob(ctx, desc) })
+		case isEmptyJSON(desc):
+			g.Go(func() error { return m.storeEmptyJSON(ctx, desc) })
+		default:
+			g.Go(func() error { return m.copyOCIBlob(ctx, host, name, desc) })
+		}
+		refs = append(refs, desc.Digest.String())
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+func (m *Manifests) copyOCIBlob(ctx context.Context, host, name string, desc ocispec.Descriptor) error {
+	return m.storeBlob(ctx, desc, func() (*http.Response, error) {
+		return m.doOCI(ctx, fmt.Sprintf("https://%s/v2/%s/blobs/%s", host, name, desc.Digest), "")
+	})
+}
+
+// isEmptyJSON reports whether desc is the OCI empty descriptor, the {} config
+// of artifacts without one, of whatever media type.
+func isEmptyJSON(desc ocispec.Descriptor) bool {
+	return desc.Size == int64(len(emptyJSON)) && desc.Digest.Validate() == nil && desc.Digest.Algorithm().FromBytes(emptyJSON) == desc.Digest
+}
+
+// storeEmptyJSON stores the empty descriptor desc without fetching it, pushing
+// clients often skip it and registries then don't serve it.
+func (m *Manifests) storeEmptyJSON(ctx context.Context, desc ocispec.Descriptor) error {
+	return m.storeBlob(ctx, desc, func() (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(emptyJSON))}, nil
+	})
+}
+
+// copyForeignBlob fetches a layer referenced by URL from the first of its
+// URLs on a ForeignLayerHosts host serving it.
+func (m *Manifests) copyForeignBlob(ctx context.Context, desc ocispec.Descriptor) error {
+	if m.config.ForeignLayerMaxSize > 0 && desc.Size > m.config.ForeignLayerMaxSize {
+		return fmt.Errorf("foreign layer %s: size %d exceeds %d", desc.Digest, desc.Size, m.config.ForeignLayerMaxSize)
+	}
+	err := fmt.Errorf("foreign layer %s: no allowed URL", desc.Digest)
+	for _, u := range desc.URLs {
+		pu, perr := url.Parse(u)
+		if perr != nil || pu.Scheme != "https" || !matchHost(m.config.ForeignLayerHosts, pu.Host) {
+			continue
+		}
+		if err = m.storeBlob(ctx, desc, func() (*http.Response, error) {
+			req, err := m.newUpstreamRequest(ctx, http.MethodGet, u)
+			if err != nil {
+				return nil, err
+			}
+			resp, err := m.do(req)
+			if err != nil {
+				return nil, err
+			}
+			if resp.StatusCode != http.StatusOK {
+				resp.Body.Close()
+				return nil, &statusError{URL: u, StatusCode: resp.StatusCode}
+			}
+			resp.Body = m.countedBody(resp)
+			return resp, nil
+		}); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// storeBlob puts the blob desc fetched with get unless it's already stored.
+// Downloads not matching the digest are retried up to BlobDigestRetries times.
+func (m *Manifests) storeBlob(ctx context.Context, desc ocispec.Descriptor, get func() (*http.Response, error)) error {
+	h, err := helper.NewHash(desc.Digest.String())
+	if err != nil {
+		return err
+	}
+	if sh, ok := m.blobHandler.(handler.BlobStatHandler); ok {
+		if _, err := sh.Stat(ctx, "", h); err == nil {
+			return nil
+		}
+	}
+	putHandler, ok := m.blobHandler.(handler.BlobPutHandler)
+	if !ok {
+		return fmt.Errorf("blob handler is read-only")
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := get()
+		if err != nil {
+			return err
+		}
+		vrc, err := verify.ReadCloser(resp.Body, desc.Size, h)
+		if err != nil {
+			resp.Body.Close()
+			return err
+		}
+		// blob handlers read it all before storing, mismatches aren't stored
+		err = putHandler.Put(ctx, "", h, vrc)
+		var verr verify.Error
+		if !cerrors.As(err, &verr) || attempt >= m.config.BlobDigestRetries {
+			return err
+		}
+		m.log.Printf("fetching blob %s again: %v", desc.Digest, err)
+	}
+}
+
+// fetchOCI returns the body of url and the headers it was served with.
+func (m *Manifests) fetchOCI(ctx context.Context, url, accept string) ([]byte, http.Header, error) {
+	resp, err := m.doOCI(ctx, url, accept)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, resp.Header, nil
+}
+
+// doOCI performs a GET against an OCI registry, following the anonymous
+// bearer token challenge if the registry asks for one.
+func (m *Manifests) doOCI(ctx context.Context, url, accept string) (*http.Response, error) {
+	var token string
+	for attempt := 0; ; attempt++ {
+		req, err := m.newUpstreamRequest(ctx, http.MethodGet, url)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := m.do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			resp.Body = m.countedBody(resp)
+			return resp, nil
+		}
+		resp.Body.Close()
+		challenge := resp.Header.Get("WWW-Authenticate")
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 || !strings.HasPrefix(challenge, "Bearer ") {
+			return nil, &statusError{URL: url, StatusCode: resp.StatusCode}
+		}
+		if token, err = m.fetchToken(ctx, challenge); err != nil {
+			return nil, err
+		}
+	}
+}
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+func (m *Manifests) fetchToken(ctx context.Context, challenge string) (string, error) {
+	params := map[string]string{}
+	for _, p := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[p[1]] = p[2]
+	}
+	if params["realm"] == "" {
+		return "", fmt.Errorf("auth challenge without realm: %s", challenge)
+	}
+	req, err := m.newUpstreamRequest(ctx, http.MethodGet, params["realm"])
+	if err != nil {
+		return "", err
+	}
+	q := req.URL.Query()
+	for _, k := range []string{"service", "scope"} {
+		if params[k] != "" {
+			q.Set(k, params[k])
+		}
+	}
+	req.URL.RawQuery = q.Encode()
+	resp, err := m.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", &statusError{URL: params["realm"], StatusCode: resp.StatusCode}
+	}
+	var res struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", err
+	}
+	if res.Token != "" {
+		return res.Token, nil
+	}
+	return res.AccessToken, nil
+}
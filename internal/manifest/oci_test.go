@@ -0,0 +1,491 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	helmregistry "helm.sh/helm/v3/pkg/registry"
+)
+
+type testManifest struct {
+	mediaType string
+	data      []byte
+}
+
+// testRegistry is an OCI registry upstream serving a single repository.
+type testRegistry struct {
+	*httptest.Server
+	lock      sync.Mutex
+	manifests map[string]testManifest // by tag and digest
+	blobs     map[digest.Digest][]byte
+	requests  map[string]int   // by path
+	onBlob    func()           // called before a blob is served, outside the lock
+	corrupt   int              // blob responses corrupted before serving them right
+	algorithm digest.Algorithm // of the Docker-Content-Digest of manifests, sha256 if unset
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	t.Helper()
+	r := &testRegistry{
+		manifests: map[string]testManifest{},
+		blobs:     map[digest.Digest][]byte{},
+		requests:  map[string]int{},
+	}
+	r.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.onBlob != nil && strings.Contains(req.URL.Path, "/blobs/") {
+			r.onBlob()
+		}
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.requests[req.URL.Path]++
+		elem := strings.Split(req.URL.Path, "/")
+		ref := elem[len(elem)-1]
+		switch elem[len(elem)-2] {
+		case "manifests":
+			ma, ok := r.manifests[ref]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			algorithm := digest.Canonical
+			if r.algorithm != "" {
+				algorithm = r.algorithm
+			}
+			w.Header().Set("Content-Type", ma.mediaType)
+			w.Header().Set("Docker-Content-Digest", algorithm.FromBytes(ma.data).String())
+			_, _ = w.Write(ma.data)
+		case "tags":
+			var list struct {
+				Tags []string `json:"tags"`
+			}
+			for ref := range r.manifests {
+				if _, err := digest.Parse(ref); err != nil {
+					list.Tags = append(list.Tags, ref)
+				}
+			}
+			_ = json.NewEncoder(w).Encode(list)
+		case "blobs", "foreign":
+			b, ok := r.blobs[digest.Digest(ref)]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			if r.corrupt > 0 {
+				r.corrupt--
+				b = append([]byte{b[0] ^ 0xff}, b[1:]...)
+			}
+			_, _ = w.Write(b)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *testRegistry) host() string {
+	return strings.TrimPrefix(r.URL, "https://")
+}
+
+func (r *testRegistry) addBlob(mediaType string, data []byte) ocispec.Descriptor {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	d := digest.FromBytes(data)
+	r.blobs[d] = data
+	return ocispec.Descriptor{MediaType: mediaType, Digest: d, Size: int64(len(data))}
+}
+
+func (r *testRegistry) addManifest(t *testing.T, mediaType string, v interface{}, tags ...string) ocispec.Descriptor {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	d := digest.FromBytes(data)
+	for _, ref := range append(tags, d.String()) {
+		r.manifests[ref] = testManifest{mediaType: mediaType, data: data}
+	}
+	return ocispec.Descriptor{MediaType: mediaType, Digest: d, Size: int64(len(data))}
+}
+
+// addChart stores a chart manifest with config and one layer.
+func (r *testRegistry) addChart(t *testing.T, content string, tags ...string) ocispec.Descriptor {
+	t.Helper()
+	om := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    r.addBlob(helmregistry.ConfigMediaType, []byte(`{"name":"foo"}`)),
+		Layers:    []ocispec.Descriptor{r.addBlob(helmregistry.ChartLayerMediaType, []byte(content))},
+	}
+	om.SchemaVersion = 2
+	return r.addManifest(t, ocispec.MediaTypeImageManifest, om, tags...)
+}
+
+func newOCITestManifests(t *testing.T, r *testRegistry, config Config) *Manifests {
+	t.Helper()
+	config.OCIUpstreams = append(config.OCIUpstreams, r.host())
+	m := newTestManifests(t, nil, config)
+	m.client = r.Client()
+	return m
+}
+
+func TestOCIImageIndexPassthrough(t *testing.T) {
+	r := newTestRegistry(t)
+	first := r.addChart(t, "first")
+	second := r.addChart(t, "second")
+	index := ocispec.Index{MediaType: ocispec.MediaTypeImageIndex, Manifests: []ocispec.Descriptor{first, second}}
+	index.SchemaVersion = 2
+	indexDesc := r.addManifest(t, ocispec.MediaTypeImageIndex, index, "1.0.0")
+
+	m := newOCITestManifests(t, r, Config{})
+	repo := "/v2/" + r.host() + "/charts/foo/manifests/"
+	rec := get(t, m.Handle, http.MethodGet, repo+"1.0.0")
+	if ct := rec.Header().Get("Content-Type"); ct != ocispec.MediaTypeImageIndex {
+		t.Errorf("Content-Type = %q; want image index", ct)
+	}
+	if d := rec.Header().Get("Docker-Content-Digest"); d != indexDesc.Digest.String() {
+		t.Errorf("Docker-Content-Digest = %s; want %s", d, indexDesc.Digest)
+	}
+
+	for _, child := range []ocispec.Descriptor{first, second} {
+		rec := get(t, m.Handle, http.MethodGet, repo+child.Digest.String())
+		if d := rec.Header().Get("Docker-Content-Digest"); d != child.Digest.String() {
+			t.Errorf("Docker-Content-Digest = %s; want %s", d, child.Digest)
+		}
+		var om ocispec.Manifest
+		if err := json.Unmarshal(rec.Body.Bytes(), &om); err != nil {
+			t.Fatal(err)
+		}
+		for _, desc := range append([]ocispec.Descriptor{om.Config}, om.Layers...) {
+			h, _ := v1.NewHash(desc.Digest.String())
+			if _, err := m.blobHandler.Get(context.Background(), "", h); err != nil {
+				t.Errorf("blob %s of %s not cached: %v", desc.Digest, child.Digest, err)
+			}
+		}
+	}
+}
+
+func TestOCIUpstreamDigest(t *testing.T) {
+	r := newTestRegistry(t)
+	r.algorithm = digest.SHA512
+	r.addChart(t, "content", "1.0.0")
+	path := "/v2/" + r.host() + "/charts/foo/manifests/"
+
+	m := newOCITestManifests(t, r, Config{})
+	rec := get(t, m.Handle, http.MethodGet, path+"1.0.0")
+	if d := rec.Header().Get("Docker-Content-Digest"); d != digest.FromBytes(rec.Body.Bytes()).String() {
+		t.Errorf("Docker-Content-Digest = %s; want the sha256 digest", d)
+	}
+
+	m = newOCITestManifests(t, r, Config{PreserveUpstreamDigests: true})
+	rec = get(t, m.Handle, http.MethodGet, path+"1.0.0")
+	upstream := digest.SHA512.FromBytes(rec.Body.Bytes())
+	if d := rec.Header().Get("Docker-Content-Digest"); d != upstream.String() {
+		t.Errorf("PreserveUpstreamDigests: Docker-Content-Digest = %s; want the upstream's %s", d, upstream)
+	}
+	// the digest pins the same manifest
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		if d := get(t, m.Handle, method, path+upstream.String()).Header().Get("Docker-Content-Digest"); d != upstream.String() {
+			t.Errorf("%s by upstream digest: Docker-Content-Digest = %s; want %s", method, d, upstream)
+		}
+	}
+	sha256 := digest.FromBytes(rec.Body.Bytes())
+	if d := get(t, m.Handle, http.MethodHead, path+sha256.String()).Header().Get("Docker-Content-Digest"); d != sha256.String() {
+		t.Errorf("HEAD by sha256: Docker-Content-Digest = %s; want %s", d, sha256)
+	}
+}
+
+func TestOCIForeignLayers(t *testing.T) {
+	r := newTestRegistry(t)
+	foreign := r.addBlob(helmregistry.ChartLayerMediaType, []byte("foreign"))
+	foreign.URLs = []string{"https://" + r.host() + "/foreign/" + foreign.Digest.String()}
+	om := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    r.addBlob(helmregistry.ConfigMediaType, []byte(`{"name":"foo"}`)),
+		Layers:    []ocispec.Descriptor{foreign},
+	}
+	om.SchemaVersion = 2
+	r.addManifest(t, ocispec.MediaTypeImageManifest, om, "1.0.0")
+	h, _ := v1.NewHash(foreign.Digest.String())
+	path := "/v2/" + r.host() + "/charts/foo/manifests/1.0.0"
+
+	for _, tc := range []struct {
+		name    string
+		config  Config
+		fetched bool
+		fail    bool
+	}{
+		{name: "passthrough"},
+		{name: "fetch", config: Config{FetchForeignLayers: true, ForeignLayerHosts: []string{r.host()}}, fetched: true},
+		{name: "host not allowed", config: Config{FetchForeignLayers: true, ForeignLayerHosts: []string{"example.com"}}, fail: true},
+		{name: "too large", config: Config{FetchForeignLayers: true, ForeignLayerHosts: []string{r.host()}, ForeignLayerMaxSize: 3}, fail: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newOCITestManifests(t, r, tc.config)
+			if tc.fail {
+				if regErr := handleErr(t, m.Handle, http.MethodGet, path); regErr.Status != http.StatusNotFound {
+					t.Errorf("status = %d; want 404", regErr.Status)
+				}
+				return
+			}
+			rec := get(t, m.Handle, http.MethodGet, path)
+			var got ocispec.Manifest
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Layers) != 1 || len(got.Layers[0].URLs) != 1 {
+				t.Errorf("foreign layer descriptor not kept intact: %+v", got.Layers)
+			}
+			_, err := m.blobHandler.Get(context.Background(), "", h)
+			if cached := err == nil; cached != tc.fetched {
+				t.Errorf("foreign layer cached = %v; want %v", cached, tc.fetched)
+			}
+		})
+	}
+}
+
+func TestOCIMaxManifestBlobs(t *testing.T) {
+	r := newTestRegistry(t)
+	om := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    r.addBlob(helmregistry.ConfigMediaType, []byte(`{"name":"foo"}`)),
+	}
+	om.SchemaVersion = 2
+	for i := 0; i < 5; i++ {
+		om.Layers = append(om.Layers, r.addBlob(helmregistry.ChartLayerMediaType, []byte{byte(i)}))
+	}
+	r.addManifest(t, ocispec.MediaTypeImageManifest, om, "1.0.0")
+
+	m := newOCITestManifests(t, r, Config{MaxManifestBlobs: 3})
+	regErr := handleErr(t, m.Handle, http.MethodGet, "/v2/"+r.host()+"/charts/foo/manifests/1.0.0")
+	if regErr.Status != http.StatusBadRequest || regErr.Code != "MANIFEST_INVALID" {
+		t.Errorf("got %d %s; want 400 MANIFEST_INVALID", regErr.Status, regErr.Code)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for path, n := range r.requests {
+		if strings.Contains(path, "/blobs/") {
+			t.Errorf("%s fetched %d times; want no downloads", path, n)
+		}
+	}
+}
+
+func TestOCIBlobFetchConcurrency(t *testing.T) {
+	r := newTestRegistry(t)
+	om := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    r.addBlob(helmregistry.ConfigMediaType, []byte(`{"name":"foo"}`)),
+	}
+	om.SchemaVersion = 2
+	for i := 0; i < 6; i++ {
+		om.Layers = append(om.Layers, r.addBlob(helmregistry.ChartLayerMediaType, []byte(fmt.Sprintf("layer %d", i))))
+	}
+	r.addManifest(t, ocispec.MediaTypeImageManifest, om, "1.0.0")
+	// a layer the registry doesn't have
+	broken := om
+	broken.Layers = append(append([]ocispec.Descriptor{}, om.Layers...), ocispec.Descriptor{
+		MediaType: helmregistry.ChartLayerMediaType,
+		Digest:    digest.FromString("missing"),
+		Size:      7,
+	})
+	r.addManifest(t, ocispec.MediaTypeImageManifest, broken, "1.0.1")
+
+	var inflight, maxInflight int32
+	r.onBlob = func() {
+		n := atomic.AddInt32(&inflight, 1)
+		for {
+			max := atomic.LoadInt32(&maxInflight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInflight, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&inflight, -1)
+	}
+
+	for _, tc := range []struct {
+		concurrency int
+		min, max    int32
+	}{{0, 1, 1}, {4, 2, 4}} {
+		atomic.StoreInt32(&maxInflight, 0)
+		m := newOCITestManifests(t, r, Config{BlobFetchConcurrency: tc.concurrency})
+		rec := get(t, m.Handle, http.MethodGet, "/v2/"+r.host()+"/charts/foo/manifests/1.0.0")
+		var got ocispec.Manifest
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Layers) != len(om.Layers) {
+			t.Errorf("got %d layers; want %d", len(got.Layers), len(om.Layers))
+		}
+		if n := atomic.LoadInt32(&maxInflight); n < tc.min || n > tc.max {
+			t.Errorf("BlobFetchConcurrency %d: %d blobs fetched at once; want %d to %d", tc.concurrency, n, tc.min, tc.max)
+		}
+
+		regErr := handleErr(t, m.Handle, http.MethodGet, "/v2/"+r.host()+"/charts/foo/manifests/1.0.1")
+		if regErr.Status != http.StatusNotFound || !strings.Contains(regErr.Message, digest.FromString("missing").String()) {
+			t.Errorf("BlobFetchConcurrency %d: got %d %s; want 404 for the missing layer", tc.concurrency, regErr.Status, regErr.Message)
+		}
+	}
+}
+
+func TestOCICosignSignatureTag(t *testing.T) {
+	r := newTestRegistry(t)
+	chart := r.addChart(t, "chart", "1.0.0")
+	sig := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    r.addBlob(ocispec.MediaTypeImageConfig, []byte(`{"architecture":"","os":"","config":{},"rootfs":{"type":"layers","diff_ids":[]}}`)),
+		Layers: []ocispec.Descriptor{r.addBlob("application/vnd.dev.cosign.simplesigning.v1+json",
+			[]byte(fmt.Sprintf(`{"critical":{"image":{"docker-manifest-digest":%q}}}`, chart.Digest)))},
+	}
+	sig.Layers[0].Annotations = map[string]string{"dev.cosignproject.cosign/signature": "MEUCIQ"}
+	sig.SchemaVersion = 2
+	tag := cosignSignatureTag(chart.Digest)
+	sigDesc := r.addManifest(t, ocispec.MediaTypeImageManifest, sig, tag)
+
+	m := newOCITestManifests(t, r, Config{})
+	repo := "/v2/" + r.host() + "/charts/foo/"
+	get(t, m.Handle, http.MethodGet, repo+"manifests/1.0.0")
+	rec := get(t, m.Handle, http.MethodGet, repo+"manifests/"+tag)
+	if d := rec.Header().Get("Docker-Content-Digest"); d != sigDesc.Digest.String() {
+		t.Errorf("Docker-Content-Digest = %s; want %s", d, sigDesc.Digest)
+	}
+	for _, desc := range append([]ocispec.Descriptor{sig.Config}, sig.Layers...) {
+		h, _ := v1.NewHash(desc.Digest.String())
+		if _, err := m.blobHandler.Get(context.Background(), "", h); err != nil {
+			t.Errorf("signature blob %s: %v", desc.Digest, err)
+		}
+	}
+
+	var index ocispec.Index
+	rec = get(t, m.HandleReferrers, http.MethodGet, repo+"referrers/"+chart.Digest.String())
+	if err := json.Unmarshal(rec.Body.Bytes(), &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 1 || index.Manifests[0].Digest != sigDesc.Digest || index.Manifests[0].ArtifactType != CosignSignatureArtifactType {
+		t.Errorf("referrers = %+v; want the signature %s", index.Manifests, sigDesc.Digest)
+	}
+
+	// chart repositories have no signatures to look for
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	hm := newTestManifests(t, u, Config{})
+	err := hm.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/"+u.host()+"/foo/manifests/"+tag, nil))
+	if regErr, ok := err.(*errors.RegError); !ok || regErr.Code != errors.CodeManifestUnknown {
+		t.Errorf("err = %v; want %s", err, errors.CodeManifestUnknown)
+	}
+	if n := atomic.LoadInt32(&u.indexRequests); n != 0 {
+		t.Errorf("index fetched %d times for a signature; want 0", n)
+	}
+}
+
+func TestOCIBlobDigestRetries(t *testing.T) {
+	for _, retries := range []int{0, 1} {
+		r := newTestRegistry(t)
+		chart := r.addChart(t, "chart", "1.0.0")
+		r.corrupt = 1
+		m := newOCITestManifests(t, r, Config{BlobDigestRetries: retries})
+		err := m.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/"+r.host()+"/charts/foo/manifests/1.0.0", nil))
+		if retries == 0 {
+			if err == nil {
+				t.Error("corrupted blob accepted without retries")
+			}
+		} else if err != nil {
+			t.Errorf("retries %d: %v", retries, err)
+		}
+
+		r.lock.Lock()
+		data := r.manifests[chart.Digest.String()].data
+		r.lock.Unlock()
+		var om ocispec.Manifest
+		if err = json.Unmarshal(data, &om); err != nil {
+			t.Fatal(err)
+		}
+		// the config is fetched first, it's the corrupted one
+		h, _ := v1.NewHash(om.Config.Digest.String())
+		_, err = m.blobHandler.Get(context.Background(), "", h)
+		if stored := err == nil; stored != (retries > 0) {
+			t.Errorf("retries %d: config stored = %v; want %v", retries, stored, retries > 0)
+		}
+	}
+}
+
+func TestOCIChartConfig(t *testing.T) {
+	r := newTestRegistry(t)
+	r.addChart(t, "valid", "1.0.0")
+	layer := r.addBlob(helmregistry.ChartLayerMediaType, []byte("chart"))
+	for tag, config := range map[string]ocispec.Descriptor{
+		"corrupt": r.addBlob(helmregistry.ConfigMediaType, []byte(`{"name":`)),
+		"unnamed": r.addBlob(helmregistry.ConfigMediaType, []byte(`{"version":"1.0.0"}`)),
+		"missing": r.addBlob(ocispec.MediaTypeImageConfig, []byte(`{}`)),
+	} {
+		om := ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Config: config, Layers: []ocispec.Descriptor{layer}}
+		om.SchemaVersion = 2
+		r.addManifest(t, ocispec.MediaTypeImageManifest, om, tag)
+	}
+	m := newOCITestManifests(t, r, Config{})
+	repo := "/v2/" + r.host() + "/charts/foo/manifests/"
+
+	if rec := get(t, m.Handle, http.MethodGet, repo+"1.0.0"); rec.Code != http.StatusOK {
+		t.Errorf("valid chart status = %d; want 200", rec.Code)
+	}
+	for _, tag := range []string{"corrupt", "unnamed", "missing"} {
+		regErr := handleErr(t, m.Handle, http.MethodGet, repo+tag)
+		if regErr.Status != http.StatusBadGateway || regErr.Code != errors.CodeManifestInvalid {
+			t.Errorf("%s config: got %d %s; want 502 %s", tag, regErr.Status, regErr.Code, errors.CodeManifestInvalid)
+		}
+	}
+	h, _ := v1.NewHash(layer.Digest.String())
+	if _, err := m.blobHandler.Get(context.Background(), "", h); err == nil {
+		t.Error("layer of a rejected chart kept")
+	}
+}
+
+func TestOCIEmptyConfig(t *testing.T) {
+	r := newTestRegistry(t)
+	// the registry doesn't hold the empty config, like those its pushers skip
+	empty := ocispec.Descriptor{MediaType: "application/vnd.oci.empty.v1+json", Digest: digest.FromBytes([]byte("{}")), Size: 2}
+	om := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    empty,
+		Layers:    []ocispec.Descriptor{r.addBlob("text/plain", []byte("notes"))},
+	}
+	om.SchemaVersion = 2
+	r.addManifest(t, ocispec.MediaTypeImageManifest, om, "notes")
+
+	m := newOCITestManifests(t, r, Config{})
+	rec := get(t, m.Handle, http.MethodGet, "/v2/"+r.host()+"/charts/foo/manifests/notes")
+	var got ocispec.Manifest
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Config.Digest != empty.Digest || got.Config.Size != empty.Size || got.Config.MediaType != empty.MediaType {
+		t.Errorf("config = %+v; want %+v", got.Config, empty)
+	}
+	h, _ := v1.NewHash(empty.Digest.String())
+	rc, err := m.blobHandler.Get(context.Background(), "", h)
+	if err != nil {
+		t.Fatalf("empty config not stored: %v", err)
+	}
+	defer rc.Close()
+	if b, _ := io.ReadAll(rc); string(b) != "{}" {
+		t.Errorf("empty config = %q; want {}", b)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if n := r.requests["/v2/charts/foo/blobs/"+empty.Digest.String()]; n != 0 {
+		t.Errorf("empty config fetched %d times; want 0", n)
+	}
+}
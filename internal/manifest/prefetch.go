@@ -0,0 +1,75 @@
+package manifest
+
+import (
+	"context"
+	"github.com/Masterminds/semver/v3"
+	"strings"
+)
+
+// maxPrefetches bounds the prefetches running at once, pulls finding them
+// all busy don't prefetch.
+const maxPrefetches = 4
+
+// prefetchNext prepares the version following repo:version in the background
+// when PrefetchNext is set, pipelines pulling a version often pull the next
+// one soon after. Must be called with the lock held.
+func (m *Manifests) prefetchNext(repo string, version string) {
+	host, _, _ := strings.Cut(repo, "/")
+	if !m.config.PrefetchNext || m.config.ReadOnly || isDigest(version) || m.isOCIUpstream(host) {
+		return
+	}
+	select {
+	case m.prefetches <- struct{}{}:
+	default:
+		return
+	}
+	go func() {
+		defer func() { <-m.prefetches }()
+		ctx := context.Background()
+		next, ok := m.nextVersion(ctx, repo, version)
+		if !ok {
+			return
+		}
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		if _, ok := m.manifests[repo][next]; ok {
+			return
+		}
+		if _, err := m.refresh(ctx, repo, next); err != nil {
+			m.log.Printf("prefetching %s:%s failed: %v", repo, next, err)
+		}
+	}()
+}
+
+// nextVersion returns the tag of the lowest version of repo above version,
+// prereleases only follow prereleases. Yanked versions are skipped.
+func (m *Manifests) nextVersion(ctx context.Context, repo string, version string) (string, bool) {
+	i := strings.LastIndex(repo, "/")
+	chart := repo[i+1:]
+	index, err := m.chartIndex(ctx, repo[:i], chart)
+	if err != nil {
+		return "", false
+	}
+	var current *semver.Version
+	for _, cv := range index.Entries[chart] {
+		if m.clientTag(cv.Version) == version {
+			current, _ = semver.NewVersion(cv.Version)
+			break
+		}
+	}
+	if current == nil {
+		return "", false
+	}
+	var next *semver.Version
+	var tag string
+	for _, cv := range index.Entries[chart] {
+		v, err := semver.NewVersion(cv.Version)
+		if err != nil || !v.GreaterThan(current) || (v.Prerelease() != "" && current.Prerelease() == "") {
+			continue
+		}
+		if t := m.clientTag(cv.Version); (next == nil || v.LessThan(next)) && !m.unlisted(repo, t) {
+			next, tag = v, t
+		}
+	}
+	return tag, next != nil
+}
@@ -0,0 +1,48 @@
+package manifest
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPrefetchNext(t *testing.T) {
+	charts := []testChart{
+		{name: "foo", version: "1.0.0"},
+		{name: "foo", version: "1.1.0-rc.1"},
+		{name: "foo", version: "1.1.0"},
+		{name: "foo", version: "2.0.0"},
+	}
+	for _, enabled := range []bool{false, true} {
+		u := newTestUpstream(t, charts...)
+		m := newTestManifests(t, u, Config{PrefetchNext: enabled})
+		repo := u.host() + "/foo"
+		get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/1.0.0")
+
+		cached := func(version string) bool {
+			m.lock.Lock()
+			defer m.lock.Unlock()
+			_, ok := m.manifests[repo][version]
+			return ok
+		}
+		if !enabled {
+			time.Sleep(50 * time.Millisecond)
+			if cached("1.1.0") {
+				t.Error("1.1.0 prefetched while disabled")
+			}
+			continue
+		}
+		eventually(t, func() bool { return cached("1.1.0") }, "1.1.0 not prefetched")
+		// only the next version is, not the ones after it
+		time.Sleep(50 * time.Millisecond)
+		for _, v := range []string{"1.1.0-rc.1", "2.0.0"} {
+			if cached(v) {
+				t.Errorf("%s prefetched", v)
+			}
+		}
+		if n := atomic.LoadInt32(&u.tarballRequests); n != 2 {
+			t.Errorf("%d archives fetched; want 2", n)
+		}
+	}
+}
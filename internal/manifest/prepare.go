@@ -0,0 +1,87 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"net/http"
+)
+
+// preparation is a prepare of a reference running, callers preparing the same
+// one wait for done and share its err, unless its caller went away.
+type preparation struct {
+	done     chan struct{}
+	err      *errors.RegError
+	canceled bool
+}
+
+// prepareChart prepares repo:reference from its upstream, cached for scope.
+// Distinct references are prepared at once, MaxConcurrentPrepares at most, a
+// reference already being prepared for the same scope is waited for instead
+// of fetched twice. Must be called with the lock held, it's released while
+// waiting.
+func (m *Manifests) prepareChart(ctx context.Context, repo string, reference string, scope string) *errors.RegError {
+	key := repo + ":" + reference
+	if scope != "" {
+		key += "@" + scope
+	}
+	if p, ok := m.preparing[key]; ok {
+		var err *errors.RegError
+		m.unlocked(func() {
+			select {
+			case <-p.done:
+			case <-ctx.Done():
+				err = prepareCanceledError(repo, reference, ctx.Err())
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if p.err != nil && p.canceled {
+			// its failure says nothing about the upstream
+			return m.prepareChart(ctx, repo, reference, scope)
+		}
+		return p.err
+	}
+	p := &preparation{done: make(chan struct{})}
+	m.preparing[key] = p
+	defer func() {
+		p.canceled = ctx.Err() != nil
+		delete(m.preparing, key)
+		close(p.done)
+	}()
+
+	if m.prepareSlot != nil {
+		m.unlocked(func() {
+			select {
+			case m.prepareSlot <- struct{}{}:
+			case <-ctx.Done():
+				p.err = prepareCanceledError(repo, reference, ctx.Err())
+			}
+		})
+		if p.err != nil {
+			return p.err
+		}
+		defer func() { <-m.prepareSlot }()
+	}
+	p.err = m.prepareUpstream(ctx, repo, reference, scope)
+	return p.err
+}
+
+// prepareCanceledError is returned to callers giving up waiting for the same
+// prepare or for one of the MaxConcurrentPrepares running.
+func prepareCanceledError(repo string, reference string, err error) *errors.RegError {
+	return &errors.RegError{
+		Status:  http.StatusServiceUnavailable,
+		Code:    errors.CodeUnavailable,
+		Message: fmt.Sprintf("Chart %s:%s wasn't prepared in time: %v", repo, reference, err),
+	}
+}
+
+// unlocked runs fn without the lock, so other references are served and
+// prepared meanwhile. Must be called with the lock held.
+func (m *Manifests) unlocked(fn func()) {
+	m.lock.Unlock()
+	defer m.lock.Lock()
+	fn()
+}
@@ -0,0 +1,157 @@
+package manifest
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPrepareTagsAtOnce(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"}, testChart{name: "foo", version: "2.0.0"})
+	// each download waits for the other one to start
+	var started sync.WaitGroup
+	started.Add(2)
+	u.onTarball = func() {
+		started.Done()
+		done := make(chan struct{})
+		go func() {
+			started.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("tags of the same repo weren't prepared at once")
+		}
+	}
+	m := newTestManifests(t, u, Config{})
+
+	var wg sync.WaitGroup
+	for _, version := range []string{"1.0.0", "2.0.0"} {
+		version := version
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/"+version)
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&u.tarballRequests); n != 2 {
+		t.Errorf("charts downloaded %d times; want 2", n)
+	}
+}
+
+func TestPrepareOCITagsAtOnce(t *testing.T) {
+	r := newTestRegistry(t)
+	r.addChart(t, "first", "1.0.0")
+	r.addChart(t, "second", "2.0.0")
+	// blob downloads wait for the other tag's to start
+	var started int32
+	both := make(chan struct{})
+	r.onBlob = func() {
+		if atomic.AddInt32(&started, 1) == 2 {
+			close(both)
+		}
+		select {
+		case <-both:
+		case <-time.After(5 * time.Second):
+			t.Error("tags of the same OCI repo weren't prepared at once")
+		}
+	}
+	m := newOCITestManifests(t, r, Config{})
+
+	var wg sync.WaitGroup
+	for _, version := range []string{"1.0.0", "2.0.0"} {
+		version := version
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := get(t, m.Handle, http.MethodGet, "/v2/"+r.host()+"/charts/foo/manifests/"+version)
+			if rec.Code != http.StatusOK {
+				t.Errorf("pulling %s: status = %d", version, rec.Code)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPrepareSameTagOnce(t *testing.T) {
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0"})
+	gate := make(chan struct{})
+	var downloading int32
+	u.onTarball = func() {
+		atomic.AddInt32(&downloading, 1)
+		<-gate
+	}
+	m := newTestManifests(t, u, Config{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/foo/manifests/1.0.0")
+		}()
+	}
+	eventually(t, func() bool {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		return len(m.preparing) == 1 && atomic.LoadInt32(&downloading) == 1
+	}, "chart wasn't being prepared")
+	// the other pulls wait for the download running
+	time.Sleep(20 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+	if n := atomic.LoadInt32(&u.tarballRequests); n != 1 {
+		t.Errorf("chart downloaded %d times; want 1", n)
+	}
+}
+
+func TestMaxConcurrentPrepares(t *testing.T) {
+	var charts []testChart
+	for i := 0; i < 8; i++ {
+		charts = append(charts, testChart{name: fmt.Sprintf("chart%d", i), version: "1.0.0"}, testChart{name: fmt.Sprintf("chart%d", i), version: "1.1.0"})
+	}
+	u := newTestUpstream(t, charts...)
+	var lock sync.Mutex
+	var running, most int
+	u.onTarball = func() {
+		lock.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		lock.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		lock.Lock()
+		running--
+		lock.Unlock()
+	}
+
+	const limit = 3
+	m := newTestManifests(t, u, Config{MaxConcurrentPrepares: limit, PrefetchNext: true})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("chart%d", i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			get(t, m.Handle, http.MethodGet, "/v2/"+u.host()+"/"+name+"/manifests/1.0.0")
+		}()
+		go func() {
+			defer wg.Done()
+			adminRequest(t, m, http.MethodPost, "/admin/prepare", []byte(`["`+u.host()+"/"+name+`:1.1.0"]`))
+		}()
+	}
+	wg.Wait()
+	eventually(t, func() bool { return len(m.prefetches) == 0 }, "prefetches didn't finish")
+
+	lock.Lock()
+	defer lock.Unlock()
+	if most > limit {
+		t.Errorf("%d charts prepared at once; want at most %d", most, limit)
+	}
+}
@@ -0,0 +1,19 @@
+package manifest
+
+import (
+	"context"
+	cerrors "errors"
+	"net/http"
+)
+
+// downloadProvenance returns the provenance file Helm publishes next to the
+// chart archive at archiveURL, none if the upstream has none for it.
+func (m *Manifests) downloadProvenance(ctx context.Context, archiveURL string) ([]byte, error) {
+	data, _, err := m.download(ctx, archiveURL+".prov")
+	var se *statusError
+	if cerrors.As(err, &se) && se.StatusCode >= http.StatusBadRequest && se.StatusCode < http.StatusInternalServerError {
+		// storages like S3 answer 403 for missing files
+		return nil, nil
+	}
+	return data, err
+}
@@ -0,0 +1,159 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"net/http"
+)
+
+// maxPushedManifestSize is the largest manifest accepted, as registries do.
+const maxPushedManifestSize = 4 << 20
+
+// handlePush stores a manifest pushed as repo:target when AllowPush is set,
+// seeding the cache. The blobs and child manifests it references must be
+// cached already, it expires like the manifests fetched upstream.
+func (m *Manifests) handlePush(resp http.ResponseWriter, req *http.Request, repo string, target string) error {
+	if !m.config.AllowPush || m.config.ReadOnly {
+		return &errors.RegError{
+			Status:  http.StatusMethodNotAllowed,
+			Code:    errors.CodeUnsupported,
+			Message: "Pushing manifests is disabled",
+		}
+	}
+	if target == "" {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    errors.CodeNameInvalid,
+			Message: fmt.Sprintf("No reference specified for %s, push a tag or a digest", repo),
+		}
+	}
+	data, err := io.ReadAll(io.LimitReader(req.Body, maxPushedManifestSize+1))
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+	if len(data) > maxPushedManifestSize {
+		return &errors.RegError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    errors.CodeSizeInvalid,
+			Message: fmt.Sprintf("Manifests are limited to %d bytes", maxPushedManifestSize),
+		}
+	}
+	d := digest.FromBytes(data)
+	if !matchesDigest(data, target) {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    errors.CodeDigestInvalid,
+			Message: fmt.Sprintf("Manifest digest is %s, not %s", d, target),
+		}
+	}
+	mediaType := req.Header.Get("Content-Type")
+	if !isManifestDescriptor(ocispec.Descriptor{MediaType: mediaType}) {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    errors.CodeManifestInvalid,
+			Message: fmt.Sprintf("Unsupported manifest media type %q", mediaType),
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	refs, rerr := m.pushedRefs(req.Context(), repo, mediaType, data)
+	if rerr != nil {
+		return rerr
+	}
+	ma := Manifest{
+		ContentType: mediaType,
+		Blob:        data,
+		Refs:        refs,
+		CreatedAt:   m.now(),
+		TTL:         m.entryTTL(),
+	}
+	for _, name := range []string{d.String(), target} {
+		if err = m.Write(repo, name, ma); err != nil {
+			return errors.RegErrInternal(err)
+		}
+	}
+	m.log.Printf("pushed %s:%s as %s", repo, target, d)
+
+	served := m.servedDigest(ma, target)
+	resp.Header().Set("Docker-Content-Digest", served.String())
+	resp.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", repo, served))
+	resp.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// pushedRefs checks everything a pushed manifest references is cached,
+// returning the digests of its blobs. Must be called with the lock held.
+func (m *Manifests) pushedRefs(ctx context.Context, repo string, mediaType string, data []byte) ([]string, *errors.RegError) {
+	invalid := func(err error) *errors.RegError {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    errors.CodeManifestInvalid,
+			Message: fmt.Sprintf("Manifest is invalid: %v", err),
+		}
+	}
+	switch mediaType {
+	case ocispec.MediaTypeImageIndex, MediaTypeManifestList:
+		var index ocispec.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, invalid(err)
+		}
+		for _, child := range index.Manifests {
+			if _, ok := m.manifests[repo][child.Digest.String()]; !ok {
+				return nil, &errors.RegError{
+					Status:  http.StatusBadRequest,
+					Code:    errors.CodeManifestBlobUnknown,
+					Message: fmt.Sprintf("Child manifest %s is unknown", child.Digest),
+				}
+			}
+		}
+		return nil, nil
+	case ocispec.MediaTypeImageManifest, MediaTypeManifest:
+		var om ocispec.Manifest
+		if err := json.Unmarshal(data, &om); err != nil {
+			return nil, invalid(err)
+		}
+		var refs []string
+		for _, desc := range append([]ocispec.Descriptor{om.Config}, om.Layers...) {
+			if len(desc.URLs) > 0 {
+				// foreign layers are fetched by clients themselves
+				continue
+			}
+			if !m.blobExists(ctx, desc.Digest) {
+				return nil, &errors.RegError{
+					Status:  http.StatusBadRequest,
+					Code:    errors.CodeManifestBlobUnknown,
+					Message: fmt.Sprintf("Blob %s is unknown", desc.Digest),
+				}
+			}
+			refs = append(refs, desc.Digest.String())
+		}
+		return refs, nil
+	}
+	return nil, invalid(fmt.Errorf("media type %s can't be pushed", mediaType))
+}
+
+// blobExists reports whether the blob store holds d.
+func (m *Manifests) blobExists(ctx context.Context, d digest.Digest) bool {
+	h, err := helper.NewHash(d.String())
+	if err != nil {
+		return false
+	}
+	if sh, ok := m.blobHandler.(handler.BlobStatHandler); ok {
+		_, err = sh.Stat(ctx, "", h)
+		return err == nil
+	}
+	rc, err := m.blobHandler.Get(ctx, "", h)
+	if err != nil {
+		return false
+	}
+	return rc.Close() == nil
+}
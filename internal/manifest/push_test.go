@@ -0,0 +1,101 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	helmregistry "helm.sh/helm/v3/pkg/registry"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func push(m *Manifests, path string, mediaType string, data []byte) (*httptest.ResponseRecorder, error) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", mediaType)
+	return rec, m.Handle(rec, req)
+}
+
+func TestPushManifest(t *testing.T) {
+	m := newTestManifests(t, nil, Config{AllowPush: true})
+	blob := func(mediaType string, data []byte, stored bool) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+		if stored {
+			h, _ := v1.NewHash(desc.Digest.String())
+			if err := m.blobHandler.(handler.BlobPutHandler).Put(context.Background(), "", h, io.NopCloser(bytes.NewReader(data))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return desc
+	}
+	manifest := func(layer ocispec.Descriptor) []byte {
+		om := ocispec.Manifest{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    blob(helmregistry.ConfigMediaType, []byte(`{"name":"foo","version":"1.0.0"}`), true),
+			Layers:    []ocispec.Descriptor{layer},
+		}
+		om.SchemaVersion = 2
+		data, err := json.Marshal(om)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	path := "/v2/example.com/foo/manifests/"
+
+	data := manifest(blob(helmregistry.ChartLayerMediaType, []byte("chart"), true))
+	rec, err := push(m, path+"1.0.0", ocispec.MediaTypeImageManifest, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusCreated || rec.Header().Get("Docker-Content-Digest") != digest.FromBytes(data).String() {
+		t.Errorf("push: %d, digest %s; want 201, %s", rec.Code, rec.Header().Get("Docker-Content-Digest"), digest.FromBytes(data))
+	}
+	for _, ref := range []string{"1.0.0", digest.FromBytes(data).String()} {
+		got := get(t, m.Handle, http.MethodGet, path+ref)
+		if !bytes.Equal(got.Body.Bytes(), data) || got.Header().Get("Content-Type") != ocispec.MediaTypeImageManifest {
+			t.Errorf("%s: got %s %s; want the pushed manifest", ref, got.Header().Get("Content-Type"), got.Body.Bytes())
+		}
+	}
+
+	missing := manifest(blob(helmregistry.ChartLayerMediaType, []byte("missing"), false))
+	for _, tc := range []struct {
+		name      string
+		mediaType string
+		data      []byte
+		code      errors.Code
+	}{
+		{"missing blob", ocispec.MediaTypeImageManifest, missing, errors.CodeManifestBlobUnknown},
+		{"unsupported media type", "application/json", data, errors.CodeManifestInvalid},
+		{"malformed", ocispec.MediaTypeImageManifest, []byte("{"), errors.CodeManifestInvalid},
+	} {
+		_, err := push(m, path+"2.0.0", tc.mediaType, tc.data)
+		if regErr, ok := err.(*errors.RegError); !ok || regErr.Status != http.StatusBadRequest || regErr.Code != tc.code {
+			t.Errorf("%s: err = %v; want 400 %s", tc.name, err, tc.code)
+		}
+	}
+	if _, err := m.Read("example.com/foo", "2.0.0"); err == nil {
+		t.Error("rejected manifest stored")
+	}
+	for _, target := range []string{"", "v"} {
+		_, err := push(m, path+target, ocispec.MediaTypeImageManifest, data)
+		if regErr, ok := err.(*errors.RegError); !ok || regErr.Status != http.StatusBadRequest {
+			t.Errorf("push to %q: err = %v; want 400", target, err)
+		}
+	}
+	if _, err := m.Read("example.com/foo", ""); err == nil {
+		t.Error("manifest stored under an empty tag")
+	}
+
+	m = newTestManifests(t, nil, Config{})
+	if _, err = push(m, path+"1.0.0", ocispec.MediaTypeImageManifest, data); err == nil {
+		t.Error("pushed while AllowPush is off")
+	}
+}
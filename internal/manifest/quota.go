@@ -0,0 +1,131 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/blobs/handler"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"sort"
+)
+
+// quotaPrefix returns the longest RepoQuotas prefix the repo of the manifests
+// key is under, the entries of every identity share its quota.
+func (m *Manifests) quotaPrefix(key string) (string, bool) {
+	repo, _ := splitScopedRepo(key)
+	return longestPrefix(m.config.RepoQuotas, repo)
+}
+
+// manifestSize is what a manifest and the blobs it refers to take.
+func manifestSize(ma Manifest) int64 {
+	size := int64(len(ma.Blob))
+	var om ocispec.Manifest
+	if err := json.Unmarshal(ma.Blob, &om); err != nil {
+		return size
+	}
+	refs := map[string]bool{}
+	for _, ref := range ma.Refs {
+		refs[ref] = true
+	}
+	for _, desc := range append([]ocispec.Descriptor{om.Config}, om.Layers...) {
+		if refs[desc.Digest.String()] {
+			size += desc.Size
+		}
+	}
+	return size
+}
+
+type quotaEntry struct {
+	repo string
+	ref  string
+	ma   Manifest
+}
+
+// enforceQuota evicts the oldest manifests of the repositories sharing the
+// quota of repo until they fit in it, keeping repo@keep. Tags go with the
+// manifest they point to, blobs no manifest left refers to are deleted. Must
+// be called with the lock held.
+func (m *Manifests) enforceQuota(ctx context.Context, repo string, keep digest.Digest) {
+	prefix, ok := m.quotaPrefix(repo)
+	if !ok {
+		return
+	}
+	var used int64
+	var entries []quotaEntry
+	for r, refs := range m.manifests {
+		if p, ok := m.quotaPrefix(r); !ok || p != prefix {
+			continue
+		}
+		for ref, ma := range refs {
+			if !isDigest(ref) {
+				// tags point to manifests also stored by digest
+				continue
+			}
+			used += manifestSize(ma)
+			if r != repo || ref != keep.String() {
+				entries = append(entries, quotaEntry{repo: r, ref: ref, ma: ma})
+			}
+		}
+	}
+	quota := m.config.RepoQuotas[prefix]
+	if used <= quota {
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ma.CreatedAt.Before(entries[j].ma.CreatedAt)
+	})
+
+	var evicted []string
+	for _, e := range entries {
+		if used <= quota {
+			break
+		}
+		for ref, ma := range m.manifests[e.repo] {
+			if ref == e.ref || digest.FromBytes(ma.Blob).String() == e.ref {
+				m.evict(e.repo, ref, EvictedQuota)
+			}
+		}
+		used -= manifestSize(e.ma)
+		evicted = append(evicted, e.ma.Refs...)
+		m.log.Printf("quota of %s exceeded, evicted %s@%s", prefix, e.repo, e.ref)
+	}
+	m.deleteUnreferenced(ctx, evicted)
+}
+
+// deleteUnreferenced deletes the blobs of digests no cached manifest refers
+// to anymore, blobs are shared by all repositories. Must be called with the
+// lock held.
+func (m *Manifests) deleteUnreferenced(ctx context.Context, digests []string) {
+	if len(digests) == 0 {
+		return
+	}
+	delHandler, _ := m.blobHandler.(handler.BlobDeleteHandler)
+	used := map[string]bool{}
+	for _, refs := range m.manifests {
+		for _, ma := range refs {
+			for _, ref := range ma.Refs {
+				used[ref] = true
+			}
+		}
+	}
+	var unused []string
+	for _, d := range digests {
+		if used[d] {
+			continue
+		}
+		used[d] = true
+		unused = append(unused, d)
+		if delHandler == nil {
+			continue
+		}
+		h, err := helper.NewHash(d)
+		if err != nil {
+			continue
+		}
+		if err = delHandler.Delete(ctx, "", h); err != nil {
+			m.log.Printf("deleting blob %s: %v", d, err)
+		}
+	}
+	m.forgetBlobs(unused)
+}
@@ -0,0 +1,150 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRepoQuotas(t *testing.T) {
+	u := newTestUpstream(t,
+		testChart{name: "foo", version: "1.0.0"},
+		testChart{name: "foo", version: "2.0.0"},
+		testChart{name: "foo", version: "3.0.0"},
+		testChart{name: "bar", version: "1.0.0"},
+		testChart{name: "bar", version: "2.0.0"},
+	)
+	foo, bar := u.host()+"/foo", u.host()+"/bar"
+	clock := &testClock{t: time.Now()}
+	pull := func(m *Manifests, repo, version string) ocispec.Manifest {
+		t.Helper()
+		clock.advance(time.Second)
+		var om ocispec.Manifest
+		if err := json.Unmarshal(get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/"+version).Body.Bytes(), &om); err != nil {
+			t.Fatal(err)
+		}
+		return om
+	}
+
+	// measure a chart without quotas first
+	m := newTestManifests(t, u, Config{})
+	m.now = clock.now
+	pull(m, foo, "1.0.0")
+	size := manifestSize(m.manifests[foo]["1.0.0"])
+
+	m = newTestManifests(t, u, Config{RepoQuotas: map[string]int64{foo: size*2 + size/2, bar: size}})
+	m.now = clock.now
+	oldest := pull(m, foo, "1.0.0")
+	pull(m, bar, "1.0.0")
+	pull(m, foo, "2.0.0")
+	pull(m, foo, "3.0.0")
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.manifests[foo]["1.0.0"]; ok {
+		t.Error("foo:1.0.0 not evicted")
+	}
+	for _, v := range []string{"2.0.0", "3.0.0"} {
+		if _, ok := m.manifests[foo][v]; !ok {
+			t.Errorf("foo:%s evicted", v)
+		}
+	}
+	if _, ok := m.manifests[bar]["1.0.0"]; !ok {
+		t.Error("bar:1.0.0 evicted by the quota of foo")
+	}
+	h, _ := v1.NewHash(oldest.Layers[0].Digest.String())
+	if _, err := m.blobHandler.Get(context.Background(), "", h); err == nil {
+		t.Error("layer of foo:1.0.0 not deleted")
+	}
+	if len(m.manifests[foo]) != 4 {
+		t.Errorf("foo has %d entries; want 2 tags and 2 digests", len(m.manifests[foo]))
+	}
+}
+
+func TestMaxChartVersions(t *testing.T) {
+	versions := []string{"1.0.0", "2.0.0", "1.5.0", "3.0.0-rc.1", "0.9.0", "2.1.0"}
+	var charts []testChart
+	for _, v := range versions {
+		charts = append(charts, testChart{name: "foo", version: v})
+	}
+	u := newTestUpstream(t, charts...)
+	m := newTestManifests(t, u, Config{MaxChartVersions: 3})
+	repo := u.host() + "/foo"
+	layers := map[string]string{}
+	for _, v := range versions {
+		var om ocispec.Manifest
+		if err := json.Unmarshal(get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/"+v).Body.Bytes(), &om); err != nil {
+			t.Fatal(err)
+		}
+		layers[v] = om.Layers[0].Digest.String()
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var tags []string
+	digests := 0
+	for ref := range m.manifests[repo] {
+		if isDigest(ref) {
+			digests++
+		} else {
+			tags = append(tags, ref)
+		}
+	}
+	sort.Strings(tags)
+	if want := []string{"2.0.0", "2.1.0", "3.0.0-rc.1"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("cached versions = %v; want %v", tags, want)
+	}
+	if digests != 3 {
+		t.Errorf("%d manifests cached by digest; want 3", digests)
+	}
+	for _, v := range []string{"0.9.0", "1.0.0", "1.5.0"} {
+		h, _ := v1.NewHash(layers[v])
+		if _, err := m.blobHandler.Get(context.Background(), "", h); err == nil {
+			t.Errorf("layer of evicted %s kept", v)
+		}
+	}
+}
+
+func TestMaxChartVersionsKeepsPulled(t *testing.T) {
+	var charts []testChart
+	for _, v := range []string{"0.9.0", "1.0.0", "2.0.0", "3.0.0"} {
+		charts = append(charts, testChart{name: "foo", version: v})
+	}
+	u := newTestUpstream(t, charts...)
+	m := newTestManifests(t, u, Config{MaxChartVersions: 3})
+	repo := u.host() + "/foo"
+	for _, v := range []string{"1.0.0", "2.0.0", "3.0.0"} {
+		get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/"+v)
+	}
+
+	// pulling an older version than the cached ones evicts the next lowest
+	var om ocispec.Manifest
+	if err := json.Unmarshal(get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/0.9.0").Body.Bytes(), &om); err != nil {
+		t.Fatal(err)
+	}
+	h, _ := v1.NewHash(om.Layers[0].Digest.String())
+	rc, err := m.blobHandler.Get(context.Background(), "", h)
+	if err != nil {
+		t.Fatalf("layer of the pulled 0.9.0 deleted: %v", err)
+	}
+	rc.Close()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var tags []string
+	for ref := range m.manifests[repo] {
+		if !isDigest(ref) {
+			tags = append(tags, ref)
+		}
+	}
+	sort.Strings(tags)
+	if want := []string{"0.9.0", "2.0.0", "3.0.0"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("cached versions = %v; want %v", tags, want)
+	}
+}
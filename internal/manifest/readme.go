@@ -0,0 +1,77 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"strings"
+	"unicode/utf8"
+)
+
+// ChartReadme modes
+const (
+	ReadmeModeAnnotation = "annotation"
+	ReadmeModeArtifact   = "artifact"
+)
+
+const (
+	// ReadmeAnnotation holds the README of a chart, up to maxReadmeAnnotation bytes
+	ReadmeAnnotation = "com.container-registry.helm.chart.readme"
+	// ReadmeArtifactType is the artifact type of the referrer holding the README of a chart
+	ReadmeArtifactType = "application/vnd.container-registry.helm.chart.readme.v1+json"
+	// ReadmeLayerMediaType is the media type of the README file of that referrer
+	ReadmeLayerMediaType = "text/markdown"
+
+	maxReadmeAnnotation = 4096
+)
+
+// chartReadme returns the README of ch, looked up like helm show readme does.
+func chartReadme(ch *chart.Chart) (string, []byte, bool) {
+	for _, name := range []string{"readme.md", "readme.txt", "readme"} {
+		for _, f := range ch.Files {
+			if strings.EqualFold(f.Name, name) {
+				return f.Name, f.Data, true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+// truncateReadme cuts data to maxReadmeAnnotation bytes, on a rune boundary.
+func truncateReadme(data []byte) string {
+	if len(data) <= maxReadmeAnnotation {
+		return string(data)
+	}
+	data = data[:maxReadmeAnnotation]
+	if r, _ := utf8.DecodeLastRune(data); r != utf8.RuneError {
+		return string(data)
+	}
+	// drop the start of a rune cut short, invalid bytes before are kept
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				data = data[:len(data)-i]
+			}
+			break
+		}
+	}
+	return string(data)
+}
+
+// storeReadme stores the README of a chart archive as a manifest referring
+// to the chart manifest subject. Charts without README are skipped.
+func (m *Manifests) storeReadme(ctx context.Context, repo string, scope string, subject ocispec.Descriptor, data []byte) error {
+	ch, err := loader.LoadArchive(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	name, readme, ok := chartReadme(ch)
+	if !ok {
+		return nil
+	}
+	return m.storeReferrer(ctx, repo, scope, subject, ReadmeArtifactType, []referrerFile{
+		{name: name, mediaType: ReadmeLayerMediaType, data: readme},
+	})
+}
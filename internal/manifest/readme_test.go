@@ -0,0 +1,87 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestChartReadme(t *testing.T) {
+	readme := "# foo\n\n" + strings.Repeat("Lorem ipsum dolor sit amet. ", 200)
+	u := newTestUpstream(t, testChart{name: "foo", version: "1.0.0", files: map[string]string{"README.md": readme}})
+	repo := u.host() + "/foo"
+
+	t.Run(ReadmeModeAnnotation, func(t *testing.T) {
+		m := newTestManifests(t, u, Config{ChartReadme: ReadmeModeAnnotation})
+		var om ocispec.Manifest
+		if err := json.Unmarshal(get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/1.0.0").Body.Bytes(), &om); err != nil {
+			t.Fatal(err)
+		}
+		got := om.Annotations[ReadmeAnnotation]
+		if len(got) != maxReadmeAnnotation || !strings.HasPrefix(readme, got) {
+			t.Errorf("annotation has %d bytes; want the first %d of the README", len(got), maxReadmeAnnotation)
+		}
+	})
+
+	t.Run(ReadmeModeArtifact, func(t *testing.T) {
+		m := newTestManifests(t, u, Config{ChartReadme: ReadmeModeArtifact})
+		chartDigest := digest.FromBytes(get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/1.0.0").Body.Bytes())
+
+		rec := get(t, m.HandleReferrers, http.MethodGet, "/v2/"+repo+"/referrers/"+chartDigest.String()+"?artifactType="+url.QueryEscape(ReadmeArtifactType))
+		var index ocispec.Index
+		if err := json.Unmarshal(rec.Body.Bytes(), &index); err != nil {
+			t.Fatal(err)
+		}
+		if len(index.Manifests) != 1 {
+			t.Fatalf("got %d README referrers; want 1", len(index.Manifests))
+		}
+		var om ocispec.Manifest
+		if err := json.Unmarshal(get(t, m.Handle, http.MethodGet, "/v2/"+repo+"/manifests/"+index.Manifests[0].Digest.String()).Body.Bytes(), &om); err != nil {
+			t.Fatal(err)
+		}
+		if len(om.Layers) != 1 || om.Layers[0].MediaType != ReadmeLayerMediaType {
+			t.Fatalf("layers = %+v; want one %s", om.Layers, ReadmeLayerMediaType)
+		}
+		h, err := v1.NewHash(om.Layers[0].Digest.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, err := m.blobHandler.Get(context.Background(), "", h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != readme {
+			t.Errorf("README artifact differs from the chart's README")
+		}
+	})
+}
+
+func TestTruncateReadme(t *testing.T) {
+	pad := strings.Repeat("a", maxReadmeAnnotation-2)
+	for _, tc := range []struct {
+		name   string
+		readme string
+		want   string
+	}{
+		{"short", "ab\xff", "ab\xff"},
+		{"cut rune", pad + "a€", pad + "a"},
+		{"invalid byte kept", "\xff" + pad + "€", "\xff" + pad},
+		{"whole rune", pad + "é", pad + "é"},
+	} {
+		if got := truncateReadme([]byte(tc.readme)); got != tc.want {
+			t.Errorf("%s: got %d bytes; want %d", tc.name, len(got), len(tc.want))
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// referrerManifest holds the fields of image and artifact manifests the
+// referrers API needs.
+type referrerManifest struct {
+	MediaType    string              `json:"mediaType"`
+	ArtifactType string              `json:"artifactType,omitempty"`
+	Config       ocispec.Descriptor  `json:"config"`
+	Subject      *ocispec.Descriptor `json:"subject,omitempty"`
+	Annotations  map[string]string   `json:"annotations,omitempty"`
+}
+
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#listing-referrers
+func (m *Manifests) HandleReferrers(resp http.ResponseWriter, req *http.Request) error {
+	elem := strings.Split(req.URL.Path, "/")
+	if len(elem) < 5 {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    errors.CodeNameInvalid,
+			Message: "No chart name specified",
+		}
+	}
+	subject, err := digest.Parse(elem[len(elem)-1])
+	if err != nil {
+		return errors.RegErrDigestInvalid
+	}
+	repo, _ := m.splitPath(req.URL.Path)
+	repo, rerr := m.resolveRepo(req, repo)
+	if rerr != nil {
+		return rerr
+	}
+	artifactType := req.URL.Query().Get("artifactType")
+	ctx := withClientAuth(req)
+	// only the referrers cached for the client's identity are listed
+	key := scopedRepo(repo, m.cacheScope(ctx, repo))
+
+	m.lock.Lock()
+	referrers := map[string]ocispec.Descriptor{}
+	indexed := m.referrers[key+"@"+subject.String()]
+	for ref := range indexed {
+		ma, ok := m.manifests[key][ref]
+		if !ok {
+			// evicted since
+			delete(indexed, ref)
+			continue
+		}
+		var rm referrerManifest
+		if err := json.Unmarshal(ma.Blob, &rm); err != nil {
+			continue
+		}
+		desc := ocispec.Descriptor{
+			MediaType:    ma.ContentType,
+			Digest:       digest.Digest(ref),
+			Size:         int64(len(ma.Blob)),
+			ArtifactType: rm.ArtifactType,
+			Annotations:  rm.Annotations,
+		}
+		if desc.ArtifactType == "" {
+			desc.ArtifactType = rm.Config.MediaType
+		}
+		if artifactType != "" && desc.ArtifactType != artifactType {
+			continue
+		}
+		referrers[ref] = desc
+	}
+	if host, _, _ := strings.Cut(repo, "/"); m.isOCIUpstream(host) {
+		// signatures cosign stored as sibling tags don't refer to their subject
+		if desc, ok := m.cosignReferrer(ctx, repo, subject); ok && (artifactType == "" || desc.ArtifactType == artifactType) {
+			referrers[desc.Digest.String()] = desc
+		}
+	}
+	m.lock.Unlock()
+
+	keys := make([]string, 0, len(referrers))
+	for k := range referrers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var n int
+	if ns := req.URL.Query().Get("n"); ns != "" {
+		if n, err = strconv.Atoi(ns); err != nil || n < 0 {
+			return &errors.RegError{
+				Status:  http.StatusBadRequest,
+				Code:    errors.CodeUnsupported,
+				Message: fmt.Sprintf("parsing n: %v", ns),
+			}
+		}
+	}
+	keys, more := paginate(keys, req.URL.Query().Get("last"), n)
+	if more {
+		setNextLink(resp, req, n, keys[len(keys)-1])
+	}
+
+	index := ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{},
+	}
+	index.SchemaVersion = 2
+	for _, k := range keys {
+		index.Manifests = append(index.Manifests, referrers[k])
+	}
+
+	msg, err := json.Marshal(index)
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+	if artifactType != "" {
+		resp.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+	resp.Header().Set("Content-Type", ocispec.MediaTypeImageIndex)
+	resp.Header().Set("Content-Length", fmt.Sprint(len(msg)))
+	resp.WriteHeader(http.StatusOK)
+	_, err = io.Copy(resp, bytes.NewReader(msg))
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package manifest
+
+import (
+	"encoding/json"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeReferrer stores an artifact manifest attached to subject.
+func writeReferrer(t *testing.T, m *Manifests, repo string, subject digest.Digest, artifactType string) digest.Digest {
+	t.Helper()
+	blob, err := json.Marshal(referrerManifest{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Subject:      &ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: subject},
+		Annotations:  map[string]string{"created": time.Now().String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := digest.FromBytes(blob)
+	if err := m.Write(repo, d.String(), Manifest{ContentType: ocispec.MediaTypeImageManifest, Blob: blob}); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestReferrersPagination(t *testing.T) {
+	m := newTestManifests(t, nil, Config{})
+	repo := "example.com/foo"
+	subject := digest.FromString("subject")
+	want := map[digest.Digest]bool{}
+	for i := 0; i < 5; i++ {
+		want[writeReferrer(t, m, repo, subject, "application/vnd.example.sig")] = true
+	}
+	writeReferrer(t, m, repo, digest.FromString("other"), "application/vnd.example.sig")
+
+	path := "/v2/" + repo + "/referrers/" + subject.String() + "?n=2"
+	var pages int
+	got := map[digest.Digest]bool{}
+	for ; path != ""; pages++ {
+		rec := get(t, m.HandleReferrers, http.MethodGet, path)
+		var index ocispec.Index
+		if err := json.Unmarshal(rec.Body.Bytes(), &index); err != nil {
+			t.Fatal(err)
+		}
+		if len(index.Manifests) > 2 {
+			t.Fatalf("page has %d referrers; want at most 2", len(index.Manifests))
+		}
+		for _, desc := range index.Manifests {
+			got[desc.Digest] = true
+		}
+		path = ""
+		if link := rec.Header().Get("Link"); link != "" {
+			path = strings.TrimPrefix(strings.Split(link, ">")[0], "<")
+		}
+	}
+	if pages != 3 {
+		t.Errorf("got %d pages; want 3", pages)
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %d referrers; want %d", len(got), len(want))
+	}
+	for d := range want {
+		if !got[d] {
+			t.Errorf("referrer %s missing", d)
+		}
+	}
+}
+
+func TestReferrersOfMirroredArtifact(t *testing.T) {
+	r := newTestRegistry(t)
+	chart := r.addChart(t, "chart", "1.0.0")
+	artifact := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    r.addBlob("application/vnd.example.sbom", []byte("{}")),
+		Layers:    []ocispec.Descriptor{r.addBlob("application/spdx+json", []byte(`{"spdxVersion":"SPDX-2.3"}`))},
+		Subject:   &ocispec.Descriptor{MediaType: chart.MediaType, Digest: chart.Digest, Size: chart.Size},
+	}
+	artifact.SchemaVersion = 2
+	artifactDesc := r.addManifest(t, ocispec.MediaTypeImageManifest, artifact)
+
+	m := newOCITestManifests(t, r, Config{})
+	repo := "/v2/" + r.host() + "/charts/foo/"
+	get(t, m.Handle, http.MethodGet, repo+"manifests/1.0.0")
+	get(t, m.Handle, http.MethodGet, repo+"manifests/"+artifactDesc.Digest.String())
+
+	referrers := func() []ocispec.Descriptor {
+		var index ocispec.Index
+		if err := json.Unmarshal(get(t, m.HandleReferrers, http.MethodGet, repo+"referrers/"+chart.Digest.String()).Body.Bytes(), &index); err != nil {
+			t.Fatal(err)
+		}
+		return index.Manifests
+	}
+	if got := referrers(); len(got) != 1 || got[0].Digest != artifactDesc.Digest || got[0].ArtifactType != "application/vnd.example.sbom" {
+		t.Errorf("referrers = %+v; want the artifact %s", got, artifactDesc.Digest)
+	}
+
+	// evicted artifacts aren't listed anymore
+	m.lock.Lock()
+	delete(m.manifests[r.host()+"/charts/foo"], artifactDesc.Digest.String())
+	m.lock.Unlock()
+	if got := referrers(); len(got) != 0 {
+		t.Errorf("referrers = %+v after eviction; want none", got)
+	}
+}
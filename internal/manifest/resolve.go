@@ -0,0 +1,118 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"net/http"
+	"strings"
+)
+
+type resolveResult struct {
+	Repository string `json:"repository"`
+	Reference  string `json:"reference"`
+	Version    string `json:"version"`
+	Digest     string `json:"digest"`
+	MediaType  string `json:"mediaType"`
+}
+
+// handleResolve resolves /admin/resolve/<repo>/<reference> to the concrete
+// version and manifest digest it pulls. The reference may be a version, a
+// semver constraint like ^1.2 or latest, for the highest version.
+func (m *Manifests) handleResolve(resp http.ResponseWriter, req *http.Request) error {
+	p := strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin/resolve/"), "/")
+	sep := strings.LastIndex(p, "/")
+	if sep < 0 || strings.Count(p[:sep], "/") < 1 {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    errors.CodeNameInvalid,
+			Message: "No chart name or reference specified",
+		}
+	}
+	repo, reference := m.canonicalRepo(p[:sep]), p[sep+1:]
+	repo, rerr := m.resolveRepo(req, repo)
+	if rerr != nil {
+		return rerr
+	}
+	// the Authorization of admin requests carries the admin token, it's never
+	// relayed upstream
+	ctx := req.Context()
+
+	version, rerr := m.resolveVersion(ctx, repo, reference)
+	if rerr != nil {
+		return rerr
+	}
+
+	m.lock.Lock()
+	ma, lerr := m.lookup(ctx, repo, version)
+	m.lock.Unlock()
+	if lerr != nil {
+		return lerr
+	}
+	msg, err := json.Marshal(resolveResult{
+		Repository: repo,
+		Reference:  reference,
+		Version:    version,
+		Digest:     m.servedDigest(ma, version).String(),
+		MediaType:  ma.ContentType,
+	})
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	_, err = resp.Write(msg)
+	return err
+}
+
+// resolveVersion returns the version of repo a version, semver constraint or
+// latest reference pulls, latest as the LatestPolicies of repo says. Indexes
+// are fetched without the lock.
+func (m *Manifests) resolveVersion(ctx context.Context, repo string, reference string) (string, *errors.RegError) {
+	version := strings.TrimPrefix(reference, "v")
+	host, _, _ := strings.Cut(repo, "/")
+	policy := ""
+	if reference == "latest" {
+		policy = m.latestPolicy(repo)
+	}
+	switch {
+	case policy == LatestTag:
+		// pulled as is
+	case policy != "" && m.isOCIUpstream(host):
+		tag, err := m.latestOCITag(ctx, repo, policy == LatestPrerelease)
+		if err != nil {
+			return "", err
+		}
+		version = tag
+	case !isDigest(reference) && !m.isOCIUpstream(host):
+		chartPath, chart := repo[:strings.LastIndex(repo, "/")], repo[strings.LastIndex(repo, "/")+1:]
+		index, err := m.chartIndex(ctx, chartPath, chart)
+		if err != nil {
+			return "", upstreamRegError(err, &errors.RegError{
+				Status:  http.StatusNotFound,
+				Code:    errors.CodeNameUnknown,
+				Message: fmt.Sprintf("index file fetch error: %s", chartPath),
+			})
+		}
+		constraint := reference
+		if policy == LatestStable {
+			constraint = ""
+		} else if policy == LatestPrerelease {
+			constraint = ">=0.0.0-0"
+		}
+		cv, err := index.Get(chart, constraint)
+		if err != nil {
+			return "", &errors.RegError{
+				Status:  http.StatusNotFound,
+				Code:    errors.CodeManifestUnknown,
+				Message: fmt.Sprintf("Chart: %s version: %s not found: %v", chart, reference, err),
+			}
+		}
+		version = m.clientTag(cv.Version)
+	}
+	if m.unlisted(repo, version) {
+		return "", m.unlistedError(repo, version)
+	}
+	return version, nil
+}
@@ -0,0 +1,40 @@
+package manifest
+
+import (
+	"helm.sh/helm/v3/pkg/repo"
+	"regexp"
+	"strings"
+)
+
+// TagRewrite turns upstream chart versions matching Pattern into the tag
+// clients use, Replacement may refer to submatches like $1.
+type TagRewrite struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// clientTag returns the tag version is served as, rewritten by the first
+// matching TagRewrites rule.
+func (m *Manifests) clientTag(version string) string {
+	for _, r := range m.config.TagRewrites {
+		if r.Pattern.MatchString(version) {
+			version = r.Pattern.ReplaceAllString(version, r.Replacement)
+			break
+		}
+	}
+	return strings.TrimPrefix(version, "v")
+}
+
+// upstreamVersion finds the version of chart served as tag, rules can't be
+// reversed so every version of the chart is rewritten until one matches.
+func (m *Manifests) upstreamVersion(index *repo.IndexFile, chart string, tag string) (*repo.ChartVersion, bool) {
+	if len(m.config.TagRewrites) == 0 || tag == "" {
+		return nil, false
+	}
+	for _, cv := range index.Entries[chart] {
+		if m.clientTag(cv.Version) == tag {
+			return cv, true
+		}
+	}
+	return nil, false
+}
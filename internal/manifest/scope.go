@@ -0,0 +1,71 @@
+package manifest
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+)
+
+// newScopeKey returns the key identities are hashed with, random so the
+// credentials can't be guessed from exported entries.
+func newScopeKey() []byte {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return key
+}
+
+// cacheScope is the identity the entries of repo fetched with the client
+// credentials of ctx are cached for, a hash of the credentials. It's empty
+// for anonymous clients and when the upstream of repo doesn't receive them,
+// the entries are the same for everyone then.
+func (m *Manifests) cacheScope(ctx context.Context, repo string) string {
+	auth, ok := ctx.Value(clientAuthKey{}).(string)
+	if !ok || !m.authPassthrough(repoHost(repo)) {
+		return ""
+	}
+	mac := hmac.New(sha256.New, m.scopeKey)
+	mac.Write([]byte(auth))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// scopedRepo is the key the entries of repo cached for scope are stored under
+// in manifests, so entries of distinct identities never replace each other.
+// resolveRepo rejects repository names containing @.
+func scopedRepo(repo string, scope string) string {
+	if scope == "" {
+		return repo
+	}
+	return repo + "@" + scope
+}
+
+// splitScopedRepo returns the repository and the scope of a manifests key.
+func splitScopedRepo(key string) (string, string) {
+	repo, scope, _ := strings.Cut(key, "@")
+	return repo, scope
+}
+
+// visibleRepo returns the repository of the manifests key and whether its
+// entries are the ones served to the client of ctx, the others were fetched
+// for other identities.
+func (m *Manifests) visibleRepo(ctx context.Context, key string) (string, bool) {
+	repo, _ := splitScopedRepo(key)
+	return repo, key == scopedRepo(repo, m.cacheScope(ctx, repo))
+}
+
+// scopedKeys returns the manifests keys of repo, the shared one first, then
+// the ones of every identity it's cached for. Must be called with the lock
+// held.
+func (m *Manifests) scopedKeys(repo string) []string {
+	var scoped []string
+	for key := range m.manifests {
+		if r, scope := splitScopedRepo(key); r == repo && scope != "" {
+			scoped = append(scoped, key)
+		}
+	}
+	sort.Strings(scoped)
+	return append([]string{repo}, scoped...)
+}
@@ -0,0 +1,85 @@
+package manifest
+
+import (
+	"encoding/json"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type searchResult struct {
+	Repository string   `json:"repository"`
+	Tags       []string `json:"tags"`
+	rank       int
+}
+
+// matchRank ranks how well the chart name matches q: 0 for the exact name,
+// 1 for a prefix, 2 for a substring and -1 for no match.
+func matchRank(name, q string) int {
+	switch name, q = strings.ToLower(name), strings.ToLower(q); {
+	case name == q:
+		return 0
+	case strings.HasPrefix(name, q):
+		return 1
+	case strings.Contains(name, q):
+		return 2
+	}
+	return -1
+}
+
+// handleSearch lists the cached repositories whose chart name contains the q
+// query parameter, best matches first.
+func (m *Manifests) handleSearch(resp http.ResponseWriter, req *http.Request) error {
+	q := strings.TrimSpace(req.URL.Query().Get("q"))
+	if q == "" {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    errors.CodeUnsupported,
+			Message: "missing q",
+		}
+	}
+
+	// the entries of every identity are searched, their tags merged
+	tags := map[string]map[string]bool{}
+	for key, refs := range m.snapshot() {
+		repo, _ := splitScopedRepo(key)
+		if matchRank(repo[strings.LastIndex(repo, "/")+1:], q) < 0 {
+			continue
+		}
+		if tags[repo] == nil {
+			tags[repo] = map[string]bool{}
+		}
+		for ref := range refs {
+			if !isDigest(ref) && !m.unlisted(repo, ref) {
+				tags[repo][ref] = true
+			}
+		}
+	}
+	results := []searchResult{}
+	for repo, set := range tags {
+		res := searchResult{Repository: repo, Tags: []string{}, rank: matchRank(repo[strings.LastIndex(repo, "/")+1:], q)}
+		for ref := range set {
+			res.Tags = append(res.Tags, ref)
+		}
+		sort.Strings(res.Tags)
+		results = append(results, res)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].rank != results[j].rank {
+			return results[i].rank < results[j].rank
+		}
+		return results[i].Repository < results[j].Repository
+	})
+
+	msg, err := json.Marshal(struct {
+		Results []searchResult `json:"results"`
+	}{results})
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	_, err = resp.Write(msg)
+	return err
+}
@@ -0,0 +1,22 @@
+package manifest
+
+import (
+	"net/http"
+	"strings"
+)
+
+// RequestSigner signs the requests sent to an upstream host of
+// UpstreamSigners, like with sigv4.Signer for cloud storages.
+type RequestSigner interface {
+	Sign(req *http.Request) error
+}
+
+// sign signs req with the UpstreamSigners entry of its host, if any. It runs
+// last, right before req is sent, so every header set before is signed.
+func (m *Manifests) sign(req *http.Request) error {
+	signer, ok := m.config.UpstreamSigners[strings.ToLower(req.URL.Host)]
+	if !ok {
+		return nil
+	}
+	return signer.Sign(req)
+}
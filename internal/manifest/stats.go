@@ -0,0 +1,115 @@
+package manifest
+
+import (
+	"encoding/json"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// maxCounterKeys bounds the keys a counter set counts by
+	maxCounterKeys = 10000
+	// otherKey counts the keys over maxCounterKeys
+	otherKey = "other"
+)
+
+type stats struct {
+	Pulls         map[string]int64 `json:"pulls"`
+	ManifestBytes map[string]int64 `json:"manifestBytes"`
+	BlobBytes     map[string]int64 `json:"blobBytes"`
+	UpstreamBytes map[string]int64 `json:"upstreamBytes"`
+	Evictions     map[string]int64 `json:"evictions"`
+}
+
+// counters is a set of counters updated without taking a lock.
+type counters struct {
+	values sync.Map // key -> *int64
+	keys   int64
+}
+
+func (c *counters) add(key string, n int64) {
+	v, ok := c.values.Load(key)
+	if !ok {
+		if atomic.LoadInt64(&c.keys) >= maxCounterKeys {
+			key = otherKey
+		}
+		var loaded bool
+		if v, loaded = c.values.LoadOrStore(key, new(int64)); !loaded && key != otherKey {
+			atomic.AddInt64(&c.keys, 1)
+		}
+	}
+	atomic.AddInt64(v.(*int64), n)
+}
+
+func (c *counters) snapshot() map[string]int64 {
+	res := map[string]int64{}
+	c.values.Range(func(k, v interface{}) bool {
+		res[k.(string)] = atomic.LoadInt64(v.(*int64))
+		return true
+	})
+	return res
+}
+
+// countPull records a pull of repo:reference.
+func (m *Manifests) countPull(repo string, reference string) {
+	m.pulls.add(repo+":"+reference, 1)
+}
+
+// countManifestBytes records n bytes of manifests of repo served.
+func (m *Manifests) countManifestBytes(repo string, n int) {
+	m.manifestBytes.add(repoHost(repo), int64(n))
+}
+
+// CountBlobBytes records n bytes of blobs of repo served.
+func (m *Manifests) CountBlobBytes(repo string, n int64) {
+	m.blobBytes.add(repoHost(repo), n)
+}
+
+func repoHost(repo string) string {
+	host, _, _ := strings.Cut(repo, "/")
+	return host
+}
+
+// countedBody counts what's read of the body of resp as fetched from its host.
+func (m *Manifests) countedBody(resp *http.Response) io.ReadCloser {
+	return &countingReadCloser{ReadCloser: resp.Body, count: func(n int) {
+		m.upstreamBytes.add(resp.Request.URL.Host, int64(n))
+	}}
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	count func(n int)
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.count(n)
+	}
+	return n, err
+}
+
+// handleStats writes the pull counts, the bytes served and fetched by host and
+// the evictions by reason.
+func (m *Manifests) handleStats(resp http.ResponseWriter) error {
+	res := stats{
+		Pulls:         m.pulls.snapshot(),
+		ManifestBytes: m.manifestBytes.snapshot(),
+		BlobBytes:     m.blobBytes.snapshot(),
+		UpstreamBytes: m.upstreamBytes.snapshot(),
+		Evictions:     m.evictions.snapshot(),
+	}
+	msg, err := json.Marshal(res)
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	_, err = resp.Write(msg)
+	return err
+}
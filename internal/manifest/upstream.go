@@ -0,0 +1,283 @@
+package manifest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	cerrors "errors"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// UpstreamHeader lets trusted callers name the upstream repository of a
+// request, bypassing the one in the path.
+const UpstreamHeader = "X-Upstream-Repo"
+
+type clientAuthKey struct{}
+
+// newUpstreamClient returns the client shared by all upstream requests, so
+// idle connections are reused across charts. Hosts with their own CA bundle
+// or skipping verification get their own transport, FileUpstreams one reading
+// their directory. HTTPFallbackHosts are retried over plain HTTP.
+func newUpstreamClient(config Config, log logrus.StdLogger) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if config.UpstreamMaxIdleConns > 0 {
+		t.MaxIdleConns = config.UpstreamMaxIdleConns
+	}
+	if config.UpstreamMaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = config.UpstreamMaxIdleConnsPerHost
+	}
+	if config.UpstreamIdleConnTimeout > 0 {
+		t.IdleConnTimeout = config.UpstreamIdleConnTimeout
+	}
+
+	tlsConfigs := map[string]*tls.Config{}
+	for host, bundle := range config.UpstreamCAs {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pool.AppendCertsFromPEM(bundle)
+		tlsConfigs[strings.ToLower(host)] = &tls.Config{RootCAs: pool}
+	}
+	for _, host := range config.InsecureSkipVerifyHosts {
+		log.Printf("WARNING: TLS certificates of %s are NOT verified, connections to it can be intercepted", host)
+		c, ok := tlsConfigs[strings.ToLower(host)]
+		if !ok {
+			c = &tls.Config{}
+			tlsConfigs[strings.ToLower(host)] = c
+		}
+		c.InsecureSkipVerify = true
+	}
+	byHost := map[string]http.RoundTripper{}
+	for host, c := range tlsConfigs {
+		ht := t.Clone()
+		ht.TLSClientConfig = c
+		byHost[host] = ht
+	}
+	for host, dir := range config.FileUpstreams {
+		byHost[strings.ToLower(host)] = http.NewFileTransport(http.Dir(strings.TrimPrefix(dir, "file://")))
+	}
+	for _, host := range config.HTTPFallbackHosts {
+		log.Printf("WARNING: %s is fetched over plain HTTP when HTTPS fails, connections to it can be intercepted", host)
+		rt, ok := byHost[strings.ToLower(host)]
+		if !ok {
+			rt = t
+		}
+		byHost[strings.ToLower(host)] = &httpFallbackTransport{base: rt}
+	}
+	if len(byHost) == 0 {
+		return &http.Client{Transport: t}
+	}
+	return &http.Client{Transport: &hostTransport{base: t, byHost: byHost}}
+}
+
+// hostTransport sends requests with the transport of their host, if any.
+type hostTransport struct {
+	base   http.RoundTripper
+	byHost map[string]http.RoundTripper
+}
+
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt, ok := t.byHost[strings.ToLower(req.URL.Host)]; ok {
+		return rt.RoundTrip(req)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// httpFallbackTransport sends requests failing over HTTPS again over plain
+// HTTP, for development upstreams not serving HTTPS. Requests with a body
+// aren't retried.
+type httpFallbackTransport struct {
+	base http.RoundTripper
+}
+
+func (t *httpFallbackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil || req.URL.Scheme != "https" || (req.Body != nil && req.Body != http.NoBody) {
+		return resp, err
+	}
+	plain := req.Clone(req.Context())
+	plain.URL.Scheme = "http"
+	return t.base.RoundTrip(plain)
+}
+
+// withClientAuth returns the request context carrying the client's
+// Authorization header for upstreams configured for passthrough.
+func withClientAuth(req *http.Request) context.Context {
+	ctx := req.Context()
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		ctx = context.WithValue(ctx, clientAuthKey{}, auth)
+	}
+	return ctx
+}
+
+// newUpstreamRequest creates a request to an upstream, relaying the client's
+// credentials only to hosts listed in AuthPassthroughHosts. It returns once
+// the FetchBudgets of the host allows sending it, it fails while the breaker
+// of the host is open.
+func (m *Manifests) newUpstreamRequest(ctx context.Context, method string, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = m.allowUpstream(req.URL.Host); err != nil {
+		return nil, err
+	}
+	if err = m.waitBudget(ctx, req.URL.Host); err != nil {
+		return nil, err
+	}
+	if auth, ok := ctx.Value(clientAuthKey{}).(string); ok && m.authPassthrough(req.URL.Host) {
+		req.Header.Set("Authorization", auth)
+	}
+	return req, nil
+}
+
+func (m *Manifests) authPassthrough(host string) bool {
+	return matchHost(m.config.AuthPassthroughHosts, host)
+}
+
+func matchHost(hosts []string, host string) bool {
+	for _, h := range hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveRepo maps the repository of req to the upstream one, expanding
+// provider prefixes, ChartAliases and applying the UpstreamHeader. Names with
+// an @ are rejected, they'd address the entries cached for other identities.
+func (m *Manifests) resolveRepo(req *http.Request, repo string) (string, *errors.RegError) {
+	repo, rerr := m.upstreamOverride(req, m.chartAlias(repo, m.expandProvider(repo)))
+	if rerr == nil && strings.Contains(repo, "@") {
+		return "", &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    errors.CodeNameInvalid,
+			Message: fmt.Sprintf("Invalid repository name %s", repo),
+		}
+	}
+	return repo, rerr
+}
+
+// chartAlias replaces the chart name of expanded, the upstream repository of
+// repo, with the one ChartAliases maps either of them to.
+func (m *Manifests) chartAlias(repo string, expanded string) string {
+	if len(m.config.ChartAliases) == 0 {
+		return expanded
+	}
+	for _, key := range []string{repo, expanded} {
+		if chart, ok := m.config.ChartAliases[strings.ToLower(key)]; ok {
+			return m.canonicalRepo(expanded[:strings.LastIndex(expanded, "/")+1] + chart)
+		}
+	}
+	return expanded
+}
+
+// expandProvider replaces a leading provider name, like bitnami in
+// bitnami/nginx, with its upstream from Providers. Other repositories start
+// with their upstream host, single-label ones too, and are kept as is.
+func (m *Manifests) expandProvider(repo string) string {
+	provider, rest, _ := strings.Cut(repo, "/")
+	if strings.ContainsAny(provider, ".:") || provider == "localhost" {
+		return repo
+	}
+	upstream, ok := m.config.Providers[provider]
+	if !ok {
+		return repo
+	}
+	return m.canonicalRepo(strings.Trim(upstream, "/") + "/" + rest)
+}
+
+// upstreamOverride replaces the upstream part of repo, everything but the
+// chart name, with the UpstreamHeader value. The header is ignored unless
+// UpstreamOverrideHosts is set, and rejected for hosts not listed there.
+func (m *Manifests) upstreamOverride(req *http.Request, repo string) (string, *errors.RegError) {
+	upstream := req.Header.Get(UpstreamHeader)
+	if upstream == "" || len(m.config.UpstreamOverrideHosts) == 0 {
+		return repo, nil
+	}
+	upstream = strings.Trim(strings.TrimPrefix(upstream, "https://"), "/")
+	host, _, _ := strings.Cut(upstream, "/")
+	if !matchHost(m.config.UpstreamOverrideHosts, host) {
+		return "", &errors.RegError{
+			Status:  http.StatusForbidden,
+			Code:    errors.CodeDenied,
+			Message: fmt.Sprintf("upstream %s is not allowed", host),
+		}
+	}
+	return m.canonicalRepo(upstream + "/" + repo[strings.LastIndex(repo, "/")+1:]), nil
+}
+
+// statusError is returned when the upstream answers with an unexpected status.
+type statusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %d", e.URL, e.StatusCode)
+}
+
+// upstreamRegError tells a broken upstream (502/504) apart from one that
+// genuinely doesn't have the resource, in which case notFound is returned.
+func upstreamRegError(err error, notFound *errors.RegError) *errors.RegError {
+	var se *statusError
+	if cerrors.As(err, &se) {
+		if se.StatusCode >= http.StatusInternalServerError {
+			return &errors.RegError{
+				Status:  http.StatusBadGateway,
+				Code:    errors.CodeUnavailable,
+				Message: fmt.Sprintf("upstream error: %v", err),
+			}
+		}
+		return notFound
+	}
+	var be *budgetError
+	if cerrors.As(err, &be) {
+		return &errors.RegError{
+			Status:  http.StatusTooManyRequests,
+			Code:    errors.CodeTooManyRequests,
+			Message: err.Error(),
+		}
+	}
+	var cte *contentTypeError
+	if cerrors.As(err, &cte) {
+		return &errors.RegError{
+			Status:  http.StatusBadGateway,
+			Code:    errors.CodeUnavailable,
+			Message: err.Error(),
+		}
+	}
+	var bre *breakerError
+	if cerrors.As(err, &bre) {
+		return &errors.RegError{
+			Status:  http.StatusServiceUnavailable,
+			Code:    errors.CodeUnavailable,
+			Message: err.Error(),
+		}
+	}
+	var ne net.Error
+	if cerrors.As(err, &ne) && ne.Timeout() {
+		return &errors.RegError{
+			Status:  http.StatusGatewayTimeout,
+			Code:    errors.CodeUnavailable,
+			Message: fmt.Sprintf("upstream timeout: %v", err),
+		}
+	}
+	var ue *url.Error
+	if cerrors.As(err, &ue) {
+		return &errors.RegError{
+			Status:  http.StatusBadGateway,
+			Code:    errors.CodeUnavailable,
+			Message: fmt.Sprintf("upstream unreachable: %v", err),
+		}
+	}
+	return notFound
+}
@@ -0,0 +1,73 @@
+package manifest
+
+import (
+	"context"
+	"github.com/Masterminds/semver/v3"
+	"github.com/opencontainers/go-digest"
+	"sort"
+)
+
+// enforceVersionCap evicts the lowest versions of repo cached beyond
+// MaxChartVersions, with the manifests no tag left points to. Blobs no
+// manifest left refers to are deleted. Tags that aren't versions, like
+// latest, aren't counted. Versions of the manifest keep, the one being
+// pulled, are never evicted, the next lowest are instead. Must be called
+// with the lock held.
+func (m *Manifests) enforceVersionCap(ctx context.Context, repo string, keep digest.Digest) {
+	limit := m.config.MaxChartVersions
+	if limit <= 0 || len(m.manifests[repo]) <= limit {
+		return
+	}
+	type cachedVersion struct {
+		tag string
+		v   *semver.Version
+	}
+	var versions []cachedVersion
+	count := 0
+	for ref, ma := range m.manifests[repo] {
+		if isDigest(ref) {
+			continue
+		}
+		if v, err := semver.NewVersion(ref); err == nil {
+			count++
+			if digest.FromBytes(ma.Blob) != keep {
+				versions = append(versions, cachedVersion{tag: ref, v: v})
+			}
+		}
+	}
+	if count <= limit {
+		return
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].v.LessThan(versions[j].v)
+	})
+	if n := count - limit; n < len(versions) {
+		versions = versions[:n]
+	}
+
+	var evicted []string
+	for _, cv := range versions {
+		d := digest.FromBytes(m.manifests[repo][cv.tag].Blob).String()
+		m.evict(repo, cv.tag, EvictedVersions)
+		m.log.Printf("%s has more than %d versions cached, evicted %s", repo, limit, cv.tag)
+		if m.tagged(repo, d) {
+			continue
+		}
+		if ma, ok := m.manifests[repo][d]; ok {
+			m.evict(repo, d, EvictedVersions)
+			evicted = append(evicted, ma.Refs...)
+		}
+	}
+	m.deleteUnreferenced(ctx, evicted)
+}
+
+// tagged reports whether a tag of repo points to the manifest d. Must be
+// called with the lock held.
+func (m *Manifests) tagged(repo string, d string) bool {
+	for ref, ma := range m.manifests[repo] {
+		if !isDigest(ref) && digest.FromBytes(ma.Blob).String() == d {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	cerrors "errors"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/opencontainers/go-digest"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// maxPrepareEntries bounds the entries of a prepare request.
+const maxPrepareEntries = 1000
+
+// WarmUpResult is the outcome of preparing one WarmUp entry, the digest of
+// the manifest prepared unless it failed.
+type WarmUpResult struct {
+	Entry  string
+	Digest digest.Digest
+	Err    error
+}
+
+// WarmUp prepares the WarmUp manifests, WarmUpConcurrency at a time, so their
+// first pulls are served from the cache. Failing entries don't stop the
+// others, the results are returned in the order of WarmUp.
+func (m *Manifests) WarmUp(ctx context.Context) []WarmUpResult {
+	if len(m.config.WarmUp) == 0 {
+		return nil
+	}
+	results := m.prepareEntries(ctx, m.config.WarmUp)
+	failed := 0
+	for _, res := range results {
+		if res.Err != nil {
+			m.log.Printf("warm-up of %s failed: %v", res.Entry, res.Err)
+			failed++
+		}
+	}
+	m.log.Printf("warm-up: %d of %d charts cached, %d failed", len(results)-failed, len(results), failed)
+	return results
+}
+
+// prepareEntries prepares repo:reference entries WarmUpConcurrency at a
+// time, returning the outcome of each in their order.
+func (m *Manifests) prepareEntries(ctx context.Context, entries []string) []WarmUpResult {
+	limit := m.config.WarmUpConcurrency
+	if limit <= 0 {
+		limit = 1
+	}
+	results := make([]WarmUpResult, len(entries))
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i, entry := range entries {
+		results[i].Entry = entry
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(res *WarmUpResult) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			res.Digest, res.Err = m.warmUpEntry(ctx, res.Entry)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// warmUpEntry prepares a repo:reference entry like a pull of it would.
+func (m *Manifests) warmUpEntry(ctx context.Context, entry string) (digest.Digest, error) {
+	repo, reference := entry, "latest"
+	if i := strings.LastIndex(entry, ":"); i > strings.LastIndex(entry, "/") {
+		repo, reference = entry[:i], entry[i+1:]
+	}
+	repo = m.expandProvider(m.canonicalRepo(repo))
+	if strings.Count(repo, "/") < 1 {
+		return "", fmt.Errorf("no chart name in %s", repo)
+	}
+	version, rerr := m.resolveVersion(ctx, repo, reference)
+	if rerr != nil {
+		return "", rerr
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ma, rerr := m.lookup(ctx, repo, version)
+	if rerr != nil {
+		return "", rerr
+	}
+	return m.servedDigest(ma, version), nil
+}
+
+type prepareItem struct {
+	Entry  string `json:"entry"`
+	Digest string `json:"digest,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type prepareResult struct {
+	Prepared int           `json:"prepared"`
+	Failed   int           `json:"failed"`
+	Results  []prepareItem `json:"results"`
+}
+
+// handlePrepare prepares the repo:reference entries of the JSON array posted
+// like WarmUp does, answering with the outcome of each. Failing entries don't
+// fail the request.
+func (m *Manifests) handlePrepare(resp http.ResponseWriter, req *http.Request) error {
+	var entries []string
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxPrepareEntries*1024)).Decode(&entries); err != nil {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    errors.CodeUnsupported,
+			Message: fmt.Sprintf("Expected a JSON array of repo:reference entries: %v", err),
+		}
+	}
+	if len(entries) > maxPrepareEntries {
+		return &errors.RegError{
+			Status:  http.StatusBadRequest,
+			Code:    errors.CodeUnsupported,
+			Message: fmt.Sprintf("At most %d entries are prepared at once", maxPrepareEntries),
+		}
+	}
+
+	// prepared as anonymous, the Authorization is the admin token's
+	res := prepareResult{Results: []prepareItem{}}
+	for _, r := range m.prepareEntries(req.Context(), entries) {
+		item := prepareItem{Entry: r.Entry, Status: http.StatusOK}
+		var regErr *errors.RegError
+		switch {
+		case r.Err == nil:
+			item.Digest = r.Digest.String()
+			res.Prepared++
+		case cerrors.As(r.Err, &regErr):
+			item.Status, item.Error = regErr.Status, regErr.Message
+		default:
+			item.Status, item.Error = http.StatusBadRequest, r.Err.Error()
+		}
+		if r.Err != nil {
+			res.Failed++
+		}
+		res.Results = append(res.Results, item)
+	}
+	msg, err := json.Marshal(res)
+	if err != nil {
+		return errors.RegErrInternal(err)
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	_, err = resp.Write(msg)
+	return err
+}
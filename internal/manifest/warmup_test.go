@@ -0,0 +1,120 @@
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	cerrors "errors"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWarmUp(t *testing.T) {
+	var charts []testChart
+	for i := 0; i < 6; i++ {
+		charts = append(charts, testChart{name: fmt.Sprintf("chart%d", i), version: "1.0.0"})
+	}
+	u := newTestUpstream(t, charts...)
+	var inFlight, maxInFlight int32
+	u.onIndex = func() {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+	}
+
+	var entries []string
+	for _, c := range charts {
+		entries = append(entries, u.host()+"/"+c.name+":"+c.version)
+	}
+	entries = append(entries, u.host()+"/missing:1.0.0", u.host()+"/chart0:2.0.0", u.host()+"/chart1")
+	// each chart fetches its own index when streaming
+	m := newTestManifests(t, u, Config{StreamIndex: true, WarmUp: entries, WarmUpConcurrency: 2})
+
+	results := m.WarmUp(context.Background())
+	if len(results) != len(entries) {
+		t.Fatalf("got %d results; want %d", len(results), len(entries))
+	}
+	for i, res := range results {
+		if res.Entry != entries[i] {
+			t.Errorf("result %d is for %s; want %s", i, res.Entry, entries[i])
+		}
+		wantErr := i == len(charts) || i == len(charts)+1
+		if (res.Err != nil) != wantErr {
+			t.Errorf("%s: err = %v; want error %v", res.Entry, res.Err, wantErr)
+		}
+	}
+	if n := atomic.LoadInt32(&maxInFlight); n > 2 {
+		t.Errorf("%d indexes fetched at once; want at most 2", n)
+	} else if n < 2 {
+		t.Errorf("%d indexes fetched at once; want 2", n)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, c := range charts {
+		if _, ok := m.manifests[u.host()+"/"+c.name][c.version]; !ok {
+			t.Errorf("%s:%s not cached", c.name, c.version)
+		}
+	}
+}
+
+func TestPrepareBatch(t *testing.T) {
+	u := newTestUpstream(t,
+		testChart{name: "foo", version: "1.0.0"},
+		testChart{name: "foo", version: "1.1.0"},
+	)
+	m := newTestManifests(t, u, Config{WarmUpConcurrency: 2})
+	repo := u.host() + "/foo"
+	entries := []string{repo + ":1.0.0", repo + ":9.9.9", u.host() + "/missing:1.0.0", repo, "foo"}
+	body, _ := json.Marshal(entries)
+
+	var res prepareResult
+	if err := json.Unmarshal(adminRequest(t, m, http.MethodPost, "/admin/prepare", body).Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Prepared != 2 || res.Failed != 3 || len(res.Results) != len(entries) {
+		t.Fatalf("got %+v; want 2 prepared and 3 failed", res)
+	}
+	want := []struct {
+		status  int
+		version string
+	}{
+		{http.StatusOK, "1.0.0"},
+		{http.StatusNotFound, ""},
+		{http.StatusNotFound, ""},
+		{http.StatusOK, "1.1.0"},
+		{http.StatusBadRequest, ""},
+	}
+	for i, item := range res.Results {
+		if item.Entry != entries[i] || item.Status != want[i].status {
+			t.Errorf("result %d = %+v; want %s with status %d", i, item, entries[i], want[i].status)
+		}
+		if want[i].version == "" {
+			if item.Error == "" || item.Digest != "" {
+				t.Errorf("%s: got digest %q, error %q; want an error only", item.Entry, item.Digest, item.Error)
+			}
+			continue
+		}
+		d := get(t, m.Handle, http.MethodHead, "/v2/"+repo+"/manifests/"+want[i].version).Header().Get("Docker-Content-Digest")
+		if item.Digest != d || item.Error != "" {
+			t.Errorf("%s: got digest %q, error %q; want %s", item.Entry, item.Digest, item.Error, d)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	var regErr *errors.RegError
+	if err := m.HandleAdmin(rec, httptest.NewRequest(http.MethodPost, "/admin/prepare", strings.NewReader("{}"))); !cerrors.As(err, &regErr) || regErr.Status != http.StatusBadRequest {
+		t.Errorf("object posted: err = %v; want a 400", err)
+	}
+}
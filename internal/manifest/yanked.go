@@ -0,0 +1,55 @@
+package manifest
+
+import (
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"net/http"
+	"strings"
+)
+
+// yanked reports whether repo:reference matches an entry of Yanked.
+func (m *Manifests) yanked(repo string, reference string) bool {
+	if len(m.config.Yanked) == 0 || isDigest(reference) {
+		return false
+	}
+	return matchAny(m.config.Yanked, repo+":"+strings.TrimPrefix(reference, "v"))
+}
+
+func (m *Manifests) yankedError(repo string, reference string) *errors.RegError {
+	status := m.config.YankedStatus
+	if status == 0 {
+		status = http.StatusGone
+	}
+	return &errors.RegError{
+		Status:  status,
+		Code:    errors.CodeManifestUnknown,
+		Message: fmt.Sprintf("Chart %s version %s was yanked", repo, reference),
+	}
+}
+
+// tombstoned reports whether repo:reference matches an entry of Tombstones.
+func (m *Manifests) tombstoned(repo string, reference string) bool {
+	if len(m.config.Tombstones) == 0 || isDigest(reference) {
+		return false
+	}
+	return matchAny(m.config.Tombstones, repo+":"+strings.TrimPrefix(reference, "v"))
+}
+
+// unlisted reports whether repo:reference is yanked or tombstoned, it's
+// neither served nor listed then.
+func (m *Manifests) unlisted(repo string, reference string) bool {
+	return m.tombstoned(repo, reference) || m.yanked(repo, reference)
+}
+
+// unlistedError is returned to pulls of an unlisted repo:reference,
+// tombstoned ones are always gone whatever YankedStatus is.
+func (m *Manifests) unlistedError(repo string, reference string) *errors.RegError {
+	if !m.tombstoned(repo, reference) {
+		return m.yankedError(repo, reference)
+	}
+	return &errors.RegError{
+		Status:  http.StatusGone,
+		Code:    errors.CodeManifestUnknown,
+		Message: fmt.Sprintf("Chart %s version %s was permanently removed", repo, reference),
+	}
+}
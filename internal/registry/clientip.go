@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// TrustedProxies makes X-Forwarded-For and X-Real-IP name the client of
+// requests coming from nets, such as load balancers. Other peers are the
+// client themselves, whatever headers they send.
+func TrustedProxies(nets []*net.IPNet) Option {
+	return func(r *Registry) {
+		r.trustedProxies = nets
+	}
+}
+
+// ParseCIDRs parses networks in CIDR notation, single addresses are
+// networks of their own.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var res []*net.IPNet
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", c)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+// ClientIP returns the address of the client of a request served by the
+// registry, the remote address if it wasn't resolved.
+func ClientIP(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteIP(req)
+}
+
+func (r *Registry) withClientIP(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), clientIPKey{}, r.clientIP(req)))
+}
+
+// clientIP walks X-Forwarded-For from the closest hop while it's a trusted
+// proxy, the first address that isn't one is the client.
+func (r *Registry) clientIP(req *http.Request) string {
+	peer := remoteIP(req)
+	if !r.trusted(peer) {
+		return peer
+	}
+	var hops []string
+	for _, h := range req.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(h, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	if len(hops) == 0 {
+		if ip := strings.TrimSpace(req.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+			return ip
+		}
+		return peer
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			// forged or garbled, the last valid hop is as far as it's trusted
+			break
+		}
+		client = hops[i]
+		if !r.trusted(client) {
+			break
+		}
+	}
+	return client
+}
+
+func (r *Registry) trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range r.trustedProxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,90 @@
+package registry
+
+import (
+	"compress/gzip"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gzipWriter compresses the body written by a handler.
+type gzipWriter struct {
+	http.ResponseWriter
+	level       int
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if status != http.StatusNoContent && status != http.StatusNotModified {
+		h := w.Header()
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		h.Add("Vary", "Accept-Encoding")
+		w.gz, _ = gzip.NewWriterLevel(w.ResponseWriter, gzipLevel(w.level))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+func (w *gzipWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
+
+// gzipLevel is level if it's from gzip.BestSpeed to gzip.BestCompression,
+// gzip.DefaultCompression otherwise.
+func gzipLevel(level int) int {
+	if level < gzip.BestSpeed || level > gzip.BestCompression {
+		return gzip.DefaultCompression
+	}
+	return level
+}
+
+// compressible reports whether the response to req is gzipped: the client
+// accepts it, there is a body and it's not a blob, which are already
+// compressed chart archives.
+func compressible(req *http.Request) bool {
+	if req.Method == http.MethodHead || helper.IsBlob(req) {
+		return false
+	}
+	return acceptsGzip(req.Header.Get("Accept-Encoding"))
+}
+
+// acceptsGzip parses an Accept-Encoding header, gzip must not be refused with
+// q=0 and identity alone means no compression.
+func acceptsGzip(header string) bool {
+	star := false
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if coding == "gzip" {
+			return q > 0
+		}
+		star = q > 0
+	}
+	return star
+}
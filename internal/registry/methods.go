@@ -0,0 +1,48 @@
+package registry
+
+import (
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"net/http"
+	"strings"
+)
+
+// routes with their own set of allowed methods
+const (
+	RouteV2        = "v2"
+	RouteBlobs     = "blobs"
+	RouteManifests = "manifests"
+	RouteTags      = "tags"
+	RouteReferrers = "referrers"
+	RouteCatalog   = "catalog"
+	RouteAdmin     = "admin"
+	RouteInfo      = "info"
+)
+
+var defaultMethods = map[string][]string{
+	RouteV2:        {http.MethodGet, http.MethodHead},
+	RouteBlobs:     {http.MethodGet, http.MethodHead},
+	RouteManifests: {http.MethodGet, http.MethodHead},
+	RouteTags:      {http.MethodGet},
+	RouteReferrers: {http.MethodGet},
+	RouteCatalog:   {http.MethodGet},
+	RouteAdmin:     {http.MethodGet, http.MethodPost, http.MethodDelete},
+	RouteInfo:      {http.MethodGet, http.MethodHead},
+}
+
+// route passes req to h if the route allows its method, answering 405 with
+// an Allow header otherwise.
+func (r *Registry) route(resp http.ResponseWriter, req *http.Request, route string, h Handler) error {
+	allowed := r.methods[route]
+	for _, m := range allowed {
+		if req.Method == m {
+			return h(resp, req)
+		}
+	}
+	resp.Header().Set("Allow", strings.Join(allowed, ", "))
+	return &errors.RegError{
+		Status:  http.StatusMethodNotAllowed,
+		Code:    errors.CodeUnsupported,
+		Message: fmt.Sprintf("%s is not allowed for %s", req.Method, req.URL.Path),
+	}
+}
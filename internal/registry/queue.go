@@ -0,0 +1,50 @@
+package registry
+
+import (
+	"context"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"net/http"
+)
+
+// requestQueue bounds the requests served at once, queuing up to a depth of
+// them for a free worker so sudden load can't spawn unbounded work.
+type requestQueue struct {
+	workers chan struct{} // a slot per request served
+	waiting chan struct{} // a slot per request queued
+}
+
+var regErrQueueFull = &errors.RegError{
+	Status:  http.StatusServiceUnavailable,
+	Code:    errors.CodeUnavailable,
+	Message: "too many requests queued, try again later",
+}
+
+func newRequestQueue(workers int, depth int) *requestQueue {
+	return &requestQueue{
+		workers: make(chan struct{}, workers),
+		waiting: make(chan struct{}, depth),
+	}
+}
+
+// acquire waits for a free worker, returning the function freeing it. It
+// fails at once if the queue is full, or when ctx ends while queued.
+func (q *requestQueue) acquire(ctx context.Context) (func(), error) {
+	release := func() { <-q.workers }
+	select {
+	case q.workers <- struct{}{}:
+		return release, nil
+	default:
+	}
+	select {
+	case q.waiting <- struct{}{}:
+	default:
+		return nil, regErrQueueFull
+	}
+	defer func() { <-q.waiting }()
+	select {
+	case q.workers <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
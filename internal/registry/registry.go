@@ -1,14 +1,18 @@
 package registry
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
 	"github.com/container-registry/helm-charts-oci-proxy/internal/helper"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/version"
 	"github.com/sirupsen/logrus"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -16,13 +20,25 @@ type Registry struct {
 	log logrus.StdLogger
 
 	// to operate blobs directly from registry
-	blobs Handler `json:"blobs"`
+	blobs Handler
 	//
-	manifests Handler `json:"manifests"`
+	manifests Handler
 	tags      Handler
 	catalog   Handler
+	referrers Handler
+	admin     Handler
 
-	debug bool
+	adminToken string
+	timeout    time.Duration
+	methods    map[string][]string // allowed methods by route
+	compress   bool
+	level      int // of gzip, the default one if it's not from 1 to 9
+	debug      bool
+	queue      *requestQueue // bounds the requests served at once, if set
+	headers    http.Header   // set on every response
+
+	notFoundRedirect string       // unknown paths outside /v2/ are sent there
+	trustedProxies   []*net.IPNet // peers whose X-Forwarded-For is honored
 }
 
 func (r *Registry) v2(resp http.ResponseWriter, req *http.Request) error {
@@ -31,31 +47,59 @@ func (r *Registry) v2(resp http.ResponseWriter, req *http.Request) error {
 		return r.homeHandler(resp, req)
 	}
 	if req.URL.Path == "/api/version" {
-		return r.versionHandler(resp)
+		return r.route(resp, req, RouteInfo, func(resp http.ResponseWriter, _ *http.Request) error {
+			return r.versionHandler(resp)
+		})
+	}
+	if req.URL.Path == "/version" {
+		return r.route(resp, req, RouteInfo, func(resp http.ResponseWriter, _ *http.Request) error {
+			return r.buildInfoHandler(resp)
+		})
 	}
 	if req.URL.Path == "/api/systeminfo" || req.URL.Path == "/api/v2.0/systeminfo" {
-		return r.harborInfoHandler(resp)
+		return r.route(resp, req, RouteInfo, func(resp http.ResponseWriter, _ *http.Request) error {
+			return r.harborInfoHandler(resp)
+		})
+	}
+	if helper.IsAdmin(req) && r.admin != nil {
+		if !r.adminAuthorized(req) {
+			resp.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			return &errors.RegError{
+				Status:  http.StatusUnauthorized,
+				Code:    errors.CodeUnauthorized,
+				Message: "admin token required",
+			}
+		}
+		return r.route(resp, req, RouteAdmin, r.admin)
 	}
 	if helper.IsBlob(req) {
-		return r.blobs(resp, req)
+		return r.route(resp, req, RouteBlobs, r.blobs)
 	}
 	if helper.IsManifest(req) {
-		return r.manifests(resp, req)
+		return r.route(resp, req, RouteManifests, r.manifests)
 	}
 	if helper.IsTags(req) {
-		return r.tags(resp, req)
+		return r.route(resp, req, RouteTags, r.tags)
+	}
+	if helper.IsReferrers(req) && r.referrers != nil {
+		return r.route(resp, req, RouteReferrers, r.referrers)
 	}
 	if helper.IsCatalog(req) {
-		return r.catalog(resp, req)
+		return r.route(resp, req, RouteCatalog, r.catalog)
 	}
 	if helper.IsV2(req) {
-		resp.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
-		resp.WriteHeader(200)
+		return r.route(resp, req, RouteV2, func(resp http.ResponseWriter, _ *http.Request) error {
+			resp.WriteHeader(200)
+			return nil
+		})
+	}
+	if r.notFoundRedirect != "" && !helper.IsRegistry(req) {
+		http.Redirect(resp, req, r.notFoundRedirect, http.StatusFound)
 		return nil
 	}
 	return &errors.RegError{
 		Status:  http.StatusNotFound,
-		Code:    "METHOD_UNKNOWN",
+		Code:    errors.CodeUnsupported,
 		Message: fmt.Sprintf("We don't understand your URL: %s", req.URL.Path),
 	}
 }
@@ -74,6 +118,27 @@ func (r *Registry) versionHandler(resp http.ResponseWriter) error {
 	return nil
 }
 
+// version
+func (r *Registry) buildInfoHandler(resp http.ResponseWriter) error {
+	res := struct {
+		Version          string `json:"version"`
+		Commit           string `json:"commit"`
+		Date             string `json:"date"`
+		DistributionSpec string `json:"distributionSpec"`
+	}{
+		Version:          version.Version,
+		Commit:           version.Commit,
+		Date:             version.Date,
+		DistributionSpec: version.DistributionSpec,
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(200)
+	if err := prettyEncode(res, resp); err != nil {
+		return errors.RegErrInternal(err)
+	}
+	return nil
+}
+
 // api/v2.0/systeminfo
 func (r *Registry) harborInfoHandler(resp http.ResponseWriter) error {
 	res := struct {
@@ -90,15 +155,57 @@ func (r *Registry) harborInfoHandler(resp http.ResponseWriter) error {
 	return nil
 }
 
+func (r *Registry) adminAuthorized(req *http.Request) bool {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && r.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(r.adminToken)) == 1
+}
+
 func (r *Registry) homeHandler(w http.ResponseWriter, req *http.Request) error {
 	http.Redirect(w, req, "https://container-registry.com/helm-charts-oci-proxy/", 302)
 	return nil
 }
 
 func (r *Registry) root(resp http.ResponseWriter, req *http.Request) {
+	req = r.withClientIP(req)
+	for k, v := range r.headers {
+		resp.Header()[k] = v
+	}
+	var release func()
+	if r.queue != nil && !helper.IsAdmin(req) {
+		// admin endpoints stay usable under load
+		var err error
+		if release, err = r.queue.acquire(req.Context()); err != nil {
+			if regErr, ok := err.(*errors.RegError); ok {
+				r.log.Printf("%s %s %s %d %s %s", ClientIP(req), req.Method, req.URL, regErr.Status, regErr.Code, regErr.Message)
+				resp.Header().Set("Retry-After", "1")
+				_ = regErr.Write(resp)
+			}
+			return
+		}
+	}
+	if helper.IsRegistry(req) {
+		resp.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	}
+	if r.compress && compressible(req) {
+		gw := &gzipWriter{ResponseWriter: resp, level: r.level}
+		defer gw.Close()
+		resp = gw
+	}
+	if r.timeout > 0 && !helper.IsAdmin(req) {
+		// exports and imports take as long as they take
+		r.serveWithDeadline(resp, req, release)
+		return
+	}
+	if release != nil {
+		defer release()
+	}
+	r.serve(resp, req)
+}
+
+func (r *Registry) serve(resp http.ResponseWriter, req *http.Request) {
 	if err := r.v2(resp, req); err != nil {
 		if regErr, ok := err.(*errors.RegError); ok {
-			r.log.Printf("%s %s %d %s %s", req.Method, req.URL, regErr.Status, regErr.Code, regErr.Message)
+			r.log.Printf("%s %s %s %d %s %s", ClientIP(req), req.Method, req.URL, regErr.Status, regErr.Code, regErr.Message)
 			_ = regErr.Write(resp)
 		} else {
 			http.Error(resp, err.Error(), http.StatusInternalServerError)
@@ -106,7 +213,7 @@ func (r *Registry) root(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 	if r.debug {
-		r.log.Printf("%s - %s", req.Method, req.URL)
+		r.log.Printf("%s %s - %s", ClientIP(req), req.Method, req.URL)
 	}
 }
 
@@ -118,6 +225,10 @@ func New(manifests Handler, blobs Handler, tags Handler, catalog Handler, opts .
 		blobs:     blobs,
 		tags:      tags,
 		catalog:   catalog,
+		methods:   map[string][]string{},
+	}
+	for route, methods := range defaultMethods {
+		r.methods[route] = methods
 	}
 	for _, o := range opts {
 		o(r)
@@ -139,6 +250,78 @@ func Logger(l logrus.StdLogger) Option {
 	}
 }
 
+// Referrers enables the referrers API served by h.
+func Referrers(h Handler) Option {
+	return func(r *Registry) {
+		r.referrers = h
+	}
+}
+
+// Admin enables the /admin/ endpoints served by h for callers presenting token
+// as a bearer token.
+func Admin(h Handler, token string) Option {
+	return func(r *Registry) {
+		r.admin = h
+		r.adminToken = token
+	}
+}
+
+// Timeout bounds the time a request is handled for, slower requests get a 503
+// and their context is canceled.
+func Timeout(d time.Duration) Option {
+	return func(r *Registry) {
+		r.timeout = d
+	}
+}
+
+// AllowMethods replaces the methods allowed for route, one of the Route
+// constants.
+func AllowMethods(route string, methods ...string) Option {
+	return func(r *Registry) {
+		r.methods[route] = methods
+	}
+}
+
+// Compress gzips responses for clients accepting it, except blobs.
+func Compress(v bool) Option {
+	return func(r *Registry) {
+		r.compress = v
+	}
+}
+
+// CompressLevel sets the gzip level of Compress from 1, the fastest, to 9,
+// the smallest. Other levels mean the default one, 6.
+func CompressLevel(level int) Option {
+	return func(r *Registry) {
+		r.level = level
+	}
+}
+
+// Queue serves at most workers requests at once, up to depth more wait for
+// one to complete and further ones get a 503 with Retry-After. Admin
+// endpoints aren't queued.
+func Queue(workers int, depth int) Option {
+	return func(r *Registry) {
+		r.queue = newRequestQueue(workers, depth)
+	}
+}
+
+// NotFoundRedirect redirects requests for unknown paths outside /v2/ to url,
+// such as the proxy's docs, instead of answering them with a 404.
+func NotFoundRedirect(url string) Option {
+	return func(r *Registry) {
+		r.notFoundRedirect = url
+	}
+}
+
+// ResponseHeaders sets h on every response, errors included, before it's
+// handled. Handlers setting the same headers replace them.
+func ResponseHeaders(h http.Header) Option {
+	return func(r *Registry) {
+		r.headers = h.Clone()
+	}
+}
+
 func Debug(v bool) Option {
 	return func(r *Registry) {
 		r.debug = v
@@ -0,0 +1,556 @@
+package registry
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/version"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func ok(resp http.ResponseWriter, _ *http.Request) error {
+	resp.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func TestAdminAuth(t *testing.T) {
+	h := New(ok, ok, ok, ok, Admin(ok, "secret"))
+
+	for _, tc := range []struct {
+		auth   string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/admin/export", nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("Authorization %q: status = %d; want %d", tc.auth, rec.Code, tc.status)
+		}
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	version.Version, version.Commit, version.Date = "v1.2.3", "abc1234", "2024-01-02T03:04:05Z"
+	h := New(ok, ok, ok, ok)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d; want 200", rec.Code)
+	}
+	var got map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{
+		"version":          "v1.2.3",
+		"commit":           "abc1234",
+		"date":             "2024-01-02T03:04:05Z",
+		"distributionSpec": version.DistributionSpec,
+	} {
+		if got[k] != want {
+			t.Errorf("%s = %q; want %q", k, got[k], want)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	canceled := make(chan struct{})
+	slow := func(resp http.ResponseWriter, req *http.Request) error {
+		<-req.Context().Done()
+		close(canceled)
+		resp.WriteHeader(http.StatusOK)
+		return nil
+	}
+	h := New(slow, ok, ok, ok, Timeout(50*time.Millisecond))
+
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/example.com/foo/manifests/1.0.0", nil))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("answered after %v; want about 50ms", elapsed)
+	}
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d; want 503", rec.Code)
+	}
+	if ra := rec.Header().Get("Retry-After"); ra != "1" {
+		t.Errorf("Retry-After = %q; want 1", ra)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("handler context wasn't canceled")
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/example.com/foo/blobs/sha256:abc", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("fast request status = %d; want 200", rec.Code)
+	}
+}
+
+func TestRequestTimeoutStreams(t *testing.T) {
+	release := make(chan struct{})
+	streaming := func(resp http.ResponseWriter, req *http.Request) error {
+		resp.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(resp, "first ")
+		resp.(http.Flusher).Flush()
+		<-release
+		if req.Context().Err() != nil {
+			t.Error("context of a started response canceled")
+		}
+		_, _ = io.WriteString(resp, "second")
+		return nil
+	}
+	s := httptest.NewServer(New(ok, streaming, ok, ok, Timeout(50*time.Millisecond)))
+	defer s.Close()
+
+	res, err := http.Get(s.URL + "/v2/example.com/foo/blobs/sha256:abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	first := make([]byte, len("first "))
+	if _, err = io.ReadFull(res.Body, first); err != nil {
+		t.Fatalf("start of the response not streamed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	rest, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(first)+string(rest) != "first second" {
+		t.Errorf("got %d %q; want 200 with the whole body past the deadline", res.StatusCode, string(first)+string(rest))
+	}
+}
+
+func TestRequestTimeoutQueued(t *testing.T) {
+	gate := make(chan struct{})
+	stuck := func(resp http.ResponseWriter, req *http.Request) error {
+		// ignores the canceled context
+		<-gate
+		return nil
+	}
+	var reg *Registry
+	h := New(stuck, ok, ok, ok, Queue(1, 0), Timeout(50*time.Millisecond), func(r *Registry) { reg = r })
+	defer close(gate)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/example.com/foo/manifests/1.0.0", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d; want 503", rec.Code)
+	}
+	// the timed out handler still runs in its slot
+	if len(reg.queue.workers) != 1 {
+		t.Errorf("%d workers taken; want the timed out request's", len(reg.queue.workers))
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/example.com/foo/blobs/sha256:abc", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("request beyond the pool = %d; want 503 with Retry-After 1", rec.Code)
+	}
+
+	gate <- struct{}{}
+	for deadline := time.Now().Add(5 * time.Second); len(reg.queue.workers) != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("slot not freed once the handler returned")
+		}
+	}
+}
+
+func TestRequestQueue(t *testing.T) {
+	started := make(chan struct{}, 4)
+	release := make(chan struct{})
+	blocking := func(resp http.ResponseWriter, req *http.Request) error {
+		started <- struct{}{}
+		<-release
+		resp.WriteHeader(http.StatusOK)
+		return nil
+	}
+	var reg *Registry
+	h := New(blocking, ok, ok, ok, Queue(2, 2), func(r *Registry) { reg = r })
+
+	codes := make(chan int, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/example.com/foo/manifests/1.0.0", nil))
+			codes <- rec.Code
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		<-started
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(reg.queue.waiting) < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests queued; want 2", len(reg.queue.waiting))
+		}
+	}
+
+	// the pool and the queue are full
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/example.com/foo/blobs/sha256:abc", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("excess request = %d, Retry-After %q; want 503 with Retry-After 1", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	close(release)
+	for i := 0; i < 4; i++ {
+		select {
+		case code := <-codes:
+			if code != http.StatusOK {
+				t.Errorf("served or queued request = %d; want 200", code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("queued requests weren't served")
+		}
+	}
+	if len(reg.queue.workers) != 0 {
+		t.Errorf("%d workers still taken", len(reg.queue.workers))
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	h := New(ok, ok, ok, ok, Referrers(ok), Admin(ok, "secret"), AllowMethods(RouteCatalog, http.MethodGet, http.MethodHead))
+
+	for _, tc := range []struct {
+		path    string
+		allowed string
+	}{
+		{"/v2/", "GET, HEAD"},
+		{"/v2/example.com/foo/blobs/sha256:abc", "GET, HEAD"},
+		{"/v2/example.com/foo/manifests/1.0.0", "GET, HEAD"},
+		{"/v2/example.com/foo/tags/list", "GET"},
+		{"/v2/example.com/foo/referrers/sha256:abc", "GET"},
+		{"/v2/_catalog", "GET, HEAD"},
+		{"/admin/export", "GET, POST, DELETE"},
+		{"/version", "GET, HEAD"},
+	} {
+		for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch} {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(method, tc.path, nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			h.ServeHTTP(rec, req)
+
+			want := http.StatusMethodNotAllowed
+			if strings.Contains(tc.allowed, method) {
+				want = http.StatusOK
+			}
+			if rec.Code != want {
+				t.Errorf("%s %s: status = %d; want %d", method, tc.path, rec.Code, want)
+			}
+			if want == http.StatusMethodNotAllowed && rec.Header().Get("Allow") != tc.allowed {
+				t.Errorf("%s %s: Allow = %q; want %q", method, tc.path, rec.Header().Get("Allow"), tc.allowed)
+			}
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	body := strings.Repeat(`{"tags":["1.0.0"]}`, 100)
+	jsonHandler := func(resp http.ResponseWriter, _ *http.Request) error {
+		resp.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		resp.WriteHeader(http.StatusOK)
+		_, err := io.WriteString(resp, body)
+		return err
+	}
+	h := New(jsonHandler, jsonHandler, jsonHandler, jsonHandler, Compress(true))
+
+	for _, tc := range []struct {
+		path           string
+		acceptEncoding string
+		gzipped        bool
+	}{
+		{"/v2/example.com/foo/tags/list", "gzip, deflate", true},
+		{"/v2/example.com/foo/tags/list", "*", true},
+		{"/v2/example.com/foo/tags/list", "identity", false},
+		{"/v2/example.com/foo/tags/list", "gzip;q=0, identity", false},
+		{"/v2/example.com/foo/tags/list", "", false},
+		{"/v2/example.com/foo/blobs/sha256:abc", "gzip", false},
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		h.ServeHTTP(rec, req)
+
+		got := rec.Body.String()
+		if ce := rec.Header().Get("Content-Encoding"); (ce == "gzip") != tc.gzipped {
+			t.Errorf("%s with %q: Content-Encoding = %q; want gzipped %v", tc.path, tc.acceptEncoding, ce, tc.gzipped)
+			continue
+		}
+		if tc.gzipped {
+			gz, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(gz)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = string(b)
+			if rec.Header().Get("Content-Length") != "" {
+				t.Errorf("%s with %q: Content-Length of the uncompressed body kept", tc.path, tc.acceptEncoding)
+			}
+		}
+		if got != body {
+			t.Errorf("%s with %q: body mismatch", tc.path, tc.acceptEncoding)
+		}
+	}
+}
+
+func TestCompressLevel(t *testing.T) {
+	var body strings.Builder
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&body, `{"tags":["%d.%d.%d"]}`, rnd.Intn(20), rnd.Intn(50), rnd.Intn(100))
+	}
+	jsonHandler := func(resp http.ResponseWriter, _ *http.Request) error {
+		_, err := io.WriteString(resp, body.String())
+		return err
+	}
+	size := func(level int) int {
+		h := New(jsonHandler, jsonHandler, jsonHandler, jsonHandler, Compress(true), CompressLevel(level))
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/v2/example.com/foo/tags/list", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		h.ServeHTTP(rec, req)
+
+		gz, err := gzip.NewReader(bytes.NewReader(rec.Body.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := io.ReadAll(gz); err != nil || string(b) != body.String() {
+			t.Fatalf("level %d: body mismatch: %v", level, err)
+		}
+		return rec.Body.Len()
+	}
+	fastest, smallest, byDefault := size(gzip.BestSpeed), size(gzip.BestCompression), size(0)
+	if smallest >= fastest {
+		t.Errorf("level 9 gave %d bytes, level 1 %d; want fewer", smallest, fastest)
+	}
+	if want := size(gzip.DefaultCompression); byDefault != want || byDefault == fastest {
+		t.Errorf("unset level gave %d bytes; want the default level's %d", byDefault, want)
+	}
+}
+
+func TestDistributionAPIVersionHeader(t *testing.T) {
+	fail := func(http.ResponseWriter, *http.Request) error {
+		return &errors.RegError{Status: http.StatusNotFound, Code: "MANIFEST_UNKNOWN", Message: "not found"}
+	}
+	h := New(ok, ok, ok, ok, Admin(ok, "secret"))
+	failing := New(fail, ok, ok, ok)
+
+	for _, tc := range []struct {
+		h    http.Handler
+		path string
+		want string
+	}{
+		{h, "/v2/", "registry/2.0"},
+		{h, "/v2/example.com/foo/manifests/1.0.0", "registry/2.0"},
+		{h, "/v2/example.com/foo/tags/list", "registry/2.0"},
+		{h, "/harbor.example.com/v2/example.com/foo/tags/list", "registry/2.0"},
+		{failing, "/v2/example.com/foo/manifests/1.0.0", "registry/2.0"},
+		{h, "/v2/example.com/foo/unknown", "registry/2.0"},
+		{h, "/version", ""},
+	} {
+		rec := httptest.NewRecorder()
+		tc.h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if got := rec.Header().Get("Docker-Distribution-API-Version"); got != tc.want {
+			t.Errorf("%s (%d): Docker-Distribution-API-Version = %q; want %q", tc.path, rec.Code, got, tc.want)
+		}
+	}
+}
+
+func TestUnknownPath(t *testing.T) {
+	for _, tc := range []struct {
+		redirect string
+		path     string
+		status   int
+	}{
+		{"", "/favicon.ico", http.StatusNotFound},
+		{"", "/v2/example.com/foo/unknown", http.StatusNotFound},
+		{"https://docs.example.com/", "/favicon.ico", http.StatusFound},
+		{"https://docs.example.com/", "/v2/example.com/foo/unknown", http.StatusNotFound},
+	} {
+		var opts []Option
+		if tc.redirect != "" {
+			opts = append(opts, NotFoundRedirect(tc.redirect))
+		}
+		rec := httptest.NewRecorder()
+		New(ok, ok, ok, ok, opts...).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if rec.Code != tc.status {
+			t.Errorf("%q %s: status = %d; want %d", tc.redirect, tc.path, rec.Code, tc.status)
+			continue
+		}
+		if tc.status == http.StatusFound {
+			if loc := rec.Header().Get("Location"); loc != tc.redirect {
+				t.Errorf("%s: Location = %q; want %q", tc.path, loc, tc.redirect)
+			}
+			continue
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: Content-Type = %q; want application/json", tc.path, ct)
+		}
+		var body struct {
+			Errors []struct {
+				Code errors.Code `json:"code"`
+			} `json:"errors"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || len(body.Errors) != 1 {
+			t.Errorf("%s: body = %s; want one JSON error", tc.path, rec.Body)
+		}
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	limits := ServerLimits{ReadHeaderTimeout: 100 * time.Millisecond, IdleTimeout: 100 * time.Millisecond, MaxConns: 1}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(New(ok, ok, ok, ok), limits)
+	go func() { _ = s.Serve(limits.Listener(l)) }()
+	t.Cleanup(func() { _ = s.Close() })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the headers never end
+	if _, err = io.WriteString(conn, "GET /v2/ HTTP/1.1\r\nHost: example.com\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the only connection is busy until it's timed out
+	served := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/v2/")
+		if err == nil {
+			resp.Body.Close()
+		}
+		served <- err
+	}()
+	select {
+	case <-served:
+		t.Fatal("second connection served beyond MaxConns")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	start := time.Now()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _ = io.ReadAll(conn)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("incomplete request held the connection %v; want about 100ms", elapsed)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("second connection: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("second connection not served after the first was timed out")
+	}
+
+	// so is a keep-alive connection idling after its request
+	idle, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	if _, err = io.WriteString(idle, "GET /v2/ HTTP/1.1\r\nHost: example.com\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	_ = idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if resp, _ := io.ReadAll(idle); !strings.HasPrefix(string(resp), "HTTP/1.1 200") {
+		t.Errorf("idle connection got %q; want its request served", resp)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("idle keep-alive connection held %v; want about 100ms", elapsed)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseCIDRs([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	record := func(resp http.ResponseWriter, req *http.Request) error {
+		got = ClientIP(req)
+		resp.WriteHeader(http.StatusOK)
+		return nil
+	}
+	h := New(record, ok, ok, ok, TrustedProxies(proxies))
+
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		header     map[string]string
+		want       string
+	}{
+		{"direct client", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"untrusted peer forging XFF", "203.0.113.7:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.7"},
+		{"untrusted peer forging X-Real-IP", "203.0.113.7:1234", map[string]string{"X-Real-IP": "198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy chain", "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, 192.168.1.1"}, "198.51.100.1"},
+		{"spoofed hop before the client", "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy X-Real-IP", "192.168.1.1:1234", map[string]string{"X-Real-IP": "198.51.100.2"}, "198.51.100.2"},
+		{"trusted proxy without headers", "10.1.2.3:1234", nil, "10.1.2.3"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/v2/example.com/foo/manifests/1.0.0", nil)
+		req.RemoteAddr = tc.remoteAddr
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if got != tc.want {
+			t.Errorf("%s: client IP = %s; want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("X-Content-Type-Options", "nosniff")
+	headers.Set("Strict-Transport-Security", "max-age=31536000")
+	fail := func(http.ResponseWriter, *http.Request) error {
+		return &errors.RegError{Status: http.StatusNotFound, Code: errors.CodeManifestUnknown, Message: "unknown"}
+	}
+	h := New(ok, ok, ok, ok, ResponseHeaders(headers))
+	for _, tc := range []struct {
+		h      http.Handler
+		path   string
+		status int
+	}{
+		{h, "/v2/example.com/foo/manifests/1.0.0", http.StatusOK},
+		{New(fail, ok, ok, ok, ResponseHeaders(headers)), "/v2/example.com/foo/manifests/1.0.0", http.StatusNotFound},
+		{h, "/v2/example.com/foo/unknown", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		tc.h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if rec.Code != tc.status {
+			t.Errorf("%s: status = %d; want %d", tc.path, rec.Code, tc.status)
+		}
+		for k := range headers {
+			if got := rec.Header().Get(k); got != headers.Get(k) {
+				t.Errorf("%s (%d): %s = %q; want %q", tc.path, rec.Code, k, got, headers.Get(k))
+			}
+		}
+	}
+}
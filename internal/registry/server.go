@@ -0,0 +1,50 @@
+package registry
+
+import (
+	"golang.org/x/net/netutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ServerLimits bound how long clients may take sending requests and reading
+// responses, how long idle keep-alive connections are kept open and how many
+// connections are served at once, so slow clients holding connections open
+// can't exhaust the server. Zero means unbounded.
+type ServerLimits struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxConns          int
+}
+
+// DefaultServerLimits leave enough time to stream large blobs to slow
+// clients. Request bodies, like blob uploads, aren't bounded.
+var DefaultServerLimits = ServerLimits{
+	ReadHeaderTimeout: 5 * time.Second,
+	WriteTimeout:      10 * time.Minute,
+	IdleTimeout:       2 * time.Minute,
+	MaxConns:          1024,
+}
+
+// NewServer serves h within limits, listeners must be wrapped by Listener
+// for MaxConns to apply.
+func NewServer(h http.Handler, limits ServerLimits) *http.Server {
+	return &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: limits.ReadHeaderTimeout,
+		ReadTimeout:       limits.ReadTimeout,
+		WriteTimeout:      limits.WriteTimeout,
+		IdleTimeout:       limits.IdleTimeout,
+	}
+}
+
+// Listener accepts at most MaxConns connections of l at once, the next ones
+// wait for one to be closed.
+func (limits ServerLimits) Listener(l net.Listener) net.Listener {
+	if limits.MaxConns <= 0 {
+		return l
+	}
+	return netutil.LimitListener(l, limits.MaxConns)
+}
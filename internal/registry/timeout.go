@@ -0,0 +1,108 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"github.com/container-registry/helm-charts-oci-proxy/internal/errors"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// timeoutWriter holds the headers of a response until the handler starts
+// writing it, streaming it from then on. Responses not started when the
+// deadline passes are dropped for the 503.
+type timeoutWriter struct {
+	resp     http.ResponseWriter
+	header   http.Header
+	lock     sync.Mutex
+	started  bool
+	timedOut bool
+}
+
+func (w *timeoutWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *timeoutWriter) WriteHeader(status int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.start(status)
+}
+
+// start sends the headers unless they were or the deadline passed. Must be
+// called with the lock held.
+func (w *timeoutWriter) start(status int) {
+	if w.started || w.timedOut {
+		return
+	}
+	w.started = true
+	for k, v := range w.header {
+		w.resp.Header()[k] = v
+	}
+	w.resp.WriteHeader(status)
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	w.start(http.StatusOK)
+	return w.resp.Write(b)
+}
+
+func (w *timeoutWriter) Flush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if f, ok := w.resp.(http.Flusher); ok && w.started && !w.timedOut {
+		f.Flush()
+	}
+}
+
+// serveWithDeadline answers 503 with Retry-After if serving req takes longer
+// than the request timeout, canceling its context. Responses the handler
+// started writing by then, like blobs being streamed, are completed instead.
+// release, if set, frees the queue slot of req once the handler returned, it
+// may still run after the 503.
+func (r *Registry) serveWithDeadline(resp http.ResponseWriter, req *http.Request, release func()) {
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	deadline := time.NewTimer(r.timeout)
+	defer deadline.Stop()
+
+	tw := &timeoutWriter{resp: resp, header: http.Header{}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if release != nil {
+			defer release()
+		}
+		r.serve(tw, req.WithContext(ctx))
+	}()
+
+	select {
+	case <-done:
+		tw.WriteHeader(http.StatusOK)
+	case <-deadline.C:
+		tw.lock.Lock()
+		if tw.started {
+			tw.lock.Unlock()
+			<-done
+			return
+		}
+		tw.timedOut = true
+		tw.lock.Unlock()
+		cancel()
+		regErr := &errors.RegError{
+			Status:  http.StatusServiceUnavailable,
+			Code:    errors.CodeUnavailable,
+			Message: fmt.Sprintf("request not completed within %s", r.timeout),
+		}
+		r.log.Printf("%s %s %s %d %s %s", ClientIP(req), req.Method, req.URL, regErr.Status, regErr.Code, regErr.Message)
+		resp.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(r.timeout.Seconds()))))
+		_ = regErr.Write(resp)
+	}
+}
@@ -0,0 +1,11 @@
+// Package version holds the build information, set with -ldflags -X at build time.
+package version
+
+var (
+	Version = "dev"
+	Commit  = "unknown"
+	Date    = "unknown"
+)
+
+// DistributionSpec is the OCI distribution-spec version the proxy implements.
+const DistributionSpec = "v1.1.0"
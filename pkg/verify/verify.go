@@ -18,6 +18,7 @@ package verify
 
 import (
 	"bytes"
+	_ "crypto/sha512" // makes sha384 and sha512 digests available
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -26,6 +27,7 @@ import (
 	"io"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/opencontainers/go-digest"
 )
 
 // SizeUnknown is a sentinel value to indicate that the expected size is not known.
@@ -80,7 +82,7 @@ func (vc *verifyReader) Read(b []byte) (int, error) {
 // A size of SizeUnknown (-1) indicates disables size verification when the size
 // is unknown ahead of time.
 func ReadCloser(r io.ReadCloser, size int64, h v1.Hash) (io.ReadCloser, error) {
-	w, err := v1.Hasher(h.Algorithm)
+	w, err := hasher(h.Algorithm)
 	if err != nil {
 		return nil, err
 	}
@@ -99,6 +101,16 @@ func ReadCloser(r io.ReadCloser, size int64, h v1.Hash) (io.ReadCloser, error) {
 	}, nil
 }
 
+// hasher returns a hash of the algorithm, any go-digest supports, where
+// v1.Hasher only knows sha256.
+func hasher(algorithm string) (hash.Hash, error) {
+	a := digest.Algorithm(algorithm)
+	if !a.Available() {
+		return nil, fmt.Errorf("unsupported hash: %q", algorithm)
+	}
+	return a.Hash(), nil
+}
+
 // Descriptor verifies that the embedded Data field matches the Size and Digest
 // fields of the given v1.Descriptor, returning an error if the Data field is
 // missing or if it contains incorrect data.
@@ -145,3 +145,26 @@ func TestDescriptor(t *testing.T) {
 		}
 	}
 }
+
+func TestVerificationSHA512(t *testing.T) {
+	want := "This is the input string."
+	h := v1.Hash{
+		Algorithm: "sha512",
+		Hex:       "098b40915a40071d31570d6736220c240f947e859f1eae619006da593a8b780fe9ee98f59100494386c66a35a198562f2145574f78ee65529340e1de66cb0d40",
+	}
+	verified, err := ReadCloser(io.NopCloser(bytes.NewBufferString(want)), int64(len(want)), h)
+	if err != nil {
+		t.Fatal("ReadCloser() =", err)
+	}
+	if _, err := io.ReadAll(verified); err != nil {
+		t.Error("ReadAll() =", err)
+	}
+
+	verified, err = ReadCloser(io.NopCloser(bytes.NewBufferString("not the same")), SizeUnknown, h)
+	if err != nil {
+		t.Fatal("ReadCloser() =", err)
+	}
+	if b, err := io.ReadAll(verified); err == nil {
+		t.Errorf("ReadAll() = %q; want verification error", string(b))
+	}
+}